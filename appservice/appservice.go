@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"html/template"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"os"
@@ -40,16 +41,18 @@ var OTKChannelSize = 4
 func Create() *AppService {
 	jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
 	return &AppService{
-		LogConfig:  CreateLogConfig(),
-		clients:    make(map[id.UserID]*mautrix.Client),
-		intents:    make(map[id.UserID]*IntentAPI),
-		HTTPClient: &http.Client{Timeout: 180 * time.Second, Jar: jar},
-		StateStore: NewBasicStateStore(),
-		Router:     mux.NewRouter(),
-		UserAgent:  mautrix.DefaultUserAgent,
-		txnIDC:     NewTransactionIDCache(128),
-		Live:       true,
-		Ready:      false,
+		LogConfig:    CreateLogConfig(),
+		clients:      make(map[id.UserID]*mautrix.Client),
+		intents:      make(map[id.UserID]*IntentAPI),
+		HTTPClient:   &http.Client{Timeout: 180 * time.Second, Jar: jar},
+		StateStore:   NewBasicStateStore(),
+		Router:       mux.NewRouter(),
+		UserAgent:    mautrix.DefaultUserAgent,
+		txnIDC:       NewTransactionIDCache(128),
+		txnTracker:   transactionTracker{events: make(map[*event.Event]*pendingTransaction)},
+		pendingPings: make(map[string]bool),
+		Live:         true,
+		Ready:        false,
 	}
 }
 
@@ -94,7 +97,16 @@ type AppService struct {
 	Registration *Registration    `yaml:"-"`
 	Log          maulogger.Logger `yaml:"-"`
 
-	txnIDC *TransactionIDCache
+	routesOnce sync.Once
+
+	txnIDC     *TransactionIDCache
+	txnTracker transactionTracker
+	// txnReplayLock is held while replaying unfinished transactions on startup
+	txnReplayLock sync.RWMutex
+
+	// TransactionLog is an optional persistent log of received transactions. If set, it's used for deduplicating
+	// transactions instead of the in-memory cache, and unfinished transactions are replayed on startup.
+	TransactionLog TransactionLog `yaml:"-"`
 
 	Events       chan *event.Event         `yaml:"-"`
 	DeviceLists  chan *mautrix.DeviceLists `yaml:"-"`
@@ -102,9 +114,31 @@ type AppService struct {
 	QueryHandler QueryHandler              `yaml:"-"`
 	StateStore   StateStore                `yaml:"-"`
 
+	// ThirdPartyHandler handles third party protocol lookups. If nil, all lookups return 404.
+	ThirdPartyHandler ThirdPartyHandler `yaml:"-"`
+	// KeyClaimHandler and KeyQueryHandler handle one-time key claims and device key queries that the homeserver
+	// forwards to the appservice. If nil, the homeserver is told that forwarding isn't supported.
+	KeyClaimHandler KeyClaimHandler `yaml:"-"`
+	KeyQueryHandler KeyQueryHandler `yaml:"-"`
+
+	// AutoLoginGhosts makes IntentAPI.EnsureRegistered also log in ghosts with m.login.application_service,
+	// so that each ghost has a real device instead of masquerading with the appservice token.
+	// The bot user is never logged in automatically, as its client is shared with the appservice itself.
+	AutoLoginGhosts bool `yaml:"-"`
+	// GhostDeviceDisplayName is the display name for devices created by automatic ghost logins.
+	GhostDeviceDisplayName string `yaml:"-"`
+	// GhostCredentialStore persists the access tokens and device IDs of logged in ghosts. If nil, ghosts will log in
+	// again (and get a new device) after restarting.
+	GhostCredentialStore GhostCredentialStore `yaml:"-"`
+
+	// BatchWorkers is the maximum number of concurrent requests made by batch operations like BatchEnsureJoined.
+	// If zero, DefaultBatchWorkers is used.
+	BatchWorkers int `yaml:"-"`
+
 	Router     *mux.Router `yaml:"-"`
 	UserAgent  string      `yaml:"-"`
 	server     *http.Server
+	listener   net.Listener
 	HTTPClient *http.Client
 	botClient  *mautrix.Client
 	botIntent  *IntentAPI
@@ -114,6 +148,9 @@ type AppService struct {
 	Live  bool
 	Ready bool
 
+	pendingPings map[string]bool
+	pingLock     sync.Mutex
+
 	clients     map[id.UserID]*mautrix.Client
 	clientsLock sync.RWMutex
 	intents     map[id.UserID]*IntentAPI
@@ -127,6 +164,10 @@ type AppService struct {
 	websocketRequests     map[int]chan<- *WebsocketCommand
 	websocketRequestsLock sync.RWMutex
 	websocketRequestID    int32
+	wsStats               websocketStatsTracker
+	// WebsocketRequestTimeout is the timeout for RequestWebsocket calls whose context doesn't have a deadline.
+	// If zero, DefaultWebsocketRequestTimeout is used.
+	WebsocketRequestTimeout time.Duration
 	// ProcessID is an identifier sent to the websocket proxy for debugging connections
 	ProcessID string
 }
@@ -289,6 +330,9 @@ func (as *AppService) Init() (bool, error) {
 		if err != nil {
 			return false, err
 		}
+		if err = as.Registration.Validate(as.HomeserverDomain); err != nil {
+			as.Log.Warnln("Registration may have problems:", err)
+		}
 	}
 
 	as.Log.Debugln("Appservice initialized successfully.")
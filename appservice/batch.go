@@ -0,0 +1,213 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultBatchWorkers is the number of concurrent workers used by batch operations if AppService.BatchWorkers is not set.
+var DefaultBatchWorkers = 8
+
+// BatchRateLimitRetries is the number of times a single operation in a batch is retried after being rate limited.
+var BatchRateLimitRetries = 5
+
+// BatchRateLimitBackoff is how long batch operations wait after being rate limited if the homeserver doesn't specify.
+var BatchRateLimitBackoff = 5 * time.Second
+
+// BatchErrors contains the errors of the failed operations in a batch, keyed by user ID.
+type BatchErrors map[id.UserID]error
+
+func (be BatchErrors) Error() string {
+	parts := make([]string, 0, len(be))
+	for userID, err := range be {
+		parts = append(parts, fmt.Sprintf("%s: %v", userID, err))
+	}
+	sort.Strings(parts)
+	return fmt.Sprintf("%d operations failed: %s", len(be), strings.Join(parts, "; "))
+}
+
+// GhostProfile is the profile to set for a ghost in AppService.BatchSetProfiles. Empty fields are left unchanged.
+type GhostProfile struct {
+	DisplayName string
+	AvatarURL   id.ContentURI
+}
+
+type batchRunner struct {
+	as     *AppService
+	client *mautrix.Client
+
+	pausedUntil time.Time
+	pauseLock   sync.Mutex
+}
+
+// waitForPause blocks until the batch is no longer paused due to rate limiting.
+func (br *batchRunner) waitForPause() {
+	br.pauseLock.Lock()
+	until := br.pausedUntil
+	br.pauseLock.Unlock()
+	if wait := time.Until(until); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// pause stops all workers of the batch from starting new operations for the given duration.
+func (br *batchRunner) pause(duration time.Duration) {
+	br.pauseLock.Lock()
+	until := time.Now().Add(duration)
+	if until.After(br.pausedUntil) {
+		br.pausedUntil = until
+	}
+	br.pauseLock.Unlock()
+}
+
+func (br *batchRunner) do(userID id.UserID, fn func(userID id.UserID) error) error {
+	for retry := 0; ; retry++ {
+		br.waitForPause()
+		err := fn(userID)
+		backoff, isRateLimited := br.client.RateLimitBackoff(err, BatchRateLimitBackoff)
+		if !isRateLimited || retry >= BatchRateLimitRetries {
+			return err
+		}
+		br.as.Log.Debugfln("Batch operation for %s was rate limited, pausing batch for %s", userID, backoff)
+		br.pause(backoff)
+	}
+}
+
+// runBatch calls fn for every given user ID using a bounded pool of workers. If an operation is rate limited,
+// the whole batch is paused for the time specified by the homeserver and the operation is retried.
+func (as *AppService) runBatch(userIDs []id.UserID, fn func(userID id.UserID) error) BatchErrors {
+	workers := as.BatchWorkers
+	if workers <= 0 {
+		workers = DefaultBatchWorkers
+	}
+	if workers > len(userIDs) {
+		workers = len(userIDs)
+	}
+	// The client instance only matters for logging if parsing the Retry-After header fails, so the bot client is fine.
+	runner := &batchRunner{as: as, client: as.BotClient()}
+	queue := make(chan id.UserID)
+	errs := make(BatchErrors)
+	var errsLock sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for userID := range queue {
+				err := runner.do(userID, fn)
+				if err != nil {
+					errsLock.Lock()
+					errs[userID] = err
+					errsLock.Unlock()
+				}
+			}
+		}()
+	}
+	seen := make(map[id.UserID]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		if _, alreadyQueued := seen[userID]; !alreadyQueued {
+			seen[userID] = struct{}{}
+			queue <- userID
+		}
+	}
+	close(queue)
+	wg.Wait()
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (as *AppService) batchIntent(userID id.UserID) (*IntentAPI, error) {
+	if _, homeserver, err := userID.Parse(); err != nil {
+		return nil, err
+	} else if homeserver != as.HomeserverDomain {
+		return nil, fmt.Errorf("%s is not on %s", userID, as.HomeserverDomain)
+	}
+	return as.Intent(userID), nil
+}
+
+// BatchEnsureRegistered makes sure all the given ghosts are registered. Ghosts that the StateStore
+// already has marked as registered are skipped.
+func (as *AppService) BatchEnsureRegistered(userIDs []id.UserID) BatchErrors {
+	return as.runBatch(userIDs, func(userID id.UserID) error {
+		intent, err := as.batchIntent(userID)
+		if err != nil {
+			return err
+		}
+		return intent.EnsureRegistered()
+	})
+}
+
+// BatchSetProfiles sets the display names and avatars of the given ghosts. If roomID is set, ghosts whose
+// member state in that room already matches the profile according to the StateStore are skipped.
+func (as *AppService) BatchSetProfiles(roomID id.RoomID, profiles map[id.UserID]GhostProfile) BatchErrors {
+	userIDs := make([]id.UserID, 0, len(profiles))
+	for userID := range profiles {
+		userIDs = append(userIDs, userID)
+	}
+	return as.runBatch(userIDs, func(userID id.UserID) error {
+		profile := profiles[userID]
+		if len(roomID) > 0 {
+			member, ok := as.StateStore.TryGetMember(roomID, userID)
+			if ok && member != nil &&
+				(len(profile.DisplayName) == 0 || member.Displayname == profile.DisplayName) &&
+				(profile.AvatarURL.IsEmpty() || member.AvatarURL == profile.AvatarURL.CUString()) {
+				return nil
+			}
+		}
+		intent, err := as.batchIntent(userID)
+		if err != nil {
+			return err
+		}
+		if len(profile.DisplayName) > 0 {
+			err = intent.SetDisplayName(profile.DisplayName)
+			if err != nil {
+				return fmt.Errorf("failed to set displayname: %w", err)
+			}
+		}
+		if !profile.AvatarURL.IsEmpty() {
+			err = intent.SetAvatarURL(profile.AvatarURL)
+			if err != nil {
+				return fmt.Errorf("failed to set avatar: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// BatchEnsureJoined makes sure all the given ghosts are registered and joined to the room.
+// Ghosts that the StateStore already shows as joined are skipped.
+func (as *AppService) BatchEnsureJoined(roomID id.RoomID, userIDs []id.UserID, extra ...EnsureJoinedParams) BatchErrors {
+	return as.runBatch(userIDs, func(userID id.UserID) error {
+		intent, err := as.batchIntent(userID)
+		if err != nil {
+			return err
+		}
+		return intent.EnsureJoined(roomID, extra...)
+	})
+}
+
+// BatchInviteUsers invites all the given users to the room using the given intent.
+// Users that the StateStore already shows as invited or joined are skipped.
+func (as *AppService) BatchInviteUsers(inviter *IntentAPI, roomID id.RoomID, userIDs []id.UserID) BatchErrors {
+	return as.runBatch(userIDs, func(userID id.UserID) error {
+		if as.StateStore.IsMembership(roomID, userID, event.MembershipJoin, event.MembershipInvite) {
+			return nil
+		}
+		return inviter.EnsureInvited(roomID, userID)
+	})
+}
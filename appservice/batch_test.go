@@ -0,0 +1,105 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type testBatchHomeserver struct {
+	rateLimited map[id.UserID]bool
+	joins       map[id.UserID]int
+	active      int
+	maxActive   int
+	lock        sync.Mutex
+}
+
+func (hs *testBatchHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	userID := id.UserID(r.URL.Query().Get("user_id"))
+	hs.lock.Lock()
+	hs.active++
+	if hs.active > hs.maxActive {
+		hs.maxActive = hs.active
+	}
+	limit := !hs.rateLimited[userID]
+	hs.rateLimited[userID] = true
+	hs.lock.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hs.active--
+
+	if userID == "@banned:example.com" {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"You are banned"}`))
+	} else if limit {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests"}`))
+	} else {
+		hs.joins[userID]++
+		_, _ = w.Write([]byte(`{"room_id":"!room:example.com"}`))
+	}
+}
+
+func TestAppService_BatchEnsureJoined(t *testing.T) {
+	hs := &testBatchHomeserver{rateLimited: make(map[id.UserID]bool), joins: make(map[id.UserID]int)}
+	server := httptest.NewServer(hs)
+	defer server.Close()
+
+	as := newTestEventProcessor().as
+	as.Registration = &Registration{AppToken: "as_token", ServerToken: "hs_token", SenderLocalpart: "bot"}
+	as.HomeserverDomain = "example.com"
+	as.HomeserverURL = server.URL
+	as.BatchWorkers = 3
+
+	const roomID = id.RoomID("!room:example.com")
+	var userIDs []id.UserID
+	for i := 0; i < 10; i++ {
+		userID := id.UserID(fmt.Sprintf("@ghost%d:example.com", i))
+		as.StateStore.MarkRegistered(userID)
+		userIDs = append(userIDs, userID)
+	}
+	as.StateStore.SetMembership(roomID, userIDs[0], event.MembershipJoin)
+	as.StateStore.MarkRegistered("@banned:example.com")
+	userIDs = append(userIDs, "@banned:example.com", "@ghost:example.org", userIDs[1])
+
+	errs := as.BatchEnsureJoined(roomID, userIDs)
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %v", errs)
+	}
+	if !errors.Is(errs["@banned:example.com"], mautrix.MForbidden) {
+		t.Errorf("Unexpected error for banned user: %v", errs["@banned:example.com"])
+	}
+	if errs["@ghost:example.org"] == nil {
+		t.Error("Expected error for ghost on another server")
+	}
+	if hs.maxActive > as.BatchWorkers {
+		t.Errorf("Expected at most %d concurrent requests, got %d", as.BatchWorkers, hs.maxActive)
+	}
+	if _, ok := hs.joins[userIDs[0]]; ok {
+		t.Error("Expected already joined ghost to be skipped")
+	}
+	for _, userID := range userIDs[1:10] {
+		if hs.joins[userID] != 1 {
+			t.Errorf("Expected %s to join once after being rate limited, got %d joins", userID, hs.joins[userID])
+		}
+		if !as.StateStore.IsInRoom(roomID, userID) {
+			t.Errorf("Expected %s to be marked as joined", userID)
+		}
+	}
+}
@@ -9,6 +9,7 @@ package appservice
 import (
 	"encoding/json"
 	"runtime/debug"
+	"sync"
 
 	log "maunium.net/go/maulogger/v2"
 
@@ -22,8 +23,18 @@ const (
 	AsyncHandlers ExecMode = iota
 	AsyncLoop
 	Sync
+	// RoomOrdered handles events in the same room one by one in the order they were received, but events in
+	// different rooms are handled in parallel. Events without a room ID are ordered by sender instead.
+	// See EventProcessor.RoomWorkers and EventProcessor.RoomQueueSize.
+	RoomOrdered
 )
 
+// DefaultRoomWorkers is the default value of EventProcessor.RoomWorkers.
+var DefaultRoomWorkers = 32
+
+// DefaultRoomQueueSize is the default value of EventProcessor.RoomQueueSize.
+var DefaultRoomQueueSize = 64
+
 type EventHandler func(evt *event.Event)
 type OTKHandler func(otk *mautrix.OTKCount)
 type DeviceListHandler func(otk *mautrix.DeviceLists, since string)
@@ -31,11 +42,24 @@ type DeviceListHandler func(otk *mautrix.DeviceLists, since string)
 type EventProcessor struct {
 	ExecMode ExecMode
 
+	// RoomWorkers is the maximum number of rooms whose events are handled concurrently in the RoomOrdered mode.
+	RoomWorkers int
+	// RoomQueueSize is the maximum number of events waiting to be handled per room in the RoomOrdered mode.
+	// When a queue is full, dispatching blocks, which in turn blocks new transactions from the homeserver
+	// once the Events channel of the AppService fills up.
+	RoomQueueSize int
+
 	as       *AppService
 	log      log.Logger
 	stop     chan struct{}
 	handlers map[event.Type][]EventHandler
 
+	runLock     sync.Mutex
+	roomLock    sync.Mutex
+	roomQueues  map[string]*roomQueue
+	roomSlots   chan struct{}
+	roomWorkers sync.WaitGroup
+
 	otkHandlers        []OTKHandler
 	deviceListHandlers []DeviceListHandler
 }
@@ -43,10 +67,15 @@ type EventProcessor struct {
 func NewEventProcessor(as *AppService) *EventProcessor {
 	return &EventProcessor{
 		ExecMode: AsyncHandlers,
-		as:       as,
-		log:      as.Log.Sub("Events"),
-		stop:     make(chan struct{}, 1),
-		handlers: make(map[event.Type][]EventHandler),
+
+		RoomWorkers:   DefaultRoomWorkers,
+		RoomQueueSize: DefaultRoomQueueSize,
+
+		as:         as,
+		log:        as.Log.Sub("Events"),
+		stop:       make(chan struct{}, 1),
+		handlers:   make(map[event.Type][]EventHandler),
+		roomQueues: make(map[string]*roomQueue),
 
 		otkHandlers:        make([]OTKHandler, 0),
 		deviceListHandlers: make([]DeviceListHandler, 0),
@@ -108,27 +137,112 @@ func (ep *EventProcessor) DispatchDeviceList(dl *mautrix.DeviceLists) {
 func (ep *EventProcessor) Dispatch(evt *event.Event) {
 	handlers, ok := ep.handlers[evt.Type]
 	if !ok {
+		ep.as.MarkEventHandled(evt)
 		return
 	}
 	switch ep.ExecMode {
 	case AsyncHandlers:
+		var wg sync.WaitGroup
+		wg.Add(len(handlers))
 		for _, handler := range handlers {
-			go ep.callHandler(handler, evt)
+			go func(handler EventHandler) {
+				defer wg.Done()
+				ep.callHandler(handler, evt)
+			}(handler)
+		}
+		if ep.as.TransactionLog != nil {
+			go func() {
+				wg.Wait()
+				ep.as.MarkEventHandled(evt)
+			}()
 		}
 	case AsyncLoop:
 		go func() {
 			for _, handler := range handlers {
 				ep.callHandler(handler, evt)
 			}
+			ep.as.MarkEventHandled(evt)
 		}()
 	case Sync:
 		for _, handler := range handlers {
 			ep.callHandler(handler, evt)
 		}
+		ep.as.MarkEventHandled(evt)
+	case RoomOrdered:
+		ep.dispatchRoomOrdered(evt)
+	}
+}
+
+type roomQueue struct {
+	events chan *event.Event
+	// pending is the number of events that have been or are about to be added to the queue, but haven't been
+	// handled yet. It's protected by EventProcessor.roomLock.
+	pending int
+}
+
+func roomQueueKey(evt *event.Event) string {
+	if len(evt.RoomID) > 0 {
+		return string(evt.RoomID)
+	}
+	return string(evt.Sender)
+}
+
+func (ep *EventProcessor) dispatchRoomOrdered(evt *event.Event) {
+	key := roomQueueKey(evt)
+	ep.roomLock.Lock()
+	if ep.roomSlots == nil {
+		workers := ep.RoomWorkers
+		if workers <= 0 {
+			workers = DefaultRoomWorkers
+		}
+		ep.roomSlots = make(chan struct{}, workers)
+	}
+	queue, ok := ep.roomQueues[key]
+	if !ok {
+		queueSize := ep.RoomQueueSize
+		if queueSize <= 0 {
+			queueSize = DefaultRoomQueueSize
+		}
+		queue = &roomQueue{events: make(chan *event.Event, queueSize)}
+		ep.roomQueues[key] = queue
+		ep.roomWorkers.Add(1)
+	}
+	queue.pending++
+	ep.roomLock.Unlock()
+
+	if !ok {
+		// Wait for a free worker slot. The event is queued after this, so the events of the room can't be
+		// handled before the worker is started.
+		ep.roomSlots <- struct{}{}
+		go ep.roomWorker(key, queue)
+	}
+	queue.events <- evt
+}
+
+func (ep *EventProcessor) roomWorker(key string, queue *roomQueue) {
+	defer func() {
+		<-ep.roomSlots
+		ep.roomWorkers.Done()
+	}()
+	for evt := range queue.events {
+		for _, handler := range ep.handlers[evt.Type] {
+			ep.callHandler(handler, evt)
+		}
+		ep.as.MarkEventHandled(evt)
+		ep.roomLock.Lock()
+		queue.pending--
+		if queue.pending == 0 {
+			delete(ep.roomQueues, key)
+			ep.roomLock.Unlock()
+			return
+		}
+		ep.roomLock.Unlock()
 	}
 }
 
 func (ep *EventProcessor) Start() {
+	ep.runLock.Lock()
+	defer ep.runLock.Unlock()
 	for {
 		select {
 		case evt := <-ep.as.Events:
@@ -143,6 +257,11 @@ func (ep *EventProcessor) Start() {
 	}
 }
 
+// Stop stops the event processor loop. In the RoomOrdered mode, it also waits until all the events that were
+// already queued have been handled.
 func (ep *EventProcessor) Stop() {
 	ep.stop <- struct{}{}
+	ep.runLock.Lock()
+	ep.roomWorkers.Wait()
+	ep.runLock.Unlock()
 }
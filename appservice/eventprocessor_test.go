@@ -0,0 +1,104 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func newTestEventProcessor() *EventProcessor {
+	as := Create()
+	as.Log = maulogger.Create()
+	as.Log.(*maulogger.BasicLogger).PrintLevel = maulogger.LevelError.Severity
+	as.Events = make(chan *event.Event, EventChannelSize)
+	ep := NewEventProcessor(as)
+	ep.ExecMode = RoomOrdered
+	return ep
+}
+
+func TestEventProcessor_RoomOrdered(t *testing.T) {
+	ep := newTestEventProcessor()
+	ep.RoomWorkers = 3
+	ep.RoomQueueSize = 2
+
+	var lock sync.Mutex
+	handled := make(map[id.RoomID][]int64)
+	ep.On(event.EventMessage, func(evt *event.Event) {
+		lock.Lock()
+		handled[evt.RoomID] = append(handled[evt.RoomID], evt.Unsigned.Age)
+		lock.Unlock()
+	})
+	go ep.Start()
+
+	const rooms, eventsPerRoom = 8, 50
+	for i := 0; i < eventsPerRoom; i++ {
+		for j := 0; j < rooms; j++ {
+			ep.as.Events <- &event.Event{
+				Type:     event.EventMessage,
+				RoomID:   id.RoomID(fmt.Sprintf("!room%d:example.com", j)),
+				Unsigned: event.Unsigned{Age: int64(i)},
+			}
+		}
+	}
+	// Wait for the loop to consume all the events before stopping it.
+	for len(ep.as.Events) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ep.Stop()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(handled) != rooms {
+		t.Fatalf("Expected events from %d rooms, got %d", rooms, len(handled))
+	}
+	for roomID, ages := range handled {
+		if len(ages) != eventsPerRoom {
+			t.Errorf("Expected %d events in %s, got %d", eventsPerRoom, roomID, len(ages))
+		}
+		for i, age := range ages {
+			if age != int64(i) {
+				t.Errorf("Event #%d in %s was handled out of order (got event #%d)", i, roomID, age)
+				break
+			}
+		}
+	}
+	if len(ep.roomQueues) != 0 {
+		t.Errorf("Expected all room queues to be removed, %d remaining", len(ep.roomQueues))
+	}
+}
+
+func TestEventProcessor_RoomOrderedParallel(t *testing.T) {
+	ep := newTestEventProcessor()
+	ep.RoomWorkers = 2
+
+	roomA := id.RoomID("!a:example.com")
+	roomB := id.RoomID("!b:example.com")
+	handledB := make(chan struct{})
+	ep.On(event.EventMessage, func(evt *event.Event) {
+		if evt.RoomID == roomA {
+			// Room A can only continue after an event in room B has been handled in parallel.
+			select {
+			case <-handledB:
+			case <-time.After(5 * time.Second):
+				t.Error("Event in room B wasn't handled while room A was busy")
+			}
+		} else {
+			close(handledB)
+		}
+	})
+	ep.Dispatch(&event.Event{Type: event.EventMessage, RoomID: roomA})
+	ep.Dispatch(&event.Event{Type: event.EventMessage, RoomID: roomB})
+	ep.Stop()
+}
@@ -0,0 +1,263 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// ErrBotLogin is returned by IntentAPI.LoginDevice and IntentAPI.EnsureLoggedIn for the appservice bot.
+// The bot intent shares its client with AppService.BotClient, which must keep using the appservice token.
+var ErrBotLogin = errors.New("the appservice bot can't log in with a separate device")
+
+// GhostCredentials are the access token and device ID of a ghost user that has logged in
+// using the m.login.application_service login type.
+type GhostCredentials struct {
+	UserID      id.UserID
+	DeviceID    id.DeviceID
+	AccessToken string
+}
+
+// GhostCredentialStore persists the credentials of ghost users that have logged in with IntentAPI.LoginDevice,
+// so that the same device can be reused after restarting instead of creating a new one every time.
+type GhostCredentialStore interface {
+	// GetGhostCredentials returns the stored credentials for the given user, or nil if there are none.
+	GetGhostCredentials(userID id.UserID) (*GhostCredentials, error)
+	// PutGhostCredentials stores the given credentials, replacing any existing credentials for the same user.
+	PutGhostCredentials(creds *GhostCredentials) error
+	// DeleteGhostCredentials removes the stored credentials for the given user.
+	DeleteGhostCredentials(userID id.UserID) error
+}
+
+// IsLoggedIn returns true if the intent is using a real device instead of masquerading with the appservice token.
+func (intent *IntentAPI) IsLoggedIn() bool {
+	accessToken, deviceID := intent.Client.GetCredentials()
+	return len(deviceID) > 0 && accessToken != intent.as.Registration.AppToken
+}
+
+// useCredentials switches the intent's client to the given device. The user_id query parameter is left in place:
+// homeservers ignore it for non-appservice tokens, and requests whose URL was built before the switch still have
+// to assert the ghost's identity if they end up being sent with the appservice token.
+func (intent *IntentAPI) useCredentials(creds *GhostCredentials) {
+	intent.Client.ReplaceCredentials(creds.AccessToken, creds.DeviceID)
+}
+
+func (intent *IntentAPI) resetCredentials() {
+	intent.Client.ReplaceCredentials(intent.as.Registration.AppToken, "")
+}
+
+// newSeparateClient creates a client that isn't shared with the intent, so that requests can be made with other
+// credentials without touching the credentials of the intent's client.
+func (intent *IntentAPI) newSeparateClient(accessToken string) (*mautrix.Client, error) {
+	client, err := mautrix.NewClient(intent.as.HomeserverURL, intent.UserID, accessToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize client: %w", err)
+	}
+	client.UserAgent = intent.as.UserAgent
+	client.Logger = intent.Client.Logger
+	client.Client = intent.as.HTTPClient
+	client.DefaultHTTPRetries = intent.as.DefaultHTTPRetries
+	return client, nil
+}
+
+// LoginDevice logs in as the ghost user using the m.login.application_service login type and switches the intent to
+// use the new device instead of masquerading with the appservice token. If the AppService has a
+// GhostCredentialStore, the credentials are stored there, and the previous device ID is reused if one exists.
+//
+// Note that the homeserver treats requests made with the device access token like normal client requests,
+// which means appservice-only features like timestamp massaging won't work for logged in intents.
+func (intent *IntentAPI) LoginDevice(deviceDisplayName string) error {
+	intent.loginLock.Lock()
+	defer intent.loginLock.Unlock()
+	return intent.login(deviceDisplayName)
+}
+
+func (intent *IntentAPI) login(deviceDisplayName string) error {
+	if intent.UserID == intent.as.BotMXID() {
+		return ErrBotLogin
+	}
+	var deviceID id.DeviceID
+	if intent.IsLoggedIn() {
+		_, deviceID = intent.Client.GetCredentials()
+	} else if store := intent.as.GhostCredentialStore; store != nil {
+		creds, err := store.GetGhostCredentials(intent.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to get stored credentials: %w", err)
+		} else if creds != nil {
+			deviceID = creds.DeviceID
+		}
+	}
+
+	// The login request is authenticated with the appservice token, so it's sent using a separate client
+	// to avoid touching the credentials of the intent's client until the login has succeeded.
+	client, err := intent.newSeparateClient(intent.as.Registration.AppToken)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Login(&mautrix.ReqLogin{
+		Type: mautrix.AuthTypeAppservice,
+		Identifier: mautrix.UserIdentifier{
+			Type: mautrix.IdentifierTypeUser,
+			User: string(intent.UserID),
+		},
+		DeviceID:                 deviceID,
+		InitialDeviceDisplayName: deviceDisplayName,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to log in as %s: %w", intent.UserID, err)
+	}
+	creds := &GhostCredentials{
+		UserID:      intent.UserID,
+		DeviceID:    resp.DeviceID,
+		AccessToken: resp.AccessToken,
+	}
+	if store := intent.as.GhostCredentialStore; store != nil {
+		err = store.PutGhostCredentials(creds)
+		if err != nil {
+			return fmt.Errorf("failed to store credentials: %w", err)
+		}
+	}
+	intent.useCredentials(creds)
+	intent.as.Log.Debugfln("Logged in as %s with device %s", intent.UserID, resp.DeviceID)
+	return nil
+}
+
+// EnsureLoggedIn makes sure the intent is using a real device. Credentials are loaded from the
+// GhostCredentialStore if possible, and a new login is only done if there are no stored credentials
+// or if the homeserver rejects the stored access token with M_UNKNOWN_TOKEN.
+func (intent *IntentAPI) EnsureLoggedIn() error {
+	if intent.IsCustomPuppet {
+		return nil
+	}
+	intent.loginLock.Lock()
+	defer intent.loginLock.Unlock()
+	if intent.IsLoggedIn() {
+		return nil
+	}
+	if store := intent.as.GhostCredentialStore; store != nil {
+		creds, err := store.GetGhostCredentials(intent.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to ensure logged in: failed to get stored credentials: %w", err)
+		} else if creds != nil && len(creds.AccessToken) > 0 {
+			valid, err := intent.checkCredentials(creds)
+			if err != nil {
+				return fmt.Errorf("failed to ensure logged in: failed to check stored credentials: %w", err)
+			} else if valid {
+				intent.useCredentials(creds)
+				return nil
+			}
+			intent.as.Log.Debugfln("Stored access token of %s/%s is no longer valid, logging in again", intent.UserID, creds.DeviceID)
+			err = store.DeleteGhostCredentials(intent.UserID)
+			if err != nil {
+				return fmt.Errorf("failed to ensure logged in: failed to delete invalid credentials: %w", err)
+			}
+		}
+	}
+	err := intent.login(intent.as.GhostDeviceDisplayName)
+	if err != nil {
+		return fmt.Errorf("failed to ensure logged in: %w", err)
+	}
+	return nil
+}
+
+// handleUnknownToken logs in again when the homeserver rejects the access token of a logged in ghost, e.g. because
+// the device was logged out by a server admin while the appservice was running. It's set as the OnUnknownToken
+// handler of the intent's client, so the rejected request is retried once with the new token.
+func (intent *IntentAPI) handleUnknownToken(rejectedToken string) error {
+	if intent.IsCustomPuppet || rejectedToken == intent.as.Registration.AppToken {
+		return errors.New("rejected token doesn't belong to a ghost device")
+	}
+	intent.loginLock.Lock()
+	defer intent.loginLock.Unlock()
+	if accessToken, _ := intent.Client.GetCredentials(); accessToken != rejectedToken {
+		// Another request already logged in again, or the intent was logged out in the meantime
+		return nil
+	}
+	intent.as.Log.Debugfln("Access token of %s was rejected, logging in again", intent.UserID)
+	return intent.login(intent.as.GhostDeviceDisplayName)
+}
+
+// checkCredentials checks that the homeserver still accepts the given stored credentials.
+// The device may have been logged out while the appservice wasn't running, e.g. by a server admin.
+func (intent *IntentAPI) checkCredentials(creds *GhostCredentials) (bool, error) {
+	if intent.UserID == intent.as.BotMXID() {
+		return false, ErrBotLogin
+	}
+	client, err := intent.newSeparateClient(creds.AccessToken)
+	if err != nil {
+		return false, err
+	}
+	_, err = client.Whoami()
+	if errors.Is(err, mautrix.MUnknownToken) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Logout logs out the device of the ghost user, deletes the stored credentials and switches the intent back to
+// masquerading with the appservice token. If the intent isn't logged in, this only deletes the stored credentials.
+//
+// For custom puppets, this just calls Logout on the client.
+func (intent *IntentAPI) Logout() (*mautrix.RespLogout, error) {
+	if intent.IsCustomPuppet {
+		return intent.Client.Logout()
+	}
+	intent.loginLock.Lock()
+	defer intent.loginLock.Unlock()
+	var resp *mautrix.RespLogout
+	if intent.IsLoggedIn() {
+		// A separate client is used, as the intent's client would try to log in again if the token was already revoked
+		accessToken, _ := intent.Client.GetCredentials()
+		client, err := intent.newSeparateClient(accessToken)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = client.Logout()
+		if err != nil && !errors.Is(err, mautrix.MUnknownToken) {
+			return nil, fmt.Errorf("failed to log out %s: %w", intent.UserID, err)
+		}
+		intent.resetCredentials()
+	}
+	if store := intent.as.GhostCredentialStore; store != nil {
+		err := store.DeleteGhostCredentials(intent.UserID)
+		if err != nil {
+			return resp, fmt.Errorf("failed to delete stored credentials: %w", err)
+		}
+	}
+	return resp, nil
+}
+
+// LogoutGhosts logs out the devices of all ghost intents that are currently logged in.
+// Errors are logged and the first one is returned after trying to log out every intent.
+func (as *AppService) LogoutGhosts() error {
+	as.intentsLock.RLock()
+	intents := make([]*IntentAPI, 0, len(as.intents))
+	for _, intent := range as.intents {
+		intents = append(intents, intent)
+	}
+	as.intentsLock.RUnlock()
+	var firstErr error
+	for _, intent := range intents {
+		if intent.IsCustomPuppet || !intent.IsLoggedIn() {
+			continue
+		}
+		_, err := intent.Logout()
+		if err != nil {
+			as.Log.Warnfln("Failed to log out %s: %v", intent.UserID, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
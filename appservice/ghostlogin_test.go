@@ -0,0 +1,204 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+type testGhostCredentialStore struct {
+	creds map[id.UserID]*GhostCredentials
+	lock  sync.Mutex
+}
+
+func (store *testGhostCredentialStore) GetGhostCredentials(userID id.UserID) (*GhostCredentials, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.creds[userID], nil
+}
+
+func (store *testGhostCredentialStore) PutGhostCredentials(creds *GhostCredentials) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.creds[creds.UserID] = creds
+	return nil
+}
+
+func (store *testGhostCredentialStore) DeleteGhostCredentials(userID id.UserID) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	delete(store.creds, userID)
+	return nil
+}
+
+type testLoginHomeserver struct {
+	logins   int
+	logouts  int
+	whoamis  int
+	revoked  map[string]bool
+	lastAuth string
+	lock     sync.Mutex
+}
+
+func (hs *testLoginHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	switch r.URL.Path {
+	case "/_matrix/client/v3/login":
+		var req mautrix.ReqLogin
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if r.Header.Get("Authorization") != "Bearer as_token" || req.Type != mautrix.AuthTypeAppservice {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"Not an appservice"}`))
+			return
+		}
+		hs.logins++
+		deviceID := req.DeviceID
+		if len(deviceID) == 0 {
+			deviceID = id.DeviceID(fmt.Sprintf("DEVICE%d", hs.logins))
+		}
+		_ = json.NewEncoder(w).Encode(&mautrix.RespLogin{
+			UserID:      id.UserID(req.Identifier.User),
+			DeviceID:    deviceID,
+			AccessToken: fmt.Sprintf("token%d", hs.logins),
+		})
+	case "/_matrix/client/v3/logout":
+		hs.logouts++
+		_, _ = w.Write([]byte(`{}`))
+	case "/_matrix/client/v3/account/whoami":
+		hs.whoamis++
+		if hs.revoked[r.Header.Get("Authorization")] {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"Unknown access token"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"user_id":"@ghost:example.com"}`))
+	default:
+		hs.lastAuth = r.Header.Get("Authorization")
+		if hs.revoked[hs.lastAuth] {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"Unknown access token"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}
+}
+
+func TestIntentAPI_GhostLogin(t *testing.T) {
+	hs := &testLoginHomeserver{revoked: make(map[string]bool)}
+	server := httptest.NewServer(hs)
+	defer server.Close()
+	store := &testGhostCredentialStore{creds: make(map[id.UserID]*GhostCredentials)}
+
+	as := newTestEventProcessor().as
+	as.Registration = &Registration{AppToken: "as_token", ServerToken: "hs_token", SenderLocalpart: "bot"}
+	as.HomeserverDomain = "example.com"
+	as.HomeserverURL = server.URL
+	as.GhostCredentialStore = store
+	as.AutoLoginGhosts = true
+	as.StateStore.MarkRegistered("@ghost:example.com")
+	as.StateStore.MarkRegistered(as.BotMXID())
+
+	// The bot shares its client with the appservice, so it must never be logged in automatically
+	if err := as.BotIntent().EnsureRegistered(); err != nil {
+		t.Fatalf("Failed to ensure bot registered: %v", err)
+	} else if as.BotIntent().IsLoggedIn() || as.BotClient().AccessToken != "as_token" || hs.logins != 0 {
+		t.Fatalf("Expected bot not to be logged in, got token %q", as.BotClient().AccessToken)
+	} else if err = as.BotIntent().LoginDevice("Bot device"); !errors.Is(err, ErrBotLogin) {
+		t.Errorf("Expected ErrBotLogin when logging in as the bot, got %v", err)
+	}
+
+	intent := as.Intent("@ghost:example.com")
+	if intent.IsLoggedIn() {
+		t.Fatal("Expected new intent not to be logged in")
+	}
+	if err := intent.EnsureRegistered(); err != nil {
+		t.Fatalf("Failed to ensure registered: %v", err)
+	}
+	if !intent.IsLoggedIn() || intent.Client.DeviceID != "DEVICE1" {
+		t.Fatalf("Unexpected client state after login: device %q", intent.Client.DeviceID)
+	}
+	if creds := store.creds["@ghost:example.com"]; creds == nil || creds.AccessToken != "token1" {
+		t.Errorf("Unexpected stored credentials %+v", creds)
+	}
+	if _, err := intent.Client.GetOwnPresence(); err != nil {
+		t.Errorf("Failed to make request with device token: %v", err)
+	} else if hs.lastAuth != "Bearer token1" {
+		t.Errorf("Expected request to use device token, got %q", hs.lastAuth)
+	}
+
+	// Stored credentials should be reused without logging in again
+	intent.resetCredentials()
+	if err := intent.EnsureLoggedIn(); err != nil {
+		t.Fatalf("Failed to ensure logged in: %v", err)
+	} else if hs.logins != 1 || hs.whoamis != 1 || intent.Client.AccessToken != "token1" {
+		t.Errorf("Expected stored credentials to be checked and reused, got %d logins and %d whoamis", hs.logins, hs.whoamis)
+	}
+
+	// Stored credentials that the homeserver no longer accepts are dropped and replaced with a new login
+	intent.resetCredentials()
+	hs.lock.Lock()
+	hs.revoked["Bearer token1"] = true
+	hs.lock.Unlock()
+	if err := intent.EnsureLoggedIn(); err != nil {
+		t.Fatalf("Failed to ensure logged in with revoked token: %v", err)
+	} else if hs.logins != 2 || intent.Client.DeviceID != "DEVICE2" || intent.Client.AccessToken != "token2" {
+		t.Errorf("Unexpected client state after revoked token: device %q, token %q", intent.Client.DeviceID, intent.Client.AccessToken)
+	}
+	if creds := store.creds["@ghost:example.com"]; creds == nil || creds.AccessToken != "token2" {
+		t.Errorf("Expected revoked credentials to be replaced in the store, got %+v", creds)
+	}
+
+	// Explicit logins reuse the device ID, and can happen while other requests are being made
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			_, _ = intent.Client.GetOwnPresence()
+		}
+	}()
+	err := intent.LoginDevice("Ghost device")
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Failed to log in: %v", err)
+	} else if hs.logins != 3 || intent.Client.DeviceID != "DEVICE2" || intent.Client.AccessToken != "token3" {
+		t.Errorf("Unexpected client state after relogin: device %q, token %q", intent.Client.DeviceID, intent.Client.AccessToken)
+	}
+
+	// Tokens revoked while the intent is in use are noticed by normal requests, which log in again and retry once
+	hs.lock.Lock()
+	hs.revoked["Bearer token3"] = true
+	hs.lock.Unlock()
+	if _, err = intent.Client.GetOwnPresence(); err != nil {
+		t.Errorf("Request with revoked token wasn't retried after logging in again: %v", err)
+	} else if accessToken, deviceID := intent.Client.GetCredentials(); hs.logins != 4 || hs.lastAuth != "Bearer token4" || accessToken != "token4" || deviceID != "DEVICE2" {
+		t.Errorf("Unexpected state after revoked token: %d logins, last request with %q, device %q", hs.logins, hs.lastAuth, deviceID)
+	}
+	if creds := store.creds["@ghost:example.com"]; creds == nil || creds.AccessToken != "token4" {
+		t.Errorf("Expected new credentials to be stored after logging in again, got %+v", creds)
+	}
+
+	if err := as.LogoutGhosts(); err != nil {
+		t.Fatalf("Failed to log out ghosts: %v", err)
+	}
+	if hs.logouts != 1 || intent.IsLoggedIn() || intent.Client.AccessToken != "as_token" || intent.Client.AppServiceUserID != intent.UserID {
+		t.Errorf("Unexpected client state after logout: %d logouts, token %q", hs.logouts, intent.Client.AccessToken)
+	}
+	if _, ok := store.creds["@ghost:example.com"]; ok {
+		t.Error("Expected stored credentials to be deleted after logout")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -22,27 +23,76 @@ import (
 	"maunium.net/go/mautrix/id"
 )
 
+// RegisterRoutes adds the appservice API endpoints to the Router. It's called automatically by Start, but can be
+// called manually to serve the Router without starting the HTTP server, e.g. in tests. Calling it multiple times is safe.
+func (as *AppService) RegisterRoutes() {
+	as.routesOnce.Do(func() {
+		as.Router.HandleFunc("/transactions/{txnID}", as.PutTransaction).Methods(http.MethodPut)
+		as.Router.HandleFunc("/rooms/{roomAlias}", as.GetRoom).Methods(http.MethodGet)
+		as.Router.HandleFunc("/users/{userID}", as.GetUser).Methods(http.MethodGet)
+		as.Router.HandleFunc("/_matrix/app/v1/transactions/{txnID}", as.PutTransaction).Methods(http.MethodPut)
+		as.Router.HandleFunc("/_matrix/app/v1/rooms/{roomAlias}", as.GetRoom).Methods(http.MethodGet)
+		as.Router.HandleFunc("/_matrix/app/v1/users/{userID}", as.GetUser).Methods(http.MethodGet)
+		as.Router.HandleFunc("/_matrix/app/v1/thirdparty/protocol/{protocol}", as.GetThirdPartyProtocol).Methods(http.MethodGet)
+		as.Router.HandleFunc("/_matrix/app/v1/thirdparty/user/{protocol}", as.GetThirdPartyUser).Methods(http.MethodGet)
+		as.Router.HandleFunc("/_matrix/app/v1/thirdparty/user", as.GetThirdPartyUser).Methods(http.MethodGet)
+		as.Router.HandleFunc("/_matrix/app/v1/thirdparty/location/{protocol}", as.GetThirdPartyLocation).Methods(http.MethodGet)
+		as.Router.HandleFunc("/_matrix/app/v1/thirdparty/location", as.GetThirdPartyLocation).Methods(http.MethodGet)
+		as.Router.HandleFunc("/_matrix/app/v1/ping", as.PostPing).Methods(http.MethodPost)
+		as.Router.HandleFunc("/_matrix/app/unstable/org.matrix.msc3983/keys/claim", as.PostKeysClaim).Methods(http.MethodPost)
+		as.Router.HandleFunc("/_matrix/app/unstable/org.matrix.msc3984/keys/query", as.PostKeysQuery).Methods(http.MethodPost)
+		as.Router.HandleFunc("/_matrix/app/unstable/fi.mau.msc2659/ping", as.PostPing).Methods(http.MethodPost)
+		as.Router.HandleFunc("/_matrix/mau/live", as.GetLive).Methods(http.MethodGet)
+		as.Router.HandleFunc("/_matrix/mau/ready", as.GetReady).Methods(http.MethodGet)
+	})
+}
+
 // Start starts the HTTP server that listens for calls from the Matrix homeserver.
+// Listen binds the HTTP listener of the appservice without serving any requests yet. Start calls this automatically,
+// but calling it first makes sure the homeserver can connect (e.g. to ping the appservice) before Start is called
+// in a goroutine. Connections made in between are accepted once Start starts serving.
+func (as *AppService) Listen() error {
+	if as.listener != nil {
+		return nil
+	}
+	listener, err := net.Listen("tcp", as.Host.Address())
+	if err != nil {
+		return err
+	}
+	as.listener = listener
+	return nil
+}
+
 func (as *AppService) Start() {
-	as.Router.HandleFunc("/transactions/{txnID}", as.PutTransaction).Methods(http.MethodPut)
-	as.Router.HandleFunc("/rooms/{roomAlias}", as.GetRoom).Methods(http.MethodGet)
-	as.Router.HandleFunc("/users/{userID}", as.GetUser).Methods(http.MethodGet)
-	as.Router.HandleFunc("/_matrix/app/v1/transactions/{txnID}", as.PutTransaction).Methods(http.MethodPut)
-	as.Router.HandleFunc("/_matrix/app/v1/rooms/{roomAlias}", as.GetRoom).Methods(http.MethodGet)
-	as.Router.HandleFunc("/_matrix/app/v1/users/{userID}", as.GetUser).Methods(http.MethodGet)
-	as.Router.HandleFunc("/_matrix/mau/live", as.GetLive).Methods(http.MethodGet)
-	as.Router.HandleFunc("/_matrix/mau/ready", as.GetReady).Methods(http.MethodGet)
+	as.RegisterRoutes()
 
-	var err error
+	// New transactions are only handled after the unfinished ones have been replayed,
+	// but the server is started immediately so that other endpoints like pings work.
+	as.txnReplayLock.Lock()
+	go func() {
+		defer as.txnReplayLock.Unlock()
+		replayErr := as.ReplayTransactions()
+		if replayErr != nil {
+			as.Log.Errorln("Failed to replay unfinished transactions:", replayErr)
+		}
+	}()
+
+	err := as.Listen()
+	if err != nil {
+		as.Log.Fatalln("Error while listening:", err)
+		return
+	}
+	listener := as.listener
+	as.listener = nil
 	as.server = &http.Server{
 		Addr:    as.Host.Address(),
 		Handler: as.Router,
 	}
 	as.Log.Infoln("Listening on", as.Host.Address())
 	if len(as.Host.TLSCert) == 0 || len(as.Host.TLSKey) == 0 {
-		err = as.server.ListenAndServe()
+		err = as.server.Serve(listener)
 	} else {
-		err = as.server.ListenAndServeTLS(as.Host.TLSCert, as.Host.TLSKey)
+		err = as.server.ServeTLS(listener, as.Host.TLSCert, as.Host.TLSKey)
 	}
 	if err != nil && err.Error() != "http: Server closed" {
 		as.Log.Fatalln("Error while listening:", err)
@@ -116,7 +166,7 @@ func (as *AppService) PutTransaction(w http.ResponseWriter, r *http.Request) {
 		}.Write(w)
 		return
 	}
-	if as.txnIDC.IsProcessed(txnID) {
+	if as.TransactionLog == nil && as.txnIDC.IsProcessed(txnID) {
 		// Duplicate transaction ID: no-op
 		WriteBlankOK(w)
 		as.Log.Debugfln("Ignoring duplicate transaction %s", txnID)
@@ -132,6 +182,21 @@ func (as *AppService) PutTransaction(w http.ResponseWriter, r *http.Request) {
 			HTTPStatus: http.StatusBadRequest,
 			Message:    "Failed to parse body JSON",
 		}.Write(w)
+		return
+	}
+	as.txnReplayLock.RLock()
+	defer as.txnReplayLock.RUnlock()
+	isNew, err := as.logTransaction(txnID, body)
+	if err != nil {
+		as.Log.Errorfln("Failed to store transaction %s: %v", txnID, err)
+		Error{
+			ErrorCode:  ErrUnknown,
+			HTTPStatus: http.StatusInternalServerError,
+			Message:    "Failed to store transaction",
+		}.Write(w)
+	} else if !isNew {
+		WriteBlankOK(w)
+		as.Log.Debugfln("Ignoring duplicate transaction %s", txnID)
 	} else {
 		as.handleTransaction(txnID, &txn)
 		WriteBlankOK(w)
@@ -140,34 +205,49 @@ func (as *AppService) PutTransaction(w http.ResponseWriter, r *http.Request) {
 
 func (as *AppService) handleTransaction(id string, txn *Transaction) {
 	as.Log.Debugfln("Starting handling of transaction %s (%s)", id, txn.ContentString())
+	pending := as.startTransaction(id)
 	if as.Registration.EphemeralEvents {
 		if txn.EphemeralEvents != nil {
-			as.handleEvents(txn.EphemeralEvents, event.EphemeralEventType)
+			as.handleEvents(txn.EphemeralEvents, event.EphemeralEventType, pending)
 		} else if txn.MSC2409EphemeralEvents != nil {
-			as.handleEvents(txn.MSC2409EphemeralEvents, event.EphemeralEventType)
+			as.handleEvents(txn.MSC2409EphemeralEvents, event.EphemeralEventType, pending)
 		}
 	}
-	as.handleEvents(txn.Events, event.UnknownEventType)
+	as.handleEvents(txn.Events, event.UnknownEventType, pending)
 	if txn.DeviceLists != nil {
 		as.handleDeviceLists(txn.DeviceLists)
 	} else if txn.MSC3202DeviceLists != nil {
 		as.handleDeviceLists(txn.MSC3202DeviceLists)
 	}
 	if txn.DeviceOTKCount != nil {
-		as.handleOTKCounts(txn.DeviceOTKCount)
+		as.handleOTKCounts(txn.DeviceOTKCount, txn.FallbackKeys)
 	} else if txn.MSC3202DeviceOTKCount != nil {
-		as.handleOTKCounts(txn.MSC3202DeviceOTKCount)
+		as.handleOTKCounts(txn.MSC3202DeviceOTKCount, txn.MSC3202FallbackKeys)
+	}
+	if pending != nil {
+		as.finishTransactionEvent(pending)
+	} else {
+		as.txnIDC.MarkProcessed(id)
 	}
-	as.txnIDC.MarkProcessed(id)
 }
 
-func (as *AppService) handleOTKCounts(otks map[id.UserID]mautrix.OTKCount) {
-	for userID, otkCounts := range otks {
-		otkCounts.UserID = userID
-		select {
-		case as.OTKCounts <- &otkCounts:
-		default:
-			as.Log.Warnfln("Dropped OTK count update for %s because channel is full", userID)
+func (as *AppService) handleOTKCounts(otks map[id.UserID]map[id.DeviceID]mautrix.OTKCount, fallbackKeys map[id.UserID]map[id.DeviceID][]id.KeyAlgorithm) {
+	for userID, devices := range otks {
+		for deviceID, counts := range devices {
+			otkCounts := counts
+			otkCounts.UserID = userID
+			otkCounts.DeviceID = deviceID
+			if fallbackKeys != nil {
+				otkCounts.UnusedFallbackKeyTypes = fallbackKeys[userID][deviceID]
+				if otkCounts.UnusedFallbackKeyTypes == nil {
+					otkCounts.UnusedFallbackKeyTypes = []id.KeyAlgorithm{}
+				}
+			}
+			select {
+			case as.OTKCounts <- &otkCounts:
+			default:
+				as.Log.Warnfln("Dropped OTK count update for %s/%s because channel is full", userID, deviceID)
+			}
 		}
 	}
 }
@@ -180,7 +260,7 @@ func (as *AppService) handleDeviceLists(dl *mautrix.DeviceLists) {
 	}
 }
 
-func (as *AppService) handleEvents(evts []*event.Event, defaultTypeClass event.TypeClass) {
+func (as *AppService) handleEvents(evts []*event.Event, defaultTypeClass event.TypeClass, pending *pendingTransaction) {
 	for _, evt := range evts {
 		if len(evt.ToUserID) > 0 {
 			evt.Type.Class = event.ToDeviceEventType
@@ -205,6 +285,7 @@ func (as *AppService) handleEvents(evts []*event.Event, defaultTypeClass event.T
 				as.UpdateState(evt)
 			}
 		}
+		as.trackTransactionEvent(pending, evt)
 		as.Events <- evt
 	}
 }
@@ -0,0 +1,66 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const testOTKTxnBody = `{
+	"events": [],
+	"org.matrix.msc3202.device_one_time_keys_count": {
+		"@bot:example.com": {
+			"DEVICE1": {"signed_curve25519": 20},
+			"DEVICE2": {"signed_curve25519": 50}
+		}
+	},
+	"org.matrix.msc3202.device_unused_fallback_key_types": {
+		"@bot:example.com": {
+			"DEVICE1": ["signed_curve25519"]
+		}
+	}
+}`
+
+func TestAppService_PutTransaction_OTKCounts(t *testing.T) {
+	as := newTestEventProcessor().as
+	as.OTKCounts = make(chan *mautrix.OTKCount, OTKChannelSize)
+	as.Registration = &Registration{ServerToken: "hs_token"}
+	as.Router.HandleFunc("/_matrix/app/v1/transactions/{txnID}", as.PutTransaction).Methods(http.MethodPut)
+
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/1", strings.NewReader(testOTKTxnBody))
+	req.Header.Set("Authorization", "Bearer hs_token")
+	w := httptest.NewRecorder()
+	as.Router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code %d for transaction with OTK counts: %s", w.Code, w.Body.String())
+	}
+
+	counts := make(map[id.DeviceID]*mautrix.OTKCount)
+	for len(as.OTKCounts) > 0 {
+		otk := <-as.OTKCounts
+		if otk.UserID != "@bot:example.com" {
+			t.Errorf("Unexpected user ID %s in OTK count", otk.UserID)
+		}
+		counts[otk.DeviceID] = otk
+	}
+	if len(counts) != 2 {
+		t.Fatalf("Expected OTK counts for 2 devices, got %d", len(counts))
+	}
+	if otk := counts["DEVICE1"]; otk.SignedCurve25519 != 20 || len(otk.UnusedFallbackKeyTypes) != 1 || otk.UnusedFallbackKeyTypes[0] != id.KeyAlgorithmSignedCurve25519 {
+		t.Errorf("Unexpected OTK count for DEVICE1: %+v", otk)
+	}
+	// The server sent fallback key types, but not for DEVICE2, so it has no unused fallback keys
+	if otk := counts["DEVICE2"]; otk.SignedCurve25519 != 50 || otk.UnusedFallbackKeyTypes == nil || len(otk.UnusedFallbackKeyTypes) != 0 {
+		t.Errorf("Unexpected OTK count for DEVICE2: %+v", otk)
+	}
+}
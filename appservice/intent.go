@@ -11,6 +11,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
@@ -25,6 +26,8 @@ type IntentAPI struct {
 	UserID    id.UserID
 
 	IsCustomPuppet bool
+
+	loginLock sync.Mutex
 }
 
 func (as *AppService) NewIntentAPI(localpart string) *IntentAPI {
@@ -33,7 +36,7 @@ func (as *AppService) NewIntentAPI(localpart string) *IntentAPI {
 	if userID == bot.UserID {
 		bot = nil
 	}
-	return &IntentAPI{
+	intent := &IntentAPI{
 		Client:    as.Client(userID),
 		bot:       bot,
 		as:        as,
@@ -42,6 +45,11 @@ func (as *AppService) NewIntentAPI(localpart string) *IntentAPI {
 
 		IsCustomPuppet: false,
 	}
+	if bot != nil {
+		// The bot never logs in with a device, so there's nothing to refresh if its token is rejected
+		intent.Client.OnUnknownToken = intent.handleUnknownToken
+	}
+	return intent
 }
 
 func (intent *IntentAPI) Register() error {
@@ -54,15 +62,20 @@ func (intent *IntentAPI) Register() error {
 }
 
 func (intent *IntentAPI) EnsureRegistered() error {
-	if intent.IsCustomPuppet || intent.as.StateStore.IsRegistered(intent.UserID) {
+	if intent.IsCustomPuppet {
 		return nil
 	}
 
-	err := intent.Register()
-	if err != nil && !errors.Is(err, mautrix.MUserInUse) {
-		return fmt.Errorf("failed to ensure registered: %w", err)
+	if !intent.as.StateStore.IsRegistered(intent.UserID) {
+		err := intent.Register()
+		if err != nil && !errors.Is(err, mautrix.MUserInUse) {
+			return fmt.Errorf("failed to ensure registered: %w", err)
+		}
+		intent.as.StateStore.MarkRegistered(intent.UserID)
+	}
+	if intent.as.AutoLoginGhosts && intent.UserID != intent.as.BotMXID() {
+		return intent.EnsureLoggedIn()
 	}
-	intent.as.StateStore.MarkRegistered(intent.UserID)
 	return nil
 }
 
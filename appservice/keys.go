@@ -0,0 +1,94 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"maunium.net/go/mautrix"
+)
+
+// KeyClaimHandler handles one-time key claims that the homeserver forwards to the appservice
+// for users in the appservice's namespace (MSC3983).
+type KeyClaimHandler interface {
+	// HandleKeyClaim claims one-time keys for the requested devices. Devices that the handler
+	// doesn't know about should be left out of the response.
+	HandleKeyClaim(req mautrix.ReqAppserviceClaimKeys) (mautrix.RespAppserviceClaimKeys, error)
+}
+
+// KeyQueryHandler handles device key queries that the homeserver forwards to the appservice
+// for users in the appservice's namespace (MSC3984).
+type KeyQueryHandler interface {
+	// HandleKeyQuery returns the device keys of the requested devices. An empty device list means all devices
+	// of the user. Devices that the handler doesn't know about should be left out of the response.
+	HandleKeyQuery(req mautrix.DeviceKeysRequest) (*mautrix.RespQueryKeys, error)
+}
+
+func (as *AppService) readKeyRequest(w http.ResponseWriter, r *http.Request, handlerSet bool, into interface{}) bool {
+	if !as.CheckServerToken(w, r) {
+		return false
+	} else if !handlerSet {
+		Error{
+			ErrorCode:  ErrUnrecognized,
+			HTTPStatus: http.StatusNotFound,
+			Message:    "This appservice doesn't support forwarded key requests",
+		}.Write(w)
+		return false
+	}
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || json.Unmarshal(body, into) != nil {
+		Error{
+			ErrorCode:  ErrNotJSON,
+			HTTPStatus: http.StatusBadRequest,
+			Message:    "Request body is not valid JSON",
+		}.Write(w)
+		return false
+	}
+	return true
+}
+
+func (as *AppService) writeKeyResponse(w http.ResponseWriter, resp interface{}, err error) {
+	if err != nil {
+		as.Log.Warnln("Failed to handle forwarded key request:", err)
+		Error{
+			ErrorCode:  ErrUnknown,
+			HTTPStatus: http.StatusInternalServerError,
+			Message:    "Failed to handle key request",
+		}.Write(w)
+	} else {
+		_ = Respond(w, resp)
+	}
+}
+
+// PostKeysClaim handles a /keys/claim POST call from the homeserver.
+func (as *AppService) PostKeysClaim(w http.ResponseWriter, r *http.Request) {
+	var req mautrix.ReqAppserviceClaimKeys
+	if !as.readKeyRequest(w, r, as.KeyClaimHandler != nil, &req) {
+		return
+	}
+	resp, err := as.KeyClaimHandler.HandleKeyClaim(req)
+	if resp == nil && err == nil {
+		resp = mautrix.RespAppserviceClaimKeys{}
+	}
+	as.writeKeyResponse(w, resp, err)
+}
+
+// PostKeysQuery handles a /keys/query POST call from the homeserver.
+func (as *AppService) PostKeysQuery(w http.ResponseWriter, r *http.Request) {
+	var req mautrix.DeviceKeysRequest
+	if !as.readKeyRequest(w, r, as.KeyQueryHandler != nil, &req) {
+		return
+	}
+	resp, err := as.KeyQueryHandler.HandleKeyQuery(req)
+	if resp == nil && err == nil {
+		resp = &mautrix.RespQueryKeys{}
+	}
+	as.writeKeyResponse(w, resp, err)
+}
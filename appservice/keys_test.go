@@ -0,0 +1,71 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+type testKeyHandler struct {
+	claimed mautrix.ReqAppserviceClaimKeys
+}
+
+func (tkh *testKeyHandler) HandleKeyClaim(req mautrix.ReqAppserviceClaimKeys) (mautrix.RespAppserviceClaimKeys, error) {
+	tkh.claimed = req
+	return mautrix.RespAppserviceClaimKeys{
+		"@bot:example.com": {"DEVICE": {"signed_curve25519:AAAAAQ": {Key: "key"}}},
+	}, nil
+}
+
+func keyRequest(as *AppService, path, body string) (int, []byte) {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer hs_token")
+	w := httptest.NewRecorder()
+	as.Router.ServeHTTP(w, req)
+	return w.Code, w.Body.Bytes()
+}
+
+func TestAppService_KeyProxies(t *testing.T) {
+	as := Create()
+	as.Registration = &Registration{ServerToken: "hs_token"}
+	as.Router.HandleFunc("/_matrix/app/unstable/org.matrix.msc3983/keys/claim", as.PostKeysClaim).Methods(http.MethodPost)
+	as.Router.HandleFunc("/_matrix/app/unstable/org.matrix.msc3984/keys/query", as.PostKeysQuery).Methods(http.MethodPost)
+
+	const claimPath = "/_matrix/app/unstable/org.matrix.msc3983/keys/claim"
+	if code, _ := keyRequest(as, claimPath, `{}`); code != http.StatusNotFound {
+		t.Errorf("Expected 404 without a claim handler, got %d", code)
+	}
+	if code, _ := keyRequest(as, "/_matrix/app/unstable/org.matrix.msc3984/keys/query", `{}`); code != http.StatusNotFound {
+		t.Errorf("Expected 404 without a query handler, got %d", code)
+	}
+
+	handler := &testKeyHandler{}
+	as.KeyClaimHandler = handler
+	if code, _ := keyRequest(as, claimPath, `not json`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid JSON, got %d", code)
+	}
+	code, body := keyRequest(as, claimPath, `{"@bot:example.com":{"DEVICE":["signed_curve25519","signed_curve25519"]}}`)
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected status %d for key claim", code)
+	}
+	if algs := handler.claimed[id.UserID("@bot:example.com")][id.DeviceID("DEVICE")]; len(algs) != 2 {
+		t.Errorf("Unexpected parsed claim request %v", handler.claimed)
+	}
+	var resp mautrix.RespAppserviceClaimKeys
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("Failed to parse claim response: %v", err)
+	} else if key := resp["@bot:example.com"]["DEVICE"]["signed_curve25519:AAAAAQ"]; key.Key != "key" {
+		t.Errorf("Unexpected claim response %s", body)
+	}
+}
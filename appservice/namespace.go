@@ -0,0 +1,104 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"regexp"
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	namespaceRegexCache     = make(map[string]*regexp.Regexp)
+	namespaceRegexCacheLock sync.RWMutex
+)
+
+// compileNamespaceRegex compiles the given namespace regex anchored at the start, or returns it from the cache
+// if it has been compiled before.
+func compileNamespaceRegex(regex string) (*regexp.Regexp, error) {
+	namespaceRegexCacheLock.RLock()
+	compiled, ok := namespaceRegexCache[regex]
+	namespaceRegexCacheLock.RUnlock()
+	if ok {
+		return compiled, nil
+	}
+	// Homeservers match namespaces with Python's re.match, which only anchors the regex at the start.
+	// The regex is wrapped in a group so that alternations are anchored too.
+	compiled, err := regexp.Compile(`^(?:` + regex + `)`)
+	if err != nil {
+		return nil, err
+	}
+	namespaceRegexCacheLock.Lock()
+	namespaceRegexCache[regex] = compiled
+	namespaceRegexCacheLock.Unlock()
+	return compiled, nil
+}
+
+// Matcher returns the compiled regex of the namespace, anchored at the start of the string.
+// Compiled regexes are cached, so this is cheap to call repeatedly.
+func (ns *Namespace) Matcher() (*regexp.Regexp, error) {
+	return compileNamespaceRegex(ns.Regex)
+}
+
+// Matches checks if the given string matches the namespace regex. Like on the homeserver, the regex is implicitly
+// anchored at the start, but not at the end, so namespaces should use $ to match whole identifiers.
+// Invalid regexes never match.
+func (ns *Namespace) Matches(str string) bool {
+	matcher, err := ns.Matcher()
+	return err == nil && matcher.MatchString(str)
+}
+
+// Match checks if the given string matches any namespace in the list. The second return value is true
+// if any of the matching namespaces is exclusive.
+func (nsl NamespaceList) Match(str string) (matches, exclusive bool) {
+	for i := range nsl {
+		if nsl[i].Matches(str) {
+			matches = true
+			if nsl[i].Exclusive {
+				return true, true
+			}
+		}
+	}
+	return
+}
+
+// IsUserInNamespace checks if the given user ID matches any of the user namespaces in the registration.
+func (reg *Registration) IsUserInNamespace(userID id.UserID) bool {
+	matches, _ := reg.Namespaces.UserIDs.Match(string(userID))
+	return matches
+}
+
+// IsUserExclusive checks if the given user ID matches any of the exclusive user namespaces in the registration.
+func (reg *Registration) IsUserExclusive(userID id.UserID) bool {
+	_, exclusive := reg.Namespaces.UserIDs.Match(string(userID))
+	return exclusive
+}
+
+// IsAliasInNamespace checks if the given room alias matches any of the alias namespaces in the registration.
+func (reg *Registration) IsAliasInNamespace(alias id.RoomAlias) bool {
+	matches, _ := reg.Namespaces.RoomAliases.Match(string(alias))
+	return matches
+}
+
+// IsAliasExclusive checks if the given room alias matches any of the exclusive alias namespaces in the registration.
+func (reg *Registration) IsAliasExclusive(alias id.RoomAlias) bool {
+	_, exclusive := reg.Namespaces.RoomAliases.Match(string(alias))
+	return exclusive
+}
+
+// IsRoomInNamespace checks if the given room ID matches any of the room namespaces in the registration.
+func (reg *Registration) IsRoomInNamespace(roomID id.RoomID) bool {
+	matches, _ := reg.Namespaces.RoomIDs.Match(string(roomID))
+	return matches
+}
+
+// IsRoomExclusive checks if the given room ID matches any of the exclusive room namespaces in the registration.
+func (reg *Registration) IsRoomExclusive(roomID id.RoomID) bool {
+	_, exclusive := reg.Namespaces.RoomIDs.Match(string(roomID))
+	return exclusive
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"errors"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func newTestRegistration() *Registration {
+	reg := CreateRegistration()
+	reg.ID = "test"
+	reg.URL = "http://localhost:29318"
+	reg.SenderLocalpart = "AbCdEf123"
+	reg.Namespaces.UserIDs.Register(regexp.MustCompile(`^@bot:example\.com$`), true)
+	reg.Namespaces.UserIDs.Register(regexp.MustCompile(`^@test_[0-9]+:example\.com$`), true)
+	reg.Namespaces.RoomAliases.Register(regexp.MustCompile(`^#test_.+:example\.com$`), false)
+	return reg
+}
+
+func TestRegistration_Namespaces(t *testing.T) {
+	reg := newTestRegistration()
+	for userID, expected := range map[id.UserID]bool{
+		"@bot:example.com":      true,
+		"@test_123:example.com": true,
+		"@test_abc:example.com": false,
+		"@bot:example.org":      false,
+	} {
+		if reg.IsUserInNamespace(userID) != expected || reg.IsUserExclusive(userID) != expected {
+			t.Errorf("Unexpected namespace match result for %s", userID)
+		}
+	}
+	if !reg.IsAliasInNamespace("#test_foo:example.com") || reg.IsAliasExclusive("#test_foo:example.com") {
+		t.Error("Expected alias to be in non-exclusive namespace")
+	}
+	if reg.IsRoomInNamespace("!foo:example.com") {
+		t.Error("Expected room not to be in namespace without room namespaces")
+	}
+
+	// Like on the homeserver, namespaces are only anchored at the start
+	unanchored := Namespace{Regex: `@a_.+:example\.com|@b:example\.com`}
+	for str, expected := range map[string]bool{
+		"@a_1:example.com":      true,
+		"@a_1:example.com.evil": true,
+		"@b:example.com":        true,
+		"evil@a_1:example.com":  false,
+		"evil@b:example.com":    false,
+	} {
+		if unanchored.Matches(str) != expected {
+			t.Errorf("Unexpected match result %t for %s", !expected, str)
+		}
+	}
+
+	invalid := Namespace{Regex: "(unclosed"}
+	if invalid.Matches("(unclosed") {
+		t.Error("Expected invalid regex not to match")
+	}
+}
+
+func TestRegistration_Validate(t *testing.T) {
+	reg := newTestRegistration()
+	if err := reg.Validate("example.com"); err != nil {
+		t.Fatalf("Unexpected error validating valid registration: %v", err)
+	}
+
+	reg.ServerToken = reg.AppToken
+	reg.URL = "localhost:29318"
+	reg.Namespaces.UserIDs = append(reg.Namespaces.UserIDs, Namespace{Regex: "(unclosed"}, Namespace{Regex: `^@test_.+:example\.com$`})
+	reg.Namespaces.RoomAliases.Register(regexp.MustCompile(`^#test_foo:example\.com$`), true)
+	err := reg.Validate("example.com")
+	var validationErr *RegistrationValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Expected validation error, got %v", err)
+	}
+	for _, expected := range []error{ErrInvalidRegistrationToken, ErrInvalidRegistrationURL, ErrInvalidNamespaceRegex, ErrOverlappingNamespaces} {
+		if !errors.Is(err, expected) {
+			t.Errorf("Expected %v in validation error %v", expected, err)
+		}
+	}
+	if errors.Is(err, ErrInvalidSenderLocalpart) {
+		t.Errorf("Unexpected sender localpart problem in %v", err)
+	}
+
+	reg = newTestRegistration()
+	reg.Namespaces.UserIDs = nil
+	reg.Namespaces.UserIDs.Register(regexp.MustCompile(`^@.+:example\.com$`), false)
+	if err = reg.Validate(""); err != nil {
+		t.Errorf("Unexpected error validating without homeserver domain: %v", err)
+	}
+	if err = reg.Validate("example.com"); !errors.Is(err, ErrInvalidSenderLocalpart) {
+		t.Errorf("Expected sender localpart error, got %v", err)
+	}
+}
+
+func TestLoadRegistration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registration.yaml")
+	reg := newTestRegistration()
+	// Lookaheads are valid in Python, but not in Go
+	reg.Namespaces.UserIDs = append(reg.Namespaces.UserIDs, Namespace{Regex: `^@(?!bot).+:example\.com$`})
+	if err := reg.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadRegistration(path)
+	if err != nil {
+		t.Fatalf("Expected registration with Python-only regex to load, got %v", err)
+	} else if loaded.ID != reg.ID || len(loaded.Namespaces.UserIDs) != 3 {
+		t.Errorf("Unexpected loaded registration %+v", loaded)
+	}
+	if _, err = LoadRegistrationStrict(path, "example.com"); !errors.Is(err, ErrInvalidNamespaceRegex) {
+		t.Errorf("Expected strict loading to fail with invalid regex error, got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"maunium.net/go/mautrix"
+)
+
+// ErrPingNotReceived is returned by Ping if the homeserver reported a successful ping,
+// but the ping request didn't reach this appservice instance.
+var ErrPingNotReceived = errors.New("homeserver reported a successful ping, but it wasn't received by this appservice")
+
+// PostPing handles a /ping POST call from the homeserver.
+func (as *AppService) PostPing(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	}
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	var req mautrix.ReqAppservicePing
+	if err != nil || (len(body) > 0 && json.Unmarshal(body, &req) != nil) {
+		Error{
+			ErrorCode:  ErrNotJSON,
+			HTTPStatus: http.StatusBadRequest,
+			Message:    "Request body is not JSON",
+		}.Write(w)
+		return
+	}
+
+	as.pingLock.Lock()
+	if _, ok := as.pendingPings[req.TxnID]; ok {
+		as.pendingPings[req.TxnID] = true
+	}
+	as.pingLock.Unlock()
+	as.Log.Debugfln("Received ping from homeserver with transaction ID %q", req.TxnID)
+	WriteBlankOK(w)
+}
+
+// Ping asks the homeserver to ping this appservice, which checks that the homeserver can reach the appservice
+// using the URL and hs_token in the registration. The HTTP server must be running for the ping to succeed.
+//
+// Errors from the homeserver can be checked with errors.Is, e.g. mautrix.MURLNotSet if the registration doesn't
+// have an URL, mautrix.MBadStatus if the appservice rejected the request (e.g. because the hs_token is wrong) and
+// mautrix.MConnectionFailed or mautrix.MConnectionTimeout if the homeserver couldn't connect to the appservice.
+// If the homeserver reports success, but this instance didn't receive the ping, ErrPingNotReceived is returned.
+func (as *AppService) Ping() (*mautrix.RespAppservicePing, error) {
+	txnID := "mautrix-go-ping-" + RandomString(16)
+	as.pingLock.Lock()
+	as.pendingPings[txnID] = false
+	as.pingLock.Unlock()
+	defer func() {
+		as.pingLock.Lock()
+		delete(as.pendingPings, txnID)
+		as.pingLock.Unlock()
+	}()
+
+	resp, err := as.BotClient().AppservicePing(as.Registration.ID, txnID)
+	if err != nil {
+		return nil, err
+	}
+	as.pingLock.Lock()
+	received := as.pendingPings[txnID]
+	as.pingLock.Unlock()
+	if !received {
+		return resp, ErrPingNotReceived
+	}
+	return resp, nil
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+)
+
+// newPingTestAppService creates an appservice whose homeserver forwards pings to the given handler.
+func newPingTestAppService(t *testing.T, forward func(as *AppService, body []byte) int) *AppService {
+	as := newTestEventProcessor().as
+	as.Registration = &Registration{ID: "test", AppToken: "as_token", ServerToken: "hs_token", SenderLocalpart: "bot"}
+	as.HomeserverDomain = "example.com"
+	as.Router.HandleFunc("/_matrix/app/v1/ping", as.PostPing).Methods(http.MethodPost)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/v1/appservice/test/ping" || r.Header.Get("Authorization") != "Bearer as_token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"Wrong appservice"}`))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		status := forward(as, body)
+		if status != http.StatusOK {
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = fmt.Fprintf(w, `{"errcode":"M_BAD_STATUS","error":"Bad status","status":%d}`, status)
+			return
+		}
+		_, _ = w.Write([]byte(`{"duration_ms":123}`))
+	}))
+	t.Cleanup(hs.Close)
+	as.HomeserverURL = hs.URL
+	return as
+}
+
+func forwardPing(token string) func(as *AppService, body []byte) int {
+	return func(as *AppService, body []byte) int {
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/app/v1/ping", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		as.Router.ServeHTTP(w, req)
+		return w.Code
+	}
+}
+
+func TestAppService_Ping(t *testing.T) {
+	as := newPingTestAppService(t, forwardPing("hs_token"))
+	resp, err := as.Ping()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	} else if resp.DurationMS != 123 {
+		t.Errorf("Unexpected duration %d", resp.DurationMS)
+	}
+	if len(as.pendingPings) != 0 {
+		t.Errorf("Expected pending pings to be cleared")
+	}
+}
+
+func TestAppService_Ping_WrongToken(t *testing.T) {
+	as := newPingTestAppService(t, forwardPing("wrong_token"))
+	_, err := as.Ping()
+	if !errors.Is(err, mautrix.MBadStatus) {
+		t.Fatalf("Expected M_BAD_STATUS, got %v", err)
+	}
+}
+
+func TestAppService_Ping_NotReceived(t *testing.T) {
+	as := newPingTestAppService(t, func(as *AppService, body []byte) int {
+		return http.StatusOK
+	})
+	_, err := as.Ping()
+	if !errors.Is(err, ErrPingNotReceived) {
+		t.Fatalf("Expected ErrPingNotReceived, got %v", err)
+	}
+}
+
+func TestAppService_Ping_ListenBeforeStart(t *testing.T) {
+	var addr string
+	as := newPingTestAppService(t, func(as *AppService, body []byte) int {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/_matrix/app/v1/ping", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer hs_token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("Failed to forward ping: %v", err)
+			return http.StatusBadGateway
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	})
+	as.Host = HostConfig{Hostname: "127.0.0.1"}
+	if err := as.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr = as.listener.Addr().String()
+	// Start serving only after the ping has been sent, like a bridge that starts the server in a goroutine
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		as.Start()
+	}()
+	defer as.Stop()
+	if _, err := as.Ping(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -19,14 +19,16 @@ import (
 
 // Transaction contains a list of events.
 type Transaction struct {
-	Events          []*event.Event                 `json:"events"`
-	EphemeralEvents []*event.Event                 `json:"ephemeral,omitempty"`
-	DeviceLists     *mautrix.DeviceLists           `json:"device_lists,omitempty"`
-	DeviceOTKCount  map[id.UserID]mautrix.OTKCount `json:"device_one_time_keys_count,omitempty"`
+	Events          []*event.Event                                  `json:"events"`
+	EphemeralEvents []*event.Event                                  `json:"ephemeral,omitempty"`
+	DeviceLists     *mautrix.DeviceLists                            `json:"device_lists,omitempty"`
+	DeviceOTKCount  map[id.UserID]map[id.DeviceID]mautrix.OTKCount  `json:"device_one_time_keys_count,omitempty"`
+	FallbackKeys    map[id.UserID]map[id.DeviceID][]id.KeyAlgorithm `json:"device_unused_fallback_key_types,omitempty"`
 
-	MSC2409EphemeralEvents []*event.Event                 `json:"de.sorunome.msc2409.ephemeral,omitempty"`
-	MSC3202DeviceLists     *mautrix.DeviceLists           `json:"org.matrix.msc3202.device_lists,omitempty"`
-	MSC3202DeviceOTKCount  map[id.UserID]mautrix.OTKCount `json:"org.matrix.msc3202.device_one_time_keys_count,omitempty"`
+	MSC2409EphemeralEvents []*event.Event                                  `json:"de.sorunome.msc2409.ephemeral,omitempty"`
+	MSC3202DeviceLists     *mautrix.DeviceLists                            `json:"org.matrix.msc3202.device_lists,omitempty"`
+	MSC3202DeviceOTKCount  map[id.UserID]map[id.DeviceID]mautrix.OTKCount  `json:"org.matrix.msc3202.device_one_time_keys_count,omitempty"`
+	MSC3202FallbackKeys    map[id.UserID]map[id.DeviceID][]id.KeyAlgorithm `json:"org.matrix.msc3202.device_unused_fallback_key_types,omitempty"`
 }
 
 func (txn *Transaction) ContentString() string {
@@ -94,6 +96,8 @@ const (
 	ErrUnknownToken ErrorCode = "M_UNKNOWN_TOKEN"
 	ErrBadJSON      ErrorCode = "M_BAD_JSON"
 	ErrNotJSON      ErrorCode = "M_NOT_JSON"
+	ErrNotFound     ErrorCode = "M_NOT_FOUND"
+	ErrUnrecognized ErrorCode = "M_UNRECOGNIZED"
 	ErrUnknown      ErrorCode = "M_UNKNOWN"
 )
 
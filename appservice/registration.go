@@ -38,6 +38,9 @@ func CreateRegistration() *Registration {
 }
 
 // LoadRegistration loads a YAML file and turns it into a Registration.
+//
+// The registration is not validated, as existing registrations may use regexes that the homeserver accepts, but
+// Go doesn't (e.g. lookaheads). Use LoadRegistrationStrict or Registration.Validate to check for problems.
 func LoadRegistration(path string) (*Registration, error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -52,6 +55,20 @@ func LoadRegistration(path string) (*Registration, error) {
 	return reg, nil
 }
 
+// LoadRegistrationStrict loads a registration like LoadRegistration, but also validates it with
+// Registration.Validate and returns an error if any problems are found.
+func LoadRegistrationStrict(path string, homeserverDomain string) (*Registration, error) {
+	reg, err := LoadRegistration(path)
+	if err != nil {
+		return nil, err
+	}
+	err = reg.Validate(homeserverDomain)
+	if err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
+
 // Save saves this Registration into a file at the given path.
 func (reg *Registration) Save(path string) error {
 	data, err := yaml.Marshal(reg)
@@ -85,6 +102,7 @@ type Namespace struct {
 
 type NamespaceList []Namespace
 
+// Register adds a namespace with the given regex to the list.
 func (nsl *NamespaceList) Register(regex *regexp.Regexp, exclusive bool) {
 	ns := Namespace{
 		Regex:     regex.String(),
@@ -0,0 +1,43 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstatestore
+
+import (
+	"database/sql"
+	"errors"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+)
+
+var _ appservice.GhostCredentialStore = (*SQLStateStore)(nil)
+
+func (store *SQLStateStore) GetGhostCredentials(userID id.UserID) (*appservice.GhostCredentials, error) {
+	creds := appservice.GhostCredentials{UserID: userID}
+	err := store.
+		QueryRow("SELECT device_id, access_token FROM mx_ghost_credentials WHERE user_id=$1", userID).
+		Scan(&creds.DeviceID, &creds.AccessToken)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &creds, nil
+}
+
+func (store *SQLStateStore) PutGhostCredentials(creds *appservice.GhostCredentials) error {
+	_, err := store.Exec(`
+		INSERT INTO mx_ghost_credentials (user_id, device_id, access_token) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET device_id=excluded.device_id, access_token=excluded.access_token
+	`, creds.UserID, creds.DeviceID, creds.AccessToken)
+	return err
+}
+
+func (store *SQLStateStore) DeleteGhostCredentials(userID id.UserID) error {
+	_, err := store.Exec("DELETE FROM mx_ghost_credentials WHERE user_id=$1", userID)
+	return err
+}
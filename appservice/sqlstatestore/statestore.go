@@ -39,6 +39,7 @@ type SQLStateStore struct {
 }
 
 var _ appservice.StateStore = (*SQLStateStore)(nil)
+var _ appservice.HistoryVisibilityStateStore = (*SQLStateStore)(nil)
 
 func NewSQLStateStore(db *dbutil.Database) *SQLStateStore {
 	return &SQLStateStore{
@@ -199,6 +200,9 @@ func (store *SQLStateStore) GetPowerLevels(roomID id.RoomID) (levels *event.Powe
 			store.Log.Errorfln("Failed to scan power levels of %s: %v", roomID, err)
 		}
 		return
+	} else if data == nil {
+		// The row may exist with only other state
+		return
 	}
 	levels = &event.PowerLevelsEventContent{}
 	err = json.Unmarshal(data, levels)
@@ -209,6 +213,27 @@ func (store *SQLStateStore) GetPowerLevels(roomID id.RoomID) (levels *event.Powe
 	return
 }
 
+func (store *SQLStateStore) SetHistoryVisibility(roomID id.RoomID, visibility event.HistoryVisibility) {
+	_, err := store.Exec(`
+		INSERT INTO mx_room_state (room_id, history_visibility) VALUES ($1, $2)
+		ON CONFLICT (room_id) DO UPDATE SET history_visibility=excluded.history_visibility
+	`, roomID, visibility)
+	if err != nil {
+		store.Log.Warnfln("Failed to store history visibility of %s: %v", roomID, err)
+	}
+}
+
+func (store *SQLStateStore) GetHistoryVisibility(roomID id.RoomID) event.HistoryVisibility {
+	var visibility sql.NullString
+	err := store.
+		QueryRow("SELECT history_visibility FROM mx_room_state WHERE room_id=$1", roomID).
+		Scan(&visibility)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		store.Log.Errorfln("Failed to scan history visibility of %s: %v", roomID, err)
+	}
+	return event.HistoryVisibility(visibility.String)
+}
+
 func (store *SQLStateStore) GetPowerLevel(roomID id.RoomID, userID id.UserID) int {
 	if store.Dialect == dbutil.Postgres {
 		var powerLevel int
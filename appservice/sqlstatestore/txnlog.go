@@ -0,0 +1,63 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstatestore
+
+import (
+	"encoding/json"
+	"time"
+
+	"maunium.net/go/mautrix/appservice"
+)
+
+var _ appservice.TransactionLog = (*SQLStateStore)(nil)
+
+func (store *SQLStateStore) MarkReceived(txnID string, body json.RawMessage) (bool, error) {
+	res, err := store.Exec(
+		"INSERT INTO mx_transaction_log (txn_id, body, received_at) VALUES ($1, $2, $3) ON CONFLICT (txn_id) DO NOTHING",
+		txnID, string(body), time.Now().UnixMilli(),
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (store *SQLStateStore) MarkCompleted(txnID string) error {
+	_, err := store.Exec("UPDATE mx_transaction_log SET completed_at=$1, body=NULL WHERE txn_id=$2", time.Now().UnixMilli(), txnID)
+	return err
+}
+
+func (store *SQLStateStore) GetUnfinished() ([]*appservice.LoggedTransaction, error) {
+	rows, err := store.Query("SELECT txn_id, body, received_at FROM mx_transaction_log WHERE completed_at IS NULL ORDER BY received_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var txns []*appservice.LoggedTransaction
+	for rows.Next() {
+		var txn appservice.LoggedTransaction
+		var body string
+		var receivedAt int64
+		err = rows.Scan(&txn.ID, &body, &receivedAt)
+		if err != nil {
+			return nil, err
+		}
+		txn.Body = json.RawMessage(body)
+		txn.ReceivedAt = time.UnixMilli(receivedAt)
+		txns = append(txns, &txn)
+	}
+	return txns, rows.Err()
+}
+
+func (store *SQLStateStore) DeleteCompleted(receivedBefore time.Time) (int64, error) {
+	res, err := store.Exec("DELETE FROM mx_transaction_log WHERE completed_at IS NOT NULL AND received_at<$1", receivedBefore.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
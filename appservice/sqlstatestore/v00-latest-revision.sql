@@ -1,4 +1,4 @@
--- v0 -> v3: Latest revision
+-- v0 -> v7: Latest revision
 
 CREATE TABLE mx_registrations (
 	user_id TEXT PRIMARY KEY
@@ -17,6 +17,20 @@ CREATE TABLE mx_user_profile (
 );
 
 CREATE TABLE mx_room_state (
-	room_id      TEXT PRIMARY KEY,
-	power_levels jsonb
+	room_id            TEXT PRIMARY KEY,
+	power_levels       jsonb,
+	history_visibility TEXT
+);
+
+CREATE TABLE mx_transaction_log (
+	txn_id       TEXT PRIMARY KEY,
+	body         TEXT,
+	received_at  BIGINT NOT NULL,
+	completed_at BIGINT
+);
+
+CREATE TABLE mx_ghost_credentials (
+	user_id      TEXT PRIMARY KEY,
+	device_id    TEXT NOT NULL,
+	access_token TEXT NOT NULL
 );
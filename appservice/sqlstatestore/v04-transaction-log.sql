@@ -0,0 +1,8 @@
+-- v4: Add persistent transaction log
+
+CREATE TABLE mx_transaction_log (
+	txn_id       TEXT PRIMARY KEY,
+	body         TEXT NOT NULL,
+	received_at  BIGINT NOT NULL,
+	completed_at BIGINT
+);
@@ -0,0 +1,7 @@
+-- v5: Add credential storage for logged in ghosts
+
+CREATE TABLE mx_ghost_credentials (
+	user_id      TEXT PRIMARY KEY,
+	device_id    TEXT NOT NULL,
+	access_token TEXT NOT NULL
+);
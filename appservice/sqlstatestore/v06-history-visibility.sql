@@ -0,0 +1,3 @@
+-- v6: Store history visibility of rooms
+
+ALTER TABLE mx_room_state ADD COLUMN history_visibility TEXT;
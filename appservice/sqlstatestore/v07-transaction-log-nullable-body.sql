@@ -0,0 +1,17 @@
+-- v7: Remove bodies of completed transactions from the transaction log
+
+-- only: postgres
+ALTER TABLE mx_transaction_log ALTER COLUMN body DROP NOT NULL;
+
+-- only: sqlite for next 9 lines
+CREATE TABLE mx_transaction_log_new (
+	txn_id       TEXT PRIMARY KEY,
+	body         TEXT,
+	received_at  BIGINT NOT NULL,
+	completed_at BIGINT
+);
+INSERT INTO mx_transaction_log_new (txn_id, body, received_at, completed_at) SELECT txn_id, body, received_at, completed_at FROM mx_transaction_log;
+DROP TABLE mx_transaction_log;
+ALTER TABLE mx_transaction_log_new RENAME TO mx_transaction_log;
+
+UPDATE mx_transaction_log SET body=NULL WHERE completed_at IS NOT NULL;
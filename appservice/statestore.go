@@ -36,12 +36,24 @@ type StateStore interface {
 	HasPowerLevel(roomID id.RoomID, userID id.UserID, eventType event.Type) bool
 }
 
+// HistoryVisibilityStateStore is an optional extension of StateStore that tracks the history visibility of rooms.
+// It's used by the crypto module to decide whether room keys can be shared with users who are invited later.
+type HistoryVisibilityStateStore interface {
+	// GetHistoryVisibility returns the current history visibility of a room, or an empty string if it's not known.
+	GetHistoryVisibility(roomID id.RoomID) event.HistoryVisibility
+	SetHistoryVisibility(roomID id.RoomID, visibility event.HistoryVisibility)
+}
+
 func (as *AppService) UpdateState(evt *event.Event) {
 	switch content := evt.Content.Parsed.(type) {
 	case *event.MemberEventContent:
 		as.StateStore.SetMember(evt.RoomID, id.UserID(evt.GetStateKey()), content)
 	case *event.PowerLevelsEventContent:
 		as.StateStore.SetPowerLevels(evt.RoomID, content)
+	case *event.HistoryVisibilityEventContent:
+		if hvStore, ok := as.StateStore.(HistoryVisibilityStateStore); ok {
+			hvStore.SetHistoryVisibility(evt.RoomID, content.HistoryVisibility)
+		}
 	}
 }
 
@@ -96,16 +108,19 @@ type BasicStateStore struct {
 	Members           map[id.RoomID]map[id.UserID]*event.MemberEventContent `json:"memberships"`
 	powerLevelsLock   sync.RWMutex                                          `json:"-"`
 	PowerLevels       map[id.RoomID]*event.PowerLevelsEventContent          `json:"power_levels"`
+	historyVisLock    sync.RWMutex                                          `json:"-"`
+	HistoryVisibility map[id.RoomID]event.HistoryVisibility                 `json:"history_visibility"`
 
 	*TypingStateStore
 }
 
 func NewBasicStateStore() StateStore {
 	return &BasicStateStore{
-		Registrations:    make(map[id.UserID]bool),
-		Members:          make(map[id.RoomID]map[id.UserID]*event.MemberEventContent),
-		PowerLevels:      make(map[id.RoomID]*event.PowerLevelsEventContent),
-		TypingStateStore: NewTypingStateStore(),
+		Registrations:     make(map[id.UserID]bool),
+		Members:           make(map[id.RoomID]map[id.UserID]*event.MemberEventContent),
+		PowerLevels:       make(map[id.RoomID]*event.PowerLevelsEventContent),
+		HistoryVisibility: make(map[id.RoomID]event.HistoryVisibility),
+		TypingStateStore:  NewTypingStateStore(),
 	}
 }
 
@@ -223,6 +238,21 @@ func (store *BasicStateStore) GetPowerLevels(roomID id.RoomID) (levels *event.Po
 	return
 }
 
+func (store *BasicStateStore) SetHistoryVisibility(roomID id.RoomID, visibility event.HistoryVisibility) {
+	store.historyVisLock.Lock()
+	if store.HistoryVisibility == nil {
+		store.HistoryVisibility = make(map[id.RoomID]event.HistoryVisibility)
+	}
+	store.HistoryVisibility[roomID] = visibility
+	store.historyVisLock.Unlock()
+}
+
+func (store *BasicStateStore) GetHistoryVisibility(roomID id.RoomID) event.HistoryVisibility {
+	store.historyVisLock.RLock()
+	defer store.historyVisLock.RUnlock()
+	return store.HistoryVisibility[roomID]
+}
+
 func (store *BasicStateStore) GetPowerLevel(roomID id.RoomID, userID id.UserID) int {
 	return store.GetPowerLevels(roomID).GetUserLevel(userID)
 }
@@ -0,0 +1,130 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// ThirdPartyHandler handles third party lookups from the homeserver for the protocols in Registration.Protocols.
+//
+// Lookup methods return an empty list (or nil protocol) if nothing was found, which is sent to the homeserver as a 404.
+// Errors are sent to the homeserver as a 500.
+type ThirdPartyHandler interface {
+	// GetProtocol returns the metadata of the given protocol.
+	GetProtocol(protocol string) (*mautrix.ThirdPartyProtocol, error)
+	// GetUser finds the Matrix user IDs of third party users matching the given protocol-specific fields.
+	GetUser(protocol string, fields map[string]string) ([]*mautrix.ThirdPartyUser, error)
+	// GetLocation finds the portal rooms of third party locations matching the given protocol-specific fields.
+	GetLocation(protocol string, fields map[string]string) ([]*mautrix.ThirdPartyLocation, error)
+	// GetUserByMXID finds the third party users represented by the given Matrix user ID.
+	GetUserByMXID(userID id.UserID) ([]*mautrix.ThirdPartyUser, error)
+	// GetLocationByAlias finds the third party locations bridged to the given room alias.
+	GetLocationByAlias(alias id.RoomAlias) ([]*mautrix.ThirdPartyLocation, error)
+}
+
+func (as *AppService) hasProtocol(protocol string) bool {
+	for _, registered := range as.Registration.Protocols {
+		if registered == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// checkThirdPartyRequest checks the server token and whether third party lookups are supported for the given protocol.
+func (as *AppService) checkThirdPartyRequest(w http.ResponseWriter, r *http.Request, protocol string) bool {
+	if !as.CheckServerToken(w, r) {
+		return false
+	} else if as.ThirdPartyHandler == nil || (len(protocol) > 0 && !as.hasProtocol(protocol)) {
+		Error{
+			ErrorCode:  ErrNotFound,
+			HTTPStatus: http.StatusNotFound,
+			Message:    "Unknown protocol",
+		}.Write(w)
+		return false
+	}
+	return true
+}
+
+// thirdPartyFields returns the query parameters of a lookup request as protocol-specific fields.
+func thirdPartyFields(r *http.Request) map[string]string {
+	query := r.URL.Query()
+	fields := make(map[string]string, len(query))
+	for key, values := range query {
+		if key != "access_token" && len(values) > 0 {
+			fields[key] = values[0]
+		}
+	}
+	return fields
+}
+
+func (as *AppService) writeThirdPartyResponse(w http.ResponseWriter, resp interface{}, found bool, err error) {
+	if err != nil {
+		as.Log.Warnln("Third party lookup failed:", err)
+		Error{
+			ErrorCode:  ErrUnknown,
+			HTTPStatus: http.StatusInternalServerError,
+			Message:    "Lookup failed",
+		}.Write(w)
+	} else if !found {
+		Error{
+			ErrorCode:  ErrNotFound,
+			HTTPStatus: http.StatusNotFound,
+			Message:    "No results found",
+		}.Write(w)
+	} else {
+		_ = Respond(w, resp)
+	}
+}
+
+// GetThirdPartyProtocol handles a /thirdparty/protocol GET call from the homeserver.
+func (as *AppService) GetThirdPartyProtocol(w http.ResponseWriter, r *http.Request) {
+	protocol := mux.Vars(r)["protocol"]
+	if !as.checkThirdPartyRequest(w, r, protocol) {
+		return
+	}
+	resp, err := as.ThirdPartyHandler.GetProtocol(protocol)
+	as.writeThirdPartyResponse(w, resp, resp != nil, err)
+}
+
+// GetThirdPartyUser handles a /thirdparty/user GET call from the homeserver.
+func (as *AppService) GetThirdPartyUser(w http.ResponseWriter, r *http.Request) {
+	protocol, hasProtocol := mux.Vars(r)["protocol"]
+	if !as.checkThirdPartyRequest(w, r, protocol) {
+		return
+	}
+	var resp []*mautrix.ThirdPartyUser
+	var err error
+	if hasProtocol {
+		resp, err = as.ThirdPartyHandler.GetUser(protocol, thirdPartyFields(r))
+	} else {
+		resp, err = as.ThirdPartyHandler.GetUserByMXID(id.UserID(r.URL.Query().Get("userid")))
+	}
+	as.writeThirdPartyResponse(w, resp, len(resp) > 0, err)
+}
+
+// GetThirdPartyLocation handles a /thirdparty/location GET call from the homeserver.
+func (as *AppService) GetThirdPartyLocation(w http.ResponseWriter, r *http.Request) {
+	protocol, hasProtocol := mux.Vars(r)["protocol"]
+	if !as.checkThirdPartyRequest(w, r, protocol) {
+		return
+	}
+	var resp []*mautrix.ThirdPartyLocation
+	var err error
+	if hasProtocol {
+		resp, err = as.ThirdPartyHandler.GetLocation(protocol, thirdPartyFields(r))
+	} else {
+		resp, err = as.ThirdPartyHandler.GetLocationByAlias(id.RoomAlias(r.URL.Query().Get("alias")))
+	}
+	as.writeThirdPartyResponse(w, resp, len(resp) > 0, err)
+}
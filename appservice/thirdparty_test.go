@@ -0,0 +1,101 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+type testThirdPartyHandler struct{}
+
+func (tph *testThirdPartyHandler) GetProtocol(protocol string) (*mautrix.ThirdPartyProtocol, error) {
+	return &mautrix.ThirdPartyProtocol{
+		UserFields:     []string{"username"},
+		LocationFields: []string{"channel"},
+		FieldTypes: map[string]mautrix.ThirdPartyFieldType{
+			"username": {Regexp: "[a-z]+", Placeholder: "alice"},
+			"channel":  {Regexp: "#[a-z]+", Placeholder: "#general"},
+		},
+		Instances: []mautrix.ThirdPartyProtocolInstance{{Description: "Example", NetworkID: "example", Fields: map[string]string{}}},
+	}, nil
+}
+
+func (tph *testThirdPartyHandler) GetUser(protocol string, fields map[string]string) ([]*mautrix.ThirdPartyUser, error) {
+	if fields["username"] != "alice" {
+		return nil, nil
+	}
+	return []*mautrix.ThirdPartyUser{{UserID: "@example_alice:example.com", Protocol: protocol, Fields: fields}}, nil
+}
+
+func (tph *testThirdPartyHandler) GetLocation(protocol string, fields map[string]string) ([]*mautrix.ThirdPartyLocation, error) {
+	return nil, nil
+}
+
+func (tph *testThirdPartyHandler) GetUserByMXID(userID id.UserID) ([]*mautrix.ThirdPartyUser, error) {
+	return []*mautrix.ThirdPartyUser{{UserID: userID, Protocol: "example", Fields: map[string]string{"username": "alice"}}}, nil
+}
+
+func (tph *testThirdPartyHandler) GetLocationByAlias(alias id.RoomAlias) ([]*mautrix.ThirdPartyLocation, error) {
+	return []*mautrix.ThirdPartyLocation{{Alias: alias, Protocol: "example", Fields: map[string]string{"channel": "#general"}}}, nil
+}
+
+func thirdPartyRequest(as *AppService, path string) (int, []byte) {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Authorization", "Bearer hs_token")
+	w := httptest.NewRecorder()
+	as.Router.ServeHTTP(w, req)
+	return w.Code, w.Body.Bytes()
+}
+
+func TestAppService_ThirdParty(t *testing.T) {
+	as := Create()
+	as.Registration = &Registration{ServerToken: "hs_token", Protocols: []string{"example"}}
+	as.ThirdPartyHandler = &testThirdPartyHandler{}
+	as.Router.HandleFunc("/_matrix/app/v1/thirdparty/protocol/{protocol}", as.GetThirdPartyProtocol).Methods(http.MethodGet)
+	as.Router.HandleFunc("/_matrix/app/v1/thirdparty/user/{protocol}", as.GetThirdPartyUser).Methods(http.MethodGet)
+	as.Router.HandleFunc("/_matrix/app/v1/thirdparty/user", as.GetThirdPartyUser).Methods(http.MethodGet)
+	as.Router.HandleFunc("/_matrix/app/v1/thirdparty/location/{protocol}", as.GetThirdPartyLocation).Methods(http.MethodGet)
+	as.Router.HandleFunc("/_matrix/app/v1/thirdparty/location", as.GetThirdPartyLocation).Methods(http.MethodGet)
+
+	code, body := thirdPartyRequest(as, "/_matrix/app/v1/thirdparty/protocol/example")
+	var protocol mautrix.ThirdPartyProtocol
+	if code != http.StatusOK {
+		t.Errorf("Unexpected status %d for protocol", code)
+	} else if err := json.Unmarshal(body, &protocol); err != nil || protocol.FieldTypes["username"].Placeholder != "alice" {
+		t.Errorf("Unexpected protocol response %s (error: %v)", body, err)
+	}
+
+	if code, _ = thirdPartyRequest(as, "/_matrix/app/v1/thirdparty/protocol/unknown"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown protocol, got %d", code)
+	}
+
+	code, body = thirdPartyRequest(as, "/_matrix/app/v1/thirdparty/user/example?username=alice&access_token=hs_token")
+	var users []*mautrix.ThirdPartyUser
+	if code != http.StatusOK {
+		t.Errorf("Unexpected status %d for user lookup", code)
+	} else if err := json.Unmarshal(body, &users); err != nil || len(users) != 1 || len(users[0].Fields) != 1 {
+		t.Errorf("Unexpected user lookup response %s (error: %v)", body, err)
+	}
+
+	if code, _ = thirdPartyRequest(as, "/_matrix/app/v1/thirdparty/user/example?username=bob"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for user lookup without results, got %d", code)
+	}
+
+	code, body = thirdPartyRequest(as, "/_matrix/app/v1/thirdparty/location?alias=%23general:example.com")
+	var locations []*mautrix.ThirdPartyLocation
+	if code != http.StatusOK {
+		t.Errorf("Unexpected status %d for reverse location lookup", code)
+	} else if err := json.Unmarshal(body, &locations); err != nil || len(locations) != 1 || locations[0].Alias != "#general:example.com" {
+		t.Errorf("Unexpected reverse location lookup response %s (error: %v)", body, err)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// LoggedTransaction is a transaction stored in a TransactionLog.
+type LoggedTransaction struct {
+	ID         string
+	Body       json.RawMessage
+	ReceivedAt time.Time
+}
+
+// TransactionLog is a persistent log of transactions received from the homeserver.
+//
+// When AppService.TransactionLog is set, transactions are stored in the log before they're acknowledged, which
+// means duplicate transactions are detected even across restarts. Transactions are marked as completed after
+// the handlers of all events in them have returned, and transactions that weren't completed (e.g. because the
+// appservice crashed) are replayed by AppService.ReplayTransactions.
+//
+// Completion is only tracked for events that are handled by an EventProcessor. Other consumers of the Events
+// channel must call AppService.MarkEventHandled after handling each event.
+type TransactionLog interface {
+	// MarkReceived stores a new transaction. If a transaction with the same ID has already been stored,
+	// it must return false and not modify the existing entry.
+	MarkReceived(txnID string, body json.RawMessage) (isNew bool, err error)
+	// MarkCompleted marks a transaction as completed, so that it won't be replayed. Completed transactions are
+	// only kept for deduplication, so the body should be discarded.
+	MarkCompleted(txnID string) error
+	// GetUnfinished returns all stored transactions that haven't been completed, in the order they were received.
+	GetUnfinished() ([]*LoggedTransaction, error)
+	// DeleteCompleted deletes completed transactions that were received before the given time.
+	DeleteCompleted(receivedBefore time.Time) (int64, error)
+}
+
+var (
+	// TransactionLogRetention is how long completed transactions are kept in the TransactionLog for deduplication.
+	TransactionLogRetention = 24 * time.Hour
+	// TransactionLogPruneInterval is how often old completed transactions are deleted from the TransactionLog.
+	// Pruning is done in the background when receiving transactions.
+	TransactionLogPruneInterval = 1 * time.Hour
+)
+
+type pendingTransaction struct {
+	id        string
+	remaining int
+}
+
+type transactionTracker struct {
+	events    map[*event.Event]*pendingTransaction
+	replayed  bool
+	lastPrune time.Time
+	lock      sync.Mutex
+}
+
+// startTransaction starts tracking a transaction. The returned transaction holds one reference,
+// which must be released with finishTransactionEvent after all events have been queued.
+func (as *AppService) startTransaction(txnID string) *pendingTransaction {
+	if as.TransactionLog == nil || len(txnID) == 0 {
+		return nil
+	}
+	return &pendingTransaction{id: txnID, remaining: 1}
+}
+
+func (as *AppService) trackTransactionEvent(txn *pendingTransaction, evt *event.Event) {
+	if txn == nil {
+		return
+	}
+	as.txnTracker.lock.Lock()
+	txn.remaining++
+	as.txnTracker.events[evt] = txn
+	as.txnTracker.lock.Unlock()
+}
+
+func (as *AppService) finishTransactionEvent(txn *pendingTransaction) {
+	as.txnTracker.lock.Lock()
+	txn.remaining--
+	done := txn.remaining == 0
+	as.txnTracker.lock.Unlock()
+	if done {
+		err := as.TransactionLog.MarkCompleted(txn.id)
+		if err != nil {
+			as.Log.Warnfln("Failed to mark transaction %s as completed: %v", txn.id, err)
+		} else {
+			as.Log.Debugfln("Finished handling transaction %s", txn.id)
+		}
+	}
+}
+
+// MarkEventHandled marks an event from the Events channel as handled. When all the events in a transaction
+// have been handled, the transaction is marked as completed in the TransactionLog.
+//
+// This is called automatically by EventProcessor, so it only needs to be called when consuming the Events
+// channel directly.
+func (as *AppService) MarkEventHandled(evt *event.Event) {
+	if as.TransactionLog == nil {
+		return
+	}
+	as.txnTracker.lock.Lock()
+	txn, ok := as.txnTracker.events[evt]
+	delete(as.txnTracker.events, evt)
+	as.txnTracker.lock.Unlock()
+	if ok {
+		as.finishTransactionEvent(txn)
+	}
+}
+
+// logTransaction stores the given transaction in the TransactionLog. If there's no log, the in-memory
+// transaction ID cache is used for deduplication instead.
+func (as *AppService) logTransaction(txnID string, body json.RawMessage) (isNew bool, err error) {
+	if as.TransactionLog == nil || len(txnID) == 0 {
+		return len(txnID) == 0 || !as.txnIDC.IsProcessed(txnID), nil
+	}
+	as.txnTracker.lock.Lock()
+	shouldPrune := time.Since(as.txnTracker.lastPrune) >= TransactionLogPruneInterval
+	if shouldPrune {
+		as.txnTracker.lastPrune = time.Now()
+	}
+	as.txnTracker.lock.Unlock()
+	if shouldPrune {
+		go as.pruneTransactionLog()
+	}
+	return as.TransactionLog.MarkReceived(txnID, body)
+}
+
+func (as *AppService) pruneTransactionLog() {
+	deleted, err := as.TransactionLog.DeleteCompleted(time.Now().Add(-TransactionLogRetention))
+	if err != nil {
+		as.Log.Warnfln("Failed to delete old transactions: %v", err)
+	} else if deleted > 0 {
+		as.Log.Debugfln("Deleted %d old transactions from the transaction log", deleted)
+	}
+}
+
+// ReplayTransactions handles all transactions in the TransactionLog that weren't completed before the appservice
+// was previously stopped, and deletes old completed transactions. It's called automatically by Start and
+// RunWebsocket, but must be called manually before StartWebsocket when using websockets without RunWebsocket.
+//
+// Unfinished transactions are only replayed on the first call, as transactions that are unfinished later may
+// still be in progress.
+func (as *AppService) ReplayTransactions() error {
+	if as.TransactionLog == nil {
+		return nil
+	}
+	as.txnTracker.lock.Lock()
+	alreadyReplayed := as.txnTracker.replayed
+	as.txnTracker.replayed = true
+	as.txnTracker.lastPrune = time.Now()
+	as.txnTracker.lock.Unlock()
+	as.pruneTransactionLog()
+	if alreadyReplayed {
+		return nil
+	}
+	txns, err := as.TransactionLog.GetUnfinished()
+	if err != nil {
+		return err
+	}
+	for _, logged := range txns {
+		var txn Transaction
+		err = json.Unmarshal(logged.Body, &txn)
+		if err != nil {
+			as.Log.Warnfln("Failed to parse logged transaction %s: %v", logged.ID, err)
+			if err = as.TransactionLog.MarkCompleted(logged.ID); err != nil {
+				as.Log.Warnfln("Failed to mark unparseable transaction %s as completed: %v", logged.ID, err)
+			}
+			continue
+		}
+		as.Log.Infofln("Replaying unfinished transaction %s received at %s", logged.ID, logged.ReceivedAt)
+		as.handleTransaction(logged.ID, &txn)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type memoryTransactionLog struct {
+	lock      sync.Mutex
+	order     []string
+	bodies    map[string]json.RawMessage
+	completed map[string]bool
+	prunes    int
+}
+
+func newMemoryTransactionLog() *memoryTransactionLog {
+	return &memoryTransactionLog{
+		bodies:    make(map[string]json.RawMessage),
+		completed: make(map[string]bool),
+	}
+}
+
+func (mtl *memoryTransactionLog) MarkReceived(txnID string, body json.RawMessage) (bool, error) {
+	mtl.lock.Lock()
+	defer mtl.lock.Unlock()
+	if _, exists := mtl.completed[txnID]; exists {
+		return false, nil
+	}
+	mtl.order = append(mtl.order, txnID)
+	mtl.bodies[txnID] = body
+	mtl.completed[txnID] = false
+	return true, nil
+}
+
+func (mtl *memoryTransactionLog) MarkCompleted(txnID string) error {
+	mtl.lock.Lock()
+	mtl.completed[txnID] = true
+	mtl.bodies[txnID] = nil
+	mtl.lock.Unlock()
+	return nil
+}
+
+func (mtl *memoryTransactionLog) GetUnfinished() (txns []*LoggedTransaction, err error) {
+	mtl.lock.Lock()
+	defer mtl.lock.Unlock()
+	for _, txnID := range mtl.order {
+		if !mtl.completed[txnID] {
+			txns = append(txns, &LoggedTransaction{ID: txnID, Body: mtl.bodies[txnID]})
+		}
+	}
+	return
+}
+
+func (mtl *memoryTransactionLog) DeleteCompleted(receivedBefore time.Time) (int64, error) {
+	mtl.lock.Lock()
+	mtl.prunes++
+	mtl.lock.Unlock()
+	return 0, nil
+}
+
+func (mtl *memoryTransactionLog) waitPruned(prevPrunes int) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		mtl.lock.Lock()
+		pruned := mtl.prunes > prevPrunes
+		mtl.lock.Unlock()
+		if pruned {
+			return
+		}
+	}
+}
+
+func (mtl *memoryTransactionLog) waitCompleted(t *testing.T, txnID string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mtl.lock.Lock()
+		done := mtl.completed[txnID]
+		mtl.lock.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Transaction %s wasn't marked as completed", txnID)
+}
+
+const testTxnBody = `{"events":[{"type":"m.room.message","room_id":"!room:example.com","event_id":"$%s","sender":"@user:example.com","content":{"msgtype":"m.text","body":"hi"}}]}`
+
+func putTestTransaction(as *AppService, txnID string) int {
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/"+txnID, strings.NewReader(strings.Replace(testTxnBody, "%s", txnID, 1)))
+	req.Header.Set("Authorization", "Bearer hs_token")
+	w := httptest.NewRecorder()
+	as.Router.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestAppService_TransactionLog(t *testing.T) {
+	origInterval := TransactionLogPruneInterval
+	TransactionLogPruneInterval = 0
+	defer func() {
+		TransactionLogPruneInterval = origInterval
+	}()
+	ep := newTestEventProcessor()
+	ep.ExecMode = Sync
+	as := ep.as
+	as.Registration = &Registration{ServerToken: "hs_token"}
+	as.Router.HandleFunc("/_matrix/app/v1/transactions/{txnID}", as.PutTransaction).Methods(http.MethodPut)
+	txnLog := newMemoryTransactionLog()
+	as.TransactionLog = txnLog
+
+	var lock sync.Mutex
+	var handled []id.EventID
+	ep.On(event.EventMessage, func(evt *event.Event) {
+		lock.Lock()
+		handled = append(handled, evt.ID)
+		lock.Unlock()
+	})
+	go ep.Start()
+	defer ep.Stop()
+
+	// A transaction that was stored, but not completed before a restart
+	_, _ = txnLog.MarkReceived("1", json.RawMessage(strings.Replace(testTxnBody, "%s", "1", 1)))
+	if err := as.ReplayTransactions(); err != nil {
+		t.Fatalf("Failed to replay transactions: %v", err)
+	}
+	txnLog.waitCompleted(t, "1")
+	// Unfinished transactions are only replayed once
+	_, _ = txnLog.MarkReceived("in-progress", json.RawMessage(strings.Replace(testTxnBody, "%s", "in-progress", 1)))
+	if err := as.ReplayTransactions(); err != nil {
+		t.Fatalf("Failed to call ReplayTransactions again: %v", err)
+	}
+	_ = txnLog.MarkCompleted("in-progress")
+	txnLog.lock.Lock()
+	prunesAfterReplay := txnLog.prunes
+	txnLog.lock.Unlock()
+
+	if code := putTestTransaction(as, "2"); code != http.StatusOK {
+		t.Fatalf("Unexpected status code %d for new transaction", code)
+	}
+	txnLog.waitCompleted(t, "2")
+	// Duplicates of both the replayed and the normal transaction must be ignored
+	for _, txnID := range []string{"1", "2"} {
+		if code := putTestTransaction(as, txnID); code != http.StatusOK {
+			t.Fatalf("Unexpected status code %d for duplicate transaction %s", code, txnID)
+		}
+	}
+
+	unfinished, _ := txnLog.GetUnfinished()
+	if len(unfinished) != 0 {
+		t.Errorf("Expected no unfinished transactions, got %d", len(unfinished))
+	}
+	if prunesAfterReplay < 2 {
+		t.Errorf("Expected transaction log to be pruned on every replay, got %d prunes", prunesAfterReplay)
+	}
+	txnLog.waitPruned(prunesAfterReplay)
+	txnLog.lock.Lock()
+	if txnLog.bodies["2"] != nil {
+		t.Error("Expected body of completed transaction to be discarded")
+	}
+	if txnLog.prunes <= prunesAfterReplay {
+		t.Error("Expected transaction log to be pruned when receiving new transactions")
+	}
+	txnLog.lock.Unlock()
+	lock.Lock()
+	defer lock.Unlock()
+	if len(handled) != 2 || handled[0] != "$1" || handled[1] != "$2" {
+		t.Errorf("Expected events $1 and $2 to be handled once, got %v", handled)
+	}
+}
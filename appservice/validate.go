@@ -0,0 +1,165 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp/syntax"
+	"strings"
+
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrMissingRegistrationID    = errors.New("registration id is missing")
+	ErrInvalidRegistrationToken = errors.New("invalid token")
+	ErrInvalidRegistrationURL   = errors.New("invalid url")
+	ErrInvalidNamespaceRegex    = errors.New("invalid namespace regex")
+	ErrOverlappingNamespaces    = errors.New("overlapping namespaces")
+	ErrInvalidSenderLocalpart   = errors.New("invalid sender_localpart")
+)
+
+// RegistrationValidationError contains all the problems found by Registration.Validate.
+// errors.Is can be used to check whether a specific kind of problem was found.
+type RegistrationValidationError struct {
+	Problems []error
+}
+
+func (rve *RegistrationValidationError) Error() string {
+	parts := make([]string, len(rve.Problems))
+	for i, problem := range rve.Problems {
+		parts[i] = problem.Error()
+	}
+	return "invalid registration: " + strings.Join(parts, "; ")
+}
+
+func (rve *RegistrationValidationError) Is(target error) bool {
+	for _, problem := range rve.Problems {
+		if errors.Is(problem, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the registration for common mistakes: missing or invalid tokens, invalid URLs and regexes,
+// namespaces that overlap each other and a sender_localpart that conflicts with the namespaces.
+//
+// If homeserverDomain is set, the sender_localpart is also checked against the user namespaces.
+// The returned error is a *RegistrationValidationError if any problems were found.
+func (reg *Registration) Validate(homeserverDomain string) error {
+	var problems []error
+	addProblem := func(err error, format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf("%w: %s", err, fmt.Sprintf(format, args...)))
+	}
+
+	if len(reg.ID) == 0 {
+		problems = append(problems, ErrMissingRegistrationID)
+	}
+	for _, token := range []struct{ name, value string }{{"as_token", reg.AppToken}, {"hs_token", reg.ServerToken}} {
+		if len(token.value) == 0 {
+			addProblem(ErrInvalidRegistrationToken, "%s is empty", token.name)
+		} else if strings.ContainsAny(token.value, " \t\r\n") {
+			addProblem(ErrInvalidRegistrationToken, "%s contains whitespace", token.name)
+		}
+	}
+	if len(reg.AppToken) > 0 && reg.AppToken == reg.ServerToken {
+		addProblem(ErrInvalidRegistrationToken, "as_token and hs_token must be different")
+	}
+
+	// An empty URL means the homeserver won't push events to the appservice, which is allowed.
+	if len(reg.URL) > 0 {
+		parsed, err := url.Parse(reg.URL)
+		if err != nil {
+			addProblem(ErrInvalidRegistrationURL, "%v", err)
+		} else if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			addProblem(ErrInvalidRegistrationURL, "scheme must be http or https, got %q", parsed.Scheme)
+		} else if len(parsed.Host) == 0 {
+			addProblem(ErrInvalidRegistrationURL, "host is missing")
+		}
+	}
+
+	for _, list := range []struct {
+		name       string
+		namespaces NamespaceList
+	}{{"users", reg.Namespaces.UserIDs}, {"aliases", reg.Namespaces.RoomAliases}, {"rooms", reg.Namespaces.RoomIDs}} {
+		for i, ns := range list.namespaces {
+			if _, err := ns.Matcher(); err != nil {
+				addProblem(ErrInvalidNamespaceRegex, "%s namespace %q: %v", list.name, ns.Regex, err)
+				continue
+			}
+			for _, other := range list.namespaces[i+1:] {
+				if namespacesOverlap(ns, other) {
+					addProblem(ErrOverlappingNamespaces, "%s namespaces %q and %q", list.name, ns.Regex, other.Regex)
+				}
+			}
+		}
+	}
+
+	// Historical user IDs allow uppercase letters and other characters, and bridges generate mixed-case sender
+	// localparts, so only reject localparts that can't form a user ID at all instead of using id.ValidateUserLocalpart.
+	if len(reg.SenderLocalpart) == 0 {
+		addProblem(ErrInvalidSenderLocalpart, "%v", id.ErrEmptyLocalpart)
+	} else if strings.ContainsAny(reg.SenderLocalpart, ": \t\r\n") || strings.HasPrefix(reg.SenderLocalpart, "@") {
+		addProblem(ErrInvalidSenderLocalpart, "%q contains disallowed characters", reg.SenderLocalpart)
+	} else if len(homeserverDomain) > 0 {
+		// The sender user always belongs to the appservice, so sharing it with other appservices makes no sense.
+		sender := id.NewUserID(reg.SenderLocalpart, homeserverDomain)
+		if matches, exclusive := reg.Namespaces.UserIDs.Match(string(sender)); matches && !exclusive {
+			addProblem(ErrInvalidSenderLocalpart, "%s is in a non-exclusive user namespace", sender)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &RegistrationValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// namespaceLiteral returns the string that the given regex matches if it only matches a single string,
+// ignoring anchors at the start and end.
+func namespaceLiteral(regex string) (string, bool) {
+	parsed, err := syntax.Parse(regex, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	parsed = parsed.Simplify()
+	if parsed.Op == syntax.OpConcat {
+		subs := parsed.Sub
+		for len(subs) > 0 && (subs[0].Op == syntax.OpBeginText || subs[0].Op == syntax.OpBeginLine) {
+			subs = subs[1:]
+		}
+		for len(subs) > 0 && (subs[len(subs)-1].Op == syntax.OpEndText || subs[len(subs)-1].Op == syntax.OpEndLine) {
+			subs = subs[:len(subs)-1]
+		}
+		if len(subs) != 1 {
+			return "", false
+		}
+		parsed = subs[0]
+	}
+	if parsed.Op != syntax.OpLiteral || parsed.Flags&syntax.FoldCase != 0 {
+		return "", false
+	}
+	return string(parsed.Rune), true
+}
+
+// namespacesOverlap checks if two namespaces can match the same identifier. Overlap between two arbitrary regexes
+// can't be detected in general, so this only detects duplicates and literal namespaces matched by the other one.
+func namespacesOverlap(a, b Namespace) bool {
+	if a.Regex == b.Regex {
+		return true
+	}
+	if literal, ok := namespaceLiteral(a.Regex); ok && b.Matches(literal) {
+		return true
+	}
+	if literal, ok := namespaceLiteral(b.Regex); ok && a.Matches(literal) {
+		return true
+	}
+	return false
+}
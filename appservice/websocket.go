@@ -102,10 +102,15 @@ var (
 	ErrWebsocketOverridden   = errors.New("a new call to StartWebsocket overrode the previous connection")
 	ErrWebsocketUnknownError = errors.New("an unknown error occurred")
 
-	ErrWebsocketNotConnected = errors.New("websocket not connected")
-	ErrWebsocketClosed       = errors.New("websocket closed before response received")
+	ErrWebsocketNotConnected   = errors.New("websocket not connected")
+	ErrWebsocketClosed         = errors.New("websocket closed before response received")
+	ErrWebsocketRequestTimeout = errors.New("websocket request timed out")
 )
 
+// DefaultWebsocketRequestTimeout is the timeout for RequestWebsocket calls if AppService.WebsocketRequestTimeout
+// is not set and the context doesn't have a deadline.
+var DefaultWebsocketRequestTimeout = 3 * time.Minute
+
 func (mwcc MeowWebsocketCloseCode) String() string {
 	switch mwcc {
 	case MeowServerShuttingDown:
@@ -205,7 +210,19 @@ func (er *ErrorResponse) Error() string {
 	return fmt.Sprintf("%s: %s", er.Code, er.Message)
 }
 
+// RequestWebsocket sends a command to the server and waits for the response. If the context doesn't have a deadline,
+// the request times out after AppService.WebsocketRequestTimeout and ErrWebsocketRequestTimeout is returned.
 func (as *AppService) RequestWebsocket(ctx context.Context, cmd *WebsocketRequest, response interface{}) error {
+	var timeout time.Duration
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		timeout = as.WebsocketRequestTimeout
+		if timeout == 0 {
+			timeout = DefaultWebsocketRequestTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 	cmd.ReqID = int(atomic.AddInt32(&as.websocketRequestID, 1))
 	respChan := make(chan *WebsocketCommand, 1)
 	as.addWebsocketResponseWaiter(cmd.ReqID, respChan)
@@ -235,6 +252,9 @@ func (as *AppService) RequestWebsocket(ctx context.Context, cmd *WebsocketReques
 			return nil
 		}
 	case <-ctx.Done():
+		if timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%w: no response to %s %d in %s", ErrWebsocketRequestTimeout, cmd.Command, cmd.ReqID, timeout)
+		}
 		return ctx.Err()
 	}
 }
@@ -250,6 +270,41 @@ func (as *AppService) SetWebsocketCommandHandler(cmd string, handler WebsocketHa
 	as.websocketHandlersLock.Unlock()
 }
 
+func (as *AppService) logWebsocketTransaction(txn *WebsocketTransaction) (bool, error) {
+	if as.TransactionLog == nil || len(txn.TxnID) == 0 {
+		return as.logTransaction(txn.TxnID, nil)
+	}
+	body, err := json.Marshal(&txn.Transaction)
+	if err != nil {
+		return false, err
+	}
+	return as.logTransaction(txn.TxnID, body)
+}
+
+// ackWebsocketTransaction tells the server that the transaction has been handled, so that it won't be redelivered
+// after reconnecting. Transactions sent as requests are acknowledged with a normal response, while others get a
+// separate ack_transaction command.
+func (as *AppService) ackWebsocketTransaction(msg *WebsocketMessage) {
+	resp := msg.MakeResponse(true, map[string]interface{}{"txn_id": msg.TxnID})
+	if resp == nil {
+		if len(msg.TxnID) == 0 {
+			return
+		}
+		resp = &WebsocketRequest{
+			Command: "ack_transaction",
+			Data:    map[string]interface{}{"txn_id": msg.TxnID},
+		}
+	}
+	err := as.SendWebsocket(resp)
+	if err != nil {
+		as.Log.Warnfln("Failed to acknowledge transaction %s: %v", msg.TxnID, err)
+		return
+	}
+	as.wsStats.update(func(stats *WebsocketStats) {
+		stats.TransactionsAcked++
+	})
+}
+
 func (as *AppService) consumeWebsocket(stopFunc func(error), ws *websocket.Conn) {
 	defer stopFunc(ErrWebsocketUnknownError)
 	for {
@@ -260,18 +315,34 @@ func (as *AppService) consumeWebsocket(stopFunc func(error), ws *websocket.Conn)
 			stopFunc(parseCloseError(err))
 			return
 		}
+		as.wsStats.update(func(stats *WebsocketStats) {
+			stats.LastMessageAt = time.Now()
+		})
 		if msg.Command == "" || msg.Command == "transaction" {
-			if msg.TxnID == "" || !as.txnIDC.IsProcessed(msg.TxnID) {
+			as.wsStats.update(func(stats *WebsocketStats) {
+				stats.TransactionsReceived++
+			})
+			isNew, err := as.logWebsocketTransaction(&msg.WebsocketTransaction)
+			if err != nil {
+				as.Log.Errorfln("Failed to store transaction %s: %v", msg.TxnID, err)
+				go func() {
+					err = as.SendWebsocket(msg.MakeResponse(false, fmt.Errorf("failed to store transaction: %w", err)))
+					if err != nil {
+						as.Log.Warnfln("Failed to send error response to %s %d: %v", msg.Command, msg.ReqID, err)
+					}
+				}()
+				continue
+			} else if isNew {
 				as.handleTransaction(msg.TxnID, &msg.Transaction)
 			} else {
 				as.Log.Debugfln("Ignoring duplicate transaction %s (%s)", msg.TxnID, msg.Transaction.ContentString())
 			}
-			go func() {
-				err = as.SendWebsocket(msg.MakeResponse(true, map[string]interface{}{"txn_id": msg.TxnID}))
-				if err != nil {
-					as.Log.Warnfln("Failed to send response to %s %d: %v", msg.Command, msg.ReqID, err)
-				}
-			}()
+			if len(msg.TxnID) > 0 {
+				as.wsStats.update(func(stats *WebsocketStats) {
+					stats.LastTxnID = msg.TxnID
+				})
+			}
+			go as.ackWebsocketTransaction(&msg)
 		} else if msg.Command == "connect" {
 			as.Log.Debugln("Websocket connect confirmation received")
 		} else if msg.Command == "response" || msg.Command == "error" {
@@ -320,23 +391,35 @@ func (as *AppService) StartWebsocket(baseURL string, onConnect func()) error {
 	} else if parsed.Scheme == "https" {
 		parsed.Scheme = "wss"
 	}
-	ws, resp, err := websocket.DefaultDialer.Dial(parsed.String(), http.Header{
+	header := http.Header{
 		"Authorization": []string{fmt.Sprintf("Bearer %s", as.Registration.AppToken)},
 		"User-Agent":    []string{as.BotClient().UserAgent},
 
-		"X-Mautrix-Process-ID":        []string{as.ProcessID},
-		"X-Mautrix-Websocket-Version": []string{"3"},
-	})
+		"X-Mautrix-Process-ID": []string{as.ProcessID},
+		// Version 4 adds transaction acknowledgements and resuming delivery after the last handled transaction
+		"X-Mautrix-Websocket-Version": []string{"4"},
+	}
+	if lastTxnID := as.lastWebsocketTxnID(); len(lastTxnID) > 0 {
+		header.Set("X-Mautrix-Last-Txn-ID", lastTxnID)
+	}
+	ws, resp, err := websocket.DefaultDialer.Dial(parsed.String(), header)
 	if resp != nil && resp.StatusCode >= 400 {
 		var errResp Error
 		err = json.NewDecoder(resp.Body).Decode(&errResp)
 		if err != nil {
-			return fmt.Errorf("websocket request returned HTTP %d with non-JSON body", resp.StatusCode)
+			err = fmt.Errorf("websocket request returned HTTP %d with non-JSON body", resp.StatusCode)
 		} else {
-			return fmt.Errorf("websocket request returned %s (HTTP %d): %s", errResp.ErrorCode, resp.StatusCode, errResp.Message)
+			err = fmt.Errorf("websocket request returned %s (HTTP %d): %s", errResp.ErrorCode, resp.StatusCode, errResp.Message)
 		}
 	} else if err != nil {
-		return fmt.Errorf("failed to open websocket: %w", err)
+		err = fmt.Errorf("failed to open websocket: %w", err)
+	}
+	if err != nil {
+		as.wsStats.update(func(stats *WebsocketStats) {
+			stats.LastError = err
+			stats.ConsecutiveFailures++
+		})
+		return err
 	}
 	if as.StopWebsocket != nil {
 		as.StopWebsocket(ErrWebsocketOverridden)
@@ -351,6 +434,11 @@ func (as *AppService) StartWebsocket(baseURL string, onConnect func()) error {
 	as.ws = ws
 	as.StopWebsocket = stopFunc
 	as.PrepareWebsocket()
+	as.wsStats.update(func(stats *WebsocketStats) {
+		stats.Connected = true
+		stats.ConnectedAt = time.Now()
+		stats.ConsecutiveFailures = 0
+	})
 	as.Log.Debugln("Appservice transaction websocket connected")
 
 	go as.consumeWebsocket(stopFunc, ws)
@@ -365,6 +453,11 @@ func (as *AppService) StartWebsocket(baseURL string, onConnect func()) error {
 		as.clearWebsocketResponseWaiters()
 		as.ws = nil
 	}
+	as.wsStats.update(func(stats *WebsocketStats) {
+		stats.Connected = false
+		stats.DisconnectedAt = time.Now()
+		stats.LastError = closeErr
+	})
 
 	_ = ws.SetWriteDeadline(time.Now().Add(3 * time.Second))
 	err = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
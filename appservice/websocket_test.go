@@ -0,0 +1,181 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"maunium.net/go/mautrix/event"
+)
+
+type testWebsocketProxy struct {
+	t           *testing.T
+	connections int
+	lastTxnIDs  []string
+	acks        chan string
+	lock        sync.Mutex
+}
+
+func (proxy *testWebsocketProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	proxy.lock.Lock()
+	proxy.connections++
+	connection := proxy.connections
+	proxy.lastTxnIDs = append(proxy.lastTxnIDs, r.Header.Get("X-Mautrix-Last-Txn-ID"))
+	proxy.lock.Unlock()
+	if connection == 1 {
+		// Fail the first connection attempt to test reconnecting after dial errors
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN","error":"Not ready"}`))
+		return
+	}
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		proxy.t.Errorf("Failed to upgrade websocket: %v", err)
+		return
+	}
+	defer conn.Close()
+	txnID := "txn1"
+	if connection == 3 {
+		txnID = "txn2"
+	}
+	err = conn.WriteJSON(map[string]interface{}{
+		"status": "ok",
+		"txn_id": txnID,
+		"events": []map[string]interface{}{{
+			"type":     "m.room.message",
+			"room_id":  "!room:example.com",
+			"event_id": "$" + txnID,
+			"sender":   "@user:example.com",
+			"content":  map[string]interface{}{"msgtype": "m.text", "body": "Hello"},
+		}},
+	})
+	if err != nil {
+		proxy.t.Errorf("Failed to write transaction: %v", err)
+		return
+	}
+	var ack WebsocketCommand
+	if err = conn.ReadJSON(&ack); err != nil {
+		proxy.t.Errorf("Failed to read ack: %v", err)
+		return
+	} else if ack.Command != "ack_transaction" {
+		proxy.t.Errorf("Expected ack_transaction command, got %s", ack.Command)
+	}
+	var ackData map[string]string
+	_ = json.Unmarshal(ack.Data, &ackData)
+	proxy.acks <- ackData["txn_id"]
+	if connection == 2 {
+		// Drop the connection without a close message to test reconnecting
+		return
+	}
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4001, ""))
+}
+
+func TestAppService_RunWebsocket(t *testing.T) {
+	origInitial, origMax := WebsocketInitialBackoff, WebsocketMaxBackoff
+	WebsocketInitialBackoff, WebsocketMaxBackoff = 10*time.Millisecond, 20*time.Millisecond
+	defer func() {
+		WebsocketInitialBackoff, WebsocketMaxBackoff = origInitial, origMax
+	}()
+
+	proxy := &testWebsocketProxy{t: t, acks: make(chan string, 4)}
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	as := newTestEventProcessor().as
+	as.Registration = &Registration{AppToken: "as_token", ServerToken: "hs_token", SenderLocalpart: "bot"}
+	as.HomeserverDomain = "example.com"
+	as.HomeserverURL = server.URL
+
+	err := as.RunWebsocket(server.URL, nil)
+	var closeCommand *CloseCommand
+	if !errors.As(err, &closeCommand) || closeCommand.Status != MeowConnectionReplaced {
+		t.Fatalf("Expected RunWebsocket to stop after connection was replaced, got %v", err)
+	}
+	proxy.lock.Lock()
+	defer proxy.lock.Unlock()
+	if proxy.connections != 3 {
+		t.Errorf("Expected 3 connection attempts, got %d", proxy.connections)
+	}
+	if proxy.lastTxnIDs[0] != "" || proxy.lastTxnIDs[2] != "txn1" {
+		t.Errorf("Expected last transaction ID to be sent when reconnecting, got %v", proxy.lastTxnIDs)
+	}
+	if ack1, ack2 := <-proxy.acks, <-proxy.acks; ack1 != "txn1" || ack2 != "txn2" {
+		t.Errorf("Expected acks for txn1 and txn2, got %s and %s", ack1, ack2)
+	}
+	for _, expectedID := range []string{"$txn1", "$txn2"} {
+		select {
+		case evt := <-as.Events:
+			if string(evt.ID) != expectedID || evt.Type != event.EventMessage {
+				t.Errorf("Expected %s, got %s (%s)", expectedID, evt.ID, evt.Type.Type)
+			}
+		default:
+			t.Errorf("Expected %s to be dispatched", expectedID)
+		}
+	}
+	stats := as.WebsocketStats()
+	if stats.Connected || stats.Reconnects != 2 || stats.TransactionsReceived != 2 || stats.LastTxnID != "txn2" {
+		t.Errorf("Unexpected websocket stats: %+v", stats)
+	}
+}
+
+func TestAppService_RequestWebsocket_Timeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Read requests, but never respond to them
+		for {
+			if _, _, err = conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	as := newTestEventProcessor().as
+	as.Registration = &Registration{AppToken: "as_token", ServerToken: "hs_token", SenderLocalpart: "bot"}
+	as.HomeserverURL = server.URL
+	as.WebsocketRequestTimeout = 50 * time.Millisecond
+
+	connected := make(chan struct{})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- as.StartWebsocket(server.URL, func() { close(connected) })
+	}()
+	<-connected
+
+	err := as.RequestWebsocket(context.Background(), &WebsocketRequest{Command: "ping"}, nil)
+	if !errors.Is(err, ErrWebsocketRequestTimeout) {
+		t.Errorf("Expected request to time out, got %v", err)
+	}
+	if pending := as.WebsocketStats().PendingRequests; pending != 0 {
+		t.Errorf("Expected no pending requests after timeout, got %d", pending)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = as.RequestWebsocket(ctx, &WebsocketRequest{Command: "ping"}, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context cancellation error, got %v", err)
+	}
+
+	as.StopWebsocket(ErrWebsocketManualStop)
+	if err = <-stopped; !errors.Is(err, ErrWebsocketManualStop) {
+		t.Errorf("Expected manual stop error, got %v", err)
+	}
+}
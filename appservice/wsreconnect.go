@@ -0,0 +1,154 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	// WebsocketInitialBackoff is the delay before the first reconnection attempt in RunWebsocket.
+	// The delay is doubled after each failed attempt, up to WebsocketMaxBackoff.
+	WebsocketInitialBackoff = 2 * time.Second
+	WebsocketMaxBackoff     = 2 * time.Minute
+	// WebsocketBackoffReset is how long a connection must stay up for the backoff to be reset to the initial value.
+	WebsocketBackoffReset = 2 * time.Minute
+)
+
+// WebsocketStats contains health information about the appservice websocket connection.
+type WebsocketStats struct {
+	Connected bool
+	// When the current connection was opened, or when the previous one was opened if not connected.
+	ConnectedAt time.Time
+	// When the last connection was closed.
+	DisconnectedAt time.Time
+	// When the last message was received from the websocket.
+	LastMessageAt time.Time
+	// The error that closed the last connection or prevented connecting.
+	LastError error
+
+	// The number of times RunWebsocket has reconnected after the connection was closed.
+	Reconnects int
+	// The number of connection attempts that have failed since the last successful connection.
+	ConsecutiveFailures int
+	// The next reconnection attempt if RunWebsocket is waiting to reconnect.
+	NextReconnect time.Time
+
+	TransactionsReceived int64
+	TransactionsAcked    int64
+	// The ID of the last transaction that was handled. It's sent to the server when reconnecting,
+	// so that delivery can be resumed from that point.
+	LastTxnID string
+	// The number of RequestWebsocket calls waiting for a response.
+	PendingRequests int
+}
+
+type websocketStatsTracker struct {
+	WebsocketStats
+	lock sync.Mutex
+}
+
+func (wst *websocketStatsTracker) update(fn func(stats *WebsocketStats)) {
+	wst.lock.Lock()
+	fn(&wst.WebsocketStats)
+	wst.lock.Unlock()
+}
+
+// WebsocketStats returns a snapshot of the health information of the websocket connection.
+func (as *AppService) WebsocketStats() WebsocketStats {
+	as.wsStats.lock.Lock()
+	stats := as.wsStats.WebsocketStats
+	as.wsStats.lock.Unlock()
+	as.websocketRequestsLock.RLock()
+	stats.PendingRequests = len(as.websocketRequests)
+	as.websocketRequestsLock.RUnlock()
+	return stats
+}
+
+func (as *AppService) lastWebsocketTxnID() string {
+	as.wsStats.lock.Lock()
+	defer as.wsStats.lock.Unlock()
+	return as.wsStats.LastTxnID
+}
+
+// jitter returns a random duration between half of the given duration and the full duration.
+func jitter(backoff time.Duration) time.Duration {
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// shouldReconnect checks if RunWebsocket should reconnect after StartWebsocket returned the given error.
+func shouldReconnect(err error) bool {
+	var closeCommand *CloseCommand
+	if errors.Is(err, ErrWebsocketManualStop) || errors.Is(err, ErrWebsocketOverridden) {
+		return false
+	} else if errors.As(err, &closeCommand) && closeCommand.Status == MeowConnectionReplaced {
+		return false
+	}
+	return true
+}
+
+// RunWebsocket connects to the websocket using StartWebsocket and automatically reconnects with a jittered
+// exponential backoff when the connection is closed or can't be opened. The onConnect function is called
+// after every successful connection.
+//
+// RunWebsocket returns when the connection is stopped with StopWebsocket (including while waiting to reconnect),
+// overridden by another StartWebsocket call or replaced by another client on the server side.
+// Transactions that weren't acknowledged before the connection was closed are redelivered by the server
+// after reconnecting, and deduplicated using the transaction log or the transaction ID cache.
+//
+// Before connecting, unfinished transactions in the TransactionLog are replayed using ReplayTransactions.
+func (as *AppService) RunWebsocket(baseURL string, onConnect func()) error {
+	if err := as.ReplayTransactions(); err != nil {
+		as.Log.Errorln("Failed to replay unfinished transactions:", err)
+	}
+	backoff := WebsocketInitialBackoff
+	for {
+		startedAt := time.Now()
+		err := as.StartWebsocket(baseURL, onConnect)
+		if !shouldReconnect(err) {
+			return err
+		}
+		as.wsStats.lock.Lock()
+		connectedAt := as.wsStats.ConnectedAt
+		if connectedAt.After(startedAt) && as.wsStats.DisconnectedAt.Sub(connectedAt) >= WebsocketBackoffReset {
+			backoff = WebsocketInitialBackoff
+		}
+		sleep := jitter(backoff)
+		as.wsStats.NextReconnect = time.Now().Add(sleep)
+		as.wsStats.lock.Unlock()
+		as.Log.Warnfln("Websocket disconnected (%v), reconnecting in %s", err, sleep.Round(time.Millisecond))
+
+		stopChan := make(chan error, 1)
+		var stopOnce sync.Once
+		as.StopWebsocket = func(err error) {
+			stopOnce.Do(func() {
+				stopChan <- err
+			})
+		}
+		select {
+		case err = <-stopChan:
+			as.StopWebsocket = nil
+			as.wsStats.update(func(stats *WebsocketStats) {
+				stats.NextReconnect = time.Time{}
+			})
+			return err
+		case <-time.After(sleep):
+		}
+		as.StopWebsocket = nil
+		backoff *= 2
+		if backoff > WebsocketMaxBackoff {
+			backoff = WebsocketMaxBackoff
+		}
+		as.wsStats.update(func(stats *WebsocketStats) {
+			stats.NextReconnect = time.Time{}
+			stats.Reconnects++
+		})
+	}
+}
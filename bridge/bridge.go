@@ -9,6 +9,7 @@ package bridge
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
@@ -134,10 +135,19 @@ type Bridge struct {
 	StateStore       *sqlstatestore.SQLStateStore
 	Crypto           Crypto
 	CryptoPickleKey  string
+	// CryptoPickleKeyProvider can be set to load the crypto store pickle key from somewhere else,
+	// e.g. crypto.FilePickleKey or crypto.EnvPickleKey. If set, CryptoPickleKey is only used to migrate
+	// an existing crypto store that was encrypted with it to the key from the provider.
+	CryptoPickleKeyProvider PickleKeyProvider
 
 	Child ChildOverride
 }
 
+// PickleKeyProvider provides the key used to encrypt the crypto store. It's implemented by the providers in the crypto package.
+type PickleKeyProvider interface {
+	GetPickleKey() ([]byte, error)
+}
+
 type Crypto interface {
 	HandleMemberEvent(*event.Event)
 	Decrypt(*event.Event) (*event.Event, error)
@@ -157,7 +167,12 @@ func (br *Bridge) GenerateRegistration() {
 		os.Exit(5)
 	}
 	reg := br.Config.GenerateRegistration()
-	err := reg.Save(*registrationPath)
+	err := reg.Validate(br.Config.Homeserver.Domain)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Generated registration is invalid:", err)
+		os.Exit(23)
+	}
+	err = reg.Save(*registrationPath)
 	if err != nil {
 		_, _ = fmt.Fprintln(os.Stderr, "Failed to save registration:", err)
 		os.Exit(21)
@@ -232,6 +247,44 @@ func (br *Bridge) ensureConnection() {
 			break
 		}
 	}
+	br.checkAppserviceConnection()
+}
+
+// checkAppserviceConnection asks the homeserver to ping the bridge to make sure
+// that the homeserver can reach the bridge using the URL and hs_token in the registration.
+func (br *Bridge) checkAppserviceConnection() {
+	resp, err := br.AS.Ping()
+	var httpErr mautrix.HTTPError
+	errors.As(err, &httpErr)
+	if err == nil {
+		br.Log.Debugfln("Homeserver -> bridge connection works (ping took %d ms)", resp.DurationMS)
+	} else if errors.Is(err, mautrix.MUnrecognized) || httpErr.IsStatus(http.StatusNotFound) {
+		br.Log.Debugln("Homeserver doesn't support appservice pings, skipping homeserver -> bridge connection check")
+	} else if errors.Is(err, mautrix.MURLNotSet) {
+		br.Log.Fatalln("The homeserver doesn't have an URL for the bridge. Is the registration file installed in your homeserver correctly?")
+		os.Exit(13)
+	} else if errors.Is(err, mautrix.MForbidden) {
+		br.Log.Fatalfln("The homeserver rejected the ping: %v. Does the appservice ID in the config match the registration?", err)
+		os.Exit(13)
+	} else if errors.Is(err, mautrix.MBadStatus) {
+		status := 0
+		if httpErr.RespError != nil {
+			statusFloat, _ := httpErr.RespError.ExtraData["status"].(float64)
+			status = int(statusFloat)
+		}
+		if status == http.StatusUnauthorized || status == http.StatusForbidden {
+			br.Log.Fatalln("The bridge rejected the hs_token sent by the homeserver. Is the registration file installed in your homeserver correctly?")
+			os.Exit(13)
+		}
+		br.Log.Errorfln("The homeserver reached the bridge, but got HTTP %d in response to the ping: %v. Is the url in the registration correct?", status, err)
+	} else if errors.Is(err, mautrix.MConnectionTimeout) || errors.Is(err, mautrix.MConnectionFailed) {
+		br.Log.Errorfln("The homeserver couldn't connect to the bridge: %v. Check that the url in the registration (%s) is reachable from the homeserver", err, br.AS.Registration.URL)
+	} else if errors.Is(err, appservice.ErrPingNotReceived) {
+		br.Log.Fatalfln("%v. Is the url in the registration (%s) pointing at another program?", err, br.AS.Registration.URL)
+		os.Exit(13)
+	} else {
+		br.Log.Errorln("Failed to ping bridge via homeserver:", err)
+	}
 }
 
 func (br *Bridge) UpdateBotProfile() {
@@ -316,6 +369,8 @@ func (br *Bridge) init() {
 	br.Log.Debugln("Initializing state store")
 	br.StateStore = sqlstatestore.NewSQLStateStore(br.DB)
 	br.AS.StateStore = br.StateStore
+	br.AS.TransactionLog = br.StateStore
+	br.AS.GhostCredentialStore = br.StateStore
 
 	br.Log.Debugln("Initializing Matrix event processor")
 	br.EventProcessor = appservice.NewEventProcessor(br.AS)
@@ -349,6 +404,16 @@ func (br *Bridge) start() {
 		br.LogDBUpgradeErrorAndExit("matrix state store", err)
 	}
 
+	// The HTTP listener is bound before checking the connection, so that the homeserver can ping it.
+	// Events aren't handled until the event processor is started below.
+	br.Log.Debugln("Starting application service HTTP server")
+	err = br.AS.Listen()
+	if err != nil {
+		br.Log.Fatalln("Failed to listen for application service HTTP requests:", err)
+		os.Exit(20)
+	}
+	go br.AS.Start()
+
 	br.Log.Debugln("Checking connection to homeserver")
 	br.ensureConnection()
 
@@ -360,8 +425,6 @@ func (br *Bridge) start() {
 		}
 	}
 
-	br.Log.Debugln("Starting application service HTTP server")
-	go br.AS.Start()
 	br.Log.Debugln("Starting event processor")
 	go br.EventProcessor.Start()
 
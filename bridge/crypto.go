@@ -16,6 +16,7 @@ import (
 	"maunium.net/go/maulogger/v2"
 
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/crypto"
 	"maunium.net/go/mautrix/event"
@@ -37,6 +38,8 @@ type CryptoHelper struct {
 	store   *SQLCryptoStore
 	log     maulogger.Logger
 	baseLog maulogger.Logger
+
+	keyServer *crypto.AppserviceKeyServer
 }
 
 func NewCryptoHelper(bridge *Bridge) Crypto {
@@ -45,34 +48,84 @@ func NewCryptoHelper(bridge *Bridge) Crypto {
 		return nil
 	}
 	baseLog := bridge.Log.Sub("Crypto")
+	// The key handlers are set here rather than in Init, as the appservice may already be serving requests by then.
+	keyServer := crypto.NewAppserviceKeyServer()
+	bridge.AS.KeyClaimHandler = keyServer
+	bridge.AS.KeyQueryHandler = keyServer
 	return &CryptoHelper{
-		bridge:  bridge,
-		log:     baseLog.Sub("Helper"),
-		baseLog: baseLog,
+		bridge:    bridge,
+		log:       baseLog.Sub("Helper"),
+		baseLog:   baseLog,
+		keyServer: keyServer,
 	}
 }
 
-func (helper *CryptoHelper) Init() error {
-	if len(helper.bridge.CryptoPickleKey) == 0 {
+func (helper *CryptoHelper) getPickleKey() (string, error) {
+	if helper.bridge.CryptoPickleKeyProvider != nil {
+		key, err := helper.bridge.CryptoPickleKeyProvider.GetPickleKey()
+		if err != nil {
+			return "", fmt.Errorf("failed to get crypto pickle key: %w", err)
+		}
+		return string(key), nil
+	} else if len(helper.bridge.CryptoPickleKey) == 0 {
 		panic("CryptoPickleKey not set")
 	}
+	return helper.bridge.CryptoPickleKey, nil
+}
+
+// migratePickleKey re-pickles the crypto store with the key from CryptoPickleKeyProvider if the store was created
+// with the hardcoded CryptoPickleKey before the provider was configured.
+func (helper *CryptoHelper) migratePickleKey() error {
+	legacyKey := []byte(helper.bridge.CryptoPickleKey)
+	newKey := helper.store.PickleKey
+	if helper.bridge.CryptoPickleKeyProvider == nil || len(legacyKey) == 0 || string(legacyKey) == string(newKey) {
+		return nil
+	}
+	// If the account can be read with the new key (or doesn't exist yet), the store has already been migrated.
+	_, err := helper.store.GetAccount()
+	if err == nil {
+		return nil
+	}
+	helper.store.PickleKey = legacyKey
+	if _, legacyErr := helper.store.GetAccount(); legacyErr != nil {
+		helper.store.PickleKey = newKey
+		return fmt.Errorf("failed to read crypto account with the pickle key from the key provider: %w", err)
+	}
+	helper.log.Infoln("Re-encrypting crypto store with the pickle key from the key provider")
+	err = helper.store.RotatePickleKey(newKey)
+	if err != nil {
+		return fmt.Errorf("failed to migrate crypto store to the new pickle key: %w", err)
+	}
+	return nil
+}
+
+func (helper *CryptoHelper) Init() error {
+	pickleKey, err := helper.getPickleKey()
+	if err != nil {
+		return err
+	}
 	helper.log.Debugln("Initializing end-to-bridge encryption...")
 
 	helper.store = NewSQLCryptoStore(helper.bridge.DB, helper.bridge.AS.BotMXID(),
 		fmt.Sprintf("@%s:%s", helper.bridge.Config.Bridge.FormatUsername("%"), helper.bridge.AS.HomeserverDomain),
-		helper.bridge.CryptoPickleKey)
+		pickleKey)
 
-	err := helper.store.Upgrade()
+	err = helper.store.Upgrade()
 	if err != nil {
 		helper.bridge.LogDBUpgradeErrorAndExit("crypto store", err)
 	}
+	err = helper.migratePickleKey()
+	if err != nil {
+		return err
+	}
 
 	helper.client, err = helper.loginBot()
 	if err != nil {
 		return err
 	}
 
-	helper.log.Debugln("Logged in as bridge bot with device ID", helper.client.DeviceID)
+	_, deviceID := helper.client.GetCredentials()
+	helper.log.Debugln("Logged in as bridge bot with device ID", deviceID)
 	logger := &cryptoLogger{helper.baseLog}
 	stateStore := &cryptoStateStore{helper.bridge}
 	helper.mach = crypto.NewOlmMachine(helper.client, logger, helper.store, stateStore)
@@ -81,7 +134,13 @@ func (helper *CryptoHelper) Init() error {
 	helper.client.Syncer = &cryptoSyncer{helper.mach}
 	helper.client.Store = &cryptoClientStore{helper.store}
 
-	return helper.mach.Load()
+	err = helper.mach.Load()
+	if err != nil {
+		return err
+	}
+	// Serve the bridge bot's device keys when the homeserver forwards key requests to the bridge.
+	helper.keyServer.AddMachine(helper.mach)
+	return nil
 }
 
 func (helper *CryptoHelper) allowKeyShare(device *crypto.DeviceIdentity, info event.RequestedKeyInfo) *crypto.KeyShareRejection {
@@ -129,7 +188,7 @@ func (helper *CryptoHelper) loginBot() (*mautrix.Client, error) {
 	}
 	// We set the API token to the AS token here to authenticate the appservice login
 	// It'll get overridden after the login
-	client.AccessToken = helper.bridge.AS.Registration.AppToken
+	client.ReplaceCredentials(helper.bridge.AS.Registration.AppToken, "")
 	resp, err := client.Login(&mautrix.ReqLogin{
 		Type: mautrix.AuthTypeAppservice,
 		Identifier: mautrix.UserIdentifier{
@@ -149,8 +208,14 @@ func (helper *CryptoHelper) loginBot() (*mautrix.Client, error) {
 }
 
 func (helper *CryptoHelper) Start() {
+	err := helper.mach.ResumeOutgoingKeyRequests()
+	if err != nil {
+		helper.log.Warnln("Failed to resume outgoing key requests:", err)
+	}
+	// Device list changes between the stored token and the first sync response are caught up if there's a gap
+	helper.mach.SetDeviceListSyncToken(helper.store.GetNextBatch())
 	helper.log.Debugln("Starting syncer for receiving to-device messages")
-	err := helper.client.Sync()
+	err = helper.client.Sync()
 	if err != nil {
 		helper.log.Errorln("Fatal error syncing:", err)
 	} else {
@@ -303,6 +368,10 @@ type cryptoStateStore struct {
 }
 
 var _ crypto.StateStore = (*cryptoStateStore)(nil)
+var _ crypto.MembershipStateStore = (*cryptoStateStore)(nil)
+var _ crypto.HistoryVisibilityStateStore = (*cryptoStateStore)(nil)
+var _ appservice.KeyClaimHandler = (*crypto.AppserviceKeyServer)(nil)
+var _ appservice.KeyQueryHandler = (*crypto.AppserviceKeyServer)(nil)
 
 func (c *cryptoStateStore) IsEncrypted(id id.RoomID) bool {
 	portal := c.bridge.Child.GetIPortal(id)
@@ -320,3 +389,15 @@ func (c *cryptoStateStore) GetEncryptionEvent(id.RoomID) *event.EncryptionEventC
 	// TODO implement
 	return nil
 }
+
+func (c *cryptoStateStore) GetHistoryVisibility(roomID id.RoomID) event.HistoryVisibility {
+	return c.bridge.StateStore.GetHistoryVisibility(roomID)
+}
+
+func (c *cryptoStateStore) SetHistoryVisibility(roomID id.RoomID, visibility event.HistoryVisibility) {
+	c.bridge.StateStore.SetHistoryVisibility(roomID, visibility)
+}
+
+func (c *cryptoStateStore) TryGetMember(roomID id.RoomID, userID id.UserID) (*event.MemberEventContent, bool) {
+	return c.bridge.StateStore.TryGetMember(roomID, userID)
+}
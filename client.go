@@ -15,6 +15,7 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -72,6 +73,14 @@ type Client struct {
 	// See https://spec.matrix.org/v1.2/application-service-api/#identity-assertion
 	AppServiceUserID id.UserID
 
+	// OnUnknownToken is called when a request is rejected with M_UNKNOWN_TOKEN, with the access token that was rejected.
+	// If it returns nil, the credentials are assumed to have been replaced (e.g. by logging in again) and the request
+	// is retried once. Requests with a streamed body (FullRequest.RequestBody) are never retried.
+	OnUnknownToken func(rejectedToken string) error
+
+	// Protects UserID, AccessToken and DeviceID when they're changed while requests are in flight.
+	credentialsLock sync.RWMutex
+
 	syncingID uint32 // Identifies the current Sync. Only one Sync can be active at any given time.
 }
 
@@ -135,15 +144,36 @@ func DiscoverClientAPI(serverName string) (*ClientWellKnown, error) {
 //
 // Deprecated: use the StoreCredentials field in ReqLogin instead.
 func (cli *Client) SetCredentials(userID id.UserID, accessToken string) {
+	cli.credentialsLock.Lock()
 	cli.AccessToken = accessToken
 	cli.UserID = userID
+	cli.credentialsLock.Unlock()
 }
 
 // ClearCredentials removes the user ID and access token on this client instance.
 func (cli *Client) ClearCredentials() {
+	cli.credentialsLock.Lock()
 	cli.AccessToken = ""
 	cli.UserID = ""
 	cli.DeviceID = ""
+	cli.credentialsLock.Unlock()
+}
+
+// ReplaceCredentials replaces the access token and device ID of this client instance.
+// Unlike setting the fields directly, this is safe to call while other goroutines are making requests.
+func (cli *Client) ReplaceCredentials(accessToken string, deviceID id.DeviceID) {
+	cli.credentialsLock.Lock()
+	cli.AccessToken = accessToken
+	cli.DeviceID = deviceID
+	cli.credentialsLock.Unlock()
+}
+
+// GetCredentials returns the access token and device ID of this client instance.
+// It's safe to call while another goroutine is calling ReplaceCredentials.
+func (cli *Client) GetCredentials() (accessToken string, deviceID id.DeviceID) {
+	cli.credentialsLock.RLock()
+	defer cli.credentialsLock.RUnlock()
+	return cli.AccessToken, cli.DeviceID
 }
 
 // Sync starts syncing with the provided Homeserver. If Sync() is called twice then the first sync will be stopped and the
@@ -336,18 +366,34 @@ func (cli *Client) MakeFullRequest(params FullRequest) ([]byte, error) {
 	if params.MaxAttempts == 0 {
 		params.MaxAttempts = 1 + cli.DefaultHTTPRetries
 	}
+	data, accessToken, err := cli.makeFullRequest(params)
+	if err != nil && len(accessToken) > 0 && cli.OnUnknownToken != nil && params.RequestBody == nil && errors.Is(err, MUnknownToken) {
+		cli.logWarning("%s %s was rejected with M_UNKNOWN_TOKEN, refreshing credentials and retrying", params.Method, params.URL)
+		if refreshErr := cli.OnUnknownToken(accessToken); refreshErr != nil {
+			cli.logWarning("Failed to refresh credentials: %v", refreshErr)
+			return data, err
+		}
+		data, _, err = cli.makeFullRequest(params)
+	}
+	return data, err
+}
+
+// makeFullRequest does the actual work of MakeFullRequest and also returns the access token that was used.
+func (cli *Client) makeFullRequest(params FullRequest) ([]byte, string, error) {
 	req, err := params.compileRequest()
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	if params.Handler == nil {
 		params.Handler = cli.handleNormalResponse
 	}
 	req.Header.Set("User-Agent", cli.UserAgent)
-	if len(cli.AccessToken) > 0 {
-		req.Header.Set("Authorization", "Bearer "+cli.AccessToken)
+	accessToken, _ := cli.GetCredentials()
+	if len(accessToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
 	}
-	return cli.executeCompiledRequest(req, params.MaxAttempts-1, 4*time.Second, params.ResponseJSON, params.Handler)
+	data, err := cli.executeCompiledRequest(req, params.MaxAttempts-1, 4*time.Second, params.ResponseJSON, params.Handler)
+	return data, accessToken, err
 }
 
 func (cli *Client) logWarning(format string, args ...interface{}) {
@@ -477,6 +523,16 @@ func (cli *Client) parseBackoffFromResponse(res *http.Response, now time.Time, f
 	return fallback
 }
 
+// RateLimitBackoff returns how long to wait before retrying a request that failed with the given error, based on the
+// Retry-After header of the response. The second return value is false if the error isn't a rate limit (HTTP 429) error.
+func (cli *Client) RateLimitBackoff(err error, fallback time.Duration) (time.Duration, bool) {
+	var httpErr HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Response == nil || httpErr.Response.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	return cli.parseBackoffFromResponse(httpErr.Response, time.Now(), fallback), true
+}
+
 func (cli *Client) shouldRetry(res *http.Response) bool {
 	return res.StatusCode == http.StatusBadGateway ||
 		res.StatusCode == http.StatusServiceUnavailable ||
@@ -690,10 +746,12 @@ func (cli *Client) Login(req *ReqLogin) (resp *RespLogin, err error) {
 		SensitiveContent: len(req.Password) > 0 || len(req.Token) > 0,
 	})
 	if req.StoreCredentials && err == nil {
-		cli.DeviceID = resp.DeviceID
+		cli.credentialsLock.Lock()
 		cli.AccessToken = resp.AccessToken
+		cli.DeviceID = resp.DeviceID
 		cli.UserID = resp.UserID
-		cli.Logger.Debugfln("Stored credentials for %s/%s after login", cli.UserID, cli.DeviceID)
+		cli.credentialsLock.Unlock()
+		cli.Logger.Debugfln("Stored credentials for %s/%s after login", resp.UserID, resp.DeviceID)
 	}
 	if req.StoreHomeserverURL && err == nil && resp.WellKnown != nil && len(resp.WellKnown.Homeserver.BaseURL) > 0 {
 		var urlErr error
@@ -1475,7 +1533,7 @@ func (cli *Client) GetKeyChanges(from, to string) (resp *RespKeyChanges, err err
 		"from": from,
 		"to":   to,
 	})
-	_, err = cli.MakeRequest("POST", urlPath, nil, &resp)
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
 	return
 }
 
@@ -1608,6 +1666,64 @@ func (cli *Client) BatchSend(roomID id.RoomID, req *ReqBatchSend) (resp *RespBat
 	return
 }
 
+// AppservicePing asks the homeserver to ping the application service with the given ID. This is only available
+// for appservices, and the ID must match the registration of the as_token being used.
+//
+// See https://github.com/matrix-org/matrix-spec-proposals/pull/2659 for more info.
+func (cli *Client) AppservicePing(appserviceID, txnID string) (resp *RespAppservicePing, err error) {
+	urlPath := cli.BuildClientURL("v1", "appservice", appserviceID, "ping")
+	_, err = cli.MakeRequest("POST", urlPath, &ReqAppservicePing{TxnID: txnID}, &resp)
+	return
+}
+
+// GetThirdPartyProtocols gets the metadata of all third party protocols supported by the homeserver.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3thirdpartyprotocols
+func (cli *Client) GetThirdPartyProtocols() (resp map[string]*ThirdPartyProtocol, err error) {
+	urlPath := cli.BuildClientURL("v3", "thirdparty", "protocols")
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// GetThirdPartyProtocol gets the metadata of a single third party protocol.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3thirdpartyprotocolprotocol
+func (cli *Client) GetThirdPartyProtocol(protocol string) (resp *ThirdPartyProtocol, err error) {
+	urlPath := cli.BuildClientURL("v3", "thirdparty", "protocol", protocol)
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// GetThirdPartyLocations finds portal rooms for third party locations matching the given protocol-specific fields.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3thirdpartylocationprotocol
+func (cli *Client) GetThirdPartyLocations(protocol string, fields map[string]string) (resp []*ThirdPartyLocation, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "thirdparty", "location", protocol}, fields)
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// GetThirdPartyUsers finds Matrix user IDs for third party users matching the given protocol-specific fields.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3thirdpartyuserprotocol
+func (cli *Client) GetThirdPartyUsers(protocol string, fields map[string]string) (resp []*ThirdPartyUser, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "thirdparty", "user", protocol}, fields)
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// GetThirdPartyLocationsByAlias finds the third party locations bridged to the given room alias.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3thirdpartylocation
+func (cli *Client) GetThirdPartyLocationsByAlias(alias id.RoomAlias) (resp []*ThirdPartyLocation, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "thirdparty", "location"}, map[string]string{"alias": string(alias)})
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// GetThirdPartyUsersByMXID finds the third party users that the given Matrix user ID represents.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3thirdpartyuser
+func (cli *Client) GetThirdPartyUsersByMXID(userID id.UserID) (resp []*ThirdPartyUser, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "thirdparty", "user"}, map[string]string{"userid": string(userID)})
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
 // TxnID returns the next transaction ID.
 func (cli *Client) TxnID() string {
 	txnID := atomic.AddInt32(&cli.txnID, 1)
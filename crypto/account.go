@@ -7,6 +7,8 @@
 package crypto
 
 import (
+	"time"
+
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto/olm"
 	"maunium.net/go/mautrix/id"
@@ -17,6 +19,10 @@ type OlmAccount struct {
 	signingKey  id.SigningKey
 	identityKey id.IdentityKey
 	Shared      bool
+
+	// FallbackKeyRotatedAt is the time when the fallback key was last replaced with a new one.
+	// It's reset to the zero value after the previous fallback key is forgotten.
+	FallbackKeyRotatedAt time.Time
 }
 
 func NewOlmAccount() *OlmAccount {
@@ -79,16 +85,37 @@ func (account *OlmAccount) getOneTimeKeys(userID id.UserID, deviceID id.DeviceID
 	// TODO do we need unsigned curve25519 one-time keys at all?
 	//      this just signs all of them
 	for keyID, key := range account.Internal.OneTimeKeys() {
-		key := mautrix.OneTimeKey{Key: key}
-		signature, _ := account.Internal.SignJSON(key)
-		key.Signatures = mautrix.Signatures{
-			userID: {
-				id.NewKeyID(id.KeyAlgorithmEd25519, deviceID.String()): signature,
-			},
-		}
-		key.IsSigned = true
-		oneTimeKeys[id.NewKeyID(id.KeyAlgorithmSignedCurve25519, keyID)] = key
+		oneTimeKeys[id.NewKeyID(id.KeyAlgorithmSignedCurve25519, keyID)] = account.signOneTimeKey(userID, deviceID, mautrix.OneTimeKey{Key: key})
 	}
 	account.Internal.MarkKeysAsPublished()
 	return oneTimeKeys
 }
+
+func (account *OlmAccount) signOneTimeKey(userID id.UserID, deviceID id.DeviceID, key mautrix.OneTimeKey) mautrix.OneTimeKey {
+	signature, _ := account.Internal.SignJSON(key)
+	key.Signatures = mautrix.Signatures{
+		userID: {
+			id.NewKeyID(id.KeyAlgorithmEd25519, deviceID.String()): signature,
+		},
+	}
+	key.IsSigned = true
+	return key
+}
+
+// getFallbackKeys returns the unpublished fallback key, generating a new one first if there's no fallback key at all
+// or if rotate is true. The keys must be marked as published (which getOneTimeKeys does) after they're uploaded.
+func (account *OlmAccount) getFallbackKeys(userID id.UserID, deviceID id.DeviceID, rotate bool) map[id.KeyID]mautrix.OneTimeKey {
+	hasFallbackKey := len(account.Internal.FallbackKey()) > 0
+	if rotate || !hasFallbackKey {
+		account.Internal.GenFallbackKey()
+		if hasFallbackKey {
+			account.FallbackKeyRotatedAt = time.Now()
+		}
+	}
+	fallbackKeys := make(map[id.KeyID]mautrix.OneTimeKey)
+	for keyID, key := range account.Internal.UnpublishedFallbackKey() {
+		fallbackKey := mautrix.OneTimeKey{Key: key, IsFallback: true}
+		fallbackKeys[id.NewKeyID(id.KeyAlgorithmSignedCurve25519, keyID)] = account.signOneTimeKey(userID, deviceID, fallbackKey)
+	}
+	return fallbackKeys
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"fmt"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// MaxClaimedKeysPerDevice is the maximum number of one-time keys generated for a single device in one claim request.
+const MaxClaimedKeysPerDevice = 50
+
+// HandleKeyClaim generates and returns new one-time keys for the device of this machine when the homeserver
+// forwards a key claim to the appservice (MSC3983). Keys are generated on demand, so they don't need to be uploaded
+// beforehand.
+//
+// Olm accounts can only hold a limited number of one-time keys and evict the oldest ones when more are generated,
+// so the number of generated keys is capped to avoid evicting keys that were already uploaded to the server.
+// If the claim can't be fully served, fewer keys are returned and the homeserver falls back to uploaded keys.
+//
+// Only the machine's own device is served, as each device has its own Olm account. Use AppserviceKeyServer to serve
+// the devices of ghost users in addition to the bridge bot's device.
+//
+// This implements the appservice.KeyClaimHandler interface.
+func (mach *OlmMachine) HandleKeyClaim(req mautrix.ReqAppserviceClaimKeys) (mautrix.RespAppserviceClaimKeys, error) {
+	algorithms, ok := req[mach.Client.UserID][mach.ownDeviceID()]
+	if !ok {
+		return nil, nil
+	}
+	count := 0
+	for _, alg := range algorithms {
+		if alg == id.KeyAlgorithmSignedCurve25519 {
+			count++
+		}
+	}
+	if count > MaxClaimedKeysPerDevice {
+		count = MaxClaimedKeysPerDevice
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	mach.otkUploadLock.Lock()
+	defer mach.otkUploadLock.Unlock()
+	// shareKeys marks keys as published right after generating them, so there are normally no unpublished keys here.
+	existingKeys := mach.account.Internal.OneTimeKeys()
+	available := int(mach.account.Internal.MaxNumberOfOneTimeKeys()) - mach.publishedOTKCount() - len(existingKeys)
+	if count > available {
+		mach.Log.Warn("Only generating %d of %d claimed one-time keys to avoid evicting published keys", available, count)
+		count = available
+	}
+	if count <= 0 {
+		return nil, nil
+	}
+	mach.account.Internal.GenOneTimeKeys(uint(count))
+	keys := make(map[id.KeyID]mautrix.OneTimeKey, count)
+	for keyID, key := range mach.account.Internal.OneTimeKeys() {
+		if _, existed := existingKeys[keyID]; !existed {
+			keys[id.NewKeyID(id.KeyAlgorithmSignedCurve25519, keyID)] = mach.account.signOneTimeKey(mach.Client.UserID, mach.ownDeviceID(), mautrix.OneTimeKey{Key: key})
+		}
+	}
+	mach.account.Internal.MarkKeysAsPublished()
+	// The private keys must be stored before the public keys are handed out, otherwise incoming sessions would fail.
+	err := mach.CryptoStore.PutAccount(mach.account)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save account after generating one-time keys: %w", err)
+	}
+	mach.Log.Debug("Generated %d one-time keys for a forwarded claim request", len(keys))
+	return mautrix.RespAppserviceClaimKeys{
+		mach.Client.UserID: {
+			mach.ownDeviceID(): keys,
+		},
+	}, nil
+}
+
+// publishedOTKCount returns the number of one-time keys that are currently on the server. If the server hasn't
+// reported the count yet, it's assumed to be half of the maximum, which is the number of keys that shareKeys
+// keeps on the server.
+func (mach *OlmMachine) publishedOTKCount() int {
+	mach.lastOTKCountLock.Lock()
+	defer mach.lastOTKCountLock.Unlock()
+	if mach.lastOTKCount == nil {
+		return int(mach.account.Internal.MaxNumberOfOneTimeKeys() / 2)
+	}
+	return mach.lastOTKCount.SignedCurve25519
+}
+
+// HandleKeyQuery returns the device keys of this machine when the homeserver forwards a key query to the appservice
+// (MSC3984). Devices other than the machine's own device are ignored, use AppserviceKeyServer to serve multiple devices.
+//
+// This implements the appservice.KeyQueryHandler interface.
+func (mach *OlmMachine) HandleKeyQuery(req mautrix.DeviceKeysRequest) (*mautrix.RespQueryKeys, error) {
+	deviceIDs, ok := req[mach.Client.UserID]
+	if !ok {
+		return nil, nil
+	}
+	found := len(deviceIDs) == 0
+	for _, deviceID := range deviceIDs {
+		if deviceID == mach.ownDeviceID() {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	deviceKeys := mach.account.getInitialKeys(mach.Client.UserID, mach.ownDeviceID())
+	return &mautrix.RespQueryKeys{
+		DeviceKeys: map[id.UserID]map[id.DeviceID]mautrix.DeviceKeys{
+			mach.Client.UserID: {
+				mach.ownDeviceID(): *deviceKeys,
+			},
+		},
+	}, nil
+}
+
+// AppserviceKeyServer serves the key claims and queries that the homeserver forwards to an appservice (MSC3983/MSC3984)
+// for all the devices the appservice manages, such as the bridge bot's device and the devices of logged in ghosts.
+// Each device has its own Olm account, so requests are split by device and dispatched to the OlmMachine of the device.
+//
+// This implements the appservice.KeyClaimHandler and appservice.KeyQueryHandler interfaces.
+type AppserviceKeyServer struct {
+	// LoadMachine is called for devices that haven't been added with AddMachine, e.g. to load the machines of ghost
+	// devices from the crypto store on demand. It should return nil if the device isn't managed by the appservice.
+	// Loaded machines are cached, so this is called at most once per device (unless it returns an error).
+	LoadMachine func(userID id.UserID, deviceID id.DeviceID) (*OlmMachine, error)
+	// ListDevices returns the IDs of all the devices of a user, which is used for key queries that don't specify
+	// any device IDs. If nil, only the devices that have been added or loaded are included in such queries.
+	ListDevices func(userID id.UserID) ([]id.DeviceID, error)
+
+	machines     map[id.UserID]map[id.DeviceID]*OlmMachine
+	machinesLock sync.RWMutex
+}
+
+// NewAppserviceKeyServer creates a new AppserviceKeyServer with no devices.
+func NewAppserviceKeyServer() *AppserviceKeyServer {
+	return &AppserviceKeyServer{
+		machines: make(map[id.UserID]map[id.DeviceID]*OlmMachine),
+	}
+}
+
+// AddMachine makes the key server serve the device of the given machine.
+func (aks *AppserviceKeyServer) AddMachine(mach *OlmMachine) {
+	aks.machinesLock.Lock()
+	defer aks.machinesLock.Unlock()
+	devices, ok := aks.machines[mach.Client.UserID]
+	if !ok {
+		devices = make(map[id.DeviceID]*OlmMachine)
+		aks.machines[mach.Client.UserID] = devices
+	}
+	devices[mach.ownDeviceID()] = mach
+}
+
+// RemoveMachine stops serving the given device, e.g. after it has been logged out.
+func (aks *AppserviceKeyServer) RemoveMachine(userID id.UserID, deviceID id.DeviceID) {
+	aks.machinesLock.Lock()
+	defer aks.machinesLock.Unlock()
+	delete(aks.machines[userID], deviceID)
+	if len(aks.machines[userID]) == 0 {
+		delete(aks.machines, userID)
+	}
+}
+
+func (aks *AppserviceKeyServer) getMachine(userID id.UserID, deviceID id.DeviceID) (*OlmMachine, error) {
+	aks.machinesLock.RLock()
+	mach, ok := aks.machines[userID][deviceID]
+	aks.machinesLock.RUnlock()
+	if ok || aks.LoadMachine == nil {
+		return mach, nil
+	}
+	mach, err := aks.LoadMachine(userID, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load machine of %s/%s: %w", userID, deviceID, err)
+	} else if mach != nil {
+		aks.AddMachine(mach)
+	}
+	return mach, nil
+}
+
+func (aks *AppserviceKeyServer) getDeviceIDs(userID id.UserID) ([]id.DeviceID, error) {
+	if aks.ListDevices != nil {
+		return aks.ListDevices(userID)
+	}
+	aks.machinesLock.RLock()
+	defer aks.machinesLock.RUnlock()
+	deviceIDs := make([]id.DeviceID, 0, len(aks.machines[userID]))
+	for deviceID := range aks.machines[userID] {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	return deviceIDs, nil
+}
+
+// HandleKeyClaim generates one-time keys for each requested device using the OlmMachine of the device.
+// Devices that aren't managed by the appservice are left out of the response. See OlmMachine.HandleKeyClaim.
+func (aks *AppserviceKeyServer) HandleKeyClaim(req mautrix.ReqAppserviceClaimKeys) (mautrix.RespAppserviceClaimKeys, error) {
+	resp := make(mautrix.RespAppserviceClaimKeys)
+	for userID, devices := range req {
+		for deviceID, algorithms := range devices {
+			mach, err := aks.getMachine(userID, deviceID)
+			if err != nil {
+				return nil, err
+			} else if mach == nil {
+				continue
+			}
+			deviceResp, err := mach.HandleKeyClaim(mautrix.ReqAppserviceClaimKeys{userID: {deviceID: algorithms}})
+			if err != nil {
+				return nil, fmt.Errorf("failed to claim keys of %s/%s: %w", userID, deviceID, err)
+			} else if keys, ok := deviceResp[userID][deviceID]; ok {
+				if _, ok = resp[userID]; !ok {
+					resp[userID] = make(map[id.DeviceID]map[id.KeyID]mautrix.OneTimeKey)
+				}
+				resp[userID][deviceID] = keys
+			}
+		}
+	}
+	return resp, nil
+}
+
+// HandleKeyQuery returns the device keys of each requested device from the OlmMachine of the device.
+// Devices that aren't managed by the appservice are left out of the response. See OlmMachine.HandleKeyQuery.
+func (aks *AppserviceKeyServer) HandleKeyQuery(req mautrix.DeviceKeysRequest) (*mautrix.RespQueryKeys, error) {
+	resp := &mautrix.RespQueryKeys{DeviceKeys: make(map[id.UserID]map[id.DeviceID]mautrix.DeviceKeys)}
+	for userID, deviceIDs := range req {
+		if len(deviceIDs) == 0 {
+			var err error
+			deviceIDs, err = aks.getDeviceIDs(userID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get devices of %s: %w", userID, err)
+			}
+		}
+		for _, deviceID := range deviceIDs {
+			mach, err := aks.getMachine(userID, deviceID)
+			if err != nil {
+				return nil, err
+			} else if mach == nil {
+				continue
+			}
+			deviceResp, err := mach.HandleKeyQuery(mautrix.DeviceKeysRequest{userID: {deviceID}})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get keys of %s/%s: %w", userID, deviceID, err)
+			} else if deviceResp == nil {
+				continue
+			} else if keys, ok := deviceResp.DeviceKeys[userID][deviceID]; ok {
+				if _, ok = resp.DeviceKeys[userID]; !ok {
+					resp.DeviceKeys[userID] = make(map[id.DeviceID]mautrix.DeviceKeys)
+				}
+				resp.DeviceKeys[userID][deviceID] = keys
+			}
+		}
+	}
+	return resp, nil
+}
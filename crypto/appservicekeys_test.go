@@ -0,0 +1,72 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"os"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestAppserviceKeyServer_Dispatch(t *testing.T) {
+	botMach, botStoreFileName := newMachine(t, "@bot:example.com")
+	defer os.Remove(botStoreFileName)
+	ghostMach, ghostStoreFileName := newMachine(t, "@ghost:example.com")
+	defer os.Remove(ghostStoreFileName)
+
+	loaded := 0
+	aks := NewAppserviceKeyServer()
+	aks.AddMachine(botMach)
+	aks.LoadMachine = func(userID id.UserID, deviceID id.DeviceID) (*OlmMachine, error) {
+		loaded++
+		if userID == ghostMach.Client.UserID && deviceID == ghostMach.Client.DeviceID {
+			return ghostMach, nil
+		}
+		return nil, nil
+	}
+
+	claim, err := aks.HandleKeyClaim(mautrix.ReqAppserviceClaimKeys{
+		"@bot:example.com":     {"device1": {id.KeyAlgorithmSignedCurve25519}},
+		"@ghost:example.com":   {"device1": {id.KeyAlgorithmSignedCurve25519, id.KeyAlgorithmSignedCurve25519}},
+		"@unknown:example.com": {"device1": {id.KeyAlgorithmSignedCurve25519}},
+	})
+	if err != nil {
+		t.Fatalf("Error claiming keys: %v", err)
+	}
+	if len(claim["@bot:example.com"]["device1"]) != 1 {
+		t.Errorf("Expected 1 key for the bot device, got %d", len(claim["@bot:example.com"]["device1"]))
+	}
+	if len(claim["@ghost:example.com"]["device1"]) != 2 {
+		t.Errorf("Expected 2 keys for the ghost device, got %d", len(claim["@ghost:example.com"]["device1"]))
+	}
+	if _, ok := claim["@unknown:example.com"]; ok {
+		t.Errorf("Unexpected keys for unmanaged device")
+	}
+
+	query, err := aks.HandleKeyQuery(mautrix.DeviceKeysRequest{
+		"@bot:example.com":   {},
+		"@ghost:example.com": {"device1", "device2"},
+	})
+	if err != nil {
+		t.Fatalf("Error querying keys: %v", err)
+	}
+	if keys, ok := query.DeviceKeys["@bot:example.com"]["device1"]; !ok || keys.Keys.GetEd25519("device1") != botMach.account.SigningKey() {
+		t.Errorf("Unexpected device keys for the bot device: %+v", keys)
+	}
+	if keys, ok := query.DeviceKeys["@ghost:example.com"]["device1"]; !ok || keys.Keys.GetEd25519("device1") != ghostMach.account.SigningKey() {
+		t.Errorf("Unexpected device keys for the ghost device: %+v", keys)
+	}
+	if len(query.DeviceKeys["@ghost:example.com"]) != 1 {
+		t.Errorf("Expected keys for 1 ghost device, got %d", len(query.DeviceKeys["@ghost:example.com"]))
+	}
+	// The ghost device is cached after the first load, the unknown devices are looked up every time
+	if loaded != 3 {
+		t.Errorf("Expected LoadMachine to be called 3 times, got %d", loaded)
+	}
+}
@@ -122,8 +122,8 @@ func (ef *EncryptedFile) Encrypt(plaintext []byte) []byte {
 func (ef *EncryptedFile) EncryptInPlace(data []byte) {
 	ef.decodeKeys(false)
 	utils.XorA256CTR(data, ef.decoded.key, ef.decoded.iv)
-	checksum := sha256.Sum256(data)
-	ef.Hashes.SHA256 = base64.RawStdEncoding.EncodeToString(checksum[:])
+	ef.decoded.sha256 = sha256.Sum256(data)
+	ef.Hashes.SHA256 = base64.RawStdEncoding.EncodeToString(ef.decoded.sha256[:])
 }
 
 type encryptingReader struct {
@@ -139,14 +139,21 @@ type encryptingReader struct {
 func (r *encryptingReader) Read(dst []byte) (n int, err error) {
 	if r.closed {
 		return 0, ReaderClosed
-	} else if r.isDecrypting && r.file.decoded == nil {
+	} else if r.isDecrypting && r.stream == nil {
 		if err = r.file.PrepareForDecryption(); err != nil {
 			return
 		}
+		block, _ := aes.NewCipher(r.file.decoded.key[:])
+		r.stream = cipher.NewCTR(block, r.file.decoded.iv[:])
 	}
 	n, err = r.source.Read(dst)
-	r.stream.XORKeyStream(dst[:n], dst[:n])
-	r.hash.Write(dst[:n])
+	if r.isDecrypting {
+		r.hash.Write(dst[:n])
+		r.stream.XORKeyStream(dst[:n], dst[:n])
+	} else {
+		r.stream.XORKeyStream(dst[:n], dst[:n])
+		r.hash.Write(dst[:n])
+	}
 	return
 }
 
@@ -157,12 +164,13 @@ func (r *encryptingReader) Close() (err error) {
 	}
 	if r.isDecrypting {
 		var downloadedChecksum [utils.SHAHashLength]byte
-		r.hash.Sum(downloadedChecksum[:])
-		if downloadedChecksum != r.file.decoded.sha256 {
+		r.hash.Sum(downloadedChecksum[:0])
+		if r.file.decoded == nil || downloadedChecksum != r.file.decoded.sha256 {
 			return HashMismatch
 		}
 	} else {
-		r.file.Hashes.SHA256 = base64.RawStdEncoding.EncodeToString(r.hash.Sum(nil))
+		r.hash.Sum(r.file.decoded.sha256[:0])
+		r.file.Hashes.SHA256 = base64.RawStdEncoding.EncodeToString(r.file.decoded.sha256[:])
 	}
 	r.closed = true
 	return
@@ -229,11 +237,11 @@ func (ef *EncryptedFile) DecryptInPlace(data []byte) error {
 // The Close call will validate the hash and return an error if it doesn't match.
 // In this case, the written data should be considered compromised and should not be used further.
 func (ef *EncryptedFile) DecryptStream(reader io.Reader) io.ReadCloser {
-	block, _ := aes.NewCipher(ef.decoded.key[:])
 	return &encryptingReader{
-		stream: cipher.NewCTR(block, ef.decoded.iv[:]),
 		hash:   sha256.New(),
 		source: reader,
 		file:   ef,
+
+		isDecrypting: true,
 	}
 }
@@ -3,6 +3,8 @@ package attachment
 import (
 	"encoding/base64"
 	"encoding/json"
+	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -49,6 +51,24 @@ func TestEncryptHelloWorld(t *testing.T) {
 	assert.Equal(t, helloWorldCiphertext, string(data), "unexpected encrypt output")
 }
 
+func TestDecryptStreamHelloWorld(t *testing.T) {
+	file := parseHelloWorld()
+	reader := file.DecryptStream(strings.NewReader(helloWorldCiphertext))
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err, "failed to read stream")
+	assert.NoError(t, reader.Close(), "failed to validate hash")
+	assert.Equal(t, "hello world", string(data), "unexpected decrypt output")
+}
+
+func TestDecryptStreamHashMismatch(t *testing.T) {
+	file := parseHelloWorld()
+	file.Hashes.SHA256 = base64.RawStdEncoding.EncodeToString([]byte(random32Bytes))
+	reader := file.DecryptStream(strings.NewReader(helloWorldCiphertext))
+	_, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err, "failed to read stream")
+	assert.ErrorIs(t, reader.Close(), HashMismatch)
+}
+
 func TestUnsupportedVersion(t *testing.T) {
 	file := parseHelloWorld()
 	file.Version = "foo"
@@ -0,0 +1,621 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package canonicaljson
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// MaxInteger is the largest integer allowed in canonical JSON.
+	MaxInteger = 1<<53 - 1
+	// MinInteger is the smallest integer allowed in canonical JSON.
+	MinInteger = -MaxInteger
+)
+
+var (
+	ErrIntegerOutOfRange = errors.New("integer is out of the range allowed in canonical JSON")
+	ErrFloatNotAllowed   = errors.New("non-integer numbers are not allowed in canonical JSON")
+	ErrInvalidNumber     = errors.New("number is not a canonical JSON integer")
+	ErrUnsupportedType   = errors.New("unsupported type")
+)
+
+var (
+	marshalerType     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	numberType        = reflect.TypeOf(json.Number(""))
+)
+
+// Marshal encodes the given value directly into canonical JSON.
+// https://spec.matrix.org/v1.3/appendices/#canonical-json
+//
+// Values are mapped to JSON the same way as encoding/json does (including `json` struct tags, json.Marshaler and
+// encoding.TextMarshaler), but the output has sorted object keys, no insignificant whitespace and no unnecessary
+// escapes. Numbers must be integers in the range [MinInteger, MaxInteger]: floats are only allowed if they have an
+// integer value, and json.Number values must be plain integer literals.
+//
+// If Marshal succeeds, the output is byte-for-byte identical to passing the output of json.Marshal to CanonicalJSON.
+func Marshal(v interface{}) ([]byte, error) {
+	var enc encoder
+	err := enc.encode(reflect.ValueOf(v), false)
+	if err != nil {
+		return nil, err
+	}
+	return enc.Bytes(), nil
+}
+
+type encoder struct {
+	bytes.Buffer
+}
+
+func (enc *encoder) encode(v reflect.Value, quoted bool) error {
+	if !v.IsValid() {
+		enc.WriteString("null")
+		return nil
+	}
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		enc.WriteString("null")
+		return nil
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() && reflect.PtrTo(v.Type()).Implements(marshalerType) {
+		v = v.Addr()
+	}
+	if v.Type().Implements(marshalerType) {
+		if v.Kind() == reflect.Interface && v.IsNil() {
+			enc.WriteString("null")
+			return nil
+		}
+		return enc.encodeMarshaler(v.Interface().(json.Marshaler))
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() && reflect.PtrTo(v.Type()).Implements(textMarshalerType) {
+		v = v.Addr()
+	}
+	if v.Type().Implements(textMarshalerType) {
+		if v.Kind() == reflect.Interface && v.IsNil() {
+			enc.WriteString("null")
+			return nil
+		}
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		enc.writeString(string(text))
+		return nil
+	}
+	if v.Type() == numberType {
+		return enc.encodeNumber(json.Number(v.String()), quoted)
+	}
+
+	if quoted {
+		switch v.Kind() {
+		case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+			reflect.Float32, reflect.Float64:
+			var inner encoder
+			err := inner.encode(v, false)
+			if err != nil {
+				return err
+			}
+			enc.writeString(inner.String())
+			return nil
+		case reflect.String:
+			// Quoted strings are double-encoded, and encoding/json escapes HTML characters in the inner encoding.
+			inner, _ := json.Marshal(v.String())
+			enc.writeString(string(inner))
+			return nil
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			enc.WriteString("true")
+		} else {
+			enc.WriteString("false")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := v.Int()
+		if i < MinInteger || i > MaxInteger {
+			return fmt.Errorf("%w: %d", ErrIntegerOutOfRange, i)
+		}
+		enc.WriteString(strconv.FormatInt(i, 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := v.Uint()
+		if u > MaxInteger {
+			return fmt.Errorf("%w: %d", ErrIntegerOutOfRange, u)
+		}
+		enc.WriteString(strconv.FormatUint(u, 10))
+	case reflect.Float32, reflect.Float64:
+		return enc.encodeFloat(v.Float(), v.Type().Bits())
+	case reflect.String:
+		enc.writeString(v.String())
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			enc.WriteString("null")
+			return nil
+		}
+		return enc.encode(v.Elem(), quoted)
+	case reflect.Struct:
+		return enc.encodeStruct(v)
+	case reflect.Map:
+		return enc.encodeMap(v)
+	case reflect.Slice:
+		if v.IsNil() {
+			enc.WriteString("null")
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 && !reflect.PtrTo(v.Type().Elem()).Implements(marshalerType) &&
+			!reflect.PtrTo(v.Type().Elem()).Implements(textMarshalerType) {
+			enc.writeString(base64.StdEncoding.EncodeToString(v.Bytes()))
+			return nil
+		}
+		return enc.encodeArray(v)
+	case reflect.Array:
+		return enc.encodeArray(v)
+	default:
+		return fmt.Errorf("%w %s", ErrUnsupportedType, v.Type())
+	}
+	return nil
+}
+
+// encodeMarshaler re-encodes the output of a json.Marshaler. The output is decoded first, so that the numbers in it
+// are validated like any other value.
+func (enc *encoder) encodeMarshaler(m json.Marshaler) error {
+	data, err := m.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var parsed interface{}
+	if err = dec.Decode(&parsed); err != nil {
+		return fmt.Errorf("invalid JSON from MarshalJSON: %w", err)
+	} else if dec.More() {
+		return fmt.Errorf("invalid JSON from MarshalJSON: trailing data")
+	}
+	return enc.encode(reflect.ValueOf(parsed), false)
+}
+
+func isCanonicalInteger(num string) bool {
+	digits := strings.TrimPrefix(num, "-")
+	if len(digits) == 0 || (len(digits) > 1 && digits[0] == '0') || num == "-0" {
+		return false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (enc *encoder) encodeNumber(num json.Number, quoted bool) error {
+	if num == "" {
+		num = "0"
+	}
+	if !isCanonicalInteger(string(num)) {
+		return fmt.Errorf("%w: %q", ErrInvalidNumber, num)
+	}
+	i, err := strconv.ParseInt(string(num), 10, 64)
+	if err != nil || i < MinInteger || i > MaxInteger {
+		return fmt.Errorf("%w: %s", ErrIntegerOutOfRange, num)
+	}
+	if quoted {
+		enc.writeString(string(num))
+	} else {
+		enc.WriteString(string(num))
+	}
+	return nil
+}
+
+func (enc *encoder) encodeFloat(f float64, bits int) error {
+	if math.IsNaN(f) || math.IsInf(f, 0) || f != math.Trunc(f) {
+		return fmt.Errorf("%w: %v", ErrFloatNotAllowed, f)
+	} else if f == 0 && math.Signbit(f) {
+		return fmt.Errorf("%w: negative zero", ErrFloatNotAllowed)
+	} else if f < MinInteger || f > MaxInteger {
+		return fmt.Errorf("%w: %v", ErrIntegerOutOfRange, f)
+	}
+	// Format the number like encoding/json does. For float64 this is always the exact integer,
+	// but float32 values above 2^24 are rounded to the shortest representation.
+	enc.WriteString(strconv.FormatFloat(f, 'f', -1, bits))
+	return nil
+}
+
+func (enc *encoder) encodeArray(v reflect.Value) error {
+	enc.WriteByte('[')
+	for i := 0; i < v.Len(); i++ {
+		if i > 0 {
+			enc.WriteByte(',')
+		}
+		if err := enc.encode(v.Index(i), false); err != nil {
+			return err
+		}
+	}
+	enc.WriteByte(']')
+	return nil
+}
+
+type mapEntry struct {
+	key   string
+	value reflect.Value
+}
+
+func resolveKeyName(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		text, err := tm.MarshalText()
+		return string(text), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("%w %s as map key", ErrUnsupportedType, k.Type())
+}
+
+func (enc *encoder) encodeMap(v reflect.Value) error {
+	if v.IsNil() {
+		enc.WriteString("null")
+		return nil
+	}
+	entries := make([]mapEntry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		key, err := resolveKeyName(iter.Key())
+		if err != nil {
+			return err
+		}
+		entries = append(entries, mapEntry{key: replaceInvalidUTF8(key), value: iter.Value()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	enc.WriteByte('{')
+	for i, entry := range entries {
+		if i > 0 {
+			enc.WriteByte(',')
+		}
+		enc.writeString(entry.key)
+		enc.WriteByte(':')
+		if err := enc.encode(entry.value, false); err != nil {
+			return err
+		}
+	}
+	enc.WriteByte('}')
+	return nil
+}
+
+func (enc *encoder) encodeStruct(v reflect.Value) error {
+	fields := cachedTypeFields(v.Type())
+	enc.WriteByte('{')
+	first := true
+FieldLoop:
+	for _, f := range fields {
+		fv := v
+		for _, i := range f.index {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue FieldLoop
+				}
+				fv = fv.Elem()
+			}
+			fv = fv.Field(i)
+		}
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		if !first {
+			enc.WriteByte(',')
+		}
+		first = false
+		enc.writeString(f.name)
+		enc.WriteByte(':')
+		if err := enc.encode(fv, f.quoted); err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+	enc.WriteByte('}')
+	return nil
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// replaceInvalidUTF8 replaces each invalid byte with U+FFFD, which is what writeString would output for them.
+// Map keys are sorted after the replacement, as the byte-based canonicalization only sees the replaced keys.
+func replaceInvalidUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	var buf strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		buf.WriteRune(r)
+		i += size
+	}
+	return buf.String()
+}
+
+// writeString writes a canonical JSON string. Only quotes, backslashes and control characters are escaped,
+// using the short escapes where possible. Invalid UTF-8 is replaced with U+FFFD like encoding/json does.
+func (enc *encoder) writeString(s string) {
+	const hex = "0123456789ABCDEF"
+	enc.WriteByte('"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				enc.WriteByte('\\')
+				enc.WriteByte(c)
+			case c == '\b':
+				enc.WriteString(`\b`)
+			case c == '\t':
+				enc.WriteString(`\t`)
+			case c == '\n':
+				enc.WriteString(`\n`)
+			case c == '\f':
+				enc.WriteString(`\f`)
+			case c == '\r':
+				enc.WriteString(`\r`)
+			case c < ' ':
+				enc.WriteString(`\u00`)
+				enc.WriteByte(hex[c>>4])
+				enc.WriteByte(hex[c&0xF])
+			default:
+				enc.WriteByte(c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			enc.WriteRune(utf8.RuneError)
+		} else {
+			enc.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	enc.WriteByte('"')
+}
+
+// field is a struct field that is encoded, resolved with the same rules as encoding/json.
+type field struct {
+	name      string
+	tag       bool
+	index     []int
+	typ       reflect.Type
+	omitEmpty bool
+	quoted    bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+func cachedTypeFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	f, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return f.([]field)
+}
+
+func isValidTag(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case strings.ContainsRune("!#$%&()*+-./:;<=>?@[]^_{|}~ ", c):
+			// Backslash and quote chars are reserved, but otherwise any punctuation chars are allowed in a tag name.
+		case !unicode.IsLetter(c) && !unicode.IsDigit(c):
+			return false
+		}
+	}
+	return true
+}
+
+func hasTagOption(opts []string, name string) bool {
+	for _, opt := range opts {
+		if opt == name {
+			return true
+		}
+	}
+	return false
+}
+
+// typeFields returns the fields that encoding/json would encode for the given struct type,
+// following the same rules for embedded structs and conflicting names.
+func typeFields(t reflect.Type) []field {
+	current := []field{}
+	next := []field{{typ: t}}
+
+	var count, nextCount map[reflect.Type]int
+	visited := map[reflect.Type]bool{}
+
+	var fields []field
+	for len(next) > 0 {
+		current, next = next, current[:0]
+		count, nextCount = nextCount, map[reflect.Type]int{}
+
+		for _, f := range current {
+			if visited[f.typ] {
+				continue
+			}
+			visited[f.typ] = true
+
+			for i := 0; i < f.typ.NumField(); i++ {
+				sf := f.typ.Field(i)
+				exported := sf.PkgPath == ""
+				if sf.Anonymous {
+					ft := sf.Type
+					if ft.Kind() == reflect.Ptr {
+						ft = ft.Elem()
+					}
+					if !exported && ft.Kind() != reflect.Struct {
+						continue
+					}
+				} else if !exported {
+					continue
+				}
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				tagParts := strings.Split(tag, ",")
+				name, opts := tagParts[0], tagParts[1:]
+				if !isValidTag(name) {
+					name = ""
+				}
+				index := make([]int, len(f.index)+1)
+				copy(index, f.index)
+				index[len(f.index)] = i
+
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+
+				quoted := false
+				if hasTagOption(opts, "string") {
+					switch ft.Kind() {
+					case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+						reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+						reflect.Float32, reflect.Float64, reflect.String:
+						quoted = true
+					}
+				}
+
+				if name != "" || !sf.Anonymous || ft.Kind() != reflect.Struct {
+					tagged := name != ""
+					if name == "" {
+						name = sf.Name
+					}
+					fields = append(fields, field{
+						name:      name,
+						tag:       tagged,
+						index:     index,
+						typ:       ft,
+						omitEmpty: hasTagOption(opts, "omitempty"),
+						quoted:    quoted,
+					})
+					if count[f.typ] > 1 {
+						// If there were multiple instances, add a second, so that the annihilation code will see
+						// a duplicate. It only cares about the distinction between 1 and 2, so don't bother
+						// generating any more copies.
+						fields = append(fields, fields[len(fields)-1])
+					}
+					continue
+				}
+
+				nextCount[ft]++
+				if nextCount[ft] == 1 {
+					next = append(next, field{name: ft.Name(), index: index, typ: ft})
+				}
+			}
+		}
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		x := fields
+		if x[i].name != x[j].name {
+			return x[i].name < x[j].name
+		}
+		if len(x[i].index) != len(x[j].index) {
+			return len(x[i].index) < len(x[j].index)
+		}
+		if x[i].tag != x[j].tag {
+			return x[i].tag
+		}
+		return indexLess(x[i].index, x[j].index)
+	})
+
+	// Delete all fields that are hidden by the Go rules for embedded fields, except that fields with JSON tags
+	// are promoted. The fields are sorted in primary order of name, secondary order of field index length.
+	out := fields[:0]
+	for advance, i := 0, 0; i < len(fields); i += advance {
+		fi := fields[i]
+		name := fi.name
+		for advance = 1; i+advance < len(fields); advance++ {
+			if fields[i+advance].name != name {
+				break
+			}
+		}
+		if advance == 1 {
+			out = append(out, fi)
+			continue
+		}
+		dominant, ok := dominantField(fields[i : i+advance])
+		if ok {
+			out = append(out, dominant)
+		}
+	}
+
+	// Canonical JSON sorts the keys, so order the fields by name instead of index.
+	// Names are already unique at this point.
+	fields = out
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].name < fields[j].name
+	})
+	return fields
+}
+
+func indexLess(a, b []int) bool {
+	for k, xik := range a {
+		if k >= len(b) {
+			return false
+		}
+		if xik != b[k] {
+			return xik < b[k]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// dominantField looks through the fields, all of which are known to have the same name, to find the single field
+// that dominates the others using Go's embedding rules, modified by the presence of JSON tags.
+func dominantField(fields []field) (field, bool) {
+	if len(fields) > 1 && len(fields[0].index) == len(fields[1].index) && fields[0].tag == fields[1].tag {
+		return field{}, false
+	}
+	return fields[0], true
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build go1.18
+
+package canonicaljson
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// FuzzMarshal checks that Marshal is equivalent to json.Marshal followed by CanonicalJSON for arbitrary JSON values.
+func FuzzMarshal(f *testing.F) {
+	f.Add([]byte(`{"b":"two","a":1,"c":[true,false,null]}`))
+	f.Add([]byte(`{"é":"🐈\u0000\u001f","<>&":" ","nested":{"z":[],"y":{}}}`))
+	f.Add([]byte(`[9007199254740991,-9007199254740991,0,"\/\b\f\n\r\t"]`))
+	f.Add([]byte(`{"a":1.5,"b":1e3,"c":-0}`))
+	f.Fuzz(func(t *testing.T, input []byte) {
+		dec := json.NewDecoder(bytes.NewReader(input))
+		dec.UseNumber()
+		var parsed interface{}
+		if dec.Decode(&parsed) != nil || dec.More() {
+			return
+		}
+		got, err := Marshal(parsed)
+		if err != nil {
+			return
+		}
+		stdJSON, err := json.Marshal(parsed)
+		if err != nil {
+			t.Fatalf("json.Marshal failed after Marshal succeeded: %v", err)
+		}
+		want, err := CanonicalJSON(stdJSON)
+		if err != nil {
+			t.Fatalf("CanonicalJSON failed: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("Marshal(%s): want %s got %s", input, want, got)
+		}
+	})
+}
+
+// FuzzMarshalStruct checks the equivalence for struct fields with arbitrary strings and integers.
+func FuzzMarshalStruct(f *testing.F) {
+	type fuzzStruct struct {
+		Key    string            `json:"key"`
+		Value  string            `json:"value,omitempty"`
+		Quoted string            `json:"quoted,string"`
+		Number int64             `json:"number"`
+		Map    map[string]string `json:"map"`
+	}
+	f.Add("key", "value", int64(1))
+	f.Add("\x00\xff", " <script>", int64(MaxInteger))
+	f.Fuzz(func(t *testing.T, key, value string, number int64) {
+		obj := fuzzStruct{Key: key, Value: value, Quoted: value, Number: number, Map: map[string]string{key: value, value: key}}
+		got, err := Marshal(obj)
+		if err != nil {
+			if number >= MinInteger && number <= MaxInteger {
+				t.Fatalf("Marshal failed for in-range number %d: %v", number, err)
+			}
+			return
+		}
+		stdJSON, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatalf("json.Marshal failed after Marshal succeeded: %v", err)
+		}
+		if want := CanonicalJSONAssumeValid(stdJSON); !bytes.Equal(got, want) {
+			t.Fatalf("Marshal(%#v): want %s got %s", obj, want, got)
+		}
+	})
+}
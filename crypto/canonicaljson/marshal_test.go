@@ -0,0 +1,125 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package canonicaljson
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// checkEquivalent verifies that Marshal produces the same output as running json.Marshal through CanonicalJSON.
+func checkEquivalent(t *testing.T, v interface{}) []byte {
+	got, err := Marshal(v)
+	if err != nil {
+		t.Errorf("Marshal(%#v) returned error: %v", v, err)
+		return nil
+	}
+	stdJSON, err := json.Marshal(v)
+	if err != nil {
+		t.Errorf("json.Marshal(%#v) returned error: %v", v, err)
+		return got
+	}
+	want, err := CanonicalJSON(stdJSON)
+	if err != nil {
+		t.Errorf("CanonicalJSON(%s) returned error: %v", stdJSON, err)
+	} else if string(got) != string(want) {
+		t.Errorf("Marshal(%#v): want %s got %s", v, want, got)
+	}
+	return got
+}
+
+func testMarshal(t *testing.T, v interface{}, want string) {
+	if got := checkEquivalent(t, v); got != nil && string(got) != want {
+		t.Errorf("Marshal(%#v): want %s got %s", v, want, got)
+	}
+}
+
+type embedded struct {
+	Inner  string `json:"inner"`
+	Shadow int    `json:"shadow"`
+}
+
+type textKey int
+
+func (tk textKey) MarshalText() ([]byte, error) {
+	return []byte("key" + string(rune('a'+tk))), nil
+}
+
+type testStruct struct {
+	embedded
+	Zebra    string            `json:"zebra"`
+	Apple    *int              `json:"apple,omitempty"`
+	Shadow   string            `json:"shadow"`
+	Quoted   int64             `json:"quoted,string"`
+	Skipped  string            `json:"-"`
+	NoTag    bool              `json:",omitempty"`
+	Map      map[string]uint16 `json:"map"`
+	TextKeys map[textKey]bool  `json:"text_keys,omitempty"`
+	Bytes    []byte            `json:"bytes"`
+	Raw      json.RawMessage   `json:"raw"`
+	Time     time.Time         `json:"time"`
+	private  string
+}
+
+func TestMarshal(t *testing.T) {
+	testMarshal(t, nil, `null`)
+	testMarshal(t, map[string]interface{}{}, `{}`)
+	testMarshal(t, []int{}, `[]`)
+	testMarshal(t, map[string]interface{}{"b": "two", "a": 1, "c": []interface{}{true, false, nil}}, `{"a":1,"b":"two","c":[true,false,null]}`)
+	testMarshal(t, map[int]string{10: "ten", 9: "nine"}, `{"10":"ten","9":"nine"}`)
+	testMarshal(t, []interface{}{MaxInteger, MinInteger, float64(1 << 40), uint8(255)}, `[9007199254740991,-9007199254740991,1099511627776,255]`)
+	testMarshal(t, json.Number("-12345"), `-12345`)
+	testMarshal(t, "\u0000\b\t\n\u000b\f\r\u001f\"\\/<>& é\U0001F408", "\"\\u0000\\b\\t\\n\\u000B\\f\\r\\u001F\\\"\\\\/<>& é\U0001F408\"")
+	testMarshal(t, "invalid \xff utf8", "\"invalid � utf8\"")
+	testMarshal(t, map[string]int{"é": 1, "z": 2, "\U0001F408": 3}, "{\"z\":2,\"é\":1,\"\U0001F408\":3}")
+	testMarshal(t, map[string]int{"\xff": 1, "\xa80": 2}, "{\"�\":1,\"�0\":2}")
+
+	apple := 5
+	testMarshal(t, &testStruct{
+		embedded: embedded{Inner: "in", Shadow: 1},
+		Zebra:    "z",
+		Apple:    &apple,
+		Shadow:   "outer",
+		Quoted:   42,
+		Skipped:  "skipped",
+		Map:      map[string]uint16{"y": 2, "x": 1},
+		TextKeys: map[textKey]bool{1: true, 0: false},
+		Bytes:    []byte("hello"),
+		Raw:      json.RawMessage(`{ "b": [ 1, 2 ], "a": "A" }`),
+		Time:     time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+		private:  "private",
+	}, `{"apple":5,"bytes":"aGVsbG8=","inner":"in","map":{"x":1,"y":2},"quoted":"42","raw":{"a":"A","b":[1,2]},"shadow":"outer","text_keys":{"keya":false,"keyb":true},"time":"2022-06-01T12:00:00Z","zebra":"z"}`)
+}
+
+func testMarshalError(t *testing.T, v interface{}, wantErr error) {
+	_, err := Marshal(v)
+	if !errors.Is(err, wantErr) {
+		t.Errorf("Marshal(%#v): want error %v got %v", v, wantErr, err)
+	}
+}
+
+func TestMarshal_Errors(t *testing.T) {
+	testMarshalError(t, int64(MaxInteger+1), ErrIntegerOutOfRange)
+	testMarshalError(t, int64(MinInteger-1), ErrIntegerOutOfRange)
+	testMarshalError(t, uint64(math.MaxUint64), ErrIntegerOutOfRange)
+	testMarshalError(t, float64(1<<53), ErrIntegerOutOfRange)
+	testMarshalError(t, 1.5, ErrFloatNotAllowed)
+	testMarshalError(t, math.NaN(), ErrFloatNotAllowed)
+	testMarshalError(t, math.Inf(1), ErrFloatNotAllowed)
+	testMarshalError(t, math.Copysign(0, -1), ErrFloatNotAllowed)
+	testMarshalError(t, json.Number("1.0"), ErrInvalidNumber)
+	testMarshalError(t, json.Number("1e3"), ErrInvalidNumber)
+	testMarshalError(t, json.Number("-0"), ErrInvalidNumber)
+	testMarshalError(t, json.Number("9007199254740992"), ErrIntegerOutOfRange)
+	testMarshalError(t, json.RawMessage(`{"a":0.5}`), ErrInvalidNumber)
+	testMarshalError(t, map[string]interface{}{"a": []interface{}{1 << 60}}, ErrIntegerOutOfRange)
+	testMarshalError(t, make(chan int), ErrUnsupportedType)
+	testMarshalError(t, complex(1, 2), ErrUnsupportedType)
+}
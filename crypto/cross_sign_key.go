@@ -139,5 +139,9 @@ func (mach *OlmMachine) PublishCrossSigningKeys(keys *CrossSigningKeysCache, uia
 	mach.CrossSigningKeys = keys
 	mach.crossSigningPubkeys = keys.PublicKeys()
 
+	if err = mach.CryptoStore.PutPinnedMasterKey(userID, keys.MasterKey.PublicKey); err != nil {
+		mach.Log.Warn("Failed to pin own new master key: %v", err)
+	}
+
 	return nil
 }
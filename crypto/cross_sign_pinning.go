@@ -0,0 +1,150 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrNoMasterKeyToPin = errors.New("user doesn't have a known cross-signing master key")
+	ErrMasterKeyChanged = errors.New("master key doesn't match the pinned master key")
+)
+
+// IdentityState describes the status of a user's cross-signing identity compared to the pinned master key.
+type IdentityState int
+
+const (
+	// IdentityStateUnknown means the user hasn't published cross-signing keys, or they haven't been fetched yet.
+	IdentityStateUnknown IdentityState = iota
+	// IdentityStatePinned means the current master key of the user matches the pinned one.
+	IdentityStatePinned
+	// IdentityStateChanged means the user's master key has changed after it was pinned and the change hasn't been accepted.
+	IdentityStateChanged
+	// IdentityStateUnpinned means the user has a master key, but nothing has been pinned for them yet.
+	IdentityStateUnpinned
+)
+
+func (is IdentityState) String() string {
+	switch is {
+	case IdentityStateUnknown:
+		return "unknown"
+	case IdentityStatePinned:
+		return "pinned"
+	case IdentityStateChanged:
+		return "changed"
+	case IdentityStateUnpinned:
+		return "unpinned"
+	default:
+		return ""
+	}
+}
+
+// UserIdentity contains the pinned and current cross-signing master keys of a user.
+type UserIdentity struct {
+	UserID     id.UserID
+	PinnedKey  id.Ed25519
+	CurrentKey id.Ed25519
+	State      IdentityState
+}
+
+// GetUserIdentity returns the pinned and current cross-signing master keys of the given user from the crypto store.
+func (mach *OlmMachine) GetUserIdentity(userID id.UserID) (*UserIdentity, error) {
+	keys, err := mach.CryptoStore.GetCrossSigningKeys(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cross-signing keys: %w", err)
+	}
+	pinnedKey, err := mach.CryptoStore.GetPinnedMasterKey(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pinned master key: %w", err)
+	}
+	identity := &UserIdentity{
+		UserID:     userID,
+		PinnedKey:  pinnedKey,
+		CurrentKey: keys[id.XSUsageMaster],
+	}
+	if identity.CurrentKey == "" {
+		identity.State = IdentityStateUnknown
+	} else if identity.PinnedKey == "" {
+		identity.State = IdentityStateUnpinned
+	} else if identity.PinnedKey == identity.CurrentKey {
+		identity.State = IdentityStatePinned
+	} else {
+		identity.State = IdentityStateChanged
+	}
+	return identity, nil
+}
+
+// IsIdentityChanged returns true if the cross-signing master key of the given user has changed since it was pinned
+// and the new identity hasn't been accepted with AcceptIdentityChange.
+//
+// If the identity can't be read from the store, the identity is treated as changed, so that keys aren't shared
+// with a possibly changed identity.
+func (mach *OlmMachine) IsIdentityChanged(userID id.UserID) bool {
+	identity, err := mach.GetUserIdentity(userID)
+	if err != nil {
+		mach.Log.Error("Failed to get identity of %s, treating it as changed: %v", userID, err)
+		return true
+	}
+	return identity.State == IdentityStateChanged
+}
+
+// FilterChangedIdentities returns the users in the given list whose identity has changed since it was pinned.
+func (mach *OlmMachine) FilterChangedIdentities(users []id.UserID) []id.UserID {
+	var changed []id.UserID
+	for _, userID := range users {
+		if mach.IsIdentityChanged(userID) {
+			changed = append(changed, userID)
+		}
+	}
+	return changed
+}
+
+// AcceptIdentityChange pins the current cross-signing master key of the given user.
+//
+// The expected key must be the master key that the user was shown, which guards against accepting a key that changed
+// again in the meantime. If it's empty, whatever key is currently stored will be pinned.
+func (mach *OlmMachine) AcceptIdentityChange(userID id.UserID, expectedKey id.Ed25519) error {
+	identity, err := mach.GetUserIdentity(userID)
+	if err != nil {
+		return err
+	} else if identity.CurrentKey == "" {
+		return ErrNoMasterKeyToPin
+	} else if expectedKey != "" && identity.CurrentKey != expectedKey {
+		return fmt.Errorf("%w: expected %s, current key is %s", ErrMasterKeyChanged, expectedKey, identity.CurrentKey)
+	} else if identity.PinnedKey == identity.CurrentKey {
+		return nil
+	}
+	mach.Log.Debug("Pinning new master key %s of %s (previously pinned: %s)", identity.CurrentKey, userID, identity.PinnedKey)
+	err = mach.CryptoStore.PutPinnedMasterKey(userID, identity.CurrentKey)
+	if err != nil {
+		return fmt.Errorf("failed to store pinned master key: %w", err)
+	}
+	return nil
+}
+
+// checkPinnedMasterKey pins the given master key if nothing has been pinned for the user yet,
+// or calls OnIdentityChanged if the key doesn't match the pinned one.
+func (mach *OlmMachine) checkPinnedMasterKey(userID id.UserID, masterKey id.Ed25519) {
+	pinnedKey, err := mach.CryptoStore.GetPinnedMasterKey(userID)
+	if err != nil {
+		mach.Log.Error("Failed to get pinned master key of %s: %v", userID, err)
+	} else if pinnedKey == "" {
+		mach.Log.Debug("Pinning first seen master key of %s: %s", userID, masterKey)
+		if err = mach.CryptoStore.PutPinnedMasterKey(userID, masterKey); err != nil {
+			mach.Log.Error("Failed to store pinned master key of %s: %v", userID, err)
+		}
+	} else if pinnedKey != masterKey {
+		mach.Log.Warn("Master key of %s changed from pinned %s to %s", userID, pinnedKey, masterKey)
+		if mach.OnIdentityChanged != nil {
+			mach.OnIdentityChanged(userID, pinnedKey, masterKey)
+		}
+	}
+}
@@ -47,7 +47,7 @@ func (mach *OlmMachine) fetchMasterKey(device *DeviceIdentity, content *event.Ve
 		return masterKey, ErrMasterKeyMACNotFound
 	}
 	expectedMasterKeyMAC, _, err := mach.getPKAndKeysMAC(verState.sas, device.UserID, device.DeviceID,
-		mach.Client.UserID, mach.Client.DeviceID, transactionID, masterKey, masterKeyID, content.Mac)
+		mach.Client.UserID, mach.ownDeviceID(), transactionID, masterKey, masterKeyID, content.Mac)
 	if err != nil {
 		return masterKey, fmt.Errorf("failed to calculate expected MAC for master key: %w", err)
 	}
@@ -83,6 +83,10 @@ func (mach *OlmMachine) SignUser(userID id.UserID, masterKey id.Ed25519) error {
 	if err := mach.CryptoStore.PutSignature(userID, masterKey, mach.Client.UserID, mach.CrossSigningKeys.UserSigningKey.PublicKey, signature); err != nil {
 		return fmt.Errorf("error storing signature in crypto store: %w", err)
 	}
+	// Signing the master key is an explicit verification, so the key is pinned as the user's identity too.
+	if err := mach.CryptoStore.PutPinnedMasterKey(userID, masterKey); err != nil {
+		return fmt.Errorf("error storing pinned master key in crypto store: %w", err)
+	}
 
 	return nil
 }
@@ -96,7 +100,7 @@ func (mach *OlmMachine) SignOwnMasterKey() error {
 	}
 
 	userID := mach.Client.UserID
-	deviceID := mach.Client.DeviceID
+	deviceID := mach.ownDeviceID()
 	masterKey := mach.CrossSigningKeys.MasterKey.PublicKey
 
 	masterKeyObj := mautrix.ReqKeysSignatures{
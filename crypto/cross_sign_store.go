@@ -41,6 +41,8 @@ func (mach *OlmMachine) storeCrossSigningKeys(crossSigningKeys map[id.UserID]mau
 				mach.Log.Debug("Storing cross-signing key for %v: %v (type %v)", userID, key, usage)
 				if err := mach.CryptoStore.PutCrossSigningKey(userID, usage, key); err != nil {
 					mach.Log.Error("Error storing cross-signing key: %v", err)
+				} else if usage == id.XSUsageMaster && currentKeys[id.XSUsageMaster] != key {
+					mach.checkPinnedMasterKey(userID, key)
 				}
 			}
 
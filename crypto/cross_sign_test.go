@@ -8,6 +8,7 @@ package crypto
 
 import (
 	"database/sql"
+	"os"
 	"testing"
 
 	"maunium.net/go/mautrix"
@@ -149,3 +150,80 @@ func TestTrustOtherDevice(t *testing.T) {
 		t.Error("Other device not trusted while it should be")
 	}
 }
+
+func TestPinnedMasterKeyChange(t *testing.T) {
+	m := getOlmMachine(t)
+	otherUser := id.UserID("@user")
+	var changedTo id.Ed25519
+	m.OnIdentityChanged = func(userID id.UserID, pinnedKey, newKey id.Ed25519) {
+		changedTo = newKey
+	}
+
+	firstKey, _ := olm.NewPkSigning()
+	m.CryptoStore.PutCrossSigningKey(otherUser, id.XSUsageMaster, firstKey.PublicKey)
+	m.checkPinnedMasterKey(otherUser, firstKey.PublicKey)
+	if m.IsIdentityChanged(otherUser) {
+		t.Error("Identity changed after first master key was pinned")
+	}
+
+	secondKey, _ := olm.NewPkSigning()
+	m.CryptoStore.PutCrossSigningKey(otherUser, id.XSUsageMaster, secondKey.PublicKey)
+	m.checkPinnedMasterKey(otherUser, secondKey.PublicKey)
+	if changedTo != secondKey.PublicKey {
+		t.Error("OnIdentityChanged not called with new master key")
+	}
+	if !m.IsIdentityChanged(otherUser) {
+		t.Error("Identity not changed after master key was replaced")
+	}
+
+	if err := m.AcceptIdentityChange(otherUser, firstKey.PublicKey); err == nil {
+		t.Error("Accepting identity change with outdated key succeeded")
+	}
+	if err := m.AcceptIdentityChange(otherUser, secondKey.PublicKey); err != nil {
+		t.Errorf("Error accepting identity change: %v", err)
+	}
+	if m.IsIdentityChanged(otherUser) {
+		t.Error("Identity still changed after accepting new master key")
+	}
+}
+
+func TestUnpinnedIdentity(t *testing.T) {
+	m := getOlmMachine(t)
+	otherUser := id.UserID("@user")
+	masterKey, _ := olm.NewPkSigning()
+	m.CryptoStore.PutCrossSigningKey(otherUser, id.XSUsageMaster, masterKey.PublicKey)
+	if identity, err := m.GetUserIdentity(otherUser); err != nil {
+		t.Fatalf("Error getting identity: %v", err)
+	} else if identity.State != IdentityStateUnpinned {
+		t.Errorf("Expected identity without pinned key to be unpinned, got %s", identity.State)
+	}
+	if m.IsIdentityChanged(otherUser) {
+		t.Error("Unpinned identity reported as changed")
+	}
+}
+
+func TestGobStoreBackfillsPinnedMasterKeys(t *testing.T) {
+	storeFileName := "gob_store_test_backfill.gob"
+	defer os.Remove(storeFileName)
+	gs, err := NewGobStore(storeFileName)
+	if err != nil {
+		t.Fatalf("Error creating Gob store: %v", err)
+	}
+	masterKey, _ := olm.NewPkSigning()
+	gs.PutCrossSigningKey("@user", id.XSUsageMaster, masterKey.PublicKey)
+	// Simulate a store that was saved before master keys were pinned
+	gs.PinnedMasterKeysBackfilled = false
+	if err = gs.Flush(); err != nil {
+		t.Fatalf("Error saving Gob store: %v", err)
+	}
+
+	gs, err = NewGobStore(storeFileName)
+	if err != nil {
+		t.Fatalf("Error loading Gob store: %v", err)
+	}
+	if pinned, _ := gs.GetPinnedMasterKey("@user"); pinned != masterKey.PublicKey {
+		t.Errorf("Expected master key to be pinned after loading, got %q", pinned)
+	} else if !gs.PinnedMasterKeysBackfilled {
+		t.Error("Expected store to be marked as backfilled")
+	}
+}
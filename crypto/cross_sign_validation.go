@@ -10,48 +10,67 @@ import (
 	"maunium.net/go/mautrix/id"
 )
 
-// IsDeviceTrusted returns whether a device has been determined to be trusted either through verification or cross-signing.
-func (mach *OlmMachine) IsDeviceTrusted(device *DeviceIdentity) bool {
+// ResolveTrust determines the trust level of a device based on local verification and cross-signing.
+//
+// Devices that are cross-signed by their owner are trusted further depending on whether we've signed the owner's
+// master key, and whether the master key matches the one that was pinned when it was first seen.
+func (mach *OlmMachine) ResolveTrust(device *DeviceIdentity) id.TrustState {
 	userID := device.UserID
 	if device.Trust == TrustStateVerified {
-		return true
+		return id.TrustStateVerified
 	} else if device.Trust == TrustStateBlacklisted {
-		return false
-	}
-	if !mach.IsUserTrusted(userID) {
-		return false
+		return id.TrustStateBlacklisted
 	}
 
 	theirKeys, err := mach.CryptoStore.GetCrossSigningKeys(userID)
 	if err != nil {
 		mach.Log.Error("Error retrieving cross-singing key of user %v from database: %v", userID, err)
-		return false
+		return id.TrustStateUnset
 	}
 	theirMSK, ok := theirKeys[id.XSUsageMaster]
 	if !ok {
-		mach.Log.Error("Master key of user %v not found", userID)
-		return false
+		mach.Log.Trace("Master key of user %v not found", userID)
+		return id.TrustStateUnset
 	}
 	theirSSK, ok := theirKeys[id.XSUsageSelfSigning]
 	if !ok {
-		mach.Log.Error("Self-signing key of user %v not found", userID)
-		return false
+		mach.Log.Trace("Self-signing key of user %v not found", userID)
+		return id.TrustStateUnset
 	}
 	sskSigExists, err := mach.CryptoStore.IsKeySignedBy(userID, theirSSK, userID, theirMSK)
 	if err != nil {
 		mach.Log.Error("Error retrieving cross-singing signatures for master key of user %v from database: %v", userID, err)
-		return false
+		return id.TrustStateUnset
 	}
 	if !sskSigExists {
 		mach.Log.Warn("Self-signing key of user %v is not signed by their master key", userID)
-		return false
+		return id.TrustStateUnset
 	}
 	deviceSigExists, err := mach.CryptoStore.IsKeySignedBy(userID, device.SigningKey, userID, theirSSK)
 	if err != nil {
 		mach.Log.Error("Error retrieving cross-singing signatures for master key of user %v from database: %v", userID, err)
-		return false
+		return id.TrustStateUnset
+	} else if !deviceSigExists {
+		return id.TrustStateUnset
 	}
-	return deviceSigExists
+
+	if mach.IsUserTrusted(userID) {
+		return id.TrustStateCrossSignedVerified
+	}
+	pinnedKey, err := mach.CryptoStore.GetPinnedMasterKey(userID)
+	if err != nil {
+		mach.Log.Error("Error retrieving pinned master key of user %v from database: %v", userID, err)
+		return id.TrustStateCrossSignedUntrusted
+	} else if pinnedKey == theirMSK {
+		return id.TrustStateCrossSignedTOFU
+	}
+	return id.TrustStateCrossSignedUntrusted
+}
+
+// IsDeviceTrusted returns whether a device has been determined to be trusted either through verification or cross-signing.
+func (mach *OlmMachine) IsDeviceTrusted(device *DeviceIdentity) bool {
+	trust := mach.ResolveTrust(device)
+	return trust == id.TrustStateVerified || trust == id.TrustStateCrossSignedVerified
 }
 
 // IsUserTrusted returns whether a user has been determined to be trusted by our user-signing key having signed their master key.
@@ -29,6 +29,37 @@ type megolmEvent struct {
 	Content event.Content `json:"content"`
 }
 
+// resolveSenderTrust determines how much the sender of a Megolm event can be trusted based on the sender device and
+// the provenance of the session. It also returns whether the session was forwarded or imported.
+func (mach *OlmMachine) resolveSenderTrust(evt *event.Event, content *event.EncryptedEventContent, sess *InboundGroupSession) (id.TrustState, bool, error) {
+	forwarded := sess.IsForwarded()
+	ownSigningKey, ownIdentityKey := mach.account.Keys()
+	if content.DeviceID == mach.ownDeviceID() && sess.SigningKey == ownSigningKey && content.SenderKey == ownIdentityKey && !forwarded {
+		return id.TrustStateVerified, false, nil
+	}
+	device, err := mach.GetOrFetchDevice(evt.Sender, content.DeviceID)
+	if err != nil {
+		// We don't want to throw these errors as the message can still be decrypted.
+		mach.Log.Debug("Failed to get device %s/%s to verify session %s: %v", evt.Sender, content.DeviceID, sess.ID(), err)
+		// TODO maybe store the info that the device is deleted?
+		return id.TrustStateUnknownDevice, forwarded, nil
+	}
+	if device.SigningKey != sess.SigningKey || device.IdentityKey != content.SenderKey {
+		// For some reason, matrix-nio had a comment saying not to events decrypted using a forwarded key as verified.
+		if !forwarded && mach.IsDeviceTrusted(device) {
+			return id.TrustStateUnset, false, DeviceKeyMismatch
+		}
+		return id.TrustStateUnknownDevice, forwarded, nil
+	}
+	trust := mach.ResolveTrust(device)
+	if trust == id.TrustStateBlacklisted {
+		return trust, forwarded, nil
+	} else if forwarded {
+		return id.TrustStateForwardedKeys, true, nil
+	}
+	return trust, false, nil
+}
+
 // DecryptMegolmEvent decrypts an m.room.encrypted event where the algorithm is m.megolm.v1.aes-sha2
 func (mach *OlmMachine) DecryptMegolmEvent(evt *event.Event) (*event.Event, error) {
 	content, ok := evt.Content.Parsed.(*event.EncryptedEventContent)
@@ -50,22 +81,9 @@ func (mach *OlmMachine) DecryptMegolmEvent(evt *event.Event) (*event.Event, erro
 		return nil, DuplicateMessageIndex
 	}
 
-	var verified bool
-	ownSigningKey, ownIdentityKey := mach.account.Keys()
-	if content.DeviceID == mach.Client.DeviceID && sess.SigningKey == ownSigningKey && content.SenderKey == ownIdentityKey {
-		verified = true
-	} else {
-		device, err := mach.GetOrFetchDevice(evt.Sender, content.DeviceID)
-		if err != nil {
-			// We don't want to throw these errors as the message can still be decrypted.
-			mach.Log.Debug("Failed to get device %s/%s to verify session %s: %v", evt.Sender, content.DeviceID, sess.ID(), err)
-			// TODO maybe store the info that the device is deleted?
-		} else if mach.IsDeviceTrusted(device) && len(sess.ForwardingChains) == 0 { // For some reason, matrix-nio had a comment saying not to events decrypted using a forwarded key as verified.
-			if device.SigningKey != sess.SigningKey || device.IdentityKey != content.SenderKey {
-				return nil, DeviceKeyMismatch
-			}
-			verified = true
-		}
+	trustLevel, forwarded, err := mach.resolveSenderTrust(evt, content, sess)
+	if err != nil {
+		return nil, err
 	}
 
 	megolmEvt := &megolmEvent{}
@@ -106,7 +124,9 @@ func (mach *OlmMachine) DecryptMegolmEvent(evt *event.Event) (*event.Event, erro
 		Content:   megolmEvt.Content,
 		Unsigned:  evt.Unsigned,
 		Mautrix: event.MautrixInfo{
-			Verified: verified,
+			Verified:      !forwarded && (trustLevel == id.TrustStateVerified || trustLevel == id.TrustStateCrossSignedVerified),
+			TrustState:    trustLevel,
+			ForwardedKeys: forwarded,
 		},
 	}, nil
 }
@@ -113,7 +113,7 @@ func (mach *OlmMachine) tryDecryptOlmCiphertext(sender id.UserID, senderKey id.S
 	if err != nil {
 		if err == DecryptionFailedWithMatchingSession {
 			mach.Log.Warn("Found matching session yet decryption failed for sender %s with key %s", sender, senderKey)
-			go mach.unwedgeDevice(sender, senderKey)
+			mach.handleOlmDecryptionFailure(sender, senderKey, err)
 		}
 		return nil, fmt.Errorf("failed to decrypt olm event: %w", err)
 	}
@@ -128,7 +128,7 @@ func (mach *OlmMachine) tryDecryptOlmCiphertext(sender id.UserID, senderKey id.S
 	// New sessions can only be created if it's a prekey message, we can't decrypt the message
 	// if it isn't one at this point in time anymore, so return early.
 	if olmType != id.OlmMsgTypePreKey {
-		go mach.unwedgeDevice(sender, senderKey)
+		mach.handleOlmDecryptionFailure(sender, senderKey, DecryptionFailedForNormalMessage)
 		return nil, DecryptionFailedForNormalMessage
 	}
 
@@ -137,7 +137,7 @@ func (mach *OlmMachine) tryDecryptOlmCiphertext(sender id.UserID, senderKey id.S
 	session, err := mach.createInboundSession(senderKey, ciphertext)
 	endTimeTrace()
 	if err != nil {
-		go mach.unwedgeDevice(sender, senderKey)
+		mach.handleOlmDecryptionFailure(sender, senderKey, err)
 		return nil, fmt.Errorf("failed to create new session from prekey message: %w", err)
 	}
 	mach.Log.Debug("Created inbound olm session %s for %s/%s: %s", session.ID(), sender, senderKey, session.Describe())
@@ -146,9 +146,10 @@ func (mach *OlmMachine) tryDecryptOlmCiphertext(sender id.UserID, senderKey id.S
 	plaintext, err = session.Decrypt(ciphertext, olmType)
 	endTimeTrace()
 	if err != nil {
-		go mach.unwedgeDevice(sender, senderKey)
+		mach.handleOlmDecryptionFailure(sender, senderKey, err)
 		return nil, fmt.Errorf("failed to decrypt olm event with session created from prekey message: %w", err)
 	}
+	mach.markOlmDecryptionSuccess(senderKey)
 
 	endTimeTrace = mach.timeTrace(fmt.Sprintf("updating new session %s/%s in database", senderKey, session.ID()), traceID, time.Second)
 	err = mach.CryptoStore.UpdateSession(senderKey, session)
@@ -184,9 +185,11 @@ func (mach *OlmMachine) tryDecryptOlmCiphertextWithExistingSession(senderKey id.
 		endTimeTrace()
 		if err != nil {
 			if olmType == id.OlmMsgTypePreKey {
+				mach.markOlmSessionFailed(senderKey, session.ID())
 				return nil, DecryptionFailedWithMatchingSession
 			}
 		} else {
+			mach.markOlmDecryptionSuccess(senderKey)
 			endTimeTrace = mach.timeTrace(fmt.Sprintf("updating session %s/%s in database", senderKey, session.ID()), traceID, time.Second)
 			err = mach.CryptoStore.UpdateSession(senderKey, session)
 			endTimeTrace()
@@ -212,36 +215,3 @@ func (mach *OlmMachine) createInboundSession(senderKey id.SenderKey, ciphertext
 	}
 	return session, nil
 }
-
-const MinUnwedgeInterval = 1 * time.Hour
-
-func (mach *OlmMachine) unwedgeDevice(sender id.UserID, senderKey id.SenderKey) {
-	mach.recentlyUnwedgedLock.Lock()
-	prevUnwedge, ok := mach.recentlyUnwedged[senderKey]
-	delta := time.Now().Sub(prevUnwedge)
-	if ok && delta < MinUnwedgeInterval {
-		mach.Log.Debug("Not creating new Olm session with %s/%s, previous recreation was %s ago", sender, senderKey, delta)
-		mach.recentlyUnwedgedLock.Unlock()
-		return
-	}
-	mach.recentlyUnwedged[senderKey] = time.Now()
-	mach.recentlyUnwedgedLock.Unlock()
-
-	deviceIdentity, err := mach.GetOrFetchDeviceByKey(sender, senderKey)
-	if err != nil {
-		mach.Log.Error("Failed to find device info by identity key: %v", err)
-		return
-	} else if deviceIdentity == nil {
-		mach.Log.Warn("Didn't find identity of %s/%s, can't unwedge session", sender, senderKey)
-		return
-	}
-
-	mach.Log.Debug("Creating new Olm session with %s/%s (key: %s)", sender, deviceIdentity.DeviceID, senderKey)
-	mach.devicesToUnwedgeLock.Lock()
-	mach.devicesToUnwedge[senderKey] = true
-	mach.devicesToUnwedgeLock.Unlock()
-	err = mach.SendEncryptedToDevice(deviceIdentity, event.ToDeviceDummy, event.Content{})
-	if err != nil {
-		mach.Log.Error("Failed to send dummy event to unwedge session with %s/%s: %v", sender, senderKey, err)
-	}
-}
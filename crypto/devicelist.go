@@ -70,6 +70,14 @@ func (mach *OlmMachine) fetchKeys(users []id.UserID, sinceToken string, includeU
 			if !ok {
 				// New device
 				changed = true
+				if existingDevices == nil {
+					// The user isn't tracked, but the identities are kept in the store after untracking.
+					// Use them so that the signing key is still checked and the trust state isn't lost.
+					existing, err = mach.CryptoStore.GetDevice(userID, deviceID)
+					if err != nil {
+						mach.Log.Warn("Failed to get stored device %s of %s: %v", deviceID, userID, err)
+					}
+				}
 			}
 			mach.Log.Trace("Validating device %s of %s", deviceID, userID)
 			newDevice, err := mach.validateDevice(userID, deviceID, deviceKeys, existing)
@@ -116,6 +124,9 @@ func (mach *OlmMachine) fetchKeys(users []id.UserID, sinceToken string, includeU
 		changed = changed || len(newDevices) != len(existingDevices)
 		if changed {
 			mach.OnDevicesChanged(userID)
+			if userID == mach.Client.UserID {
+				mach.resendKeyRequestsToNewDevices()
+			}
 		}
 	}
 	for userID := range req.DeviceKeys {
@@ -174,13 +185,145 @@ func (mach *OlmMachine) validateDevice(userID id.UserID, deviceID id.DeviceID, d
 		name = string(deviceID)
 	}
 
+	trust := TrustStateUnset
+	if existing != nil {
+		// The signing key hasn't changed, so the trust in the device still applies
+		trust = existing.Trust
+	}
+
 	return &DeviceIdentity{
 		UserID:      userID,
 		DeviceID:    deviceID,
 		IdentityKey: identityKey,
 		SigningKey:  signingKey,
-		Trust:       TrustStateUnset,
+		Trust:       trust,
 		Name:        name,
 		Deleted:     false,
 	}, nil
 }
+
+func (mach *OlmMachine) markUsersOutdated(users []id.UserID) {
+	err := mach.CryptoStore.MarkTrackedUsersOutdated(users)
+	if err != nil {
+		mach.Log.Warn("Failed to mark device lists of %v as outdated: %v", users, err)
+	}
+}
+
+func (mach *OlmMachine) untrackUsersWithoutSharedRooms(users []id.UserID) {
+	untrack := make([]id.UserID, 0, len(users))
+	for _, userID := range users {
+		if userID != mach.Client.UserID && len(mach.StateStore.FindSharedRooms(userID)) == 0 {
+			untrack = append(untrack, userID)
+		}
+	}
+	if len(untrack) == 0 {
+		return
+	}
+	mach.Log.Debug("Untracking device lists of %v: no shared encrypted rooms", untrack)
+	err := mach.CryptoStore.UntrackUsers(untrack)
+	if err != nil {
+		mach.Log.Warn("Failed to untrack device lists of %v: %v", untrack, err)
+	}
+}
+
+// CatchUpDeviceListChanges asks the server which users' device lists changed between the two sync tokens
+// and marks them as outdated. This should be used when there's a gap in the sync stream, e.g. when the client
+// was offline and started syncing from scratch instead of the stored sync token.
+//
+// The outdated device lists are fetched lazily, either by RefreshOutdatedDeviceLists or before sharing a group session.
+func (mach *OlmMachine) CatchUpDeviceListChanges(from, to string) error {
+	resp, err := mach.Client.GetKeyChanges(from, to)
+	if err != nil {
+		return fmt.Errorf("failed to get key changes: %w", err)
+	}
+	mach.Log.Debug("Key changes between %s and %s: %d changed, %d left", from, to, len(resp.Changed), len(resp.Left))
+	err = mach.CryptoStore.MarkTrackedUsersOutdated(append(resp.Changed, resp.Left...))
+	if err != nil {
+		return fmt.Errorf("failed to mark users as outdated: %w", err)
+	}
+	mach.untrackUsersWithoutSharedRooms(resp.Left)
+	return nil
+}
+
+// SetDeviceListSyncToken sets the sync token up to which device list changes have been handled, e.g. the stored
+// sync token when starting up. If the next sync response passed to ProcessSyncResponse doesn't continue from this
+// token, the changes in between are caught up with CatchUpDeviceListChanges.
+func (mach *OlmMachine) SetDeviceListSyncToken(token string) {
+	mach.deviceListSyncTokenLock.Lock()
+	mach.deviceListSyncToken = token
+	mach.deviceListSyncTokenLock.Unlock()
+}
+
+// catchUpSyncGap catches up with device list changes if the sync response starting at since doesn't continue
+// from the previously handled one, and then remembers nextBatch as the handled token.
+func (mach *OlmMachine) catchUpSyncGap(since, nextBatch string) {
+	mach.deviceListSyncTokenLock.Lock()
+	prev := mach.deviceListSyncToken
+	mach.deviceListSyncToken = nextBatch
+	mach.deviceListSyncTokenLock.Unlock()
+	if prev == "" || prev == since {
+		return
+	}
+	// An initial sync doesn't include device list changes at all, so everything since the previous token is missing
+	to := since
+	if to == "" {
+		to = nextBatch
+	}
+	mach.Log.Debug("Sync response starts at %q rather than %q, catching up with device list changes", since, prev)
+	err := mach.CatchUpDeviceListChanges(prev, to)
+	if err != nil {
+		mach.Log.Warn("Failed to catch up with device list changes: %v", err)
+		// Without knowing who changed, refresh everyone before the next group session is shared
+		mach.markAllTrackedUsersOutdated()
+	}
+}
+
+func (mach *OlmMachine) markAllTrackedUsersOutdated() {
+	store, ok := mach.CryptoStore.(MigratableStore)
+	if !ok {
+		return
+	}
+	users, err := store.GetAllTrackedUsers()
+	if err != nil {
+		mach.Log.Warn("Failed to get tracked users: %v", err)
+		return
+	}
+	mach.markUsersOutdated(users)
+}
+
+// RefreshOutdatedDeviceLists fetches the device lists of all tracked users that have been marked as outdated.
+func (mach *OlmMachine) RefreshOutdatedDeviceLists() error {
+	outdated, err := mach.CryptoStore.GetOutdatedTrackedUsers()
+	if err != nil {
+		return fmt.Errorf("failed to get outdated users: %w", err)
+	} else if len(outdated) > 0 {
+		mach.Log.Debug("Refreshing outdated device lists of %v", outdated)
+		mach.fetchKeys(outdated, "", false)
+	}
+	return nil
+}
+
+// refreshOutdatedUsers fetches the device lists of the given users that have been marked as outdated in a single query.
+func (mach *OlmMachine) refreshOutdatedUsers(users []id.UserID) {
+	outdated, err := mach.CryptoStore.GetOutdatedTrackedUsers()
+	if err != nil {
+		mach.Log.Warn("Failed to get outdated users: %v", err)
+		return
+	} else if len(outdated) == 0 {
+		return
+	}
+	outdatedMap := make(map[id.UserID]struct{}, len(outdated))
+	for _, userID := range outdated {
+		outdatedMap[userID] = struct{}{}
+	}
+	var refresh []id.UserID
+	for _, userID := range users {
+		if _, ok := outdatedMap[userID]; ok {
+			refresh = append(refresh, userID)
+		}
+	}
+	if len(refresh) > 0 {
+		mach.Log.Trace("Refreshing outdated device lists of %v", refresh)
+		mach.fetchKeys(refresh, "", false)
+	}
+}
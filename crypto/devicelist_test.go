@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestOlmMachine_TrustSurvivesUntrack(t *testing.T) {
+	machineIn, storeFileNameIn := newMachine(t, "user2")
+	defer os.Remove(storeFileNameIn)
+	httpServer := httptest.NewServer(&fakeKeyServer{t: t, machineIn: machineIn})
+	defer httpServer.Close()
+
+	stores, cleanup := getCryptoStores(t)
+	defer cleanup()
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			client, err := mautrix.NewClient(httpServer.URL, "user1", "token")
+			if err != nil {
+				t.Fatalf("Error creating client: %v", err)
+			}
+			client.DeviceID = "dev"
+			mach := NewOlmMachine(client, emptyLogger{}, store, mockStateStore{})
+			if err = mach.Load(); err != nil {
+				t.Fatalf("Error loading machine: %v", err)
+			}
+
+			device := mach.LoadDevices("user2")["device1"]
+			if device == nil {
+				t.Fatal("Expected device1 of user2 to be fetched")
+			}
+			device.Trust = TrustStateVerified
+			if err = store.PutDevice("user2", device); err != nil {
+				t.Fatalf("Error storing device: %v", err)
+			}
+			if device = mach.LoadDevices("user2")["device1"]; device == nil || device.Trust != TrustStateVerified {
+				t.Fatalf("Expected trust to survive re-fetching the device list, got %+v", device)
+			}
+
+			if err = store.UntrackUsers([]id.UserID{"user2"}); err != nil {
+				t.Fatalf("Error untracking user: %v", err)
+			}
+			if device = mach.LoadDevices("user2")["device1"]; device == nil || device.Trust != TrustStateVerified {
+				t.Errorf("Expected trust to survive untracking and re-fetching, got %+v", device)
+			}
+			if device, err = store.GetDevice("user2", "device1"); err != nil || device == nil || device.Trust != TrustStateVerified {
+				t.Errorf("Expected stored device to be verified after re-tracking, got %+v (error: %v)", device, err)
+			}
+			if filtered := store.FilterTrackedUsers([]id.UserID{"user2"}); len(filtered) != 1 {
+				t.Errorf("Expected user2 to be tracked again, got %v", filtered)
+			}
+		})
+	}
+}
+
+func TestOlmMachine_ProcessSyncResponseCatchesUpGap(t *testing.T) {
+	mach, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	if err := mach.CryptoStore.PutDevices("user2", map[id.DeviceID]*DeviceIdentity{}); err != nil {
+		t.Fatalf("Error storing devices: %v", err)
+	}
+
+	var changesFrom, changesTo string
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/keys/changes") {
+			// Don't answer key queries, so that user2 stays outdated
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNRECOGNIZED"}`))
+			return
+		}
+		changesFrom, changesTo = r.URL.Query().Get("from"), r.URL.Query().Get("to")
+		_ = json.NewEncoder(w).Encode(&mautrix.RespKeyChanges{Changed: []id.UserID{"user2"}})
+	}))
+	defer httpServer.Close()
+	mach.Client.HomeserverURL, _ = url.Parse(httpServer.URL)
+
+	mach.SetDeviceListSyncToken("s1")
+	mach.ProcessSyncResponse(&mautrix.RespSync{NextBatch: "s2"}, "s1")
+	if changesFrom != "" {
+		t.Errorf("Expected no catch-up for a continuous sync, got request from %s", changesFrom)
+	}
+	mach.ProcessSyncResponse(&mautrix.RespSync{NextBatch: "s5"}, "")
+	if changesFrom != "s2" || changesTo != "s5" {
+		t.Errorf("Expected catch-up from s2 to s5, got %s to %s", changesFrom, changesTo)
+	}
+	if outdated, err := mach.CryptoStore.GetOutdatedTrackedUsers(); err != nil || len(outdated) != 1 || outdated[0] != "user2" {
+		t.Errorf("Expected user2 to be outdated after catching up, got %v (error: %v)", outdated, err)
+	}
+}
@@ -0,0 +1,383 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// CryptoDiagnosticsOptions limits what is included in GetCryptoDiagnostics.
+type CryptoDiagnosticsOptions struct {
+	// Users limits the listed users (and their devices and Olm sessions) to the given users.
+	// If empty, all users whose device lists are tracked are included.
+	Users []id.UserID
+	// Rooms limits the listed group sessions to the given rooms. If empty, the sessions of all rooms are included.
+	Rooms []id.RoomID
+	// SkipGroupSessions disables listing inbound and outbound group sessions, which can be slow with large stores.
+	SkipGroupSessions bool
+}
+
+// CryptoDiagnostics is a snapshot of the state of an OlmMachine and its crypto store, meant for debugging
+// decryption problems. All the fields can be serialized to JSON.
+type CryptoDiagnostics struct {
+	GeneratedAt time.Time `json:"generated_at"`
+
+	OwnDevice             OwnDeviceDiagnostics              `json:"own_device"`
+	Users                 []UserDiagnostics                 `json:"users"`
+	InboundGroupSessions  []InboundGroupSessionDiagnostics  `json:"inbound_group_sessions,omitempty"`
+	OutboundGroupSessions []OutboundGroupSessionDiagnostics `json:"outbound_group_sessions,omitempty"`
+	KeyRequests           []KeyRequestDiagnostics           `json:"key_requests"`
+
+	// Errors contains the errors that occurred while collecting the diagnostics.
+	// The parts that failed are left out, but everything else is still included.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// OwnDeviceDiagnostics contains information about our own device and Olm account.
+type OwnDeviceDiagnostics struct {
+	UserID      id.UserID      `json:"user_id"`
+	DeviceID    id.DeviceID    `json:"device_id"`
+	IdentityKey id.IdentityKey `json:"identity_key"`
+	SigningKey  id.SigningKey  `json:"signing_key"`
+	Fingerprint string         `json:"fingerprint"`
+	Shared      bool           `json:"shared"`
+
+	// ServerOTKCount is the number of signed curve25519 one-time keys on the server from the last sync,
+	// or nil if no count has been received since the machine was started.
+	ServerOTKCount       *int      `json:"server_otk_count,omitempty"`
+	ServerOTKCountTime   time.Time `json:"server_otk_count_time,omitempty"`
+	UnpublishedOTKCount  int       `json:"unpublished_otk_count"`
+	MaxOTKCount          int       `json:"max_otk_count"`
+	FallbackKeyRotatedAt time.Time `json:"fallback_key_rotated_at,omitempty"`
+
+	CrossSigningMasterKey id.Ed25519 `json:"cross_signing_master_key,omitempty"`
+}
+
+// UserDiagnostics contains information about a user whose devices are tracked.
+type UserDiagnostics struct {
+	UserID id.UserID `json:"user_id"`
+	// Outdated is true if the device list of the user has been marked as outdated and will be re-fetched.
+	Outdated bool `json:"outdated"`
+
+	MasterKey       id.Ed25519 `json:"master_key,omitempty"`
+	PinnedMasterKey id.Ed25519 `json:"pinned_master_key,omitempty"`
+	IdentityState   string     `json:"identity_state"`
+
+	Devices []DeviceDiagnostics `json:"devices"`
+}
+
+// DeviceDiagnostics contains information about a device of another user, or another device of our own user.
+type DeviceDiagnostics struct {
+	DeviceID    id.DeviceID    `json:"device_id"`
+	Name        string         `json:"name,omitempty"`
+	IdentityKey id.IdentityKey `json:"identity_key"`
+	SigningKey  id.SigningKey  `json:"signing_key"`
+	Deleted     bool           `json:"deleted,omitempty"`
+	// Trust is the trust state stored for the device, while ResolvedTrust also takes cross-signing into account.
+	Trust         string `json:"trust"`
+	ResolvedTrust string `json:"resolved_trust"`
+
+	Olm *OlmDeviceDiagnostics `json:"olm,omitempty"`
+}
+
+// InboundGroupSessionDiagnostics contains information about an inbound Megolm session.
+type InboundGroupSessionDiagnostics struct {
+	RoomID     id.RoomID     `json:"room_id"`
+	SessionID  id.SessionID  `json:"session_id"`
+	SenderKey  id.SenderKey  `json:"sender_key"`
+	SigningKey id.SigningKey `json:"signing_key"`
+
+	FirstKnownIndex uint32 `json:"first_known_index"`
+	// LatestIndex is the highest message index that has been decrypted with the session, or -1 if none are known.
+	LatestIndex int64 `json:"latest_index"`
+
+	KeySource       KeySource `json:"key_source"`
+	Forwarded       bool      `json:"forwarded"`
+	ForwardingChain []string  `json:"forwarding_chain,omitempty"`
+	SharedHistory   bool      `json:"shared_history"`
+
+	ReceivedAt  time.Time `json:"received_at,omitempty"`
+	MaxAge      int64     `json:"max_age_ms,omitempty"`
+	MaxMessages int       `json:"max_messages,omitempty"`
+	Expired     bool      `json:"expired"`
+}
+
+// OutboundGroupSessionDiagnostics contains information about an outbound Megolm session.
+type OutboundGroupSessionDiagnostics struct {
+	RoomID    id.RoomID    `json:"room_id"`
+	SessionID id.SessionID `json:"session_id"`
+
+	CreatedAt    time.Time `json:"created_at"`
+	LastUsed     time.Time `json:"last_used"`
+	MessageCount int       `json:"message_count"`
+	MaxMessages  int       `json:"max_messages"`
+	MaxAge       int64     `json:"max_age_ms"`
+	Expired      bool      `json:"expired"`
+
+	Shared        bool `json:"shared"`
+	SharedHistory bool `json:"shared_history"`
+	// Devices contains the sharing state of the session for each device, grouped by user ID.
+	Devices map[id.UserID]map[id.DeviceID]string `json:"devices,omitempty"`
+}
+
+// KeyRequestDiagnostics contains information about a pending outgoing room key request.
+type KeyRequestDiagnostics struct {
+	RequestID  string                      `json:"request_id"`
+	RoomID     id.RoomID                   `json:"room_id"`
+	SenderKey  id.SenderKey                `json:"sender_key"`
+	SessionID  id.SessionID                `json:"session_id"`
+	Targets    map[id.UserID][]id.DeviceID `json:"targets"`
+	OwnDevices bool                        `json:"own_devices"`
+	CreatedAt  time.Time                   `json:"created_at"`
+}
+
+func (diag *CryptoDiagnostics) addError(format string, args ...interface{}) {
+	diag.Errors = append(diag.Errors, fmt.Sprintf(format, args...))
+}
+
+func containsRoom(rooms []id.RoomID, roomID id.RoomID) bool {
+	for _, room := range rooms {
+		if room == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCryptoDiagnostics collects information about our own device, the tracked users and their devices,
+// the Olm and Megolm sessions and pending key requests.
+//
+// Listing all tracked users and all outbound group sessions requires the crypto store to implement MigratableStore
+// (which both built-in stores do). Errors don't stop the collection, they're returned in the Errors field instead.
+func (mach *OlmMachine) GetCryptoDiagnostics(opts CryptoDiagnosticsOptions) *CryptoDiagnostics {
+	diag := &CryptoDiagnostics{GeneratedAt: time.Now()}
+	mach.fillOwnDeviceDiagnostics(diag)
+
+	// Copy the list so that sorting doesn't modify the caller's slice
+	users := append([]id.UserID{}, opts.Users...)
+	if len(users) == 0 {
+		if listStore, ok := mach.CryptoStore.(MigratableStore); ok {
+			var err error
+			users, err = listStore.GetAllTrackedUsers()
+			if err != nil {
+				diag.addError("failed to get tracked users: %v", err)
+			}
+		} else {
+			diag.addError("crypto store doesn't support listing tracked users")
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i] < users[j]
+	})
+	outdated := make(map[id.UserID]bool)
+	if outdatedList, err := mach.CryptoStore.GetOutdatedTrackedUsers(); err != nil {
+		diag.addError("failed to get outdated users: %v", err)
+	} else {
+		for _, userID := range outdatedList {
+			outdated[userID] = true
+		}
+	}
+	diag.Users = make([]UserDiagnostics, 0, len(users))
+	for _, userID := range users {
+		diag.Users = append(diag.Users, mach.getUserDiagnostics(diag, userID, outdated[userID]))
+	}
+
+	if !opts.SkipGroupSessions {
+		mach.fillInboundGroupSessionDiagnostics(diag, opts.Rooms)
+		mach.fillOutboundGroupSessionDiagnostics(diag, opts.Rooms)
+	}
+
+	reqs, err := mach.CryptoStore.GetOutgoingKeyRequests()
+	if err != nil {
+		diag.addError("failed to get outgoing key requests: %v", err)
+	}
+	diag.KeyRequests = make([]KeyRequestDiagnostics, 0, len(reqs))
+	for _, req := range reqs {
+		if len(opts.Rooms) > 0 && !containsRoom(opts.Rooms, req.RoomID) {
+			continue
+		}
+		diag.KeyRequests = append(diag.KeyRequests, KeyRequestDiagnostics{
+			RequestID:  req.RequestID,
+			RoomID:     req.RoomID,
+			SenderKey:  req.SenderKey,
+			SessionID:  req.SessionID,
+			Targets:    req.Targets,
+			OwnDevices: req.OwnDevices,
+			CreatedAt:  req.CreatedAt,
+		})
+	}
+	return diag
+}
+
+func (mach *OlmMachine) fillOwnDeviceDiagnostics(diag *CryptoDiagnostics) {
+	own := &diag.OwnDevice
+	own.UserID = mach.Client.UserID
+	own.DeviceID = mach.ownDeviceID()
+	mach.otkUploadLock.Lock()
+	if mach.account != nil {
+		own.SigningKey, own.IdentityKey = mach.account.Keys()
+		own.Fingerprint = Fingerprint(own.SigningKey)
+		own.Shared = mach.account.Shared
+		own.UnpublishedOTKCount = len(mach.account.Internal.OneTimeKeys())
+		own.MaxOTKCount = int(mach.account.Internal.MaxNumberOfOneTimeKeys())
+		own.FallbackKeyRotatedAt = mach.account.FallbackKeyRotatedAt
+	} else {
+		diag.addError("olm account is not loaded")
+	}
+	mach.otkUploadLock.Unlock()
+	mach.lastOTKCountLock.Lock()
+	if mach.lastOTKCount != nil {
+		count := mach.lastOTKCount.SignedCurve25519
+		own.ServerOTKCount = &count
+		own.ServerOTKCountTime = mach.lastOTKCountTime
+	}
+	mach.lastOTKCountLock.Unlock()
+	if keys := mach.GetOwnCrossSigningPublicKeys(); keys != nil {
+		own.CrossSigningMasterKey = keys.MasterKey
+	}
+}
+
+func (mach *OlmMachine) getUserDiagnostics(diag *CryptoDiagnostics, userID id.UserID, outdated bool) UserDiagnostics {
+	user := UserDiagnostics{UserID: userID, Outdated: outdated}
+	if identity, err := mach.GetUserIdentity(userID); err != nil {
+		diag.addError("failed to get identity of %s: %v", userID, err)
+	} else {
+		user.MasterKey = identity.CurrentKey
+		user.PinnedMasterKey = identity.PinnedKey
+		user.IdentityState = identity.State.String()
+	}
+	devices, err := mach.CryptoStore.GetDevices(userID)
+	if err != nil {
+		diag.addError("failed to get devices of %s: %v", userID, err)
+	}
+	user.Devices = make([]DeviceDiagnostics, 0, len(devices))
+	for _, device := range devices {
+		if userID == mach.Client.UserID && device.DeviceID == mach.ownDeviceID() {
+			continue
+		}
+		deviceDiag := DeviceDiagnostics{
+			DeviceID:      device.DeviceID,
+			Name:          device.Name,
+			IdentityKey:   device.IdentityKey,
+			SigningKey:    device.SigningKey,
+			Deleted:       device.Deleted,
+			Trust:         device.Trust.String(),
+			ResolvedTrust: mach.ResolveTrust(device).String(),
+		}
+		if deviceDiag.Olm, err = mach.GetOlmDeviceDiagnostics(device); err != nil {
+			diag.addError("failed to get olm sessions with %s/%s: %v", userID, device.DeviceID, err)
+		}
+		user.Devices = append(user.Devices, deviceDiag)
+	}
+	sort.Slice(user.Devices, func(i, j int) bool {
+		return user.Devices[i].DeviceID < user.Devices[j].DeviceID
+	})
+	return user
+}
+
+func (mach *OlmMachine) fillInboundGroupSessionDiagnostics(diag *CryptoDiagnostics, rooms []id.RoomID) {
+	var sessions []*InboundGroupSession
+	if len(rooms) > 0 {
+		for _, roomID := range rooms {
+			roomSessions, err := mach.CryptoStore.GetGroupSessionsForRoom(roomID)
+			if err != nil {
+				diag.addError("failed to get inbound group sessions in %s: %v", roomID, err)
+			}
+			sessions = append(sessions, roomSessions...)
+		}
+	} else {
+		var err error
+		sessions, err = mach.CryptoStore.GetAllGroupSessions()
+		if err != nil {
+			diag.addError("failed to get inbound group sessions: %v", err)
+		}
+	}
+	diag.InboundGroupSessions = make([]InboundGroupSessionDiagnostics, len(sessions))
+	for i, igs := range sessions {
+		sessDiag := InboundGroupSessionDiagnostics{
+			RoomID:          igs.RoomID,
+			SessionID:       igs.ID(),
+			SenderKey:       igs.SenderKey,
+			SigningKey:      igs.SigningKey,
+			FirstKnownIndex: igs.Internal.FirstKnownIndex(),
+			LatestIndex:     -1,
+			KeySource:       igs.KeySource,
+			Forwarded:       igs.IsForwarded(),
+			SharedHistory:   igs.SharedHistory,
+			ReceivedAt:      igs.ReceivedAt,
+			MaxAge:          igs.MaxAge.Milliseconds(),
+			MaxMessages:     igs.MaxMessages,
+		}
+		if sessDiag.Forwarded {
+			sessDiag.ForwardingChain = igs.ForwardingChains
+		}
+		if index, ok, err := mach.CryptoStore.GetLatestMessageIndex(igs.SenderKey, igs.ID()); err != nil {
+			diag.addError("failed to get latest message index of %s: %v", igs.ID(), err)
+		} else if ok {
+			sessDiag.LatestIndex = int64(index)
+		}
+		sessDiag.Expired = igs.IsExpired(sessDiag.LatestIndex, 0)
+		diag.InboundGroupSessions[i] = sessDiag
+	}
+	sort.SliceStable(diag.InboundGroupSessions, func(i, j int) bool {
+		return diag.InboundGroupSessions[i].RoomID < diag.InboundGroupSessions[j].RoomID
+	})
+}
+
+func (mach *OlmMachine) fillOutboundGroupSessionDiagnostics(diag *CryptoDiagnostics, rooms []id.RoomID) {
+	var sessions []*OutboundGroupSession
+	if len(rooms) > 0 {
+		for _, roomID := range rooms {
+			session, err := mach.CryptoStore.GetOutboundGroupSession(roomID)
+			if err != nil {
+				diag.addError("failed to get outbound group session in %s: %v", roomID, err)
+			} else if session != nil {
+				sessions = append(sessions, session)
+			}
+		}
+	} else if listStore, ok := mach.CryptoStore.(MigratableStore); ok {
+		var err error
+		sessions, err = listStore.GetAllOutboundGroupSessions()
+		if err != nil {
+			diag.addError("failed to get outbound group sessions: %v", err)
+		}
+	} else {
+		diag.addError("crypto store doesn't support listing outbound group sessions")
+	}
+	diag.OutboundGroupSessions = make([]OutboundGroupSessionDiagnostics, len(sessions))
+	for i, ogs := range sessions {
+		sessDiag := OutboundGroupSessionDiagnostics{
+			RoomID:        ogs.RoomID,
+			SessionID:     ogs.ID(),
+			CreatedAt:     ogs.CreationTime,
+			LastUsed:      ogs.LastEncryptedTime,
+			MessageCount:  ogs.MessageCount,
+			MaxMessages:   ogs.MaxMessages,
+			MaxAge:        ogs.MaxAge.Milliseconds(),
+			Expired:       ogs.Expired(),
+			Shared:        ogs.Shared,
+			SharedHistory: ogs.SharedHistory,
+		}
+		if userStates := ogs.UserStates(); len(userStates) > 0 {
+			sessDiag.Devices = make(map[id.UserID]map[id.DeviceID]string)
+			for userDevice, state := range userStates {
+				if sessDiag.Devices[userDevice.UserID] == nil {
+					sessDiag.Devices[userDevice.UserID] = make(map[id.DeviceID]string)
+				}
+				sessDiag.Devices[userDevice.UserID][userDevice.DeviceID] = state.String()
+			}
+		}
+		diag.OutboundGroupSessions[i] = sessDiag
+	}
+	sort.Slice(diag.OutboundGroupSessions, func(i, j int) bool {
+		return diag.OutboundGroupSessions[i].RoomID < diag.OutboundGroupSessions[j].RoomID
+	})
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestOlmMachine_GetCryptoDiagnostics(t *testing.T) {
+	stores, cleanup := getCryptoStores(t)
+	defer cleanup()
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			client, err := mautrix.NewClient("http://localhost", "user1", "token")
+			if err != nil {
+				t.Fatalf("Error creating client: %v", err)
+			}
+			client.DeviceID = "dev"
+			mach := NewOlmMachine(client, emptyLogger{}, store, mockStateStore{})
+			if err = mach.Load(); err != nil {
+				t.Fatalf("Error loading machine: %v", err)
+			}
+
+			otherAccount := NewOlmAccount()
+			err = store.PutDevices("user2", map[id.DeviceID]*DeviceIdentity{
+				"dev2": {
+					UserID:      "user2",
+					DeviceID:    "dev2",
+					IdentityKey: otherAccount.IdentityKey(),
+					SigningKey:  otherAccount.SigningKey(),
+					Trust:       TrustStateVerified,
+				},
+			})
+			if err != nil {
+				t.Fatalf("Error storing devices: %v", err)
+			}
+			session := NewOutboundGroupSession("room1", nil)
+			session.setUserState(UserDevice{UserID: "user2", DeviceID: "dev2"}, OGSAlreadyShared)
+			session.Shared = true
+			if err = store.AddOutboundGroupSession(session); err != nil {
+				t.Fatalf("Error storing outbound session: %v", err)
+			}
+			if storeName == "sql" {
+				// Make sure the sharing state comes from the database rather than the stored pointer
+				session, err = store.GetOutboundGroupSession("room1")
+				if err != nil || session == nil {
+					t.Fatalf("Error loading outbound session: %v", err)
+				}
+			}
+
+			// Sharing the session with more devices while collecting diagnostics must not race with reading the states
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					session.setUserState(UserDevice{UserID: "user3", DeviceID: id.DeviceID(rune('a' + i%26))}, OGSIgnored)
+				}
+			}()
+			diag := mach.GetCryptoDiagnostics(CryptoDiagnosticsOptions{})
+			wg.Wait()
+
+			if diag.OwnDevice.DeviceID != "dev" || diag.OwnDevice.IdentityKey != mach.account.IdentityKey() {
+				t.Errorf("Unexpected own device diagnostics: %+v", diag.OwnDevice)
+			}
+			if len(diag.Users) != 1 || diag.Users[0].UserID != "user2" || len(diag.Users[0].Devices) != 1 {
+				t.Fatalf("Expected diagnostics for user2's device, got %+v", diag.Users)
+			} else if dev := diag.Users[0].Devices[0]; dev.DeviceID != "dev2" || dev.Trust != "verified" {
+				t.Errorf("Unexpected device diagnostics: %+v", dev)
+			}
+			if len(diag.OutboundGroupSessions) != 1 {
+				t.Fatalf("Expected 1 outbound group session, got %d", len(diag.OutboundGroupSessions))
+			} else if ogs := diag.OutboundGroupSessions[0]; ogs.RoomID != "room1" || !ogs.Shared || ogs.Devices["user2"]["dev2"] != "shared" {
+				t.Errorf("Unexpected outbound group session diagnostics: %+v", ogs)
+			}
+			if _, err = json.Marshal(diag); err != nil {
+				t.Errorf("Failed to serialize diagnostics: %v", err)
+			}
+		})
+	}
+}
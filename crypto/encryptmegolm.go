@@ -75,7 +75,7 @@ func (mach *OlmMachine) EncryptMegolmEvent(roomID id.RoomID, evtType event.Type,
 	return &event.EncryptedEventContent{
 		Algorithm:        id.AlgorithmMegolmV1,
 		SenderKey:        mach.account.IdentityKey(),
-		DeviceID:         mach.Client.DeviceID,
+		DeviceID:         mach.ownDeviceID(),
 		SessionID:        session.ID(),
 		MegolmCiphertext: ciphertext,
 		RelatesTo:        getRelatesTo(content),
@@ -84,8 +84,9 @@ func (mach *OlmMachine) EncryptMegolmEvent(roomID id.RoomID, evtType event.Type,
 
 func (mach *OlmMachine) newOutboundGroupSession(roomID id.RoomID) *OutboundGroupSession {
 	session := NewOutboundGroupSession(roomID, mach.StateStore.GetEncryptionEvent(roomID))
+	session.SharedHistory = mach.isHistoryShared(roomID)
 	signingKey, idKey := mach.account.Keys()
-	mach.createGroupSession(idKey, signingKey, roomID, session.ID(), session.Internal.Key(), "create")
+	mach.createGroupSession(idKey, signingKey, roomID, session.ID(), session.Internal.Key(), session.SharedHistory, session.MaxAge, session.MaxMessages, "create")
 	return session
 }
 
@@ -97,9 +98,14 @@ type deviceSessionWrapper struct {
 // ShareGroupSession shares a group session for a specific room with all the devices of the given user list.
 //
 // For devices with TrustStateBlacklisted, a m.room_key.withheld event with code=m.blacklisted is sent.
-// If AllowUnverifiedDevices is false, a similar event with code=m.unverified is sent to devices with TrustStateUnset
+// If AllowUnverifiedDevices is false, a similar event with code=m.unverified is sent to devices with TrustStateUnset.
+// If AllowChangedIdentities is false, the same is done for users whose identity has changed (see IsIdentityChanged).
+//
+// Device lists of the given users that have been marked as outdated are re-fetched before sharing.
 func (mach *OlmMachine) ShareGroupSession(roomID id.RoomID, users []id.UserID) error {
 	mach.Log.Debug("Sharing group session for room %s to %v", roomID, users)
+	// Refresh outdated device lists first, so that any changes invalidate the current session before it's loaded.
+	mach.refreshOutdatedUsers(users)
 	session, err := mach.CryptoStore.GetOutboundGroupSession(roomID)
 	if err != nil {
 		return fmt.Errorf("failed to get previous outbound group session: %w", err)
@@ -233,12 +239,13 @@ func (mach *OlmMachine) encryptAndSendGroupSession(session *OutboundGroupSession
 }
 
 func (mach *OlmMachine) findOlmSessionsForUser(session *OutboundGroupSession, userID id.UserID, devices map[id.DeviceID]*DeviceIdentity, output map[id.DeviceID]deviceSessionWrapper, withheld map[id.DeviceID]*event.Content, missingOutput map[id.DeviceID]*DeviceIdentity) {
+	identityChanged := !mach.AllowChangedIdentities && userID != mach.Client.UserID && mach.IsIdentityChanged(userID)
 	for deviceID, device := range devices {
 		userKey := UserDevice{UserID: userID, DeviceID: deviceID}
-		if state := session.Users[userKey]; state != OGSNotShared {
+		if state := session.getUserState(userKey); state != OGSNotShared {
 			continue
-		} else if userID == mach.Client.UserID && deviceID == mach.Client.DeviceID {
-			session.Users[userKey] = OGSIgnored
+		} else if userID == mach.Client.UserID && deviceID == mach.ownDeviceID() {
+			session.setUserState(userKey, OGSIgnored)
 		} else if device.Trust == TrustStateBlacklisted {
 			mach.Log.Debug("Not encrypting group session %s for %s of %s: device is blacklisted", session.ID(), deviceID, userID)
 			withheld[deviceID] = &event.Content{Parsed: &event.RoomKeyWithheldEventContent{
@@ -249,7 +256,7 @@ func (mach *OlmMachine) findOlmSessionsForUser(session *OutboundGroupSession, us
 				Code:      event.RoomKeyWithheldBlacklisted,
 				Reason:    "Device is blacklisted",
 			}}
-			session.Users[userKey] = OGSIgnored
+			session.setUserState(userKey, OGSIgnored)
 		} else if !mach.AllowUnverifiedDevices && !mach.IsDeviceTrusted(device) {
 			mach.Log.Debug("Not encrypting group session %s for %s of %s: device is not verified", session.ID(), deviceID, userID)
 			withheld[deviceID] = &event.Content{Parsed: &event.RoomKeyWithheldEventContent{
@@ -260,7 +267,18 @@ func (mach *OlmMachine) findOlmSessionsForUser(session *OutboundGroupSession, us
 				Code:      event.RoomKeyWithheldUnverified,
 				Reason:    "This device does not encrypt messages for unverified devices",
 			}}
-			session.Users[userKey] = OGSIgnored
+			session.setUserState(userKey, OGSIgnored)
+		} else if identityChanged {
+			mach.Log.Debug("Not encrypting group session %s for %s of %s: user's identity has changed", session.ID(), deviceID, userID)
+			withheld[deviceID] = &event.Content{Parsed: &event.RoomKeyWithheldEventContent{
+				RoomID:    session.RoomID,
+				Algorithm: id.AlgorithmMegolmV1,
+				SessionID: session.ID(),
+				SenderKey: mach.account.IdentityKey(),
+				Code:      event.RoomKeyWithheldUnverified,
+				Reason:    "The user's cross-signing identity has changed and hasn't been accepted by this device",
+			}}
+			session.setUserState(userKey, OGSIgnored)
 		} else if deviceSession, err := mach.CryptoStore.GetLatestSession(device.IdentityKey); err != nil {
 			mach.Log.Error("Failed to get session for %s of %s: %v", deviceID, userID, err)
 		} else if deviceSession == nil {
@@ -273,7 +291,7 @@ func (mach *OlmMachine) findOlmSessionsForUser(session *OutboundGroupSession, us
 				session:  deviceSession,
 				identity: device,
 			}
-			session.Users[userKey] = OGSAlreadyShared
+			session.setUserState(userKey, OGSAlreadyShared)
 		}
 	}
 }
@@ -19,7 +19,7 @@ import (
 func (mach *OlmMachine) encryptOlmEvent(session *OlmSession, recipient *DeviceIdentity, evtType event.Type, content event.Content) *event.EncryptedEventContent {
 	evt := &DecryptedOlmEvent{
 		Sender:        mach.Client.UserID,
-		SenderDevice:  mach.Client.DeviceID,
+		SenderDevice:  mach.ownDeviceID(),
 		Keys:          OlmEventKeys{Ed25519: mach.account.SigningKey()},
 		Recipient:     recipient.UserID,
 		RecipientKeys: OlmEventKeys{Ed25519: recipient.SigningKey},
@@ -52,13 +52,7 @@ func (mach *OlmMachine) shouldCreateNewSession(identityKey id.IdentityKey) bool
 	if !mach.CryptoStore.HasSession(identityKey) {
 		return true
 	}
-	mach.devicesToUnwedgeLock.Lock()
-	_, shouldUnwedge := mach.devicesToUnwedge[identityKey]
-	if shouldUnwedge {
-		delete(mach.devicesToUnwedge, identityKey)
-	}
-	mach.devicesToUnwedgeLock.Unlock()
-	return shouldUnwedge
+	return mach.takePendingUnwedge(identityKey)
 }
 
 func (mach *OlmMachine) createOutboundSessions(input map[id.UserID]map[id.DeviceID]*DeviceIdentity) error {
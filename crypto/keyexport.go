@@ -38,6 +38,7 @@ type ExportedSession struct {
 	SenderClaimedKeys SenderClaimedKeys `json:"sender_claimed_keys"`
 	SessionID         id.SessionID      `json:"session_id"`
 	SessionKey        string            `json:"session_key"`
+	SharedHistory     bool              `json:"org.matrix.msc3061.shared_history,omitempty"`
 }
 
 // The default number of pbkdf2 rounds to use when exporting keys
@@ -104,6 +105,7 @@ func exportSessions(sessions []*InboundGroupSession) ([]ExportedSession, error)
 			SenderClaimedKeys: SenderClaimedKeys{},
 			SessionID:         session.ID(),
 			SessionKey:        key,
+			SharedHistory:     session.SharedHistory,
 		}
 	}
 	return export, nil
@@ -0,0 +1,284 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// OutgoingKeyRequest is a room key request sent by this device that hasn't been fulfilled or cancelled yet.
+//
+// Requests are stored in the crypto store, so that they can be cancelled when the key arrives and re-sent to
+// new devices even after a restart. There is at most one request per session.
+type OutgoingKeyRequest struct {
+	RequestID string
+	RoomID    id.RoomID
+	SenderKey id.SenderKey
+	SessionID id.SessionID
+	// Targets contains the devices that the request has been sent to.
+	Targets map[id.UserID][]id.DeviceID
+	// OwnDevices specifies whether the request should be sent to all of our own devices,
+	// including ones that appear after the request was created.
+	OwnDevices bool
+	CreatedAt  time.Time
+}
+
+func (req *OutgoingKeyRequest) wasSentTo(userID id.UserID, deviceID id.DeviceID) bool {
+	for _, target := range req.Targets[userID] {
+		if target == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestRoomKeyFromOwnDevices sends a key request for the given session to all of our own other devices.
+//
+// Like SendRoomKeyRequest, the request is stored in the crypto store and cancelled automatically when the key
+// is received. Devices that are added to our account later will also receive the request.
+func (mach *OlmMachine) RequestRoomKeyFromOwnDevices(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) error {
+	return mach.sendRoomKeyRequest(roomID, senderKey, sessionID, "", nil, true)
+}
+
+func (mach *OlmMachine) findOwnKeyRequestTargets(req *OutgoingKeyRequest) []id.DeviceID {
+	devices, err := mach.CryptoStore.GetDevices(mach.Client.UserID)
+	if err != nil {
+		mach.Log.Warn("Failed to get own devices to send key request for %s: %v", req.SessionID, err)
+		return nil
+	}
+	var targets []id.DeviceID
+	for deviceID, device := range devices {
+		if deviceID != mach.ownDeviceID() && device.Trust != TrustStateBlacklisted && !req.wasSentTo(mach.Client.UserID, deviceID) {
+			targets = append(targets, deviceID)
+		}
+	}
+	return targets
+}
+
+func (mach *OlmMachine) sendRoomKeyRequest(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, requestID string, users map[id.UserID][]id.DeviceID, ownDevices bool) error {
+	if ownDevices {
+		// Fetch our own device list before locking if it's not known yet, as fetching may re-send pending requests.
+		if devices, err := mach.CryptoStore.GetDevices(mach.Client.UserID); err == nil && devices == nil {
+			mach.LoadDevices(mach.Client.UserID)
+		}
+	}
+	mach.keyRequestLock.Lock()
+	defer mach.keyRequestLock.Unlock()
+	req, err := mach.CryptoStore.GetOutgoingKeyRequest(sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to get existing key request: %w", err)
+	} else if req == nil {
+		if len(requestID) == 0 {
+			requestID = mach.Client.TxnID()
+		}
+		req = &OutgoingKeyRequest{
+			RequestID: requestID,
+			RoomID:    roomID,
+			SenderKey: senderKey,
+			SessionID: sessionID,
+			Targets:   make(map[id.UserID][]id.DeviceID),
+			CreatedAt: time.Now(),
+		}
+	} else if len(requestID) > 0 && requestID != req.RequestID {
+		mach.Log.Debug("Reusing existing key request %s for %s instead of %s", req.RequestID, sessionID, requestID)
+	}
+	req.OwnDevices = req.OwnDevices || ownDevices
+
+	targets := make(map[id.UserID][]id.DeviceID, len(users)+1)
+	for userID, devices := range users {
+		for _, deviceID := range devices {
+			if !req.wasSentTo(userID, deviceID) {
+				targets[userID] = append(targets[userID], deviceID)
+			}
+		}
+	}
+	if req.OwnDevices {
+		for _, deviceID := range mach.findOwnKeyRequestTargets(req) {
+			targets[mach.Client.UserID] = append(targets[mach.Client.UserID], deviceID)
+		}
+	}
+
+	if len(targets) > 0 {
+		err = mach.sendKeyRequestEvent(req, event.KeyRequestActionRequest, targets)
+		if err != nil {
+			// Store the request anyway, so that it can be retried when resuming requests.
+			err = fmt.Errorf("failed to send key request: %w", err)
+		} else {
+			for userID, devices := range targets {
+				req.Targets[userID] = append(req.Targets[userID], devices...)
+			}
+			mach.Log.Debug("Sent key request %s for %s to %v", req.RequestID, sessionID, targets)
+		}
+	} else {
+		mach.Log.Trace("Key request %s for %s has already been sent to all targets", req.RequestID, sessionID)
+	}
+	// Mark the request as pending before storing it, so that a key arriving in between still cancels it.
+	mach.setPendingKeyRequest(sessionID, true)
+	if storeErr := mach.CryptoStore.PutOutgoingKeyRequest(req); storeErr != nil {
+		mach.Log.Error("Failed to store key request %s for %s: %v", req.RequestID, sessionID, storeErr)
+		if err == nil {
+			err = fmt.Errorf("failed to store key request: %w", storeErr)
+		}
+	}
+	return err
+}
+
+func (mach *OlmMachine) sendKeyRequestEvent(req *OutgoingKeyRequest, action event.KeyRequestAction, targets map[id.UserID][]id.DeviceID) error {
+	content := &event.RoomKeyRequestEventContent{
+		Action:             action,
+		RequestID:          req.RequestID,
+		RequestingDeviceID: mach.ownDeviceID(),
+	}
+	if action == event.KeyRequestActionRequest {
+		content.Body = event.RequestedKeyInfo{
+			Algorithm: id.AlgorithmMegolmV1,
+			RoomID:    req.RoomID,
+			SenderKey: req.SenderKey,
+			SessionID: req.SessionID,
+		}
+	}
+	wrappedContent := &event.Content{Parsed: content}
+	toDeviceReq := &mautrix.ReqSendToDevice{
+		Messages: make(map[id.UserID]map[id.DeviceID]*event.Content, len(targets)),
+	}
+	for userID, devices := range targets {
+		toDeviceReq.Messages[userID] = make(map[id.DeviceID]*event.Content, len(devices))
+		for _, deviceID := range devices {
+			toDeviceReq.Messages[userID][deviceID] = wrappedContent
+		}
+	}
+	_, err := mach.Client.SendToDevice(event.ToDeviceRoomKeyRequest, toDeviceReq)
+	return err
+}
+
+// CancelRoomKeyRequest sends a request_cancellation for the outgoing key request of the given session to every
+// device the request was sent to, and removes the request from the crypto store.
+//
+// This is called automatically when the session is received, so it usually doesn't need to be called manually.
+func (mach *OlmMachine) CancelRoomKeyRequest(sessionID id.SessionID) error {
+	mach.keyRequestLock.Lock()
+	defer mach.keyRequestLock.Unlock()
+	req, err := mach.CryptoStore.GetOutgoingKeyRequest(sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to get key request: %w", err)
+	} else if req == nil {
+		return nil
+	}
+	if len(req.Targets) > 0 {
+		err = mach.sendKeyRequestEvent(req, event.KeyRequestActionCancel, req.Targets)
+		if err != nil {
+			return fmt.Errorf("failed to send key request cancellation: %w", err)
+		}
+	}
+	mach.Log.Debug("Cancelled key request %s for %s", req.RequestID, sessionID)
+	err = mach.CryptoStore.DeleteOutgoingKeyRequest(sessionID)
+	if err == nil {
+		mach.setPendingKeyRequest(sessionID, false)
+	}
+	return err
+}
+
+// hasPendingKeyRequest checks whether there's an outgoing key request for the given session without querying
+// the crypto store. The session IDs of the stored requests are loaded into memory the first time this is called.
+func (mach *OlmMachine) hasPendingKeyRequest(sessionID id.SessionID) bool {
+	mach.pendingKeyRequestsLock.Lock()
+	defer mach.pendingKeyRequestsLock.Unlock()
+	if !mach.loadPendingKeyRequestsLocked() {
+		// Fall back to checking the store for this session, and try loading again next time
+		req, err := mach.CryptoStore.GetOutgoingKeyRequest(sessionID)
+		return err != nil || req != nil
+	}
+	_, ok := mach.pendingKeyRequests[sessionID]
+	return ok
+}
+
+func (mach *OlmMachine) loadPendingKeyRequestsLocked() bool {
+	if mach.pendingKeyRequests != nil {
+		return true
+	}
+	reqs, err := mach.CryptoStore.GetOutgoingKeyRequests()
+	if err != nil {
+		mach.Log.Warn("Failed to get pending key requests: %v", err)
+		return false
+	}
+	mach.pendingKeyRequests = make(map[id.SessionID]struct{}, len(reqs))
+	for _, req := range reqs {
+		mach.pendingKeyRequests[req.SessionID] = struct{}{}
+	}
+	return true
+}
+
+func (mach *OlmMachine) setPendingKeyRequest(sessionID id.SessionID, pending bool) {
+	mach.pendingKeyRequestsLock.Lock()
+	defer mach.pendingKeyRequestsLock.Unlock()
+	if !mach.loadPendingKeyRequestsLocked() {
+		return
+	} else if pending {
+		mach.pendingKeyRequests[sessionID] = struct{}{}
+	} else {
+		delete(mach.pendingKeyRequests, sessionID)
+	}
+}
+
+// cancelFulfilledKeyRequest cancels the pending key request for the given session in the background, if there is one.
+func (mach *OlmMachine) cancelFulfilledKeyRequest(sessionID id.SessionID) {
+	if mach.hasPendingKeyRequest(sessionID) {
+		go func() {
+			err := mach.CancelRoomKeyRequest(sessionID)
+			if err != nil {
+				mach.Log.Warn("Failed to cancel fulfilled key request for %s: %v", sessionID, err)
+			}
+		}()
+	}
+}
+
+// resendKeyRequestsToNewDevices sends pending key requests that target our own devices to any new devices.
+func (mach *OlmMachine) resendKeyRequestsToNewDevices() {
+	reqs, err := mach.CryptoStore.GetOutgoingKeyRequests()
+	if err != nil {
+		mach.Log.Warn("Failed to get pending key requests: %v", err)
+		return
+	}
+	for _, req := range reqs {
+		if !req.OwnDevices {
+			continue
+		}
+		err = mach.sendRoomKeyRequest(req.RoomID, req.SenderKey, req.SessionID, "", nil, true)
+		if err != nil {
+			mach.Log.Warn("Failed to re-send key request %s to new devices: %v", req.RequestID, err)
+		}
+	}
+}
+
+// ResumeOutgoingKeyRequests goes through the outgoing key requests in the crypto store after a restart.
+//
+// Requests for sessions that have been received in the meantime (e.g. via key backup imports) are cancelled,
+// and requests that target our own devices are sent to any devices that haven't received them yet.
+func (mach *OlmMachine) ResumeOutgoingKeyRequests() error {
+	reqs, err := mach.CryptoStore.GetOutgoingKeyRequests()
+	if err != nil {
+		return fmt.Errorf("failed to get pending key requests: %w", err)
+	}
+	mach.Log.Debug("Resuming %d pending key requests", len(reqs))
+	for _, req := range reqs {
+		sess, _ := mach.CryptoStore.GetGroupSession(req.RoomID, req.SenderKey, req.SessionID)
+		if sess != nil {
+			err = mach.CancelRoomKeyRequest(req.SessionID)
+		} else {
+			err = mach.sendRoomKeyRequest(req.RoomID, req.SenderKey, req.SessionID, "", nil, req.OwnDevices)
+		}
+		if err != nil {
+			mach.Log.Warn("Failed to resume key request %s for %s: %v", req.RequestID, req.SessionID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestOlmMachine_RequestRoomKeyDetachesCaller(t *testing.T) {
+	mach, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+
+	var lock sync.Mutex
+	actions := make(map[event.KeyRequestAction]int)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "/sendToDevice/m.room_key_request/") {
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var req mautrix.ReqSendToDevice
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Failed to decode to-device request: %v", err)
+		}
+		lock.Lock()
+		for _, content := range req.Messages["user1"] {
+			var parsed event.RoomKeyRequestEventContent
+			_ = json.Unmarshal(content.VeryRaw, &parsed)
+			actions[parsed.Action]++
+		}
+		lock.Unlock()
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer httpServer.Close()
+	mach.Client.HomeserverURL, _ = url.Parse(httpServer.URL)
+	getActions := func(action event.KeyRequestAction) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return actions[action]
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resA, err := mach.RequestRoomKey(ctx, "user1", "device2", "room1", "senderkey", "session1")
+	if err != nil {
+		t.Fatalf("Failed to request key: %v", err)
+	}
+	resB, err := mach.RequestRoomKey(context.Background(), "user1", "device2", "room1", "senderkey", "session1")
+	if err != nil {
+		t.Fatalf("Failed to request key: %v", err)
+	}
+	if sent := getActions(event.KeyRequestActionRequest); sent != 1 {
+		t.Errorf("Expected the key request to be sent once, got %d", sent)
+	}
+
+	cancel()
+	select {
+	case received := <-resA:
+		if received {
+			t.Error("Expected the cancelled caller to not receive the key")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the cancelled caller")
+	}
+	if cancelled := getActions(event.KeyRequestActionCancel); cancelled != 0 {
+		t.Errorf("Expected the shared request to not be cancelled, got %d cancellations", cancelled)
+	}
+	if req, _ := mach.CryptoStore.GetOutgoingKeyRequest("session1"); req == nil {
+		t.Error("Expected the key request to still be pending")
+	}
+	select {
+	case <-resB:
+		t.Error("Expected the other caller to still be waiting")
+	default:
+	}
+
+	if mach.hasPendingKeyRequest("session2") {
+		t.Error("Expected no pending key request for an unrequested session")
+	}
+	mach.markSessionReceived("session1")
+	for i := 0; i < 50 && mach.hasPendingKeyRequest("session1"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if mach.hasPendingKeyRequest("session1") {
+		t.Error("Expected the fulfilled request to not be pending anymore")
+	}
+	if cancelled := getActions(event.KeyRequestActionCancel); cancelled != 1 {
+		t.Errorf("Expected the fulfilled request to be cancelled once, got %d cancellations", cancelled)
+	}
+}
@@ -11,11 +11,11 @@ package crypto
 
 import (
 	"context"
+	"time"
 
 	"maunium.net/go/mautrix/crypto/olm"
 	"maunium.net/go/mautrix/id"
 
-	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 )
 
@@ -35,18 +35,19 @@ var (
 	KeyShareRejectInternalError = KeyShareRejection{event.RoomKeyWithheldUnavailable, "An internal error occurred while trying to share the requested session"}
 )
 
-// RequestRoomKey sends a key request for a room to the current user's devices. If the context is cancelled, then so is the key request.
-// Returns a bool channel that will get notified either when the key is received or the request is cancelled.
+// RequestRoomKey sends a key request for a room to the current user's devices.
+// Returns a bool channel that will get notified either when the key is received or the context is cancelled.
+//
+// Key requests are shared by everyone requesting the same session, so cancelling the context only stops waiting
+// for the key: the request itself stays pending until the key is received or CancelRoomKeyRequest is called.
 //
 // Deprecated: this only supports a single key request target, so the whole automatic cancelling feature isn't very useful.
 func (mach *OlmMachine) RequestRoomKey(ctx context.Context, toUser id.UserID, toDevice id.DeviceID,
 	roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) (chan bool, error) {
 
-	requestID := mach.Client.TxnID()
-	keyResponseReceived := make(chan struct{})
-	mach.roomKeyRequestFilled.Store(sessionID, keyResponseReceived)
+	keyResponseReceived, _ := mach.roomKeyRequestFilled.LoadOrStore(sessionID, make(chan struct{}))
 
-	err := mach.SendRoomKeyRequest(roomID, senderKey, sessionID, requestID, map[id.UserID][]id.DeviceID{toUser: {toDevice}})
+	err := mach.SendRoomKeyRequest(roomID, senderKey, sessionID, "", map[id.UserID][]id.DeviceID{toUser: {toDevice}})
 	if err != nil {
 		return nil, err
 	}
@@ -54,36 +55,15 @@ func (mach *OlmMachine) RequestRoomKey(ctx context.Context, toUser id.UserID, to
 	resChan := make(chan bool, 1)
 	go func() {
 		select {
-		case <-keyResponseReceived:
-			// key request successful
-			mach.Log.Debug("Key for session %v was received, cancelling other key requests", sessionID)
+		case <-keyResponseReceived.(chan struct{}):
+			// key request successful, the request is cancelled automatically when the key is stored
+			mach.Log.Debug("Key for session %v was received", sessionID)
 			resChan <- true
 		case <-ctx.Done():
-			// if the context is done, key request was unsuccessful
-			mach.Log.Debug("Context closed (%v) before forwared key for session %v received, sending key request cancellation", ctx.Err(), sessionID)
+			// the request may still have other waiters, so it's only cancelled when the key is received
+			mach.Log.Debug("Context closed (%v) before forwarded key for session %v received, no longer waiting for it", ctx.Err(), sessionID)
 			resChan <- false
 		}
-
-		// send a message to all devices cancelling this key request
-		mach.roomKeyRequestFilled.Delete(sessionID)
-
-		cancelEvtContent := &event.Content{
-			Parsed: event.RoomKeyRequestEventContent{
-				Action:             event.KeyRequestActionCancel,
-				RequestID:          requestID,
-				RequestingDeviceID: mach.Client.DeviceID,
-			},
-		}
-
-		toDeviceCancel := &mautrix.ReqSendToDevice{
-			Messages: map[id.UserID]map[id.DeviceID]*event.Content{
-				toUser: {
-					toDevice: cancelEvtContent,
-				},
-			},
-		}
-
-		mach.Client.SendToDevice(event.ToDeviceRoomKeyRequest, toDeviceCancel)
 	}()
 	return resChan, nil
 }
@@ -92,40 +72,14 @@ func (mach *OlmMachine) RequestRoomKey(ctx context.Context, toUser id.UserID, to
 //
 // The request ID parameter is optional. If it's empty, a random ID will be generated.
 //
+// Requests are stored in the crypto store and deduplicated by session: if there's already a pending request for the
+// session, its request ID is reused and it's only sent to the devices that haven't received it yet. When the key is
+// received in any way, a request_cancellation is sent to every device the request was sent to.
+//
 // This function does not wait for the keys to arrive. You can use WaitForSession to wait for the session to
-// arrive (in any way, not just as a reply to this request). There's also RequestRoomKey which waits for a response
-// to the specific key request, but currently it only supports a single target device and is therefore deprecated.
-// A future function may properly support multiple targets and automatically canceling the other requests when receiving
-// the first response.
+// arrive (in any way, not just as a reply to this request). See also RequestRoomKeyFromOwnDevices.
 func (mach *OlmMachine) SendRoomKeyRequest(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, requestID string, users map[id.UserID][]id.DeviceID) error {
-	if len(requestID) == 0 {
-		requestID = mach.Client.TxnID()
-	}
-	requestEvent := &event.Content{
-		Parsed: &event.RoomKeyRequestEventContent{
-			Action: event.KeyRequestActionRequest,
-			Body: event.RequestedKeyInfo{
-				Algorithm: id.AlgorithmMegolmV1,
-				RoomID:    roomID,
-				SenderKey: senderKey,
-				SessionID: sessionID,
-			},
-			RequestID:          requestID,
-			RequestingDeviceID: mach.Client.DeviceID,
-		},
-	}
-
-	toDeviceReq := &mautrix.ReqSendToDevice{
-		Messages: make(map[id.UserID]map[id.DeviceID]*event.Content, len(users)),
-	}
-	for user, devices := range users {
-		toDeviceReq.Messages[user] = make(map[id.DeviceID]*event.Content, len(devices))
-		for _, device := range devices {
-			toDeviceReq.Messages[user][device] = requestEvent
-		}
-	}
-	_, err := mach.Client.SendToDevice(event.ToDeviceRoomKeyRequest, toDeviceReq)
-	return err
+	return mach.sendRoomKeyRequest(roomID, senderKey, sessionID, requestID, users, false)
 }
 
 func (mach *OlmMachine) importForwardedRoomKey(evt *DecryptedOlmEvent, content *event.ForwardedRoomKeyEventContent) bool {
@@ -148,6 +102,11 @@ func (mach *OlmMachine) importForwardedRoomKey(evt *DecryptedOlmEvent, content *
 		SenderKey:        content.SenderKey,
 		RoomID:           content.RoomID,
 		ForwardingChains: append(content.ForwardingKeyChain, evt.SenderKey.String()),
+		SharedHistory:    content.SharedHistory,
+		KeySource:        KeySourceForwarded,
+		ReceivedAt:       time.Now(),
+		MaxAge:           time.Duration(content.MaxAge) * time.Millisecond,
+		MaxMessages:      content.MaxMessages,
 		id:               content.SessionID,
 	}
 	err = mach.CryptoStore.PutGroupSession(content.RoomID, content.SenderKey, content.SessionID, igs)
@@ -187,7 +146,7 @@ func (mach *OlmMachine) defaultAllowKeyShare(device *DeviceIdentity, _ event.Req
 	if mach.Client.UserID != device.UserID {
 		mach.Log.Debug("Ignoring key request from a different user (%s)", device.UserID)
 		return &KeyShareRejectOtherUser
-	} else if mach.Client.DeviceID == device.DeviceID {
+	} else if mach.ownDeviceID() == device.DeviceID {
 		mach.Log.Debug("Ignoring key request from ourselves")
 		return &KeyShareRejectNoResponse
 	} else if device.Trust == TrustStateBlacklisted {
@@ -208,7 +167,7 @@ func (mach *OlmMachine) defaultAllowKeyShare(device *DeviceIdentity, _ event.Req
 func (mach *OlmMachine) handleRoomKeyRequest(sender id.UserID, content *event.RoomKeyRequestEventContent) {
 	if content.Action != event.KeyRequestActionRequest {
 		return
-	} else if content.RequestingDeviceID == mach.Client.DeviceID && sender == mach.Client.UserID {
+	} else if content.RequestingDeviceID == mach.ownDeviceID() && sender == mach.Client.UserID {
 		mach.Log.Debug("Ignoring key request %s from ourselves", content.RequestID)
 		return
 	}
@@ -252,6 +211,8 @@ func (mach *OlmMachine) handleRoomKeyRequest(sender id.UserID, content *event.Ro
 				RoomID:     igs.RoomID,
 				SessionID:  igs.ID(),
 				SessionKey: exportedKey,
+
+				SharedHistory: igs.SharedHistory,
 			},
 			SenderKey:          content.Body.SenderKey,
 			ForwardingKeyChain: igs.ForwardingChains,
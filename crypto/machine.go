@@ -43,24 +43,58 @@ type OlmMachine struct {
 
 	AllowKeyShare func(*DeviceIdentity, event.RequestedKeyInfo) *KeyShareRejection
 
+	// AllowChangedIdentities determines whether group sessions are shared with users whose cross-signing master key
+	// has changed since it was pinned. If false, the keys are withheld until the change is accepted.
+	AllowChangedIdentities bool
+	// OnIdentityChanged is called when a user's cross-signing master key no longer matches the pinned key.
+	// The change can be accepted by calling AcceptIdentityChange.
+	OnIdentityChanged func(userID id.UserID, pinnedKey, newKey id.Ed25519)
+
+	// FallbackKeyGracePeriod is how long the previous fallback key is kept after rotating to a new one,
+	// so that messages encrypted with the old key while the new one was being uploaded can still be decrypted.
+	FallbackKeyGracePeriod time.Duration
+
+	// UnwedgePolicy configures when new Olm sessions are created to recover from sessions that fail to decrypt.
+	UnwedgePolicy OlmUnwedgePolicy
+
 	DefaultSASTimeout time.Duration
 	// AcceptVerificationFrom determines whether the machine will accept verification requests from this device.
 	AcceptVerificationFrom func(string, *DeviceIdentity, id.RoomID) (VerificationRequestResponse, VerificationHooks)
+	// OnVerificationRequest is called with a new VerificationSession when a verification request is received.
+	// If set, incoming requests are handled through sessions and AcceptVerificationFrom is only used for
+	// verifications that are started without a request. The function must not block.
+	OnVerificationRequest func(session *VerificationSession)
 
 	account *OlmAccount
 
 	roomKeyRequestFilled            *sync.Map
 	keyVerificationTransactionState *sync.Map
+	verificationSessions            *sync.Map
+	// Held while sending an in-room verification request, so that responses wait for the session to be registered.
+	verificationRequestLock sync.RWMutex
 
 	keyWaiters     map[id.SessionID]chan struct{}
 	keyWaitersLock sync.Mutex
 
-	devicesToUnwedge     map[id.IdentityKey]bool
-	devicesToUnwedgeLock sync.Mutex
-	recentlyUnwedged     map[id.IdentityKey]time.Time
-	recentlyUnwedgedLock sync.Mutex
+	keyRequestLock sync.Mutex
+	// Session IDs of the outgoing key requests in the crypto store, loaded lazily by hasPendingKeyRequest.
+	pendingKeyRequests     map[id.SessionID]struct{}
+	pendingKeyRequestsLock sync.Mutex
+
+	olmHealth      map[id.IdentityKey]*olmDeviceHealth
+	olmHealthSwept time.Time
+	recentUnwedges []time.Time
+	olmHealthLock  sync.Mutex
 
-	olmLock sync.Mutex
+	olmLock       sync.Mutex
+	otkUploadLock sync.Mutex
+
+	lastOTKCount     *mautrix.OTKCount
+	lastOTKCountTime time.Time
+	lastOTKCountLock sync.Mutex
+
+	deviceListSyncToken     string
+	deviceListSyncTokenLock sync.Mutex
 
 	CrossSigningKeys    *CrossSigningKeysCache
 	crossSigningPubkeys *CrossSigningPublicKeysCache
@@ -87,6 +121,10 @@ func NewOlmMachine(client *mautrix.Client, log Logger, cryptoStore Store, stateS
 
 		AllowUnverifiedDevices:       true,
 		ShareKeysToUnverifiedDevices: false,
+		AllowChangedIdentities:       true,
+
+		FallbackKeyGracePeriod: 1 * time.Hour,
+		UnwedgePolicy:          DefaultOlmUnwedgePolicy,
 
 		DefaultSASTimeout: 10 * time.Minute,
 		AcceptVerificationFrom: func(string, *DeviceIdentity, id.RoomID) (VerificationRequestResponse, VerificationHooks) {
@@ -96,11 +134,11 @@ func NewOlmMachine(client *mautrix.Client, log Logger, cryptoStore Store, stateS
 
 		roomKeyRequestFilled:            &sync.Map{},
 		keyVerificationTransactionState: &sync.Map{},
+		verificationSessions:            &sync.Map{},
 
 		keyWaiters: make(map[id.SessionID]chan struct{}),
 
-		devicesToUnwedge: make(map[id.IdentityKey]bool),
-		recentlyUnwedged: make(map[id.IdentityKey]time.Time),
+		olmHealth: make(map[id.IdentityKey]*olmDeviceHealth),
 	}
 	mach.AllowKeyShare = mach.defaultAllowKeyShare
 	return mach
@@ -119,6 +157,13 @@ func (mach *OlmMachine) Load() (err error) {
 	return nil
 }
 
+// ownDeviceID returns the device ID of the machine's client. The credentials of the client may be replaced while
+// the machine is in use (e.g. when a ghost logs in again), so the field isn't read directly.
+func (mach *OlmMachine) ownDeviceID() id.DeviceID {
+	_, deviceID := mach.Client.GetCredentials()
+	return deviceID
+}
+
 func (mach *OlmMachine) saveAccount() {
 	err := mach.CryptoStore.PutAccount(mach.account)
 	if err != nil {
@@ -164,7 +209,7 @@ func (mach *OlmMachine) Fingerprint() string {
 func (mach *OlmMachine) OwnIdentity() *DeviceIdentity {
 	return &DeviceIdentity{
 		UserID:      mach.Client.UserID,
-		DeviceID:    mach.Client.DeviceID,
+		DeviceID:    mach.ownDeviceID(),
 		IdentityKey: mach.account.IdentityKey(),
 		SigningKey:  mach.account.SigningKey(),
 		Trust:       TrustStateVerified,
@@ -179,43 +224,89 @@ func (mach *OlmMachine) AddAppserviceListener(ep *appservice.EventProcessor, az
 	ep.On(event.ToDeviceRoomKeyWithheld, mach.HandleToDeviceEvent)
 	ep.On(event.ToDeviceOrgMatrixRoomKeyWithheld, mach.HandleToDeviceEvent)
 	ep.On(event.ToDeviceVerificationRequest, mach.HandleToDeviceEvent)
+	ep.On(event.ToDeviceVerificationReady, mach.HandleToDeviceEvent)
 	ep.On(event.ToDeviceVerificationStart, mach.HandleToDeviceEvent)
 	ep.On(event.ToDeviceVerificationAccept, mach.HandleToDeviceEvent)
 	ep.On(event.ToDeviceVerificationKey, mach.HandleToDeviceEvent)
 	ep.On(event.ToDeviceVerificationMAC, mach.HandleToDeviceEvent)
 	ep.On(event.ToDeviceVerificationCancel, mach.HandleToDeviceEvent)
+	ep.On(event.ToDeviceVerificationDone, mach.HandleToDeviceEvent)
 	ep.OnOTK(mach.HandleOTKCounts)
 	ep.OnDeviceList(mach.HandleDeviceLists)
 	mach.Log.Trace("Added listeners for encryption data coming from appservice transactions")
 }
 
+// HandleDeviceLists handles the device list changes in a /sync response or appservice transaction.
+//
+// Changed users are marked as outdated and their device lists are fetched immediately. If fetching fails,
+// the users stay outdated and are refreshed before the next ShareGroupSession call. Users we no longer share
+// any encrypted rooms with are untracked.
 func (mach *OlmMachine) HandleDeviceLists(dl *mautrix.DeviceLists, since string) {
 	if len(dl.Changed) > 0 {
 		traceID := time.Now().Format("15:04:05.000000")
 		mach.Log.Trace("Device list changes in /sync: %v (trace: %s)", dl.Changed, traceID)
+		mach.markUsersOutdated(dl.Changed)
 		mach.fetchKeys(dl.Changed, since, false)
 		mach.Log.Trace("Finished handling device list changes (trace: %s)", traceID)
 	}
+	if len(dl.Left) > 0 {
+		mach.Log.Trace("Users left in /sync: %v", dl.Left)
+		mach.markUsersOutdated(dl.Left)
+		mach.untrackUsersWithoutSharedRooms(dl.Left)
+	}
 }
 
 func (mach *OlmMachine) HandleOTKCounts(otkCount *mautrix.OTKCount) {
-	if (len(otkCount.UserID) > 0 && otkCount.UserID != mach.Client.UserID) || (len(otkCount.DeviceID) > 0 && otkCount.DeviceID != mach.Client.DeviceID) {
+	if (len(otkCount.UserID) > 0 && otkCount.UserID != mach.Client.UserID) || (len(otkCount.DeviceID) > 0 && otkCount.DeviceID != mach.ownDeviceID()) {
 		// TODO This log probably needs to be silence-able if someone wants to use encrypted appservices with multiple e2ee sessions
 		mach.Log.Debug("Dropping OTK counts targeted to %s/%s (not us)", otkCount.UserID, otkCount.DeviceID)
 		return
 	}
+	mach.lastOTKCountLock.Lock()
+	mach.lastOTKCount = otkCount
+	mach.lastOTKCountTime = time.Now()
+	mach.lastOTKCountLock.Unlock()
 
+	// A nil list means the server doesn't support fallback keys, so there's nothing to rotate.
+	rotateFallbackKey := otkCount.UnusedFallbackKeyTypes != nil && !hasKeyAlgorithm(otkCount.UnusedFallbackKeyTypes, id.KeyAlgorithmSignedCurve25519)
 	minCount := mach.account.Internal.MaxNumberOfOneTimeKeys() / 2
-	if otkCount.SignedCurve25519 < int(minCount) {
+	if otkCount.SignedCurve25519 < int(minCount) || rotateFallbackKey {
 		traceID := time.Now().Format("15:04:05.000000")
-		mach.Log.Debug("Sync response said we have %d signed curve25519 keys left, sharing new ones... (trace: %s)", otkCount.SignedCurve25519, traceID)
-		err := mach.ShareKeys(otkCount.SignedCurve25519)
+		if rotateFallbackKey {
+			mach.Log.Debug("Sync response said our fallback key has been used, sharing a new one... (trace: %s)", traceID)
+		} else {
+			mach.Log.Debug("Sync response said we have %d signed curve25519 keys left, sharing new ones... (trace: %s)", otkCount.SignedCurve25519, traceID)
+		}
+		err := mach.shareKeys(otkCount.SignedCurve25519, rotateFallbackKey)
 		if err != nil {
 			mach.Log.Error("Failed to share keys: %v (trace: %s)", err, traceID)
 		} else {
 			mach.Log.Debug("Successfully shared keys (trace: %s)", traceID)
 		}
 	}
+	mach.forgetOldFallbackKey()
+}
+
+func hasKeyAlgorithm(algorithms []id.KeyAlgorithm, target id.KeyAlgorithm) bool {
+	for _, alg := range algorithms {
+		if alg == target {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetOldFallbackKey forgets the previous fallback key if it was replaced more than FallbackKeyGracePeriod ago.
+func (mach *OlmMachine) forgetOldFallbackKey() {
+	mach.otkUploadLock.Lock()
+	defer mach.otkUploadLock.Unlock()
+	if mach.account.FallbackKeyRotatedAt.IsZero() || time.Since(mach.account.FallbackKeyRotatedAt) < mach.FallbackKeyGracePeriod {
+		return
+	}
+	mach.Log.Debug("Forgetting old fallback key that was replaced at %s", mach.account.FallbackKeyRotatedAt)
+	mach.account.Internal.ForgetOldFallbackKey()
+	mach.account.FallbackKeyRotatedAt = time.Time{}
+	mach.saveAccount()
 }
 
 // ProcessSyncResponse processes a single /sync response.
@@ -223,7 +314,11 @@ func (mach *OlmMachine) HandleOTKCounts(otkCount *mautrix.OTKCount) {
 // This can be easily registered into a mautrix client using .OnSync():
 //
 //     client.Syncer.(*mautrix.DefaultSyncer).OnSync(c.crypto.ProcessSyncResponse)
+//
+// If the response doesn't continue from the previously processed one, e.g. because the sync was restarted without
+// a token, the device list changes in between are caught up with CatchUpDeviceListChanges.
 func (mach *OlmMachine) ProcessSyncResponse(resp *mautrix.RespSync, since string) bool {
+	mach.catchUpSyncGap(since, resp.NextBatch)
 	mach.HandleDeviceLists(&resp.DeviceLists, since)
 
 	for _, evt := range resp.ToDevice.Events {
@@ -236,6 +331,7 @@ func (mach *OlmMachine) ProcessSyncResponse(resp *mautrix.RespSync, since string
 		mach.HandleToDeviceEvent(evt)
 	}
 
+	resp.DeviceOTKCount.UnusedFallbackKeyTypes = resp.DeviceUnusedFallbackKeyTypes
 	mach.HandleOTKCounts(&resp.DeviceOTKCount)
 	return true
 }
@@ -277,7 +373,7 @@ func (mach *OlmMachine) HandleMemberEvent(evt *event.Event) {
 // HandleToDeviceEvent handles a single to-device event. This is automatically called by ProcessSyncResponse, so you
 // don't need to add any custom handlers if you use that method.
 func (mach *OlmMachine) HandleToDeviceEvent(evt *event.Event) {
-	if len(evt.ToUserID) > 0 && (evt.ToUserID != mach.Client.UserID || evt.ToDeviceID != mach.Client.DeviceID) {
+	if len(evt.ToUserID) > 0 && (evt.ToUserID != mach.Client.UserID || evt.ToDeviceID != mach.ownDeviceID()) {
 		// TODO This log probably needs to be silence-able if someone wants to use encrypted appservices with multiple e2ee sessions
 		mach.Log.Debug("Dropping to-device event targeted to %s/%s (not us)", evt.ToUserID, evt.ToDeviceID)
 		return
@@ -302,7 +398,7 @@ func (mach *OlmMachine) HandleToDeviceEvent(evt *event.Event) {
 			mach.Log.Trace("Handled room key event from %s/%s (trace: %s)", decryptedEvt.Sender, decryptedEvt.SenderDevice, traceID)
 		case *event.ForwardedRoomKeyEventContent:
 			if mach.importForwardedRoomKey(decryptedEvt, decryptedContent) {
-				if ch, ok := mach.roomKeyRequestFilled.Load(decryptedContent.SessionID); ok {
+				if ch, ok := mach.roomKeyRequestFilled.LoadAndDelete(decryptedContent.SessionID); ok {
 					// close channel to notify listener that the key was received
 					close(ch.(chan struct{}))
 				}
@@ -318,7 +414,15 @@ func (mach *OlmMachine) HandleToDeviceEvent(evt *event.Event) {
 		mach.handleRoomKeyRequest(evt.Sender, content)
 	// verification cases
 	case *event.VerificationStartEventContent:
-		mach.handleVerificationStart(evt.Sender, content, content.TransactionID, 10*time.Minute, "")
+		if !mach.handleVerificationSessionStart(evt.Sender, content.TransactionID) {
+			mach.handleVerificationStart(evt.Sender, content, content.TransactionID, 10*time.Minute, "")
+		}
+	case *event.VerificationReadyEventContent:
+		if !mach.handleVerificationSessionReady(evt.Sender, content, content.TransactionID) {
+			mach.Log.Debug("Ignoring verification ready from %s for unknown transaction %s", evt.Sender, content.TransactionID)
+		}
+	case *event.VerificationDoneEventContent:
+		mach.handleVerificationDone(evt.Sender, content.TransactionID)
 	case *event.VerificationAcceptEventContent:
 		mach.handleVerificationAccept(evt.Sender, content, content.TransactionID)
 	case *event.VerificationKeyEventContent:
@@ -416,7 +520,7 @@ func (mach *OlmMachine) SendEncryptedToDevice(device *DeviceIdentity, evtType ev
 	return err
 }
 
-func (mach *OlmMachine) createGroupSession(senderKey id.SenderKey, signingKey id.Ed25519, roomID id.RoomID, sessionID id.SessionID, sessionKey string, traceID string) {
+func (mach *OlmMachine) createGroupSession(senderKey id.SenderKey, signingKey id.Ed25519, roomID id.RoomID, sessionID id.SessionID, sessionKey string, sharedHistory bool, maxAge time.Duration, maxMessages int, traceID string) {
 	igs, err := NewInboundGroupSession(senderKey, signingKey, roomID, sessionKey)
 	if err != nil {
 		mach.Log.Error("Failed to create inbound group session: %v", err)
@@ -425,6 +529,10 @@ func (mach *OlmMachine) createGroupSession(senderKey id.SenderKey, signingKey id
 		mach.Log.Warn("Mismatched session ID while creating inbound group session")
 		return
 	}
+	igs.SharedHistory = sharedHistory
+	igs.KeySource = KeySourceDirect
+	igs.MaxAge = maxAge
+	igs.MaxMessages = maxMessages
 	err = mach.CryptoStore.PutGroupSession(roomID, senderKey, sessionID, igs)
 	if err != nil {
 		mach.Log.Error("Failed to store new inbound group session: %v", err)
@@ -442,6 +550,7 @@ func (mach *OlmMachine) markSessionReceived(id id.SessionID) {
 		delete(mach.keyWaiters, id)
 	}
 	mach.keyWaitersLock.Unlock()
+	mach.cancelFulfilledKeyRequest(id)
 }
 
 // WaitForSession waits for the given Megolm session to arrive.
@@ -471,7 +580,8 @@ func (mach *OlmMachine) receiveRoomKey(evt *DecryptedOlmEvent, content *event.Ro
 		return
 	}
 
-	mach.createGroupSession(evt.SenderKey, evt.Keys.Ed25519, content.RoomID, content.SessionID, content.SessionKey, traceID)
+	mach.createGroupSession(evt.SenderKey, evt.Keys.Ed25519, content.RoomID, content.SessionID, content.SessionKey, content.SharedHistory,
+		time.Duration(content.MaxAge)*time.Millisecond, content.MaxMessages, traceID)
 }
 
 func (mach *OlmMachine) handleRoomKeyWithheld(content *event.RoomKeyWithheldEventContent) {
@@ -490,22 +600,40 @@ func (mach *OlmMachine) handleRoomKeyWithheld(content *event.RoomKeyWithheldEven
 // If the Olm account hasn't been shared, the account keys will be uploaded.
 // If currentOTKCount is less than half of the limit (100 / 2 = 50), enough one-time keys will be uploaded so exactly
 // half of the limit is filled.
+// A fallback key will also be generated and uploaded if the account doesn't have one yet.
 func (mach *OlmMachine) ShareKeys(currentOTKCount int) error {
+	return mach.shareKeys(currentOTKCount, false)
+}
+
+// RotateFallbackKey generates a new fallback key and uploads it to the server.
+//
+// The previous fallback key is forgotten after FallbackKeyGracePeriod. This is called automatically by
+// HandleOTKCounts when the server reports that the fallback key has been used.
+func (mach *OlmMachine) RotateFallbackKey() error {
+	return mach.shareKeys(int(mach.account.Internal.MaxNumberOfOneTimeKeys()), true)
+}
+
+func (mach *OlmMachine) shareKeys(currentOTKCount int, rotateFallbackKey bool) error {
+	mach.otkUploadLock.Lock()
+	defer mach.otkUploadLock.Unlock()
 	var deviceKeys *mautrix.DeviceKeys
 	if !mach.account.Shared {
-		deviceKeys = mach.account.getInitialKeys(mach.Client.UserID, mach.Client.DeviceID)
+		deviceKeys = mach.account.getInitialKeys(mach.Client.UserID, mach.ownDeviceID())
 		mach.Log.Trace("Going to upload initial account keys")
 	}
-	oneTimeKeys := mach.account.getOneTimeKeys(mach.Client.UserID, mach.Client.DeviceID, currentOTKCount)
-	if len(oneTimeKeys) == 0 && deviceKeys == nil {
+	// The fallback keys must be fetched before the one-time keys, because getOneTimeKeys marks all keys as published.
+	fallbackKeys := mach.account.getFallbackKeys(mach.Client.UserID, mach.ownDeviceID(), rotateFallbackKey)
+	oneTimeKeys := mach.account.getOneTimeKeys(mach.Client.UserID, mach.ownDeviceID(), currentOTKCount)
+	if len(oneTimeKeys) == 0 && len(fallbackKeys) == 0 && deviceKeys == nil {
 		mach.Log.Trace("No one-time keys nor device keys got when trying to share keys")
 		return nil
 	}
 	req := &mautrix.ReqUploadKeys{
-		DeviceKeys:  deviceKeys,
-		OneTimeKeys: oneTimeKeys,
+		DeviceKeys:   deviceKeys,
+		OneTimeKeys:  oneTimeKeys,
+		FallbackKeys: fallbackKeys,
 	}
-	mach.Log.Trace("Uploading %d one-time keys", len(oneTimeKeys))
+	mach.Log.Trace("Uploading %d one-time keys and %d fallback keys", len(oneTimeKeys), len(fallbackKeys))
 	_, err := mach.Client.UploadKeys(req)
 	if err != nil {
 		return err
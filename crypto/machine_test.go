@@ -11,6 +11,7 @@ import (
 	"testing"
 
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/olm"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
@@ -38,6 +39,12 @@ func (mockStateStore) FindSharedRooms(id.UserID) []id.RoomID {
 	return []id.RoomID{"room1"}
 }
 
+func (mockStateStore) GetHistoryVisibility(id.RoomID) event.HistoryVisibility {
+	return event.HistoryVisibilityShared
+}
+
+func (mockStateStore) SetHistoryVisibility(id.RoomID, event.HistoryVisibility) {}
+
 func newMachine(t *testing.T, userID id.UserID) (*OlmMachine, string) {
 	client, err := mautrix.NewClient("http://localhost", userID, "token")
 	if err != nil {
@@ -123,6 +130,9 @@ func TestOlmMachineOlmMegolmSessions(t *testing.T) {
 		if err != nil {
 			t.Errorf("Error creating inbound megolm session: %v", err)
 		}
+		if !roomKeyEvt.SharedHistory {
+			t.Errorf("Room key for room with shared history visibility wasn't marked as shared history")
+		}
 		if err = machineIn.CryptoStore.PutGroupSession("room1", senderKey, igs.ID(), igs); err != nil {
 			t.Errorf("Error storing inbound megolm session: %v", err)
 		}
@@ -167,3 +177,42 @@ func TestOlmMachineOlmMegolmSessions(t *testing.T) {
 		t.Error("Megolm outbound session not expired after 3rd message")
 	}
 }
+
+func TestOlmAccountFallbackKeys(t *testing.T) {
+	machine, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+	account := machine.account
+
+	fallbackKeys := account.getFallbackKeys("user1", "device1", false)
+	if len(fallbackKeys) != 1 {
+		t.Fatalf("Expected 1 initial fallback key, got %d", len(fallbackKeys))
+	}
+	var firstKeyID id.KeyID
+	for keyID, key := range fallbackKeys {
+		firstKeyID = keyID
+		if !key.IsFallback {
+			t.Error("Fallback key is not marked as fallback")
+		}
+		if ok, err := olm.VerifySignatureJSON(key, "user1", "device1", account.SigningKey()); err != nil || !ok {
+			t.Errorf("Fallback key signature doesn't verify: %v", err)
+		}
+	}
+	if !account.FallbackKeyRotatedAt.IsZero() {
+		t.Error("Generating the first fallback key shouldn't count as rotation")
+	}
+	account.Internal.MarkKeysAsPublished()
+
+	if keys := account.getFallbackKeys("user1", "device1", false); len(keys) != 0 {
+		t.Errorf("Expected no unpublished fallback keys after publishing, got %d", len(keys))
+	}
+
+	rotatedKeys := account.getFallbackKeys("user1", "device1", true)
+	if len(rotatedKeys) != 1 {
+		t.Fatalf("Expected 1 rotated fallback key, got %d", len(rotatedKeys))
+	} else if _, ok := rotatedKeys[firstKeyID]; ok {
+		t.Error("Rotated fallback key has the same ID as the previous one")
+	}
+	if account.FallbackKeyRotatedAt.IsZero() {
+		t.Error("Rotating the fallback key didn't store the rotation time")
+	}
+}
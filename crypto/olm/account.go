@@ -10,9 +10,8 @@ import (
 	"unsafe"
 
 	"github.com/tidwall/gjson"
-	"github.com/tidwall/sjson"
 
-	"maunium.net/go/mautrix/crypto/canonicaljson"
+	"maunium.net/go/mautrix/crypto/signatures"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -119,6 +118,24 @@ func (a *Account) genOneTimeKeysRandomLen(num uint) uint {
 		C.size_t(num)))
 }
 
+// fallbackKeyLen returns the size of the output buffer needed to hold the
+// current fallback key.
+func (a *Account) fallbackKeyLen() uint {
+	return uint(C.olm_account_fallback_key_length((*C.OlmAccount)(a.int)))
+}
+
+// unpublishedFallbackKeyLen returns the size of the output buffer needed to
+// hold the unpublished fallback key.
+func (a *Account) unpublishedFallbackKeyLen() uint {
+	return uint(C.olm_account_unpublished_fallback_key_length((*C.OlmAccount)(a.int)))
+}
+
+// genFallbackKeyRandomLen returns the number of random bytes needed to
+// generate a new fallback key.
+func (a *Account) genFallbackKeyRandomLen() uint {
+	return uint(C.olm_account_generate_fallback_key_random_length((*C.OlmAccount)(a.int)))
+}
+
 // Pickle returns an Account as a base64 string. Encrypts the Account using the
 // supplied key.
 func (a *Account) Pickle(key []byte) []byte {
@@ -235,13 +252,11 @@ func (a *Account) Sign(message []byte) []byte {
 // SignJSON signs the given JSON object following the Matrix specification:
 // https://matrix.org/docs/spec/appendices#signing-json
 func (a *Account) SignJSON(obj interface{}) (string, error) {
-	objJSON, err := json.Marshal(obj)
+	canonical, err := signatures.CanonicalJSON(obj)
 	if err != nil {
 		return "", err
 	}
-	objJSON, _ = sjson.DeleteBytes(objJSON, "unsigned")
-	objJSON, _ = sjson.DeleteBytes(objJSON, "signatures")
-	return string(a.Sign(canonicaljson.CanonicalJSONAssumeValid(objJSON))), nil
+	return string(a.Sign(canonical)), nil
 }
 
 // OneTimeKeys returns the public parts of the unpublished one time keys for
@@ -275,8 +290,8 @@ func (a *Account) OneTimeKeys() map[string]id.Curve25519 {
 	return oneTimeKeys.Curve25519
 }
 
-// MarkKeysAsPublished marks the current set of one time keys as being
-// published.
+// MarkKeysAsPublished marks the current set of one time keys and the current
+// fallback key as being published.
 func (a *Account) MarkKeysAsPublished() {
 	C.olm_account_mark_keys_as_published((*C.OlmAccount)(a.int))
 }
@@ -394,3 +409,69 @@ func (a *Account) RemoveOneTimeKeys(s *Session) error {
 	}
 	return nil
 }
+
+// GenFallbackKey generates a new fallback key. The previous fallback key is
+// kept and can still be used for creating inbound sessions until
+// ForgetOldFallbackKey is called.
+func (a *Account) GenFallbackKey() {
+	random := make([]byte, a.genFallbackKeyRandomLen()+1)
+	_, err := rand.Read(random)
+	if err != nil {
+		panic(NotEnoughGoRandom)
+	}
+	r := C.olm_account_generate_fallback_key(
+		(*C.OlmAccount)(a.int),
+		unsafe.Pointer(&random[0]),
+		C.size_t(len(random)))
+	if r == errorVal() {
+		panic(a.lastError())
+	}
+}
+
+func parseFallbackKeyJSON(fallbackKeyJSON []byte) map[string]id.Curve25519 {
+	var fallbackKey struct {
+		Curve25519 map[string]id.Curve25519 `json:"curve25519"`
+	}
+	err := json.Unmarshal(fallbackKeyJSON, &fallbackKey)
+	if err != nil {
+		panic(err)
+	}
+	return fallbackKey.Curve25519
+}
+
+// FallbackKey returns the current fallback key of the Account, regardless of
+// whether it has been published. The map is empty if no fallback key has been
+// generated. The format of the JSON is the same as with OneTimeKeys.
+func (a *Account) FallbackKey() map[string]id.Curve25519 {
+	fallbackKeyJSON := make([]byte, a.fallbackKeyLen())
+	r := C.olm_account_fallback_key(
+		(*C.OlmAccount)(a.int),
+		unsafe.Pointer(&fallbackKeyJSON[0]),
+		C.size_t(len(fallbackKeyJSON)))
+	if r == errorVal() {
+		panic(a.lastError())
+	}
+	return parseFallbackKeyJSON(fallbackKeyJSON[:r])
+}
+
+// UnpublishedFallbackKey returns the current fallback key of the Account if it
+// hasn't been marked as published yet with MarkKeysAsPublished. The map is
+// empty if there's no unpublished fallback key.
+func (a *Account) UnpublishedFallbackKey() map[string]id.Curve25519 {
+	fallbackKeyJSON := make([]byte, a.unpublishedFallbackKeyLen())
+	r := C.olm_account_unpublished_fallback_key(
+		(*C.OlmAccount)(a.int),
+		unsafe.Pointer(&fallbackKeyJSON[0]),
+		C.size_t(len(fallbackKeyJSON)))
+	if r == errorVal() {
+		panic(a.lastError())
+	}
+	return parseFallbackKeyJSON(fallbackKeyJSON[:r])
+}
+
+// ForgetOldFallbackKey forgets the previous fallback key. This should be called
+// once the new fallback key has been published and enough time has passed for
+// any pending messages using the old key to have been received.
+func (a *Account) ForgetOldFallbackKey() {
+	C.olm_account_forget_old_fallback_key((*C.OlmAccount)(a.int))
+}
@@ -7,12 +7,9 @@ import "C"
 
 import (
 	"crypto/rand"
-	"encoding/json"
 	"unsafe"
 
-	"github.com/tidwall/sjson"
-
-	"maunium.net/go/mautrix/crypto/canonicaljson"
+	"maunium.net/go/mautrix/crypto/signatures"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -92,13 +89,11 @@ func (p *PkSigning) Sign(message []byte) ([]byte, error) {
 
 // SignJSON creates a signature for the given object after encoding it to canonical JSON.
 func (p *PkSigning) SignJSON(obj interface{}) (string, error) {
-	objJSON, err := json.Marshal(obj)
+	canonical, err := signatures.CanonicalJSON(obj)
 	if err != nil {
 		return "", err
 	}
-	objJSON, _ = sjson.DeleteBytes(objJSON, "unsigned")
-	objJSON, _ = sjson.DeleteBytes(objJSON, "signatures")
-	signature, err := p.Sign(canonicaljson.CanonicalJSONAssumeValid(objJSON))
+	signature, err := p.Sign(canonical)
 	if err != nil {
 		return "", err
 	}
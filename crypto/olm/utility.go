@@ -6,14 +6,9 @@ import "C"
 
 import (
 	"encoding/json"
-	"fmt"
-	"strings"
 	"unsafe"
 
-	"github.com/tidwall/gjson"
-	"github.com/tidwall/sjson"
-
-	"maunium.net/go/mautrix/crypto/canonicaljson"
+	"maunium.net/go/mautrix/crypto/signatures"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -102,26 +97,6 @@ func (u *Utility) VerifySignature(message string, key id.Ed25519, signature stri
 	return ok, err
 }
 
-var gjsonEscaper = strings.NewReplacer(
-	`\`, `\\`,
-	".", `\.`,
-	"|", `\|`,
-	"#", `\#`,
-	"@", `\@`,
-	"*", `\*`,
-	"?", `\?`)
-
-func gjsonPath(path ...string) string {
-	var result strings.Builder
-	for i, part := range path {
-		_, _ = gjsonEscaper.WriteString(&result, part)
-		if i < len(path)-1 {
-			result.WriteRune('.')
-		}
-	}
-	return result.String()
-}
-
 // VerifySignatureJSON verifies the signature in the JSON object _obj following
 // the Matrix specification:
 // https://matrix.org/speculator/spec/drafts%2Fe2e/appendices.html#signing-json
@@ -131,20 +106,19 @@ func (u *Utility) VerifySignatureJSON(obj interface{}, userID id.UserID, keyName
 	if err != nil {
 		return false, err
 	}
-	sig := gjson.GetBytes(objJSON, gjsonPath("signatures", string(userID), fmt.Sprintf("ed25519:%s", keyName)))
-	if !sig.Exists() || sig.Type != gjson.String {
-		return false, SignatureNotFound
-	}
-	objJSON, err = sjson.DeleteBytes(objJSON, "unsigned")
+	sigs, err := signatures.GetSignatures(objJSON)
 	if err != nil {
 		return false, err
 	}
-	objJSON, err = sjson.DeleteBytes(objJSON, "signatures")
+	sig := sigs.Get(userID, id.NewKeyID(id.KeyAlgorithmEd25519, keyName))
+	if len(sig) == 0 {
+		return false, SignatureNotFound
+	}
+	canonical, err := signatures.CanonicalJSON(objJSON)
 	if err != nil {
 		return false, err
 	}
-	objJSONString := string(canonicaljson.CanonicalJSONAssumeValid(objJSON))
-	return u.VerifySignature(objJSONString, key, sig.Str)
+	return u.VerifySignature(string(canonical), key, sig)
 }
 
 // VerifySignatureJSON verifies the signature in the JSON object _obj following
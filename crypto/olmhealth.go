@@ -0,0 +1,333 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var ErrUnwedgeRateLimited = errors.New("too many Olm sessions recreated recently")
+
+// MinUnwedgeInterval is the default minimum time between creating new Olm sessions with the same device.
+const MinUnwedgeInterval = 1 * time.Hour
+
+// OlmHealthTTL is how long the in-memory decryption failure counters of a device are kept after the last message
+// from the device. Devices with a pending or in-progress unwedge are kept regardless.
+var OlmHealthTTL = 24 * time.Hour
+
+// OlmUnwedgePolicy configures how broken ("wedged") Olm sessions are recovered from. When decrypting messages from
+// a device keeps failing, a new Olm session is created with the device and an m.dummy event is sent through it,
+// so that the other side will also start using the new session.
+type OlmUnwedgePolicy struct {
+	// Disabled disables creating new sessions automatically. RecreateOlmSession can still be used manually.
+	Disabled bool
+	// FailureThreshold is the number of consecutive decryption failures from a device before creating a new session.
+	FailureThreshold int
+	// MinInterval is the minimum time between creating new sessions with the same device.
+	MinInterval time.Duration
+	// MaxPerHour is the maximum number of new sessions created automatically per hour across all devices.
+	// Zero means there's no limit.
+	MaxPerHour int
+}
+
+// DefaultOlmUnwedgePolicy is the default value of OlmMachine.UnwedgePolicy.
+var DefaultOlmUnwedgePolicy = OlmUnwedgePolicy{
+	FailureThreshold: 1,
+	MinInterval:      MinUnwedgeInterval,
+}
+
+type olmDeviceHealth struct {
+	sessionFailures     map[id.SessionID]int
+	consecutiveFailures int
+	totalFailures       int
+	lastFailure         time.Time
+	lastFailureReason   string
+	lastSuccess         time.Time
+	pendingUnwedge      bool
+	unwedgeInProgress   bool
+	lastSeen            time.Time
+}
+
+// getOlmHealth returns the health entry of a device and marks it as recently used. The caller must hold olmHealthLock.
+func (mach *OlmMachine) getOlmHealth(senderKey id.SenderKey) *olmDeviceHealth {
+	now := time.Now()
+	mach.evictOlmHealth(now)
+	health, ok := mach.olmHealth[senderKey]
+	if !ok {
+		health = &olmDeviceHealth{sessionFailures: make(map[id.SessionID]int)}
+		mach.olmHealth[senderKey] = health
+	}
+	health.lastSeen = now
+	return health
+}
+
+// evictOlmHealth removes the health entries of devices that haven't been seen within OlmHealthTTL.
+// The entries are checked at most once per tenth of the TTL. The caller must hold olmHealthLock.
+func (mach *OlmMachine) evictOlmHealth(now time.Time) {
+	if now.Sub(mach.olmHealthSwept) < OlmHealthTTL/10 {
+		return
+	}
+	mach.olmHealthSwept = now
+	cutoff := now.Add(-OlmHealthTTL)
+	for senderKey, health := range mach.olmHealth {
+		if health.lastSeen.Before(cutoff) && !health.pendingUnwedge && !health.unwedgeInProgress {
+			delete(mach.olmHealth, senderKey)
+		}
+	}
+}
+
+// markOlmSessionFailed counts a decryption failure with a specific session.
+func (mach *OlmMachine) markOlmSessionFailed(senderKey id.SenderKey, sessionID id.SessionID) {
+	mach.olmHealthLock.Lock()
+	mach.getOlmHealth(senderKey).sessionFailures[sessionID]++
+	mach.olmHealthLock.Unlock()
+}
+
+// markOlmDecryptionSuccess resets the consecutive failure counter of a device after a message was decrypted.
+func (mach *OlmMachine) markOlmDecryptionSuccess(senderKey id.SenderKey) {
+	mach.olmHealthLock.Lock()
+	health := mach.getOlmHealth(senderKey)
+	health.consecutiveFailures = 0
+	health.lastSuccess = time.Now()
+	mach.olmHealthLock.Unlock()
+}
+
+// handleOlmDecryptionFailure counts a failure to decrypt a message from a device, and starts unwedging the session
+// in the background if the failure threshold of the unwedge policy is reached.
+func (mach *OlmMachine) handleOlmDecryptionFailure(sender id.UserID, senderKey id.SenderKey, reason error) {
+	mach.olmHealthLock.Lock()
+	health := mach.getOlmHealth(senderKey)
+	health.consecutiveFailures++
+	health.totalFailures++
+	health.lastFailure = time.Now()
+	health.lastFailureReason = reason.Error()
+	failures := health.consecutiveFailures
+	mach.olmHealthLock.Unlock()
+
+	policy := mach.UnwedgePolicy
+	if policy.Disabled {
+		return
+	} else if failures < policy.FailureThreshold {
+		mach.Log.Debug("Not unwedging session with %s/%s yet (%d/%d failures)", sender, senderKey, failures, policy.FailureThreshold)
+		return
+	}
+	go mach.unwedgeDevice(sender, senderKey)
+}
+
+// takeUnwedgeRateLimit checks whether a new session can be created under the global rate limit and reserves it.
+func (mach *OlmMachine) takeUnwedgeRateLimit() bool {
+	limit := mach.UnwedgePolicy.MaxPerHour
+	if limit <= 0 {
+		return true
+	}
+	mach.olmHealthLock.Lock()
+	defer mach.olmHealthLock.Unlock()
+	cutoff := time.Now().Add(-1 * time.Hour)
+	recent := mach.recentUnwedges[:0]
+	for _, ts := range mach.recentUnwedges {
+		if ts.After(cutoff) {
+			recent = append(recent, ts)
+		}
+	}
+	mach.recentUnwedges = recent
+	if len(recent) >= limit {
+		return false
+	}
+	mach.recentUnwedges = append(mach.recentUnwedges, time.Now())
+	return true
+}
+
+// reserveUnwedge marks an automatic unwedge of the given device as in progress. It returns false if another
+// unwedge is already in progress, so that concurrent decryption failures from one device don't all pass the
+// MinInterval check before the first one has stored the new unwedge time.
+func (mach *OlmMachine) reserveUnwedge(senderKey id.SenderKey) bool {
+	mach.olmHealthLock.Lock()
+	defer mach.olmHealthLock.Unlock()
+	health := mach.getOlmHealth(senderKey)
+	if health.unwedgeInProgress {
+		return false
+	}
+	health.unwedgeInProgress = true
+	return true
+}
+
+func (mach *OlmMachine) releaseUnwedge(senderKey id.SenderKey) {
+	mach.olmHealthLock.Lock()
+	mach.getOlmHealth(senderKey).unwedgeInProgress = false
+	mach.olmHealthLock.Unlock()
+}
+
+func (mach *OlmMachine) unwedgeDevice(sender id.UserID, senderKey id.SenderKey) {
+	if !mach.reserveUnwedge(senderKey) {
+		mach.Log.Debug("Not creating new Olm session with %s/%s, another recreation is already in progress", sender, senderKey)
+		return
+	}
+	defer mach.releaseUnwedge(senderKey)
+
+	prevUnwedge, err := mach.CryptoStore.GetOlmUnwedgeTime(senderKey)
+	if err != nil {
+		mach.Log.Warn("Failed to get previous unwedge time of %s/%s: %v", sender, senderKey, err)
+	} else if delta := time.Since(prevUnwedge); !prevUnwedge.IsZero() && delta < mach.UnwedgePolicy.MinInterval {
+		mach.Log.Debug("Not creating new Olm session with %s/%s, previous recreation was %s ago", sender, senderKey, delta)
+		return
+	}
+
+	deviceIdentity, err := mach.GetOrFetchDeviceByKey(sender, senderKey)
+	if err != nil {
+		mach.Log.Error("Failed to find device info by identity key: %v", err)
+		return
+	} else if deviceIdentity == nil {
+		mach.Log.Warn("Didn't find identity of %s/%s, can't unwedge session", sender, senderKey)
+		return
+	}
+
+	if !mach.takeUnwedgeRateLimit() {
+		mach.Log.Warn("Not creating new Olm session with %s/%s: %v", sender, senderKey, ErrUnwedgeRateLimited)
+		return
+	}
+	err = mach.RecreateOlmSession(deviceIdentity)
+	if err != nil {
+		mach.Log.Error("Failed to unwedge session with %s/%s: %v", sender, senderKey, err)
+	}
+}
+
+// RecreateOlmSession creates a new Olm session with the given device and sends an m.dummy event through it,
+// so that both sides switch to the new session. The unwedge policy is not applied to manual calls.
+func (mach *OlmMachine) RecreateOlmSession(device *DeviceIdentity) error {
+	mach.Log.Debug("Creating new Olm session with %s/%s (key: %s)", device.UserID, device.DeviceID, device.IdentityKey)
+	err := mach.CryptoStore.PutOlmUnwedgeTime(device.IdentityKey, time.Now())
+	if err != nil {
+		mach.Log.Warn("Failed to store unwedge time of %s/%s: %v", device.UserID, device.DeviceID, err)
+	}
+	mach.olmHealthLock.Lock()
+	mach.getOlmHealth(device.IdentityKey).pendingUnwedge = true
+	mach.olmHealthLock.Unlock()
+	err = mach.SendEncryptedToDevice(device, event.ToDeviceDummy, event.Content{})
+	if err != nil {
+		return fmt.Errorf("failed to send dummy event: %w", err)
+	}
+	return nil
+}
+
+// takePendingUnwedge returns true if a new session should be created with the given device because the
+// existing one was wedged, and clears the flag.
+func (mach *OlmMachine) takePendingUnwedge(identityKey id.IdentityKey) bool {
+	mach.olmHealthLock.Lock()
+	defer mach.olmHealthLock.Unlock()
+	health, ok := mach.olmHealth[identityKey]
+	if !ok || !health.pendingUnwedge {
+		return false
+	}
+	health.pendingUnwedge = false
+	return true
+}
+
+// OlmSessionDiagnostics contains information about a single Olm session with another device.
+type OlmSessionDiagnostics struct {
+	SessionID     id.SessionID `json:"session_id"`
+	CreatedAt     time.Time    `json:"created_at"`
+	LastEncrypted time.Time    `json:"last_encrypted"`
+	LastDecrypted time.Time    `json:"last_decrypted"`
+	// Failures is the number of prekey messages that matched this session, but failed to decrypt.
+	Failures int `json:"failures"`
+	// Preferred is true if this is the session that is used for encrypting new messages to the device.
+	Preferred bool `json:"preferred"`
+	Expired   bool `json:"expired"`
+}
+
+// OlmDeviceDiagnostics contains information about the state of the Olm sessions with another device.
+type OlmDeviceDiagnostics struct {
+	UserID      id.UserID      `json:"user_id"`
+	DeviceID    id.DeviceID    `json:"device_id"`
+	IdentityKey id.IdentityKey `json:"identity_key"`
+
+	Sessions []OlmSessionDiagnostics `json:"sessions"`
+
+	// ConsecutiveFailures is the number of messages from the device that failed to decrypt since the last
+	// successfully decrypted message. TotalFailures counts all failures since the machine was started.
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	TotalFailures       int       `json:"total_failures"`
+	LastFailure         time.Time `json:"last_failure"`
+	LastFailureReason   string    `json:"last_failure_reason,omitempty"`
+	LastSuccess         time.Time `json:"last_success"`
+
+	// LastUnwedge is the last time a new session was created to recover from a broken session.
+	LastUnwedge time.Time `json:"last_unwedge"`
+	// UnwedgePending is true if a new session will be created the next time something is encrypted for the device.
+	UnwedgePending bool `json:"unwedge_pending"`
+}
+
+// GetOlmDeviceDiagnostics returns information about the Olm sessions with the given device.
+// Failure counters are only kept in memory, so they're reset when the machine is restarted.
+func (mach *OlmMachine) GetOlmDeviceDiagnostics(device *DeviceIdentity) (*OlmDeviceDiagnostics, error) {
+	sessions, err := mach.CryptoStore.GetSessions(device.IdentityKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions: %w", err)
+	}
+	latest, err := mach.CryptoStore.GetLatestSession(device.IdentityKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest session: %w", err)
+	}
+	lastUnwedge, err := mach.CryptoStore.GetOlmUnwedgeTime(device.IdentityKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get unwedge time: %w", err)
+	}
+	diag := &OlmDeviceDiagnostics{
+		UserID:      device.UserID,
+		DeviceID:    device.DeviceID,
+		IdentityKey: device.IdentityKey,
+		Sessions:    make([]OlmSessionDiagnostics, len(sessions)),
+		LastUnwedge: lastUnwedge,
+	}
+	mach.olmHealthLock.Lock()
+	health, hasHealth := mach.olmHealth[device.IdentityKey]
+	if hasHealth {
+		diag.ConsecutiveFailures = health.consecutiveFailures
+		diag.TotalFailures = health.totalFailures
+		diag.LastFailure = health.lastFailure
+		diag.LastFailureReason = health.lastFailureReason
+		diag.LastSuccess = health.lastSuccess
+		diag.UnwedgePending = health.pendingUnwedge
+	}
+	for i, session := range sessions {
+		diag.Sessions[i] = OlmSessionDiagnostics{
+			SessionID:     session.ID(),
+			CreatedAt:     session.CreationTime,
+			LastEncrypted: session.LastEncryptedTime,
+			LastDecrypted: session.LastDecryptedTime,
+			Preferred:     latest != nil && latest.ID() == session.ID(),
+			Expired:       session.Expired(),
+		}
+		if hasHealth {
+			diag.Sessions[i].Failures = health.sessionFailures[session.ID()]
+		}
+	}
+	mach.olmHealthLock.Unlock()
+	return diag, nil
+}
+
+// GetOlmUserDiagnostics returns information about the Olm sessions with all the known devices of the given user.
+func (mach *OlmMachine) GetOlmUserDiagnostics(userID id.UserID) ([]*OlmDeviceDiagnostics, error) {
+	devices, err := mach.CryptoStore.GetDevices(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get devices: %w", err)
+	}
+	diags := make([]*OlmDeviceDiagnostics, 0, len(devices))
+	for _, device := range devices {
+		diag, err := mach.GetOlmDeviceDiagnostics(device)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get diagnostics of %s: %w", device.DeviceID, err)
+		}
+		diags = append(diags, diag)
+	}
+	return diags, nil
+}
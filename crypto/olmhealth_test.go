@@ -0,0 +1,133 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func newUnwedgeTestMachines(t *testing.T) (*OlmMachine, *OlmMachine, *fakeKeyServer) {
+	machineOut, storeFileNameOut := newMachine(t, "user1")
+	t.Cleanup(func() { os.Remove(storeFileNameOut) })
+	machineIn, storeFileNameIn := newMachine(t, "user2")
+	t.Cleanup(func() { os.Remove(storeFileNameIn) })
+	machineOut.CryptoStore.PutDevices("user2", map[id.DeviceID]*DeviceIdentity{
+		"device1": {
+			UserID:      "user2",
+			DeviceID:    "device1",
+			IdentityKey: machineIn.account.IdentityKey(),
+			SigningKey:  machineIn.account.SigningKey(),
+		},
+	})
+
+	server := &fakeKeyServer{t: t, machineIn: machineIn}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	machineOut.Client.HomeserverURL, _ = url.Parse(httpServer.URL)
+	return machineOut, machineIn, server
+}
+
+func (fks *fakeKeyServer) sentCount() int {
+	fks.lock.Lock()
+	defer fks.lock.Unlock()
+	return len(fks.sentToDevice)
+}
+
+func TestOlmMachine_UnwedgeThreshold(t *testing.T) {
+	machineOut, machineIn, server := newUnwedgeTestMachines(t)
+	machineOut.UnwedgePolicy = OlmUnwedgePolicy{FailureThreshold: 2, MinInterval: time.Hour}
+	senderKey := machineIn.account.IdentityKey()
+	reason := errors.New("test failure")
+
+	machineOut.handleOlmDecryptionFailure("user2", senderKey, reason)
+	time.Sleep(100 * time.Millisecond)
+	if sent := server.sentCount(); sent != 0 {
+		t.Fatalf("Expected no new session below the failure threshold, got %d to-device requests", sent)
+	}
+
+	machineOut.handleOlmDecryptionFailure("user2", senderKey, reason)
+	deadline := time.Now().Add(5 * time.Second)
+	for server.sentCount() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sent := server.sentCount(); sent != 1 {
+		t.Fatalf("Expected a new session after reaching the failure threshold, got %d to-device requests", sent)
+	}
+	if unwedgeTime, _ := machineOut.CryptoStore.GetOlmUnwedgeTime(senderKey); unwedgeTime.IsZero() {
+		t.Error("Expected unwedge time to be stored")
+	}
+
+	// Further failures within the minimum interval must not create new sessions
+	machineOut.unwedgeDevice("user2", senderKey)
+	if sent := server.sentCount(); sent != 1 {
+		t.Errorf("Expected no new session within the minimum interval, got %d to-device requests", sent)
+	}
+}
+
+func TestOlmMachine_UnwedgeConcurrent(t *testing.T) {
+	machineOut, machineIn, server := newUnwedgeTestMachines(t)
+	machineOut.UnwedgePolicy = OlmUnwedgePolicy{FailureThreshold: 1, MinInterval: time.Hour}
+	senderKey := machineIn.account.IdentityKey()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			machineOut.unwedgeDevice("user2", senderKey)
+		}()
+	}
+	wg.Wait()
+	if sent := server.sentCount(); sent != 1 {
+		t.Errorf("Expected concurrent failures to create exactly one new session, got %d to-device requests", sent)
+	}
+}
+
+func TestOlmMachine_UnwedgeDisabled(t *testing.T) {
+	machineOut, machineIn, server := newUnwedgeTestMachines(t)
+	machineOut.UnwedgePolicy = OlmUnwedgePolicy{Disabled: true, FailureThreshold: 1}
+	machineOut.handleOlmDecryptionFailure("user2", machineIn.account.IdentityKey(), errors.New("test failure"))
+	time.Sleep(100 * time.Millisecond)
+	if sent := server.sentCount(); sent != 0 {
+		t.Errorf("Expected no new session with unwedging disabled, got %d to-device requests", sent)
+	}
+}
+
+func TestOlmMachine_OlmHealthEviction(t *testing.T) {
+	mach, storeFileName := newMachine(t, "user1")
+	defer os.Remove(storeFileName)
+
+	mach.markOlmSessionFailed("key1", "session1")
+	mach.markOlmSessionFailed("key2", "session2")
+	mach.olmHealthLock.Lock()
+	mach.olmHealth["key1"].lastSeen = time.Now().Add(-2 * OlmHealthTTL)
+	mach.olmHealth["key2"].lastSeen = time.Now().Add(-2 * OlmHealthTTL)
+	mach.olmHealth["key2"].pendingUnwedge = true
+	mach.olmHealthSwept = time.Time{}
+	mach.olmHealthLock.Unlock()
+
+	mach.markOlmDecryptionSuccess("key3")
+	mach.olmHealthLock.Lock()
+	defer mach.olmHealthLock.Unlock()
+	if _, ok := mach.olmHealth["key1"]; ok {
+		t.Error("Expected stale health entry to be evicted")
+	}
+	if _, ok := mach.olmHealth["key2"]; !ok {
+		t.Error("Expected health entry with a pending unwedge to be kept")
+	}
+	if _, ok := mach.olmHealth["key3"]; !ok {
+		t.Error("Expected new health entry to be added")
+	}
+}
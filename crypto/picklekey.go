@@ -0,0 +1,71 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+var ErrEmptyPickleKey = errors.New("pickle key is empty")
+
+// PickleKeyProvider provides the key that is used to encrypt the crypto material in a crypto store.
+type PickleKeyProvider interface {
+	GetPickleKey() ([]byte, error)
+}
+
+// StaticPickleKey is a PickleKeyProvider that always returns the same hardcoded key.
+type StaticPickleKey []byte
+
+func (key StaticPickleKey) GetPickleKey() ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyPickleKey
+	}
+	return key, nil
+}
+
+// FilePickleKey is a PickleKeyProvider that reads the key from the file at the given path,
+// e.g. a secret mounted into a container. Leading and trailing whitespace is ignored.
+type FilePickleKey string
+
+func (path FilePickleKey) GetPickleKey() ([]byte, error) {
+	data, err := os.ReadFile(string(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pickle key file: %w", err)
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%w (file %s)", ErrEmptyPickleKey, string(path))
+	}
+	return key, nil
+}
+
+// EnvPickleKey is a PickleKeyProvider that reads the key from the environment variable with the given name.
+type EnvPickleKey string
+
+func (name EnvPickleKey) GetPickleKey() ([]byte, error) {
+	key := os.Getenv(string(name))
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%w (environment variable %s)", ErrEmptyPickleKey, string(name))
+	}
+	return []byte(key), nil
+}
+
+// NewSQLCryptoStoreWithKeyProvider initializes a new crypto Store like NewSQLCryptoStore,
+// but gets the pickle key from the given provider.
+func NewSQLCryptoStoreWithKeyProvider(db *dbutil.Database, accountID string, deviceID id.DeviceID, keyProvider PickleKeyProvider) (*SQLCryptoStore, error) {
+	pickleKey, err := keyProvider.GetPickleKey()
+	if err != nil {
+		return nil, err
+	}
+	return NewSQLCryptoStore(db, accountID, deviceID, pickleKey), nil
+}
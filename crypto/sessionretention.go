@@ -0,0 +1,173 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MembershipStateStore is an optional extension of StateStore that provides the membership of users in rooms.
+//
+// It is required for deleting the sessions of rooms that have been left (GroupSessionRetention.DeleteLeftRooms).
+type MembershipStateStore interface {
+	// TryGetMember returns the member event content of the given user in the given room.
+	// The boolean is false if the membership is not known.
+	TryGetMember(roomID id.RoomID, userID id.UserID) (*event.MemberEventContent, bool)
+}
+
+// GroupSessionRetention configures which inbound group sessions and message indices are deleted by PruneGroupSessions.
+type GroupSessionRetention struct {
+	// DeleteLeftRooms deletes all sessions of rooms that our user has left or been banned from.
+	// This requires the StateStore to implement MembershipStateStore.
+	DeleteLeftRooms bool
+	// DeleteExpired deletes sessions that are past the max age or max message count that was sent with the room key.
+	DeleteExpired bool
+	// ExpiryGracePeriod is added to the max age of sessions before considering them expired,
+	// so that delayed messages can still be decrypted.
+	ExpiryGracePeriod time.Duration
+	// MessageIndexMaxAge is the maximum age of the message indices stored for detecting replay attacks.
+	// Indices older than this are deleted. Zero means that indices are never deleted.
+	MessageIndexMaxAge time.Duration
+}
+
+// GroupSessionPruneResult contains the number of entries deleted by PruneGroupSessions.
+type GroupSessionPruneResult struct {
+	LeftRoomSessions int64
+	ExpiredSessions  int64
+	MessageIndices   int64
+}
+
+// RoomGroupSessionReport contains statistics about the inbound group sessions of a single room.
+type RoomGroupSessionReport struct {
+	RoomID    id.RoomID
+	Sessions  int
+	Forwarded int
+	Expired   int
+}
+
+// IsExpired returns true if the session has been used for more messages than the max message count that was sent
+// with the key, or if the session is older than its max age plus the given grace period.
+//
+// latestIndex is the highest message index that has been decrypted with the session, or -1 if it's not known.
+func (igs *InboundGroupSession) IsExpired(latestIndex int64, gracePeriod time.Duration) bool {
+	if igs.MaxAge > 0 && !igs.ReceivedAt.IsZero() && time.Since(igs.ReceivedAt) > igs.MaxAge+gracePeriod {
+		return true
+	}
+	return igs.MaxMessages > 0 && latestIndex+1 >= int64(igs.MaxMessages)
+}
+
+// makeGroupSessionReport counts the given sessions per room. latestIndices contains the highest decrypted message
+// index of each session, or -1 if it's not known.
+func makeGroupSessionReport(sessions []*InboundGroupSession, latestIndices []int64, gracePeriod time.Duration) []RoomGroupSessionReport {
+	reportIndex := make(map[id.RoomID]int)
+	var reports []RoomGroupSessionReport
+	for i, igs := range sessions {
+		index, ok := reportIndex[igs.RoomID]
+		if !ok {
+			index = len(reports)
+			reportIndex[igs.RoomID] = index
+			reports = append(reports, RoomGroupSessionReport{RoomID: igs.RoomID})
+		}
+		report := &reports[index]
+		report.Sessions++
+		if igs.IsForwarded() {
+			report.Forwarded++
+		}
+		if igs.IsExpired(latestIndices[i], gracePeriod) {
+			report.Expired++
+		}
+	}
+	return reports
+}
+
+func (mach *OlmMachine) hasLeftRoom(roomID id.RoomID) bool {
+	memberStore, ok := mach.StateStore.(MembershipStateStore)
+	if !ok {
+		return false
+	}
+	member, ok := memberStore.TryGetMember(roomID, mach.Client.UserID)
+	return ok && member != nil && (member.Membership == event.MembershipLeave || member.Membership == event.MembershipBan)
+}
+
+// PruneGroupSessions deletes inbound group sessions and message indices according to the given retention policy.
+func (mach *OlmMachine) PruneGroupSessions(retention GroupSessionRetention) (*GroupSessionPruneResult, error) {
+	var result GroupSessionPruneResult
+	if retention.DeleteLeftRooms {
+		if _, ok := mach.StateStore.(MembershipStateStore); !ok {
+			mach.Log.Warn("State store doesn't provide room memberships, not deleting sessions of left rooms")
+		} else {
+			reports, err := mach.CryptoStore.GetGroupSessionReport(retention.ExpiryGracePeriod)
+			if err != nil {
+				return &result, fmt.Errorf("failed to get rooms with group sessions: %w", err)
+			}
+			for _, report := range reports {
+				if !mach.hasLeftRoom(report.RoomID) {
+					continue
+				}
+				count, err := mach.CryptoStore.RemoveGroupSessionsForRoom(report.RoomID)
+				if err != nil {
+					return &result, fmt.Errorf("failed to delete sessions of %s: %w", report.RoomID, err)
+				}
+				mach.Log.Debug("Deleted %d sessions of %s as we've left the room", count, report.RoomID)
+				result.LeftRoomSessions += count
+			}
+		}
+	}
+	if retention.DeleteExpired {
+		count, err := mach.CryptoStore.RemoveExpiredGroupSessions(retention.ExpiryGracePeriod)
+		if err != nil {
+			return &result, fmt.Errorf("failed to delete expired sessions: %w", err)
+		}
+		result.ExpiredSessions = count
+	}
+	if retention.MessageIndexMaxAge > 0 {
+		before := time.Now().Add(-retention.MessageIndexMaxAge).UnixNano() / int64(time.Millisecond)
+		count, err := mach.CryptoStore.PruneMessageIndices(before)
+		if err != nil {
+			return &result, fmt.Errorf("failed to prune message indices: %w", err)
+		}
+		result.MessageIndices = count
+	}
+	mach.Log.Debug("Pruned %d sessions of left rooms, %d expired sessions and %d message indices",
+		result.LeftRoomSessions, result.ExpiredSessions, result.MessageIndices)
+	return &result, nil
+}
+
+// StartGroupSessionPruning runs PruneGroupSessions with the given retention policy immediately and then periodically
+// at the given interval until the context is cancelled. Errors are logged and don't stop the loop.
+func (mach *OlmMachine) StartGroupSessionPruning(ctx context.Context, interval time.Duration, retention GroupSessionRetention) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			_, err := mach.PruneGroupSessions(retention)
+			if err != nil {
+				mach.Log.Error("Failed to prune group sessions: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// GetGroupSessionReport returns the number of inbound group sessions stored for each room. Expired sessions are
+// counted without a grace period.
+func (mach *OlmMachine) GetGroupSessionReport() ([]RoomGroupSessionReport, error) {
+	reports, err := mach.CryptoStore.GetGroupSessionReport(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get group session report: %w", err)
+	}
+	return reports, nil
+}
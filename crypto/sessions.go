@@ -8,6 +8,7 @@ package crypto
 
 import (
 	"errors"
+	"sync"
 	"time"
 
 	"maunium.net/go/mautrix/crypto/olm"
@@ -22,7 +23,7 @@ var (
 )
 
 // OlmSessionList is a list of OlmSessions.
-// It implements sort.Interface so that the session with recent successful decryptions comes first.
+// It implements sort.Interface so that the most recently used session comes first.
 type OlmSessionList []*OlmSession
 
 func (o OlmSessionList) Len() int {
@@ -30,7 +31,7 @@ func (o OlmSessionList) Len() int {
 }
 
 func (o OlmSessionList) Less(i, j int) bool {
-	return o[i].LastDecryptedTime.After(o[j].LastEncryptedTime)
+	return o[i].LastUsedTime().After(o[j].LastUsedTime())
 }
 
 func (o OlmSessionList) Swap(i, j int) {
@@ -89,6 +90,20 @@ func (session *OlmSession) Decrypt(ciphertext string, msgType id.OlmMsgType) ([]
 	return msg, err
 }
 
+// KeySource describes where an inbound group session was received from.
+type KeySource string
+
+const (
+	// KeySourceUnknown is used for sessions that were stored before the source was tracked.
+	KeySourceUnknown KeySource = ""
+	// KeySourceDirect means the session was received in a m.room_key event from the sender device.
+	KeySourceDirect KeySource = "direct"
+	// KeySourceForwarded means the session was received in a m.forwarded_room_key event from another device.
+	KeySourceForwarded KeySource = "forwarded"
+	// KeySourceImport means the session was imported from a key export file.
+	KeySourceImport KeySource = "import"
+)
+
 type InboundGroupSession struct {
 	Internal olm.InboundGroupSession
 
@@ -97,6 +112,15 @@ type InboundGroupSession struct {
 	RoomID     id.RoomID
 
 	ForwardingChains []string
+	// SharedHistory is true if the session can be shared with users invited to the room later (MSC3061).
+	SharedHistory bool
+	// KeySource is where the session was received from.
+	KeySource KeySource
+	// ReceivedAt is when the session was received or imported.
+	ReceivedAt time.Time
+	// MaxAge and MaxMessages are the rotation settings that the sender sent with the key, or zero if they're unknown.
+	MaxAge      time.Duration
+	MaxMessages int
 
 	id id.SessionID
 }
@@ -112,6 +136,7 @@ func NewInboundGroupSession(senderKey id.SenderKey, signingKey id.Ed25519, roomI
 		SenderKey:        senderKey,
 		RoomID:           roomID,
 		ForwardingChains: nil,
+		ReceivedAt:       time.Now(),
 	}, nil
 }
 
@@ -122,6 +147,20 @@ func (igs *InboundGroupSession) ID() id.SessionID {
 	return igs.id
 }
 
+// IsForwarded returns true if the session wasn't received directly from the sender device,
+// which means the signing key in the session is only claimed by whoever forwarded it.
+func (igs *InboundGroupSession) IsForwarded() bool {
+	if igs.KeySource == KeySourceForwarded || igs.KeySource == KeySourceImport {
+		return true
+	}
+	for _, chain := range igs.ForwardingChains {
+		if chain != "" {
+			return true
+		}
+	}
+	return false
+}
+
 type OGSState int
 
 const (
@@ -130,6 +169,19 @@ const (
 	OGSIgnored
 )
 
+func (state OGSState) String() string {
+	switch state {
+	case OGSNotShared:
+		return "not_shared"
+	case OGSAlreadyShared:
+		return "shared"
+	case OGSIgnored:
+		return "ignored"
+	default:
+		return ""
+	}
+}
+
 type UserDevice struct {
 	UserID   id.UserID
 	DeviceID id.DeviceID
@@ -142,12 +194,17 @@ type OutboundGroupSession struct {
 	MaxMessages  int
 	MessageCount int
 
+	// Users contains the sharing state of the session for each device. It's modified while the session is being
+	// shared, so it should only be read with UserStates if the session may be in use.
 	Users  map[UserDevice]OGSState
 	RoomID id.RoomID
 	Shared bool
+	// SharedHistory is true if the room's history was visible to invited users when the session was created (MSC3061).
+	SharedHistory bool
 
-	id      id.SessionID
-	content *event.RoomKeyEventContent
+	id        id.SessionID
+	content   *event.RoomKeyEventContent
+	usersLock sync.RWMutex
 }
 
 func NewOutboundGroupSession(roomID id.RoomID, encryptionContent *event.EncryptionEventContent) *OutboundGroupSession {
@@ -176,6 +233,33 @@ func NewOutboundGroupSession(roomID id.RoomID, encryptionContent *event.Encrypti
 	return ogs
 }
 
+func (ogs *OutboundGroupSession) getUserState(key UserDevice) OGSState {
+	ogs.usersLock.RLock()
+	defer ogs.usersLock.RUnlock()
+	return ogs.Users[key]
+}
+
+func (ogs *OutboundGroupSession) setUserState(key UserDevice, state OGSState) {
+	ogs.usersLock.Lock()
+	if ogs.Users == nil {
+		ogs.Users = make(map[UserDevice]OGSState)
+	}
+	ogs.Users[key] = state
+	ogs.usersLock.Unlock()
+}
+
+// UserStates returns a copy of the sharing state of the session for each device.
+// It's safe to call while the session is being shared.
+func (ogs *OutboundGroupSession) UserStates() map[UserDevice]OGSState {
+	ogs.usersLock.RLock()
+	defer ogs.usersLock.RUnlock()
+	states := make(map[UserDevice]OGSState, len(ogs.Users))
+	for key, state := range ogs.Users {
+		states[key] = state
+	}
+	return states
+}
+
 func (ogs *OutboundGroupSession) ShareContent() event.Content {
 	if ogs.content == nil {
 		ogs.content = &event.RoomKeyEventContent{
@@ -183,6 +267,11 @@ func (ogs *OutboundGroupSession) ShareContent() event.Content {
 			RoomID:     ogs.RoomID,
 			SessionID:  ogs.ID(),
 			SessionKey: ogs.Internal.Key(),
+
+			SharedHistory: ogs.SharedHistory,
+
+			MaxAge:      ogs.MaxAge.Milliseconds(),
+			MaxMessages: ogs.MaxMessages,
 		}
 	}
 	return event.Content{Parsed: ogs.content}
@@ -216,6 +305,14 @@ type TimeMixin struct {
 	LastDecryptedTime time.Time
 }
 
+// LastUsedTime returns the last time the session was used for either encrypting or decrypting.
+func (tm *TimeMixin) LastUsedTime() time.Time {
+	if tm.LastEncryptedTime.After(tm.LastDecryptedTime) {
+		return tm.LastEncryptedTime
+	}
+	return tm.LastDecryptedTime
+}
+
 type ExpirationMixin struct {
 	TimeMixin
 	MaxAge time.Duration
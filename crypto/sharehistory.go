@@ -0,0 +1,182 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrHistoryNotShared = errors.New("room history visibility doesn't allow sharing history with invited users")
+	ErrNoDevicesToShare = errors.New("user doesn't have any devices to share history with")
+)
+
+// HistoryVisibilityStateStore is an optional extension of StateStore that provides the history visibility of rooms.
+// The appservice state stores (appservice.BasicStateStore and sqlstatestore) implement this interface and track the
+// history visibility from the m.room.history_visibility events they receive.
+//
+// The history visibility is never fetched from the homeserver, because it's checked every time an outbound session
+// is created. If the StateStore doesn't implement this interface or doesn't know the history visibility of a room,
+// the room's history is treated as not shared.
+type HistoryVisibilityStateStore interface {
+	// GetHistoryVisibility returns the current history visibility of a room, or an empty string if it's not known.
+	GetHistoryVisibility(id.RoomID) event.HistoryVisibility
+	SetHistoryVisibility(id.RoomID, event.HistoryVisibility)
+}
+
+// isHistoryShared returns true if users invited to the given room are allowed to see messages sent before they joined.
+func (mach *OlmMachine) isHistoryShared(roomID id.RoomID) bool {
+	hvStore, ok := mach.StateStore.(HistoryVisibilityStateStore)
+	if !ok {
+		return false
+	}
+	visibility := hvStore.GetHistoryVisibility(roomID)
+	return visibility == event.HistoryVisibilityShared || visibility == event.HistoryVisibilityWorldReadable
+}
+
+// GetSharedHistorySessions returns the inbound group sessions in the given room that are marked as shareable
+// with users invited later (i.e. the sessions that ShareHistoryWith would send).
+func (mach *OlmMachine) GetSharedHistorySessions(roomID id.RoomID) ([]*InboundGroupSession, error) {
+	sessions, err := mach.CryptoStore.GetGroupSessionsForRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	var shared []*InboundGroupSession
+	for _, session := range sessions {
+		if session.SharedHistory {
+			shared = append(shared, session)
+		}
+	}
+	return shared, nil
+}
+
+func (mach *OlmMachine) findDevicesToShareHistory(userID id.UserID) map[id.DeviceID]*DeviceIdentity {
+	devices := mach.fetchKeys([]id.UserID{userID}, "", true)[userID]
+	if devices == nil {
+		mach.Log.Debug("Failed to fetch devices of %s for sharing history, falling back to stored devices", userID)
+		var err error
+		devices, err = mach.CryptoStore.GetDevices(userID)
+		if err != nil {
+			mach.Log.Error("Failed to get devices of %s: %v", userID, err)
+			return nil
+		}
+	}
+	identityChanged := !mach.AllowChangedIdentities && userID != mach.Client.UserID && mach.IsIdentityChanged(userID)
+	filtered := make(map[id.DeviceID]*DeviceIdentity, len(devices))
+	for deviceID, device := range devices {
+		if userID == mach.Client.UserID && deviceID == mach.ownDeviceID() {
+			continue
+		} else if device.Trust == TrustStateBlacklisted {
+			mach.Log.Debug("Not sharing history with %s of %s: device is blacklisted", deviceID, userID)
+		} else if !mach.AllowUnverifiedDevices && !mach.IsDeviceTrusted(device) {
+			mach.Log.Debug("Not sharing history with %s of %s: device is not verified", deviceID, userID)
+		} else if identityChanged {
+			mach.Log.Debug("Not sharing history with %s of %s: user's identity has changed", deviceID, userID)
+		} else {
+			filtered[deviceID] = device
+		}
+	}
+	return filtered
+}
+
+func (mach *OlmMachine) sendSharedHistorySessions(sessions []*InboundGroupSession, olmSessions map[id.DeviceID]deviceSessionWrapper) error {
+	forwardedRoomKeys := make([]event.Content, len(sessions))
+	for i, igs := range sessions {
+		exportedKey, err := igs.Internal.Export(igs.Internal.FirstKnownIndex())
+		if err != nil {
+			return fmt.Errorf("failed to export session %s: %w", igs.ID(), err)
+		}
+		forwardedRoomKeys[i] = event.Content{
+			Parsed: &event.ForwardedRoomKeyEventContent{
+				RoomKeyEventContent: event.RoomKeyEventContent{
+					Algorithm:  id.AlgorithmMegolmV1,
+					RoomID:     igs.RoomID,
+					SessionID:  igs.ID(),
+					SessionKey: exportedKey,
+
+					SharedHistory: true,
+				},
+				SenderKey:          igs.SenderKey,
+				ForwardingKeyChain: igs.ForwardingChains,
+				SenderClaimedKey:   igs.SigningKey,
+			},
+		}
+	}
+
+	mach.olmLock.Lock()
+	defer mach.olmLock.Unlock()
+	// A to-device request can only hold one event per device, so every request contains one session for all devices.
+	requests := make([]*mautrix.ReqSendToDevice, len(forwardedRoomKeys))
+	for i, forwardedRoomKey := range forwardedRoomKeys {
+		output := make(map[id.DeviceID]*event.Content, len(olmSessions))
+		var userID id.UserID
+		for deviceID, device := range olmSessions {
+			userID = device.identity.UserID
+			output[deviceID] = &event.Content{Parsed: mach.encryptOlmEvent(device.session, device.identity, event.ToDeviceForwardedRoomKey, forwardedRoomKey)}
+		}
+		requests[i] = &mautrix.ReqSendToDevice{Messages: map[id.UserID]map[id.DeviceID]*event.Content{userID: output}}
+	}
+	for i, req := range requests {
+		_, err := mach.Client.SendToDevice(event.ToDeviceEncrypted, req)
+		if err != nil {
+			return fmt.Errorf("failed to share session %s: %w", sessions[i].ID(), err)
+		}
+	}
+	return nil
+}
+
+// ShareHistoryWith forwards the keys of all shareable inbound group sessions in the given room to the devices of
+// the given user using m.forwarded_room_key events, so that a newly invited user can read messages sent before they
+// joined (MSC3061).
+//
+// Only sessions marked with the shared_history flag are sent, and only if the room's history visibility
+// (as reported by the StateStore) is currently shared or world_readable. Devices are filtered with the same rules
+// as ShareGroupSession: blacklisted devices never receive keys, unverified devices only receive keys if
+// AllowUnverifiedDevices is true, and users with changed identities only if AllowChangedIdentities is true.
+func (mach *OlmMachine) ShareHistoryWith(roomID id.RoomID, userID id.UserID) error {
+	if !mach.isHistoryShared(roomID) {
+		return ErrHistoryNotShared
+	}
+	sessions, err := mach.GetSharedHistorySessions(roomID)
+	if err != nil {
+		return fmt.Errorf("failed to get shareable sessions: %w", err)
+	} else if len(sessions) == 0 {
+		mach.Log.Debug("No shareable sessions in %s to share with %s", roomID, userID)
+		return nil
+	}
+
+	devices := mach.findDevicesToShareHistory(userID)
+	if len(devices) == 0 {
+		return ErrNoDevicesToShare
+	}
+	err = mach.createOutboundSessions(map[id.UserID]map[id.DeviceID]*DeviceIdentity{userID: devices})
+	if err != nil {
+		return fmt.Errorf("failed to create olm sessions: %w", err)
+	}
+	olmSessions := make(map[id.DeviceID]deviceSessionWrapper, len(devices))
+	for deviceID, device := range devices {
+		olmSess, err := mach.CryptoStore.GetLatestSession(device.IdentityKey)
+		if err != nil {
+			mach.Log.Error("Failed to get olm session for %s of %s: %v", deviceID, userID, err)
+		} else if olmSess == nil {
+			mach.Log.Warn("Didn't find an olm session for %s of %s, not sharing history with it", deviceID, userID)
+		} else {
+			olmSessions[deviceID] = deviceSessionWrapper{session: olmSess, identity: device}
+		}
+	}
+	if len(olmSessions) == 0 {
+		return ErrNoDevicesToShare
+	}
+
+	mach.Log.Debug("Sharing %d sessions in %s with %d devices of %s", len(sessions), roomID, len(olmSessions), userID)
+	return mach.sendSharedHistorySessions(sessions, olmSessions)
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type historyStateStore struct {
+	mockStateStore
+	lock       sync.Mutex
+	visibility map[id.RoomID]event.HistoryVisibility
+}
+
+func (store *historyStateStore) GetHistoryVisibility(roomID id.RoomID) event.HistoryVisibility {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.visibility[roomID]
+}
+
+func (store *historyStateStore) SetHistoryVisibility(roomID id.RoomID, visibility event.HistoryVisibility) {
+	store.lock.Lock()
+	store.visibility[roomID] = visibility
+	store.lock.Unlock()
+}
+
+// fakeKeyServer serves the endpoints ShareHistoryWith uses, with machineIn as the only device of user2.
+type fakeKeyServer struct {
+	t         *testing.T
+	machineIn *OlmMachine
+
+	lock         sync.Mutex
+	sentToDevice []*mautrix.ReqSendToDevice
+}
+
+func (fks *fakeKeyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fks.lock.Lock()
+	defer fks.lock.Unlock()
+	var resp interface{}
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/keys/query"):
+		resp = &mautrix.RespQueryKeys{
+			DeviceKeys: map[id.UserID]map[id.DeviceID]mautrix.DeviceKeys{
+				"user2": {"device1": *fks.machineIn.account.getInitialKeys("user2", "device1")},
+			},
+		}
+	case strings.HasSuffix(r.URL.Path, "/keys/claim"):
+		resp = &mautrix.RespClaimKeys{
+			OneTimeKeys: map[id.UserID]map[id.DeviceID]map[id.KeyID]mautrix.OneTimeKey{
+				"user2": {"device1": fks.machineIn.account.getOneTimeKeys("user2", "device1", 0)},
+			},
+		}
+	case strings.Contains(r.URL.Path, "/sendToDevice/"):
+		var req mautrix.ReqSendToDevice
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			fks.t.Errorf("Failed to decode to-device request: %v", err)
+		}
+		fks.sentToDevice = append(fks.sentToDevice, &req)
+		resp = struct{}{}
+	default:
+		fks.t.Errorf("Unexpected request to %s", r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func TestOlmMachine_ShareHistoryWith(t *testing.T) {
+	machineOut, storeFileNameOut := newMachine(t, "user1")
+	defer os.Remove(storeFileNameOut)
+	machineIn, storeFileNameIn := newMachine(t, "user2")
+	defer os.Remove(storeFileNameIn)
+	stateStore := &historyStateStore{visibility: map[id.RoomID]event.HistoryVisibility{
+		"room1": event.HistoryVisibilityShared,
+		"room2": event.HistoryVisibilityJoined,
+	}}
+	machineOut.StateStore = stateStore
+	machineIn.CryptoStore.PutDevices("user1", map[id.DeviceID]*DeviceIdentity{
+		"device1": {
+			UserID:      "user1",
+			DeviceID:    "device1",
+			IdentityKey: machineOut.account.IdentityKey(),
+			SigningKey:  machineOut.account.SigningKey(),
+		},
+	})
+
+	server := &fakeKeyServer{t: t, machineIn: machineIn}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	machineOut.Client.HomeserverURL, _ = url.Parse(httpServer.URL)
+
+	sharedSession := machineOut.newOutboundGroupSession("room1")
+	if !sharedSession.SharedHistory {
+		t.Fatal("Session in room with shared history visibility wasn't marked as shared history")
+	}
+	if unsharedSession := machineOut.newOutboundGroupSession("room2"); unsharedSession.SharedHistory {
+		t.Error("Session in room with joined history visibility was marked as shared history")
+	}
+	if err := machineOut.ShareHistoryWith("room2", "user2"); !errors.Is(err, ErrHistoryNotShared) {
+		t.Errorf("Expected ErrHistoryNotShared for room with joined history visibility, got %v", err)
+	}
+
+	// Unknown history visibility isn't fetched from the server (the fake server fails on state requests)
+	if unknownSession := machineOut.newOutboundGroupSession("room3"); unknownSession.SharedHistory {
+		t.Error("Session in room with unknown history visibility was marked as shared history")
+	}
+
+	// Every session in the room is forwarded in its own to-device request
+	secondSession := machineOut.newOutboundGroupSession("room1")
+	if err := machineOut.ShareHistoryWith("room1", "user2"); err != nil {
+		t.Fatalf("Failed to share history: %v", err)
+	}
+	if len(server.sentToDevice) != 2 {
+		t.Fatalf("Expected 2 to-device requests, got %d", len(server.sentToDevice))
+	}
+	forwardedSessions := make(map[id.SessionID]bool)
+	for _, req := range server.sentToDevice {
+		content := req.Messages["user2"]["device1"]
+		if content == nil {
+			t.Fatal("Expected to-device event for user2's device")
+		}
+		if err := content.ParseRaw(event.ToDeviceEncrypted); err != nil {
+			t.Fatalf("Failed to parse encrypted content: %v", err)
+		}
+		for _, ciphertext := range content.AsEncrypted().OlmCiphertext {
+			decrypted, err := machineIn.decryptAndParseOlmCiphertext("user1", machineOut.account.IdentityKey(), ciphertext.Type, ciphertext.Body, "test")
+			if err != nil {
+				t.Fatalf("Failed to decrypt olm ciphertext: %v", err)
+			}
+			if decrypted.Type != event.ToDeviceForwardedRoomKey {
+				t.Fatalf("Expected forwarded room key, got %s", decrypted.Type.Type)
+			}
+			_ = decrypted.Content.ParseRaw(event.ToDeviceForwardedRoomKey)
+			forwarded := decrypted.Content.AsForwardedRoomKey()
+			if forwarded.RoomID != "room1" || !forwarded.SharedHistory {
+				t.Errorf("Unexpected forwarded room key: %+v", forwarded)
+			}
+			forwardedSessions[forwarded.SessionID] = true
+		}
+	}
+	if !forwardedSessions[sharedSession.ID()] || !forwardedSessions[secondSession.ID()] {
+		t.Errorf("Expected both sessions to be forwarded, got %v", forwardedSessions)
+	}
+}
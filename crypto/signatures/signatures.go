@@ -0,0 +1,235 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package signatures implements signing and verifying JSON objects following the Matrix specification:
+// https://spec.matrix.org/v1.3/appendices/#signing-json
+//
+// The functions accept arbitrary Go values (which are encoded with encoding/json, so `json` tags are honored)
+// as well as raw JSON ([]byte or json.RawMessage). They work for any signed object in the spec, e.g. device keys,
+// cross-signing keys, key backup auth_data and server keys.
+package signatures
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+
+	"maunium.net/go/mautrix/crypto/canonicaljson"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrInvalidJSON          = errors.New("invalid JSON")
+	ErrNotObject            = errors.New("signed JSON must be an object")
+	ErrMalformedSignatures  = errors.New("malformed signatures object")
+	ErrSignatureNotFound    = errors.New("signature not found")
+	ErrInvalidSignature     = errors.New("invalid signature")
+	ErrInvalidKey           = errors.New("invalid public key")
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+)
+
+// Signatures is the content of the signatures field of a signed object: a map from entity (a user ID, or a server
+// name for server keys) to key ID to unpadded base64 signature. It has the same underlying type as
+// mautrix.Signatures, so the two can be converted to each other directly.
+type Signatures map[id.UserID]map[id.KeyID]string
+
+// Get returns the signature by the given key, or an empty string if there is no such signature.
+func (sigs Signatures) Get(entity id.UserID, keyID id.KeyID) string {
+	return sigs[entity][keyID]
+}
+
+// Set adds a signature to the map.
+func (sigs Signatures) Set(entity id.UserID, keyID id.KeyID, signature string) {
+	keys, ok := sigs[entity]
+	if !ok {
+		keys = make(map[id.KeyID]string)
+		sigs[entity] = keys
+	}
+	keys[keyID] = signature
+}
+
+// Signer creates signatures with a single private key.
+//
+// The signature must be returned as unpadded base64, which is what olm.PkSigning and olm.Account already return.
+type Signer interface {
+	Sign(message []byte) ([]byte, error)
+}
+
+// SignerFunc is a function that implements Signer.
+type SignerFunc func(message []byte) ([]byte, error)
+
+func (fn SignerFunc) Sign(message []byte) ([]byte, error) {
+	return fn(message)
+}
+
+// Ed25519Signer is a Signer that signs messages with an ed25519 private key in pure Go.
+type Ed25519Signer ed25519.PrivateKey
+
+func (key Ed25519Signer) Sign(message []byte) ([]byte, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid ed25519 private key length %d", len(key))
+	}
+	sig := ed25519.Sign(ed25519.PrivateKey(key), message)
+	return []byte(base64.RawStdEncoding.EncodeToString(sig)), nil
+}
+
+// PublicKey returns the public key of the private key in unpadded base64.
+func (key Ed25519Signer) PublicKey() id.Ed25519 {
+	return id.Ed25519(base64.RawStdEncoding.EncodeToString(ed25519.PrivateKey(key).Public().(ed25519.PublicKey)))
+}
+
+// SigningKey is a private key that signatures are created with.
+type SigningKey struct {
+	// Entity is the user ID or server name that owns the key.
+	Entity id.UserID
+	// KeyID is the key identifier, e.g. ed25519:DEVICEID or ed25519:<base64 public key>
+	KeyID  id.KeyID
+	Signer Signer
+}
+
+func marshal(obj interface{}) ([]byte, error) {
+	var objJSON []byte
+	switch typed := obj.(type) {
+	case json.RawMessage:
+		objJSON = typed
+	case []byte:
+		objJSON = typed
+	default:
+		var err error
+		objJSON, err = json.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !gjson.ValidBytes(objJSON) {
+		return nil, ErrInvalidJSON
+	} else if !gjson.ParseBytes(objJSON).IsObject() {
+		return nil, ErrNotObject
+	}
+	return objJSON, nil
+}
+
+func canonicalize(objJSON []byte) ([]byte, error) {
+	var err error
+	objJSON, err = sjson.DeleteBytes(objJSON, "unsigned")
+	if err != nil {
+		return nil, err
+	}
+	objJSON, err = sjson.DeleteBytes(objJSON, "signatures")
+	if err != nil {
+		return nil, err
+	}
+	return canonicaljson.CanonicalJSONAssumeValid(objJSON), nil
+}
+
+// CanonicalJSON returns the bytes that are signed for the given object: the canonical JSON encoding of the object
+// with the signatures and unsigned fields removed.
+func CanonicalJSON(obj interface{}) ([]byte, error) {
+	objJSON, err := marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	return canonicalize(objJSON)
+}
+
+func getSignatures(objJSON []byte) (Signatures, error) {
+	sigs := make(Signatures)
+	field := gjson.GetBytes(objJSON, "signatures")
+	if !field.Exists() {
+		return sigs, nil
+	} else if !field.IsObject() {
+		return nil, ErrMalformedSignatures
+	}
+	err := json.Unmarshal([]byte(field.Raw), &sigs)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedSignatures, err)
+	}
+	return sigs, nil
+}
+
+// GetSignatures returns the signatures that are in the given object.
+func GetSignatures(obj interface{}) (Signatures, error) {
+	objJSON, err := marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	return getSignatures(objJSON)
+}
+
+func sign(canonical []byte, keys []SigningKey, into Signatures) error {
+	for _, key := range keys {
+		signature, err := key.Signer.Sign(canonical)
+		if err != nil {
+			return fmt.Errorf("failed to sign with %s of %s: %w", key.KeyID, key.Entity, err)
+		}
+		into.Set(key.Entity, key.KeyID, string(signature))
+	}
+	return nil
+}
+
+// Sign signs the given object with all the given keys and returns the new signatures.
+// Existing signatures in the object are ignored and not included in the returned map.
+func Sign(obj interface{}, keys ...SigningKey) (Signatures, error) {
+	canonical, err := CanonicalJSON(obj)
+	if err != nil {
+		return nil, err
+	}
+	sigs := make(Signatures, len(keys))
+	err = sign(canonical, keys, sigs)
+	if err != nil {
+		return nil, err
+	}
+	return sigs, nil
+}
+
+// SignJSON signs the given object with all the given keys and returns the JSON of the object with the new
+// signatures merged into the existing signatures field. Other fields, including unsigned, are kept as-is.
+func SignJSON(obj interface{}, keys ...SigningKey) (json.RawMessage, error) {
+	objJSON, err := marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	sigs, err := getSignatures(objJSON)
+	if err != nil {
+		return nil, err
+	}
+	canonical, err := canonicalize(objJSON)
+	if err != nil {
+		return nil, err
+	}
+	err = sign(canonical, keys, sigs)
+	if err != nil {
+		return nil, err
+	}
+	sigsJSON, err := json.Marshal(sigs)
+	if err != nil {
+		return nil, err
+	}
+	return sjson.SetRawBytes(objJSON, "signatures", sigsJSON)
+}
+
+// VerifyEd25519 verifies an unpadded base64 ed25519 signature of the given message.
+// Padded base64 is also accepted for the key and the signature.
+func VerifyEd25519(message []byte, key id.Ed25519, signature string) error {
+	keyBytes, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(string(key), "="))
+	if err != nil || len(keyBytes) != ed25519.PublicKeySize {
+		return ErrInvalidKey
+	}
+	sigBytes, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(signature, "="))
+	if err != nil || len(sigBytes) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: malformed signature", ErrInvalidSignature)
+	}
+	if !ed25519.Verify(keyBytes, message, sigBytes) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signatures
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// The test vectors from https://spec.matrix.org/v1.3/appendices/#json-signing
+const specSeed = "YJDBA9Xnr2sVqXD9Vj7XVUnmFZcZrlw8Md7kMW+3XA1"
+
+func getSpecKey(t *testing.T) SigningKey {
+	seed, err := base64.RawStdEncoding.DecodeString(specSeed)
+	require.NoError(t, err)
+	return SigningKey{Entity: "domain", KeyID: "ed25519:1", Signer: Ed25519Signer(ed25519.NewKeyFromSeed(seed))}
+}
+
+func TestSign_SpecVectors(t *testing.T) {
+	key := getSpecKey(t)
+	assert.Equal(t, id.Ed25519("XGX0JRS2Af3be3knz2fBiRbApjm2Dh61gXDJA8kcJNI"), key.Signer.(Ed25519Signer).PublicKey())
+
+	sigs, err := Sign(json.RawMessage(`{}`), key)
+	require.NoError(t, err)
+	assert.Equal(t, "K8280/U9SSy9IVtjBuVeLr+HpOB4BQFWbg+UZaADMtTdGYI7Geitb76LTrr5QV/7Xg4ahLwYGYZzuHGZKM5ZAQ", sigs.Get("domain", "ed25519:1"))
+
+	sigs, err = Sign(map[string]interface{}{"two": "Two", "one": 1}, key)
+	require.NoError(t, err)
+	assert.Equal(t, "KqmLSbO39/Bzb0QIYE82zqLwsA+PDzYIpIRA2sRQ4sL53+sN6/fpNSoqE7BP7vBZhG6kYdD13EIMJpvhJI+6Bw", sigs.Get("domain", "ed25519:1"))
+}
+
+func TestSignJSON_KeepsExistingFields(t *testing.T) {
+	key := getSpecKey(t)
+	input := `{"one":1,"unsigned":{"age":5},"signatures":{"other":{"ed25519:x":"abc"}}}`
+	signed, err := SignJSON([]byte(input), key)
+	require.NoError(t, err)
+
+	sigs, err := GetSignatures(signed)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", sigs.Get("other", "ed25519:x"))
+	assert.NotEmpty(t, sigs.Get("domain", "ed25519:1"))
+
+	var parsed map[string]interface{}
+	require.NoError(t, json.Unmarshal(signed, &parsed))
+	assert.Contains(t, parsed, "unsigned")
+}
+
+func TestVerify(t *testing.T) {
+	key := getSpecKey(t)
+	pubKey := key.Signer.(Ed25519Signer).PublicKey()
+	signed, err := SignJSON(map[string]interface{}{"one": 1, "two": "Two"}, key)
+	require.NoError(t, err)
+
+	// Fields that aren't signed can be changed without invalidating the signature.
+	withUnsigned := json.RawMessage(`{"unsigned":{"foo":"bar"},` + string(signed[1:]))
+
+	result, err := Verify(withUnsigned,
+		VerificationKey{Entity: "domain", KeyID: "ed25519:1", Key: pubKey},
+		VerificationKey{Entity: "domain", KeyID: "ed25519:2", Key: pubKey},
+		VerificationKey{Entity: "domain", KeyID: "curve25519:1", Key: pubKey},
+	)
+	require.NoError(t, err)
+	require.Len(t, result.Results, 3)
+	assert.Equal(t, SignatureValid, result.Results[0].Status)
+	assert.Equal(t, SignatureMissing, result.Results[1].Status)
+	assert.Equal(t, SignatureUnsupported, result.Results[2].Status)
+	assert.True(t, result.AnyValid())
+	assert.False(t, result.AllValid())
+	assert.True(t, result.IsValid("domain", "ed25519:1"))
+	assert.True(t, errors.Is(result.Err(), ErrSignatureNotFound))
+	assert.Empty(t, result.Unverified)
+
+	assert.NoError(t, VerifyOne(signed, "domain", "ed25519:1", pubKey))
+	tampered := json.RawMessage(`{"one":2,` + string(signed[len(`{"one":1,`):]))
+	assert.True(t, errors.Is(VerifyOne(tampered, "domain", "ed25519:1", pubKey), ErrInvalidSignature))
+	assert.True(t, errors.Is(VerifyOne(signed, "domain", "ed25519:1", "invalid"), ErrInvalidKey))
+}
+
+func TestVerify_InvalidInput(t *testing.T) {
+	_, err := Verify(json.RawMessage(`[]`))
+	assert.True(t, errors.Is(err, ErrNotObject))
+	_, err = Verify(json.RawMessage(`{"a":`))
+	assert.True(t, errors.Is(err, ErrInvalidJSON))
+	_, err = Verify(json.RawMessage(`{"signatures":{"domain":"abc"}}`))
+	assert.True(t, errors.Is(err, ErrMalformedSignatures))
+}
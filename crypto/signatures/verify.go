@@ -0,0 +1,163 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signatures
+
+import (
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// VerificationKey is a public key that signatures are verified with.
+type VerificationKey struct {
+	// Entity is the user ID or server name that owns the key.
+	Entity id.UserID
+	// KeyID is the key identifier, e.g. ed25519:DEVICEID or ed25519:<base64 public key>
+	KeyID id.KeyID
+	Key   id.Ed25519
+}
+
+// SignatureStatus is the result of verifying a single signature.
+type SignatureStatus string
+
+const (
+	SignatureValid       SignatureStatus = "valid"
+	SignatureInvalid     SignatureStatus = "invalid"
+	SignatureMissing     SignatureStatus = "missing"
+	SignatureKeyInvalid  SignatureStatus = "key_invalid"
+	SignatureUnsupported SignatureStatus = "unsupported_algorithm"
+)
+
+// SignatureResult is the result of verifying the signature by a single key.
+type SignatureResult struct {
+	Entity id.UserID
+	KeyID  id.KeyID
+	Status SignatureStatus
+	// Error is set if the status is not SignatureValid.
+	Error error
+}
+
+// VerificationResult contains the results of verifying an object with a set of keys.
+type VerificationResult struct {
+	// Results contains one entry for each key that was passed to Verify, in the same order.
+	Results []SignatureResult
+	// Unverified contains the signatures in the object that weren't checked, because no key was provided for them.
+	Unverified Signatures
+}
+
+// AllValid returns true if all the keys passed to Verify had a valid signature.
+func (vr *VerificationResult) AllValid() bool {
+	for _, res := range vr.Results {
+		if res.Status != SignatureValid {
+			return false
+		}
+	}
+	return len(vr.Results) > 0
+}
+
+// AnyValid returns true if at least one of the keys passed to Verify had a valid signature.
+func (vr *VerificationResult) AnyValid() bool {
+	for _, res := range vr.Results {
+		if res.Status == SignatureValid {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValid returns true if the signature by the given key was verified successfully.
+func (vr *VerificationResult) IsValid(entity id.UserID, keyID id.KeyID) bool {
+	for _, res := range vr.Results {
+		if res.Entity == entity && res.KeyID == keyID {
+			return res.Status == SignatureValid
+		}
+	}
+	return false
+}
+
+// Err returns the error of the first key that didn't have a valid signature, or nil if all signatures were valid.
+func (vr *VerificationResult) Err() error {
+	for _, res := range vr.Results {
+		if res.Status != SignatureValid {
+			return fmt.Errorf("%s of %s: %w", res.KeyID, res.Entity, res.Error)
+		}
+	}
+	return nil
+}
+
+func verifySignature(canonical []byte, sigs Signatures, key VerificationKey) SignatureResult {
+	res := SignatureResult{Entity: key.Entity, KeyID: key.KeyID}
+	if algorithm, _ := key.KeyID.Parse(); algorithm != id.KeyAlgorithmEd25519 {
+		res.Status = SignatureUnsupported
+		res.Error = fmt.Errorf("%w %q", ErrUnsupportedAlgorithm, algorithm)
+		return res
+	}
+	signature, ok := sigs[key.Entity][key.KeyID]
+	if !ok {
+		res.Status = SignatureMissing
+		res.Error = ErrSignatureNotFound
+		return res
+	}
+	res.Error = VerifyEd25519(canonical, key.Key, signature)
+	if res.Error == nil {
+		res.Status = SignatureValid
+	} else if errors.Is(res.Error, ErrInvalidKey) {
+		res.Status = SignatureKeyInvalid
+	} else {
+		res.Status = SignatureInvalid
+	}
+	return res
+}
+
+// Verify checks the signatures of the given object by all the given keys.
+//
+// An error is only returned if the object itself can't be processed. Missing or invalid signatures are reported
+// in the returned VerificationResult.
+func Verify(obj interface{}, keys ...VerificationKey) (*VerificationResult, error) {
+	objJSON, err := marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	sigs, err := getSignatures(objJSON)
+	if err != nil {
+		return nil, err
+	}
+	canonical, err := canonicalize(objJSON)
+	if err != nil {
+		return nil, err
+	}
+	result := &VerificationResult{
+		Results:    make([]SignatureResult, len(keys)),
+		Unverified: make(Signatures),
+	}
+	checked := make(map[id.UserID]map[id.KeyID]struct{}, len(keys))
+	for i, key := range keys {
+		result.Results[i] = verifySignature(canonical, sigs, key)
+		if checked[key.Entity] == nil {
+			checked[key.Entity] = make(map[id.KeyID]struct{})
+		}
+		checked[key.Entity][key.KeyID] = struct{}{}
+	}
+	for entity, entitySigs := range sigs {
+		for keyID, signature := range entitySigs {
+			if _, ok := checked[entity][keyID]; !ok {
+				result.Unverified.Set(entity, keyID, signature)
+			}
+		}
+	}
+	return result, nil
+}
+
+// VerifyOne checks the signature of the given object by a single key. It returns nil if the signature is valid.
+func VerifyOne(obj interface{}, entity id.UserID, keyID id.KeyID, key id.Ed25519) error {
+	result, err := Verify(obj, VerificationKey{Entity: entity, KeyID: keyID, Key: key})
+	if err != nil {
+		return err
+	}
+	return result.Err()
+}
@@ -7,12 +7,15 @@
 package crypto
 
 import (
+	"crypto/cipher"
 	"database/sql"
 	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"maunium.net/go/mautrix/crypto/olm"
 	"maunium.net/go/mautrix/crypto/sql_store_upgrade"
@@ -36,11 +39,22 @@ type SQLCryptoStore struct {
 	PickleKey []byte
 	Account   *OlmAccount
 
+	// EncryptSensitiveColumns enables encrypting device and cross-signing data (in addition to the pickled olm objects)
+	// with a key derived from PickleKey. Use SetSensitiveColumnEncryption to convert existing data when changing this.
+	// PickleKey and EncryptSensitiveColumns must not be changed directly after the store has been used.
+	EncryptSensitiveColumns bool
+	// pickleKeyLock is held for reading while anything is pickled, unpickled, encrypted or decrypted with PickleKey,
+	// and for writing while the key is being rotated, so that nothing is written with the old key during a rotation.
+	pickleKeyLock sync.RWMutex
+
 	olmSessionCache     map[id.SenderKey]map[id.SessionID]*OlmSession
 	olmSessionCacheLock sync.Mutex
+
+	columnCipher     cipher.AEAD
+	columnCipherLock sync.Mutex
 }
 
-var _ Store = (*SQLCryptoStore)(nil)
+var _ MigratableStore = (*SQLCryptoStore)(nil)
 
 // NewSQLCryptoStore initializes a new crypto Store using the given database, for a device's crypto material.
 // The stored material will be encrypted with the given key.
@@ -91,13 +105,17 @@ func (store *SQLCryptoStore) GetNextBatch() string {
 
 // PutAccount stores an OlmAccount in the database.
 func (store *SQLCryptoStore) PutAccount(account *OlmAccount) error {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	store.Account = account
 	bytes := account.Internal.Pickle(store.PickleKey)
 	_, err := store.DB.Exec(`
-		INSERT INTO crypto_account (device_id, shared, sync_token, account, account_id) VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO crypto_account (device_id, shared, sync_token, account, fallback_key_rotated_at, account_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
 		ON CONFLICT (account_id) DO UPDATE SET shared=excluded.shared, sync_token=excluded.sync_token,
-											   account=excluded.account, account_id=excluded.account_id
-	`, store.DeviceID, account.Shared, store.SyncToken, bytes, store.AccountID)
+											   account=excluded.account, fallback_key_rotated_at=excluded.fallback_key_rotated_at,
+											   account_id=excluded.account_id
+	`, store.DeviceID, account.Shared, store.SyncToken, bytes, sql.NullTime{Time: account.FallbackKeyRotatedAt, Valid: !account.FallbackKeyRotatedAt.IsZero()}, store.AccountID)
 	if err != nil {
 		store.Log.Warnfln("Failed to store account: %v", err)
 	}
@@ -106,11 +124,14 @@ func (store *SQLCryptoStore) PutAccount(account *OlmAccount) error {
 
 // GetAccount retrieves an OlmAccount from the database.
 func (store *SQLCryptoStore) GetAccount() (*OlmAccount, error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	if store.Account == nil {
-		row := store.DB.QueryRow("SELECT shared, sync_token, account FROM crypto_account WHERE account_id=$1", store.AccountID)
+		row := store.DB.QueryRow("SELECT shared, sync_token, account, fallback_key_rotated_at FROM crypto_account WHERE account_id=$1", store.AccountID)
 		acc := &OlmAccount{Internal: *olm.NewBlankAccount()}
 		var accountBytes []byte
-		err := row.Scan(&acc.Shared, &store.SyncToken, &accountBytes)
+		var fallbackKeyRotatedAt sql.NullTime
+		err := row.Scan(&acc.Shared, &store.SyncToken, &accountBytes, &fallbackKeyRotatedAt)
 		if err == sql.ErrNoRows {
 			return nil, nil
 		} else if err != nil {
@@ -120,6 +141,7 @@ func (store *SQLCryptoStore) GetAccount() (*OlmAccount, error) {
 		if err != nil {
 			return nil, err
 		}
+		acc.FallbackKeyRotatedAt = fallbackKeyRotatedAt.Time
 		store.Account = acc
 	}
 	return store.Account, nil
@@ -144,6 +166,8 @@ func (store *SQLCryptoStore) HasSession(key id.SenderKey) bool {
 
 // GetSessions returns all the known Olm sessions for a sender key.
 func (store *SQLCryptoStore) GetSessions(key id.SenderKey) (OlmSessionList, error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	rows, err := store.DB.Query("SELECT session_id, session, created_at, last_encrypted, last_decrypted FROM crypto_olm_session WHERE sender_key=$1 AND account_id=$2 ORDER BY last_decrypted DESC",
 		key, store.AccountID)
 	if err != nil {
@@ -183,13 +207,19 @@ func (store *SQLCryptoStore) getOlmSessionCache(key id.SenderKey) map[id.Session
 	return data
 }
 
-// GetLatestSession retrieves the Olm session for a given sender key from the database that has the largest ID.
+// GetLatestSession retrieves the most recently used Olm session for a given sender key from the database.
 func (store *SQLCryptoStore) GetLatestSession(key id.SenderKey) (*OlmSession, error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	store.olmSessionCacheLock.Lock()
 	defer store.olmSessionCacheLock.Unlock()
 
-	row := store.DB.QueryRow("SELECT session_id, session, created_at, last_encrypted, last_decrypted FROM crypto_olm_session WHERE sender_key=$1 AND account_id=$2 ORDER BY last_decrypted DESC LIMIT 1",
-		key, store.AccountID)
+	row := store.DB.QueryRow(`
+		SELECT session_id, session, created_at, last_encrypted, last_decrypted FROM crypto_olm_session
+		WHERE sender_key=$1 AND account_id=$2
+		ORDER BY CASE WHEN last_encrypted > last_decrypted THEN last_encrypted ELSE last_decrypted END DESC
+		LIMIT 1
+	`, key, store.AccountID)
 
 	sess := OlmSession{Internal: *olm.NewBlankSession()}
 	var sessionBytes []byte
@@ -215,6 +245,8 @@ func (store *SQLCryptoStore) GetLatestSession(key id.SenderKey) (*OlmSession, er
 
 // AddSession persists an Olm session for a sender in the database.
 func (store *SQLCryptoStore) AddSession(key id.SenderKey, session *OlmSession) error {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	store.olmSessionCacheLock.Lock()
 	defer store.olmSessionCacheLock.Unlock()
 	sessionBytes := session.Internal.Pickle(store.PickleKey)
@@ -226,6 +258,8 @@ func (store *SQLCryptoStore) AddSession(key id.SenderKey, session *OlmSession) e
 
 // UpdateSession replaces the Olm session for a sender in the database.
 func (store *SQLCryptoStore) UpdateSession(_ id.SenderKey, session *OlmSession) error {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	sessionBytes := session.Internal.Pickle(store.PickleKey)
 	_, err := store.DB.Exec("UPDATE crypto_olm_session SET session=$1, last_encrypted=$2, last_decrypted=$3 WHERE session_id=$4 AND account_id=$5",
 		sessionBytes, session.LastEncryptedTime, session.LastDecryptedTime, session.ID(), store.AccountID)
@@ -234,29 +268,44 @@ func (store *SQLCryptoStore) UpdateSession(_ id.SenderKey, session *OlmSession)
 
 // PutGroupSession stores an inbound Megolm group session for a room, sender and session.
 func (store *SQLCryptoStore) PutGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, session *InboundGroupSession) error {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	sessionBytes := session.Internal.Pickle(store.PickleKey)
 	forwardingChains := strings.Join(session.ForwardingChains, ",")
 	_, err := store.DB.Exec(`
 		INSERT INTO crypto_megolm_inbound_session
-			(session_id, sender_key, signing_key, room_id, session, forwarding_chains, account_id)
-			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			(session_id, sender_key, signing_key, room_id, session, forwarding_chains, shared_history, key_source,
+			 received_at, max_age, max_messages, account_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
 		ON CONFLICT (session_id, account_id) DO UPDATE
 		    SET withheld_code=NULL, withheld_reason=NULL, sender_key=excluded.sender_key, signing_key=excluded.signing_key,
-		        room_id=excluded.room_id, session=excluded.session, forwarding_chains=excluded.forwarding_chains
-	`, sessionID, senderKey, session.SigningKey, roomID, sessionBytes, forwardingChains, store.AccountID)
+		        room_id=excluded.room_id, session=excluded.session, forwarding_chains=excluded.forwarding_chains,
+		        shared_history=excluded.shared_history, key_source=excluded.key_source, received_at=excluded.received_at,
+		        max_age=excluded.max_age, max_messages=excluded.max_messages
+	`, sessionID, senderKey, session.SigningKey, roomID, sessionBytes, forwardingChains, session.SharedHistory, session.KeySource,
+		sql.NullTime{Time: session.ReceivedAt.UTC(), Valid: !session.ReceivedAt.IsZero()},
+		sql.NullInt64{Int64: int64(session.MaxAge), Valid: session.MaxAge != 0},
+		sql.NullInt64{Int64: int64(session.MaxMessages), Valid: session.MaxMessages != 0},
+		store.AccountID)
 	return err
 }
 
 // GetGroupSession retrieves an inbound Megolm group session for a room, sender and session.
 func (store *SQLCryptoStore) GetGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) (*InboundGroupSession, error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	var signingKey, forwardingChains, withheldCode sql.NullString
 	var sessionBytes []byte
+	var sharedHistory bool
+	var keySource KeySource
+	var receivedAt sql.NullTime
+	var maxAge, maxMessages sql.NullInt64
 	err := store.DB.QueryRow(`
-		SELECT signing_key, session, forwarding_chains, withheld_code
+		SELECT signing_key, session, forwarding_chains, shared_history, key_source, received_at, max_age, max_messages, withheld_code
 		FROM crypto_megolm_inbound_session
 		WHERE room_id=$1 AND sender_key=$2 AND session_id=$3 AND account_id=$4`,
 		roomID, senderKey, sessionID, store.AccountID,
-	).Scan(&signingKey, &sessionBytes, &forwardingChains, &withheldCode)
+	).Scan(&signingKey, &sessionBytes, &forwardingChains, &sharedHistory, &keySource, &receivedAt, &maxAge, &maxMessages, &withheldCode)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
@@ -275,6 +324,11 @@ func (store *SQLCryptoStore) GetGroupSession(roomID id.RoomID, senderKey id.Send
 		SenderKey:        senderKey,
 		RoomID:           roomID,
 		ForwardingChains: strings.Split(forwardingChains.String, ","),
+		SharedHistory:    sharedHistory,
+		KeySource:        keySource,
+		ReceivedAt:       receivedAt.Time,
+		MaxAge:           time.Duration(maxAge.Int64),
+		MaxMessages:      int(maxMessages.Int64),
 	}, nil
 }
 
@@ -311,7 +365,11 @@ func (store *SQLCryptoStore) scanGroupSessionList(rows *sql.Rows) (result []*Inb
 		var roomID id.RoomID
 		var signingKey, senderKey, forwardingChains sql.NullString
 		var sessionBytes []byte
-		err := rows.Scan(&roomID, &signingKey, &senderKey, &sessionBytes, &forwardingChains)
+		var sharedHistory bool
+		var keySource KeySource
+		var receivedAt sql.NullTime
+		var maxAge, maxMessages sql.NullInt64
+		err := rows.Scan(&roomID, &signingKey, &senderKey, &sessionBytes, &forwardingChains, &sharedHistory, &keySource, &receivedAt, &maxAge, &maxMessages)
 		if err != nil {
 			store.Log.Warnfln("Failed to scan row: %v", err)
 			continue
@@ -328,15 +386,22 @@ func (store *SQLCryptoStore) scanGroupSessionList(rows *sql.Rows) (result []*Inb
 			SenderKey:        id.Curve25519(senderKey.String),
 			RoomID:           roomID,
 			ForwardingChains: strings.Split(forwardingChains.String, ","),
+			SharedHistory:    sharedHistory,
+			KeySource:        keySource,
+			ReceivedAt:       receivedAt.Time,
+			MaxAge:           time.Duration(maxAge.Int64),
+			MaxMessages:      int(maxMessages.Int64),
 		})
 	}
 	return
 }
 
 func (store *SQLCryptoStore) GetGroupSessionsForRoom(roomID id.RoomID) ([]*InboundGroupSession, error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	rows, err := store.DB.Query(`
-		SELECT room_id, signing_key, sender_key, session, forwarding_chains
-		FROM crypto_megolm_inbound_session WHERE room_id=$1 AND account_id=$2`,
+		SELECT room_id, signing_key, sender_key, session, forwarding_chains, shared_history, key_source, received_at, max_age, max_messages
+		FROM crypto_megolm_inbound_session WHERE room_id=$1 AND account_id=$2 AND session IS NOT NULL`,
 		roomID, store.AccountID,
 	)
 	if err == sql.ErrNoRows {
@@ -348,9 +413,11 @@ func (store *SQLCryptoStore) GetGroupSessionsForRoom(roomID id.RoomID) ([]*Inbou
 }
 
 func (store *SQLCryptoStore) GetAllGroupSessions() ([]*InboundGroupSession, error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	rows, err := store.DB.Query(`
-		SELECT room_id, signing_key, sender_key, session, forwarding_chains
-		FROM crypto_megolm_inbound_session WHERE account_id=$2`,
+		SELECT room_id, signing_key, sender_key, session, forwarding_chains, shared_history, key_source, received_at, max_age, max_messages
+		FROM crypto_megolm_inbound_session WHERE account_id=$1 AND session IS NOT NULL`,
 		store.AccountID,
 	)
 	if err == sql.ErrNoRows {
@@ -361,24 +428,227 @@ func (store *SQLCryptoStore) GetAllGroupSessions() ([]*InboundGroupSession, erro
 	return store.scanGroupSessionList(rows), nil
 }
 
+// RemoveGroupSession removes an inbound Megolm session and the message indices stored for it.
+func (store *SQLCryptoStore) RemoveGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) error {
+	tx, err := store.DB.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM crypto_megolm_inbound_session WHERE room_id=$1 AND sender_key=$2 AND session_id=$3 AND account_id=$4",
+		roomID, senderKey, sessionID, store.AccountID)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM crypto_message_index WHERE sender_key=$1 AND session_id=$2", senderKey, sessionID)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveGroupSessionsForRoom removes all inbound Megolm sessions and withheld entries of a room, along with
+// the message indices stored for them.
+func (store *SQLCryptoStore) RemoveGroupSessionsForRoom(roomID id.RoomID) (int64, error) {
+	tx, err := store.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`
+		DELETE FROM crypto_message_index WHERE session_id IN (
+			SELECT session_id FROM crypto_megolm_inbound_session WHERE room_id=$1 AND account_id=$2
+		)
+	`, roomID, store.AccountID)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	res, err := tx.Exec("DELETE FROM crypto_megolm_inbound_session WHERE room_id=$1 AND account_id=$2", roomID, store.AccountID)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	return count, tx.Commit()
+}
+
+// groupSessionMetadataQuery selects the metadata of inbound Megolm sessions without the pickled sessions,
+// along with the highest message index stored for each session (or -1 if there are none).
+const groupSessionMetadataQuery = `
+	SELECT room_id, sender_key, session_id, forwarding_chains, key_source, received_at, max_age, max_messages, latest_index
+	FROM (
+		SELECT s.room_id, s.sender_key, s.session_id, s.forwarding_chains, s.key_source, s.received_at, s.max_age, s.max_messages,
+		       COALESCE((
+		           SELECT MAX(mi."index") FROM crypto_message_index mi WHERE mi.sender_key=s.sender_key AND mi.session_id=s.session_id
+		       ), -1) AS latest_index
+		FROM crypto_megolm_inbound_session s
+		WHERE s.account_id=$1 AND s.session IS NOT NULL
+	) sessions
+`
+
+func scanGroupSessionMetadata(rows *sql.Rows) ([]*InboundGroupSession, []int64, error) {
+	defer rows.Close()
+	var sessions []*InboundGroupSession
+	var latestIndices []int64
+	for rows.Next() {
+		var igs InboundGroupSession
+		var forwardingChains sql.NullString
+		var receivedAt sql.NullTime
+		var maxAge, maxMessages sql.NullInt64
+		var latestIndex int64
+		err := rows.Scan(&igs.RoomID, &igs.SenderKey, &igs.id, &forwardingChains, &igs.KeySource, &receivedAt, &maxAge, &maxMessages, &latestIndex)
+		if err != nil {
+			return nil, nil, err
+		}
+		igs.ForwardingChains = strings.Split(forwardingChains.String, ",")
+		igs.ReceivedAt = receivedAt.Time
+		igs.MaxAge = time.Duration(maxAge.Int64)
+		igs.MaxMessages = int(maxMessages.Int64)
+		sessions = append(sessions, &igs)
+		latestIndices = append(latestIndices, latestIndex)
+	}
+	return sessions, latestIndices, rows.Err()
+}
+
+// RemoveExpiredGroupSessions removes the inbound Megolm sessions that are expired with the given grace period,
+// along with the message indices stored for them.
+//
+// Sessions past their max message count are selected entirely in the database. The database only narrows down the
+// sessions that may be past their max age, as the per-session age limit is checked in Go for portability.
+func (store *SQLCryptoStore) RemoveExpiredGroupSessions(gracePeriod time.Duration) (int64, error) {
+	tx, err := store.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.Query(groupSessionMetadataQuery+`
+		WHERE (max_messages > 0 AND latest_index + 1 >= max_messages) OR (max_age > 0 AND received_at < $2)
+	`, store.AccountID, time.Now().Add(-gracePeriod).UTC())
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	sessions, latestIndices, err := scanGroupSessionMetadata(rows)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	var count int64
+	for i, igs := range sessions {
+		if !igs.IsExpired(latestIndices[i], gracePeriod) {
+			continue
+		}
+		_, err = tx.Exec("DELETE FROM crypto_megolm_inbound_session WHERE session_id=$1 AND account_id=$2", igs.ID(), store.AccountID)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM crypto_message_index WHERE sender_key=$1 AND session_id=$2", igs.SenderKey, igs.ID())
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, fmt.Errorf("failed to delete expired session %s: %w", igs.ID(), err)
+		}
+		count++
+	}
+	return count, tx.Commit()
+}
+
+// GetGroupSessionReport returns the number of inbound Megolm sessions stored for each room, without unpickling them.
+func (store *SQLCryptoStore) GetGroupSessionReport(gracePeriod time.Duration) ([]RoomGroupSessionReport, error) {
+	rows, err := store.DB.Query(groupSessionMetadataQuery+" ORDER BY room_id", store.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	sessions, latestIndices, err := scanGroupSessionMetadata(rows)
+	if err != nil {
+		return nil, err
+	}
+	return makeGroupSessionReport(sessions, latestIndices, gracePeriod), nil
+}
+
+// PruneMessageIndices removes message indices of events older than the given unix timestamp (in milliseconds).
+//
+// Note that message indices are not scoped to an account, so this affects every store sharing the same database.
+func (store *SQLCryptoStore) PruneMessageIndices(before int64) (int64, error) {
+	res, err := store.DB.Exec("DELETE FROM crypto_message_index WHERE timestamp<$1", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetLatestMessageIndex returns the highest message index stored for the given session.
+func (store *SQLCryptoStore) GetLatestMessageIndex(senderKey id.SenderKey, sessionID id.SessionID) (uint, bool, error) {
+	var index sql.NullInt64
+	err := store.DB.QueryRow(`SELECT MAX("index") FROM crypto_message_index WHERE sender_key=$1 AND session_id=$2`, senderKey, sessionID).Scan(&index)
+	if err != nil {
+		return 0, false, err
+	}
+	return uint(index.Int64), index.Valid, nil
+}
+
 // AddOutboundGroupSession stores an outbound Megolm session, along with the information about the room and involved devices.
 func (store *SQLCryptoStore) AddOutboundGroupSession(session *OutboundGroupSession) error {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	sessionBytes := session.Internal.Pickle(store.PickleKey)
-	_, err := store.DB.Exec(`
+	sharedWith, err := marshalOGSUserStates(session.UserStates())
+	if err != nil {
+		return err
+	}
+	_, err = store.DB.Exec(`
 		INSERT INTO crypto_megolm_outbound_session
-			(room_id, session_id, session, shared, max_messages, message_count, max_age, created_at, last_used, account_id)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			(room_id, session_id, session, shared, max_messages, message_count, max_age, created_at, last_used, shared_history,
+			 shared_with, account_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
 		ON CONFLICT (account_id, room_id) DO UPDATE
 			SET session_id=excluded.session_id, session=excluded.session, shared=excluded.shared,
 				max_messages=excluded.max_messages, message_count=excluded.message_count, max_age=excluded.max_age,
-				created_at=excluded.created_at, last_used=excluded.last_used, account_id=excluded.account_id
+				created_at=excluded.created_at, last_used=excluded.last_used, shared_history=excluded.shared_history,
+				shared_with=excluded.shared_with, account_id=excluded.account_id
 	`, session.RoomID, session.ID(), sessionBytes, session.Shared, session.MaxMessages, session.MessageCount,
-		session.MaxAge, session.CreationTime, session.LastEncryptedTime, store.AccountID)
+		session.MaxAge, session.CreationTime, session.LastEncryptedTime, session.SharedHistory, sharedWith, store.AccountID)
 	return err
 }
 
+// marshalOGSUserStates converts the sharing state of an outbound group session to the JSON stored in the shared_with
+// column, which maps user IDs to device IDs to OGSState values.
+func marshalOGSUserStates(states map[UserDevice]OGSState) (string, error) {
+	grouped := make(map[id.UserID]map[id.DeviceID]OGSState)
+	for key, state := range states {
+		if grouped[key.UserID] == nil {
+			grouped[key.UserID] = make(map[id.DeviceID]OGSState)
+		}
+		grouped[key.UserID][key.DeviceID] = state
+	}
+	data, err := json.Marshal(grouped)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal outbound group session sharing state: %w", err)
+	}
+	return string(data), nil
+}
+
+func unmarshalOGSUserStates(data sql.NullString) (map[UserDevice]OGSState, error) {
+	states := make(map[UserDevice]OGSState)
+	if !data.Valid || len(data.String) == 0 {
+		return states, nil
+	}
+	var grouped map[id.UserID]map[id.DeviceID]OGSState
+	if err := json.Unmarshal([]byte(data.String), &grouped); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal outbound group session sharing state: %w", err)
+	}
+	for userID, devices := range grouped {
+		for deviceID, state := range devices {
+			states[UserDevice{UserID: userID, DeviceID: deviceID}] = state
+		}
+	}
+	return states, nil
+}
+
 // UpdateOutboundGroupSession replaces an outbound Megolm session with for same room and session ID.
 func (store *SQLCryptoStore) UpdateOutboundGroupSession(session *OutboundGroupSession) error {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	sessionBytes := session.Internal.Pickle(store.PickleKey)
 	_, err := store.DB.Exec("UPDATE crypto_megolm_outbound_session SET session=$1, message_count=$2, last_used=$3 WHERE room_id=$4 AND session_id=$5 AND account_id=$6",
 		sessionBytes, session.MessageCount, session.LastEncryptedTime, session.RoomID, session.ID(), store.AccountID)
@@ -387,17 +657,22 @@ func (store *SQLCryptoStore) UpdateOutboundGroupSession(session *OutboundGroupSe
 
 // GetOutboundGroupSession retrieves the outbound Megolm session for the given room ID.
 func (store *SQLCryptoStore) GetOutboundGroupSession(roomID id.RoomID) (*OutboundGroupSession, error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	var ogs OutboundGroupSession
 	var sessionBytes []byte
+	var sharedWith sql.NullString
 	err := store.DB.QueryRow(`
-		SELECT session, shared, max_messages, message_count, max_age, created_at, last_used
+		SELECT session, shared, max_messages, message_count, max_age, created_at, last_used, shared_history, shared_with
 		FROM crypto_megolm_outbound_session WHERE room_id=$1 AND account_id=$2`,
 		roomID, store.AccountID,
-	).Scan(&sessionBytes, &ogs.Shared, &ogs.MaxMessages, &ogs.MessageCount, &ogs.MaxAge, &ogs.CreationTime, &ogs.LastEncryptedTime)
+	).Scan(&sessionBytes, &ogs.Shared, &ogs.MaxMessages, &ogs.MessageCount, &ogs.MaxAge, &ogs.CreationTime, &ogs.LastEncryptedTime, &ogs.SharedHistory, &sharedWith)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
+	} else if ogs.Users, err = unmarshalOGSUserStates(sharedWith); err != nil {
+		return nil, err
 	}
 	intOGS := olm.NewBlankOutboundGroupSession()
 	err = intOGS.Unpickle(sessionBytes, store.PickleKey)
@@ -445,6 +720,8 @@ func (store *SQLCryptoStore) ValidateMessageIndex(senderKey id.SenderKey, sessio
 
 // GetDevices returns a map of device IDs to device identities, including the identity and signing keys, for a given user ID.
 func (store *SQLCryptoStore) GetDevices(userID id.UserID) (map[id.DeviceID]*DeviceIdentity, error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	var ignore id.UserID
 	err := store.DB.QueryRow("SELECT user_id FROM crypto_tracked_user WHERE user_id=$1", userID).Scan(&ignore)
 	if err == sql.ErrNoRows {
@@ -463,6 +740,8 @@ func (store *SQLCryptoStore) GetDevices(userID id.UserID) (map[id.DeviceID]*Devi
 		err := rows.Scan(&identity.DeviceID, &identity.IdentityKey, &identity.SigningKey, &identity.Trust, &identity.Deleted, &identity.Name)
 		if err != nil {
 			return nil, err
+		} else if err = store.decryptDeviceColumns(&identity); err != nil {
+			return nil, err
 		}
 		identity.UserID = userID
 		data[identity.DeviceID] = &identity
@@ -472,6 +751,8 @@ func (store *SQLCryptoStore) GetDevices(userID id.UserID) (map[id.DeviceID]*Devi
 
 // GetDevice returns the device dentity for a given user and device ID.
 func (store *SQLCryptoStore) GetDevice(userID id.UserID, deviceID id.DeviceID) (*DeviceIdentity, error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	var identity DeviceIdentity
 	err := store.DB.QueryRow(`
 		SELECT identity_key, signing_key, trust, deleted, name
@@ -483,6 +764,8 @@ func (store *SQLCryptoStore) GetDevice(userID id.UserID, deviceID id.DeviceID) (
 			return nil, nil
 		}
 		return nil, err
+	} else if err = store.decryptDeviceColumns(&identity); err != nil {
+		return nil, err
 	}
 	identity.UserID = userID
 	identity.DeviceID = deviceID
@@ -491,6 +774,8 @@ func (store *SQLCryptoStore) GetDevice(userID id.UserID, deviceID id.DeviceID) (
 
 // FindDeviceByKey finds a specific device by its sender key.
 func (store *SQLCryptoStore) FindDeviceByKey(userID id.UserID, identityKey id.IdentityKey) (*DeviceIdentity, error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	var identity DeviceIdentity
 	err := store.DB.QueryRow(`
 		SELECT device_id, signing_key, trust, deleted, name
@@ -502,6 +787,8 @@ func (store *SQLCryptoStore) FindDeviceByKey(userID id.UserID, identityKey id.Id
 			return nil, nil
 		}
 		return nil, err
+	} else if err = store.decryptDeviceColumns(&identity); err != nil {
+		return nil, err
 	}
 	identity.UserID = userID
 	identity.IdentityKey = identityKey
@@ -510,21 +797,31 @@ func (store *SQLCryptoStore) FindDeviceByKey(userID id.UserID, identityKey id.Id
 
 // PutDevice stores a single device for a user, replacing it if it exists already.
 func (store *SQLCryptoStore) PutDevice(userID id.UserID, device *DeviceIdentity) error {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	_, err := store.DB.Exec(`
 			INSERT INTO crypto_device (user_id, device_id, identity_key, signing_key, trust, deleted, name) VALUES ($1, $2, $3, $4, $5, $6, $7)
 			ON CONFLICT (user_id, device_id) DO UPDATE SET identity_key=excluded.identity_key, signing_key=excluded.signing_key, trust=excluded.trust, deleted=excluded.deleted, name=excluded.name`,
-		userID, device.DeviceID, device.IdentityKey, device.SigningKey, device.Trust, device.Deleted, device.Name)
+		userID, device.DeviceID, device.IdentityKey,
+		store.encryptColumn("crypto_device.signing_key", device.SigningKey.String()),
+		device.Trust, device.Deleted,
+		store.encryptColumn("crypto_device.name", device.Name))
 	return err
 }
 
 // PutDevices stores the device identity information for the given user ID.
 func (store *SQLCryptoStore) PutDevices(userID id.UserID, devices map[id.DeviceID]*DeviceIdentity) error {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	tx, err := store.DB.Begin()
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.Exec("INSERT INTO crypto_tracked_user (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING", userID)
+	_, err = tx.Exec(`
+		INSERT INTO crypto_tracked_user (user_id, devices_outdated) VALUES ($1, false)
+		ON CONFLICT (user_id) DO UPDATE SET devices_outdated=false
+	`, userID)
 	if err != nil {
 		return fmt.Errorf("failed to add user to tracked users list: %w", err)
 	}
@@ -559,7 +856,11 @@ func (store *SQLCryptoStore) PutDevices(userID id.UserID, devices map[id.DeviceI
 		i := 2
 		for _, deviceID := range batchDevices {
 			identity := devices[deviceID]
-			values = append(values, deviceID, identity.IdentityKey, identity.SigningKey, identity.Trust, identity.Deleted, identity.Name)
+			values = append(values,
+				deviceID, identity.IdentityKey,
+				store.encryptColumn("crypto_device.signing_key", identity.SigningKey.String()),
+				identity.Trust, identity.Deleted,
+				store.encryptColumn("crypto_device.name", identity.Name))
 			valueStrings = append(valueStrings, fmt.Sprintf("($1, $%d, $%d, $%d, $%d, $%d, $%d)", i, i+1, i+2, i+3, i+4, i+5))
 			i += 6
 		}
@@ -608,17 +909,69 @@ func (store *SQLCryptoStore) FilterTrackedUsers(users []id.UserID) []id.UserID {
 	return users[:ptr]
 }
 
+// MarkTrackedUsersOutdated flags the device lists of the given users as outdated. Users who aren't tracked are ignored.
+func (store *SQLCryptoStore) MarkTrackedUsersOutdated(users []id.UserID) error {
+	return store.execForUsers("UPDATE crypto_tracked_user SET devices_outdated=true WHERE user_id=$1", users)
+}
+
+// GetOutdatedTrackedUsers returns the tracked users whose device lists are flagged as outdated.
+func (store *SQLCryptoStore) GetOutdatedTrackedUsers() ([]id.UserID, error) {
+	rows, err := store.DB.Query("SELECT user_id FROM crypto_tracked_user WHERE devices_outdated=true")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []id.UserID
+	for rows.Next() {
+		var userID id.UserID
+		err = rows.Scan(&userID)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, userID)
+	}
+	return result, rows.Err()
+}
+
+// UntrackUsers removes the given users from the tracked users list. Their devices are kept in the database,
+// so that FindDeviceByKey keeps working for events that were sent before, but GetDevices returns nil for them.
+func (store *SQLCryptoStore) UntrackUsers(users []id.UserID) error {
+	return store.execForUsers("DELETE FROM crypto_tracked_user WHERE user_id=$1", users)
+}
+
+func (store *SQLCryptoStore) execForUsers(query string, users []id.UserID) error {
+	if len(users) == 0 {
+		return nil
+	}
+	tx, err := store.DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, userID := range users {
+		_, err = tx.Exec(query, userID)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 // PutCrossSigningKey stores a cross-signing key of some user along with its usage.
 func (store *SQLCryptoStore) PutCrossSigningKey(userID id.UserID, usage id.CrossSigningUsage, key id.Ed25519) error {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	_, err := store.DB.Exec(`
 		INSERT INTO crypto_cross_signing_keys (user_id, usage, key) VALUES ($1, $2, $3)
 		ON CONFLICT (user_id, usage) DO UPDATE SET key=excluded.key
-	`, userID, usage, key)
+	`, userID, usage, store.encryptColumn("crypto_cross_signing_keys.key", key.String()))
 	return err
 }
 
 // GetCrossSigningKeys retrieves a user's stored cross-signing keys.
 func (store *SQLCryptoStore) GetCrossSigningKeys(userID id.UserID) (map[id.CrossSigningUsage]id.Ed25519, error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	rows, err := store.DB.Query("SELECT usage, key FROM crypto_cross_signing_keys WHERE user_id=$1", userID)
 	if err != nil {
 		return nil, err
@@ -630,6 +983,8 @@ func (store *SQLCryptoStore) GetCrossSigningKeys(userID id.UserID) (map[id.Cross
 		err := rows.Scan(&usage, &key)
 		if err != nil {
 			return nil, err
+		} else if key, err = store.decryptKeyColumn("crypto_cross_signing_keys.key", key); err != nil {
+			return nil, err
 		}
 		data[usage] = key
 	}
@@ -639,15 +994,19 @@ func (store *SQLCryptoStore) GetCrossSigningKeys(userID id.UserID) (map[id.Cross
 
 // PutSignature stores a signature of a cross-signing or device key along with the signer's user ID and key.
 func (store *SQLCryptoStore) PutSignature(signedUserID id.UserID, signedKey id.Ed25519, signerUserID id.UserID, signerKey id.Ed25519, signature string) error {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	_, err := store.DB.Exec(`
 		INSERT INTO crypto_cross_signing_signatures (signed_user_id, signed_key, signer_user_id, signer_key, signature) VALUES ($1, $2, $3, $4, $5)
 		ON CONFLICT (signed_user_id, signed_key, signer_user_id, signer_key) DO UPDATE SET signature=excluded.signature
-	`, signedUserID, signedKey, signerUserID, signerKey, signature)
+	`, signedUserID, signedKey, signerUserID, signerKey, store.encryptColumn("crypto_cross_signing_signatures.signature", signature))
 	return err
 }
 
 // GetSignaturesForKeyBy retrieves the stored signatures for a given cross-signing or device key, by the given signer.
 func (store *SQLCryptoStore) GetSignaturesForKeyBy(userID id.UserID, key id.Ed25519, signerID id.UserID) (map[id.Ed25519]string, error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
 	rows, err := store.DB.Query("SELECT signer_key, signature FROM crypto_cross_signing_signatures WHERE signed_user_id=$1 AND signed_key=$2 AND signer_user_id=$3", userID, key, signerID)
 	if err != nil {
 		return nil, err
@@ -659,6 +1018,8 @@ func (store *SQLCryptoStore) GetSignaturesForKeyBy(userID id.UserID, key id.Ed25
 		err := rows.Scan(&signerKey, &signature)
 		if err != nil {
 			return nil, err
+		} else if signature, err = store.decryptColumn("crypto_cross_signing_signatures.signature", signature); err != nil {
+			return nil, err
 		}
 		data[signerKey] = signature
 	}
@@ -688,3 +1049,349 @@ func (store *SQLCryptoStore) DropSignaturesByKey(userID id.UserID, key id.Ed2551
 	}
 	return count, nil
 }
+
+// PutPinnedMasterKey pins the given cross-signing master key as the trusted identity of a user.
+func (store *SQLCryptoStore) PutPinnedMasterKey(userID id.UserID, key id.Ed25519) error {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
+	_, err := store.DB.Exec(`
+		INSERT INTO crypto_cross_signing_pinned_key (user_id, key) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET key=excluded.key
+	`, userID, store.encryptColumn("crypto_cross_signing_pinned_key.key", key.String()))
+	return err
+}
+
+// GetPinnedMasterKey retrieves the pinned cross-signing master key of a user.
+func (store *SQLCryptoStore) GetPinnedMasterKey(userID id.UserID) (key id.Ed25519, err error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
+	err = store.DB.QueryRow("SELECT key FROM crypto_cross_signing_pinned_key WHERE user_id=$1", userID).Scan(&key)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	} else if err == nil {
+		key, err = store.decryptKeyColumn("crypto_cross_signing_pinned_key.key", key)
+	}
+	return
+}
+
+// PutOlmUnwedgeTime stores the time when a new Olm session was last created with the given device to unwedge it.
+func (store *SQLCryptoStore) PutOlmUnwedgeTime(senderKey id.SenderKey, ts time.Time) error {
+	_, err := store.DB.Exec(`
+		INSERT INTO crypto_olm_unwedge (account_id, sender_key, unwedged_at) VALUES ($1, $2, $3)
+		ON CONFLICT (account_id, sender_key) DO UPDATE SET unwedged_at=excluded.unwedged_at
+	`, store.AccountID, senderKey, ts)
+	return err
+}
+
+// GetOlmUnwedgeTime returns the time when a new Olm session was last created with the given device to unwedge it.
+func (store *SQLCryptoStore) GetOlmUnwedgeTime(senderKey id.SenderKey) (ts time.Time, err error) {
+	err = store.DB.QueryRow("SELECT unwedged_at FROM crypto_olm_unwedge WHERE account_id=$1 AND sender_key=$2",
+		store.AccountID, senderKey).Scan(&ts)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+// PutOutgoingKeyRequest stores an outgoing room key request, replacing the existing request for the same session.
+func (store *SQLCryptoStore) PutOutgoingKeyRequest(req *OutgoingKeyRequest) error {
+	targets, err := json.Marshal(req.Targets)
+	if err != nil {
+		return err
+	}
+	_, err = store.DB.Exec(`
+		INSERT INTO crypto_outgoing_key_request (account_id, session_id, request_id, room_id, sender_key, targets, own_devices, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (account_id, session_id) DO UPDATE
+			SET request_id=excluded.request_id, room_id=excluded.room_id, sender_key=excluded.sender_key,
+			    targets=excluded.targets, own_devices=excluded.own_devices
+	`, store.AccountID, req.SessionID, req.RequestID, req.RoomID, req.SenderKey, string(targets), req.OwnDevices, req.CreatedAt)
+	return err
+}
+
+func (store *SQLCryptoStore) scanOutgoingKeyRequest(row dbutil.Scannable) (*OutgoingKeyRequest, error) {
+	var req OutgoingKeyRequest
+	var targets string
+	err := row.Scan(&req.SessionID, &req.RequestID, &req.RoomID, &req.SenderKey, &targets, &req.OwnDevices, &req.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(targets), &req.Targets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse targets of key request %s: %w", req.RequestID, err)
+	} else if req.Targets == nil {
+		req.Targets = make(map[id.UserID][]id.DeviceID)
+	}
+	return &req, nil
+}
+
+// GetOutgoingKeyRequest returns the outgoing room key request for the given session, or nil if there isn't one.
+func (store *SQLCryptoStore) GetOutgoingKeyRequest(sessionID id.SessionID) (*OutgoingKeyRequest, error) {
+	req, err := store.scanOutgoingKeyRequest(store.DB.QueryRow(`
+		SELECT session_id, request_id, room_id, sender_key, targets, own_devices, created_at
+		FROM crypto_outgoing_key_request WHERE account_id=$1 AND session_id=$2
+	`, store.AccountID, sessionID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return req, err
+}
+
+// GetOutgoingKeyRequests returns all the outgoing room key requests of the current account.
+func (store *SQLCryptoStore) GetOutgoingKeyRequests() ([]*OutgoingKeyRequest, error) {
+	rows, err := store.DB.Query(`
+		SELECT session_id, request_id, room_id, sender_key, targets, own_devices, created_at
+		FROM crypto_outgoing_key_request WHERE account_id=$1
+	`, store.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []*OutgoingKeyRequest
+	for rows.Next() {
+		req, err := store.scanOutgoingKeyRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, req)
+	}
+	return result, rows.Err()
+}
+
+// DeleteOutgoingKeyRequest removes the outgoing room key request for the given session.
+func (store *SQLCryptoStore) DeleteOutgoingKeyRequest(sessionID id.SessionID) error {
+	_, err := store.DB.Exec("DELETE FROM crypto_outgoing_key_request WHERE account_id=$1 AND session_id=$2", store.AccountID, sessionID)
+	return err
+}
+
+// GetAllOlmSessions returns all the Olm sessions of the current account grouped by sender key.
+func (store *SQLCryptoStore) GetAllOlmSessions() (map[id.SenderKey]OlmSessionList, error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
+	rows, err := store.DB.Query("SELECT sender_key, session, created_at, last_encrypted, last_decrypted FROM crypto_olm_session WHERE account_id=$1 ORDER BY last_decrypted DESC",
+		store.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	data := make(map[id.SenderKey]OlmSessionList)
+	for rows.Next() {
+		sess := OlmSession{Internal: *olm.NewBlankSession()}
+		var sessionBytes []byte
+		var senderKey id.SenderKey
+		err = rows.Scan(&senderKey, &sessionBytes, &sess.CreationTime, &sess.LastEncryptedTime, &sess.LastDecryptedTime)
+		if err != nil {
+			return nil, err
+		}
+		err = sess.Internal.Unpickle(sessionBytes, store.PickleKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unpickle Olm session with %s: %w", senderKey, err)
+		}
+		data[senderKey] = append(data[senderKey], &sess)
+	}
+	return data, rows.Err()
+}
+
+// GetAllWithheldGroupSessions returns all the withheld group session events of the current account.
+func (store *SQLCryptoStore) GetAllWithheldGroupSessions() ([]*event.RoomKeyWithheldEventContent, error) {
+	rows, err := store.DB.Query(`
+		SELECT room_id, sender_key, session_id, withheld_code, withheld_reason FROM crypto_megolm_inbound_session
+		WHERE account_id=$1 AND session IS NULL AND withheld_code IS NOT NULL`,
+		store.AccountID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []*event.RoomKeyWithheldEventContent
+	for rows.Next() {
+		var reason sql.NullString
+		content := &event.RoomKeyWithheldEventContent{Algorithm: id.AlgorithmMegolmV1}
+		err = rows.Scan(&content.RoomID, &content.SenderKey, &content.SessionID, &content.Code, &reason)
+		if err != nil {
+			return nil, err
+		}
+		content.Reason = reason.String
+		result = append(result, content)
+	}
+	return result, rows.Err()
+}
+
+// GetAllOutboundGroupSessions returns all the outbound Megolm sessions of the current account.
+func (store *SQLCryptoStore) GetAllOutboundGroupSessions() ([]*OutboundGroupSession, error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
+	rows, err := store.DB.Query(`
+		SELECT room_id, session, shared, max_messages, message_count, max_age, created_at, last_used, shared_history, shared_with
+		FROM crypto_megolm_outbound_session WHERE account_id=$1`,
+		store.AccountID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []*OutboundGroupSession
+	for rows.Next() {
+		var ogs OutboundGroupSession
+		var sessionBytes []byte
+		var sharedWith sql.NullString
+		err = rows.Scan(&ogs.RoomID, &sessionBytes, &ogs.Shared, &ogs.MaxMessages, &ogs.MessageCount, &ogs.MaxAge, &ogs.CreationTime, &ogs.LastEncryptedTime, &ogs.SharedHistory, &sharedWith)
+		if err != nil {
+			return nil, err
+		} else if ogs.Users, err = unmarshalOGSUserStates(sharedWith); err != nil {
+			return nil, err
+		}
+		intOGS := olm.NewBlankOutboundGroupSession()
+		err = intOGS.Unpickle(sessionBytes, store.PickleKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unpickle outbound group session in %s: %w", ogs.RoomID, err)
+		}
+		ogs.Internal = *intOGS
+		result = append(result, &ogs)
+	}
+	return result, rows.Err()
+}
+
+// GetAllMessageIndices returns all the message indices in the database.
+func (store *SQLCryptoStore) GetAllMessageIndices() ([]MessageIndex, error) {
+	rows, err := store.DB.Query(`SELECT sender_key, session_id, "index", event_id, timestamp FROM crypto_message_index`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []MessageIndex
+	for rows.Next() {
+		var index MessageIndex
+		err = rows.Scan(&index.SenderKey, &index.SessionID, &index.Index, &index.EventID, &index.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, index)
+	}
+	return result, rows.Err()
+}
+
+// GetAllTrackedUsers returns all the users whose device lists are stored in the database.
+func (store *SQLCryptoStore) GetAllTrackedUsers() ([]id.UserID, error) {
+	rows, err := store.DB.Query("SELECT user_id FROM crypto_tracked_user")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []id.UserID
+	for rows.Next() {
+		var userID id.UserID
+		err = rows.Scan(&userID)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, userID)
+	}
+	return result, rows.Err()
+}
+
+// GetAllUntrackedDevices returns the devices in the database whose users aren't in the tracked users list.
+func (store *SQLCryptoStore) GetAllUntrackedDevices() (map[id.UserID]map[id.DeviceID]*DeviceIdentity, error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
+	rows, err := store.DB.Query(`
+		SELECT user_id, device_id, identity_key, signing_key, trust, deleted, name FROM crypto_device
+		WHERE user_id NOT IN (SELECT user_id FROM crypto_tracked_user)
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	data := make(map[id.UserID]map[id.DeviceID]*DeviceIdentity)
+	for rows.Next() {
+		var identity DeviceIdentity
+		err = rows.Scan(&identity.UserID, &identity.DeviceID, &identity.IdentityKey, &identity.SigningKey, &identity.Trust, &identity.Deleted, &identity.Name)
+		if err != nil {
+			return nil, err
+		} else if err = store.decryptDeviceColumns(&identity); err != nil {
+			return nil, err
+		}
+		if _, ok := data[identity.UserID]; !ok {
+			data[identity.UserID] = make(map[id.DeviceID]*DeviceIdentity)
+		}
+		data[identity.UserID][identity.DeviceID] = &identity
+	}
+	return data, rows.Err()
+}
+
+// GetAllCrossSigningKeys returns the cross-signing keys of all users in the database.
+func (store *SQLCryptoStore) GetAllCrossSigningKeys() (map[id.UserID]map[id.CrossSigningUsage]id.Ed25519, error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
+	rows, err := store.DB.Query("SELECT user_id, usage, key FROM crypto_cross_signing_keys")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	data := make(map[id.UserID]map[id.CrossSigningUsage]id.Ed25519)
+	for rows.Next() {
+		var userID id.UserID
+		var usage id.CrossSigningUsage
+		var key id.Ed25519
+		err = rows.Scan(&userID, &usage, &key)
+		if err != nil {
+			return nil, err
+		} else if key, err = store.decryptKeyColumn("crypto_cross_signing_keys.key", key); err != nil {
+			return nil, err
+		}
+		userKeys, ok := data[userID]
+		if !ok {
+			userKeys = make(map[id.CrossSigningUsage]id.Ed25519)
+			data[userID] = userKeys
+		}
+		userKeys[usage] = key
+	}
+	return data, rows.Err()
+}
+
+// GetAllSignatures returns all the cross-signing and device key signatures in the database.
+func (store *SQLCryptoStore) GetAllSignatures() ([]KeySignature, error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
+	rows, err := store.DB.Query("SELECT signed_user_id, signed_key, signer_user_id, signer_key, signature FROM crypto_cross_signing_signatures")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []KeySignature
+	for rows.Next() {
+		var sig KeySignature
+		err = rows.Scan(&sig.SignedUserID, &sig.SignedKey, &sig.SignerUserID, &sig.SignerKey, &sig.Signature)
+		if err != nil {
+			return nil, err
+		} else if sig.Signature, err = store.decryptColumn("crypto_cross_signing_signatures.signature", sig.Signature); err != nil {
+			return nil, err
+		}
+		result = append(result, sig)
+	}
+	return result, rows.Err()
+}
+
+// GetAllPinnedMasterKeys returns the pinned master keys of all users in the database.
+func (store *SQLCryptoStore) GetAllPinnedMasterKeys() (map[id.UserID]id.Ed25519, error) {
+	store.pickleKeyLock.RLock()
+	defer store.pickleKeyLock.RUnlock()
+	rows, err := store.DB.Query("SELECT user_id, key FROM crypto_cross_signing_pinned_key")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	data := make(map[id.UserID]id.Ed25519)
+	for rows.Next() {
+		var userID id.UserID
+		var key id.Ed25519
+		err = rows.Scan(&userID, &key)
+		if err != nil {
+			return nil, err
+		} else if key, err = store.decryptKeyColumn("crypto_cross_signing_pinned_key.key", key); err != nil {
+			return nil, err
+		}
+		data[userID] = key
+	}
+	return data, rows.Err()
+}
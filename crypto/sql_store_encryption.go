@@ -0,0 +1,305 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/id"
+)
+
+const encryptedColumnPrefix = "enc1:"
+
+var ErrColumnDecryptionFailed = errors.New("failed to decrypt encrypted crypto store column")
+
+// sensitiveTable describes a table with columns that are encrypted when SQLCryptoStore.EncryptSensitiveColumns is set.
+type sensitiveTable struct {
+	name       string
+	primaryKey []string
+	columns    []string
+}
+
+// sensitiveTables lists the columns that are encrypted in addition to the pickled olm objects. Columns that are used
+// for lookups (like identity keys and signed keys) are not encrypted.
+var sensitiveTables = []sensitiveTable{
+	{"crypto_device", []string{"user_id", "device_id"}, []string{"signing_key", "name"}},
+	{"crypto_cross_signing_keys", []string{"user_id", "usage"}, []string{"key"}},
+	{"crypto_cross_signing_signatures", []string{"signed_user_id", "signed_key", "signer_user_id", "signer_key"}, []string{"signature"}},
+	{"crypto_cross_signing_pinned_key", []string{"user_id"}, []string{"key"}},
+}
+
+func newColumnCipher(pickleKey []byte) cipher.AEAD {
+	var key [32]byte
+	_, err := io.ReadFull(hkdf.New(sha256.New, pickleKey, nil, []byte("mautrix crypto store column encryption")), key[:])
+	if err != nil {
+		panic(err)
+	}
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+func (store *SQLCryptoStore) getColumnCipher() cipher.AEAD {
+	store.columnCipherLock.Lock()
+	defer store.columnCipherLock.Unlock()
+	if store.columnCipher == nil {
+		store.columnCipher = newColumnCipher(store.PickleKey)
+	}
+	return store.columnCipher
+}
+
+func encryptColumnWith(aead cipher.AEAD, column, value string) string {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	// The column name is used as additional data so that encrypted values can't be moved to other columns.
+	return encryptedColumnPrefix + base64.RawStdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(value), []byte(column)))
+}
+
+func decryptColumnWith(aead cipher.AEAD, column, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedColumnPrefix) {
+		return value, nil
+	}
+	data, err := base64.RawStdEncoding.DecodeString(value[len(encryptedColumnPrefix):])
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("%w: invalid value in %s", ErrColumnDecryptionFailed, column)
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(column))
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %v", ErrColumnDecryptionFailed, column, err)
+	}
+	return string(plaintext), nil
+}
+
+// encryptColumn encrypts the value of a sensitive column if EncryptSensitiveColumns is enabled.
+// The column must be specified as table.column.
+func (store *SQLCryptoStore) encryptColumn(column, value string) string {
+	if !store.EncryptSensitiveColumns {
+		return value
+	}
+	return encryptColumnWith(store.getColumnCipher(), column, value)
+}
+
+// decryptColumn decrypts the value of a sensitive column. Plaintext values are returned as-is,
+// so enabling encryption doesn't break reading data that was stored before.
+func (store *SQLCryptoStore) decryptColumn(column, value string) (string, error) {
+	return decryptColumnWith(store.getColumnCipher(), column, value)
+}
+
+func (store *SQLCryptoStore) decryptKeyColumn(column string, key id.Ed25519) (id.Ed25519, error) {
+	decrypted, err := store.decryptColumn(column, string(key))
+	return id.Ed25519(decrypted), err
+}
+
+func (store *SQLCryptoStore) decryptDeviceColumns(device *DeviceIdentity) (err error) {
+	if device.SigningKey, err = store.decryptKeyColumn("crypto_device.signing_key", device.SigningKey); err != nil {
+		return
+	}
+	device.Name, err = store.decryptColumn("crypto_device.name", device.Name)
+	return
+}
+
+type pickleable interface {
+	Pickle(key []byte) []byte
+	Unpickle(pickled, key []byte) error
+}
+
+// pickledTable describes a table that contains pickled olm objects.
+type pickledTable struct {
+	name         string
+	idColumn     string
+	pickleColumn string
+	newBlank     func() pickleable
+}
+
+var pickledTables = []pickledTable{
+	{"crypto_account", "account_id", "account", func() pickleable { return olm.NewBlankAccount() }},
+	{"crypto_olm_session", "session_id", "session", func() pickleable { return olm.NewBlankSession() }},
+	{"crypto_megolm_inbound_session", "session_id", "session", func() pickleable { return olm.NewBlankInboundGroupSession() }},
+	{"crypto_megolm_outbound_session", "room_id", "session", func() pickleable { return olm.NewBlankOutboundGroupSession() }},
+}
+
+func (store *SQLCryptoStore) repickleTable(tx *sql.Tx, table pickledTable, oldKey, newKey []byte) (int, error) {
+	rows, err := tx.Query(fmt.Sprintf(
+		"SELECT %s, %s FROM %s WHERE account_id=$1 AND %s IS NOT NULL",
+		table.idColumn, table.pickleColumn, table.name, table.pickleColumn,
+	), store.AccountID)
+	if err != nil {
+		return 0, err
+	}
+	repickled := make(map[string][]byte)
+	for rows.Next() {
+		var rowID string
+		var pickled []byte
+		if err = rows.Scan(&rowID, &pickled); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		obj := table.newBlank()
+		if err = obj.Unpickle(pickled, oldKey); err != nil {
+			_ = rows.Close()
+			return 0, fmt.Errorf("failed to unpickle %s: %w", rowID, err)
+		}
+		repickled[rowID] = obj.Pickle(newKey)
+	}
+	_ = rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	query := fmt.Sprintf("UPDATE %s SET %s=$1 WHERE %s=$2 AND account_id=$3", table.name, table.pickleColumn, table.idColumn)
+	for rowID, pickled := range repickled {
+		if _, err = tx.Exec(query, pickled, rowID, store.AccountID); err != nil {
+			return 0, err
+		}
+	}
+	return len(repickled), nil
+}
+
+func reencryptTable(tx *sql.Tx, table sensitiveTable, oldCipher, newCipher cipher.AEAD, encrypt bool) (int, error) {
+	allColumns := append(append([]string{}, table.primaryKey...), table.columns...)
+	rows, err := tx.Query(fmt.Sprintf("SELECT %s FROM %s", strings.Join(allColumns, ", "), table.name))
+	if err != nil {
+		return 0, err
+	}
+	var updates [][]interface{}
+	for rows.Next() {
+		values := make([]sql.NullString, len(allColumns))
+		scanTargets := make([]interface{}, len(values))
+		for i := range values {
+			scanTargets[i] = &values[i]
+		}
+		if err = rows.Scan(scanTargets...); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		// The updated columns come first in the query, followed by the primary key.
+		update := make([]interface{}, 0, len(allColumns))
+		for i, column := range table.columns {
+			value := values[len(table.primaryKey)+i]
+			if !value.Valid {
+				update = append(update, nil)
+				continue
+			}
+			fullColumn := table.name + "." + column
+			plaintext, err := decryptColumnWith(oldCipher, fullColumn, value.String)
+			if err != nil {
+				_ = rows.Close()
+				return 0, err
+			}
+			if encrypt {
+				plaintext = encryptColumnWith(newCipher, fullColumn, plaintext)
+			}
+			update = append(update, plaintext)
+		}
+		for _, value := range values[:len(table.primaryKey)] {
+			update = append(update, value.String)
+		}
+		updates = append(updates, update)
+	}
+	_ = rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	setParts := make([]string, len(table.columns))
+	for i, column := range table.columns {
+		setParts[i] = fmt.Sprintf("%s=$%d", column, i+1)
+	}
+	whereParts := make([]string, len(table.primaryKey))
+	for i, column := range table.primaryKey {
+		whereParts[i] = fmt.Sprintf("%s=$%d", column, len(table.columns)+i+1)
+	}
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s", table.name, strings.Join(setParts, ", "), strings.Join(whereParts, " AND "))
+	for _, update := range updates {
+		if _, err = tx.Exec(query, update...); err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), nil
+}
+
+// reencrypt re-pickles all olm objects of the account with the new key and re-encrypts the sensitive columns
+// in a single transaction. If anything fails, the database is left unchanged.
+//
+// Other store methods that use the pickle key block until the rotation is done, so that nothing can be written
+// with the old key after the existing rows have been re-pickled.
+func (store *SQLCryptoStore) reencrypt(newKey []byte, encryptColumns bool) (err error) {
+	if len(newKey) == 0 {
+		return ErrEmptyPickleKey
+	}
+	store.pickleKeyLock.Lock()
+	defer store.pickleKeyLock.Unlock()
+	tx, err := store.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	oldKey := store.PickleKey
+	var count int
+	for _, table := range pickledTables {
+		count, err = store.repickleTable(tx, table, oldKey, newKey)
+		if err != nil {
+			return fmt.Errorf("failed to re-pickle %s: %w", table.name, err)
+		}
+		store.Log.Debugfln("Re-pickled %d rows in %s", count, table.name)
+	}
+
+	oldCipher := store.getColumnCipher()
+	newCipher := newColumnCipher(newKey)
+	for _, table := range sensitiveTables {
+		count, err = reencryptTable(tx, table, oldCipher, newCipher, encryptColumns)
+		if err != nil {
+			return fmt.Errorf("failed to re-encrypt %s: %w", table.name, err)
+		}
+		store.Log.Debugfln("Re-encrypted %d rows in %s", count, table.name)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	store.columnCipherLock.Lock()
+	store.PickleKey = newKey
+	store.columnCipher = newCipher
+	store.EncryptSensitiveColumns = encryptColumns
+	store.columnCipherLock.Unlock()
+	return nil
+}
+
+// RotatePickleKey changes the key used to encrypt the crypto store.
+//
+// The account, all Olm sessions and all Megolm sessions of this account are re-pickled with the new key,
+// and the sensitive columns are re-encrypted if EncryptSensitiveColumns is enabled. Everything is done in
+// a single transaction, so the old key stays valid if the rotation fails.
+func (store *SQLCryptoStore) RotatePickleKey(newKey []byte) error {
+	return store.reencrypt(newKey, store.EncryptSensitiveColumns)
+}
+
+// SetSensitiveColumnEncryption enables or disables encrypting the sensitive columns (device and cross-signing data)
+// and converts the existing rows accordingly.
+//
+// Note that those tables are not scoped to an account, so every store sharing the same database must use the same
+// pickle key when column encryption is enabled.
+func (store *SQLCryptoStore) SetSensitiveColumnEncryption(enabled bool) error {
+	return store.reencrypt(store.PickleKey, enabled)
+}
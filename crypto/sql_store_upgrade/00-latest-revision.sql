@@ -1,10 +1,12 @@
--- v0 -> v6: Latest revision
+-- v0 -> v16: Latest revision
 CREATE TABLE IF NOT EXISTS crypto_account (
 	account_id TEXT    PRIMARY KEY,
 	device_id  TEXT    NOT NULL,
 	shared     BOOLEAN NOT NULL,
 	sync_token TEXT    NOT NULL,
-	account    bytea   NOT NULL
+	account    bytea   NOT NULL,
+
+	fallback_key_rotated_at timestamp
 );
 
 CREATE TABLE IF NOT EXISTS crypto_message_index (
@@ -17,14 +19,15 @@ CREATE TABLE IF NOT EXISTS crypto_message_index (
 );
 
 CREATE TABLE IF NOT EXISTS crypto_tracked_user (
-	user_id TEXT PRIMARY KEY
+	user_id          TEXT    PRIMARY KEY,
+	devices_outdated BOOLEAN NOT NULL DEFAULT false
 );
 
 CREATE TABLE IF NOT EXISTS crypto_device (
 	user_id      TEXT,
 	device_id    TEXT,
 	identity_key CHAR(43) NOT NULL,
-	signing_key  CHAR(43) NOT NULL,
+	signing_key  TEXT     NOT NULL,
 	trust        SMALLINT NOT NULL,
 	deleted      BOOLEAN  NOT NULL,
 	name         TEXT     NOT NULL,
@@ -42,6 +45,13 @@ CREATE TABLE IF NOT EXISTS crypto_olm_session (
 	PRIMARY KEY (account_id, session_id)
 );
 
+CREATE TABLE IF NOT EXISTS crypto_olm_unwedge (
+	account_id  TEXT,
+	sender_key  CHAR(43),
+	unwedged_at timestamp NOT NULL,
+	PRIMARY KEY (account_id, sender_key)
+);
+
 CREATE TABLE IF NOT EXISTS crypto_megolm_inbound_session (
 	account_id        TEXT,
 	session_id        CHAR(43),
@@ -52,27 +62,34 @@ CREATE TABLE IF NOT EXISTS crypto_megolm_inbound_session (
 	forwarding_chains bytea,
 	withheld_code     TEXT,
 	withheld_reason   TEXT,
+	shared_history    BOOLEAN  NOT NULL DEFAULT false,
+	key_source        TEXT     NOT NULL DEFAULT '',
+	received_at       timestamp,
+	max_age           BIGINT,
+	max_messages      INTEGER,
 	PRIMARY KEY (account_id, session_id)
 );
 
 CREATE TABLE IF NOT EXISTS crypto_megolm_outbound_session (
-	account_id    TEXT,
-	room_id       TEXT,
-	session_id    CHAR(43)  NOT NULL UNIQUE,
-	session       bytea     NOT NULL,
-	shared        BOOLEAN   NOT NULL,
-	max_messages  INTEGER   NOT NULL,
-	message_count INTEGER   NOT NULL,
-	max_age       BIGINT    NOT NULL,
-	created_at    timestamp NOT NULL,
-	last_used     timestamp NOT NULL,
+	account_id     TEXT,
+	room_id        TEXT,
+	session_id     CHAR(43)  NOT NULL UNIQUE,
+	session        bytea     NOT NULL,
+	shared         BOOLEAN   NOT NULL,
+	max_messages   INTEGER   NOT NULL,
+	message_count  INTEGER   NOT NULL,
+	max_age        BIGINT    NOT NULL,
+	created_at     timestamp NOT NULL,
+	last_used      timestamp NOT NULL,
+	shared_history BOOLEAN   NOT NULL DEFAULT false,
+	shared_with    TEXT,
 	PRIMARY KEY (account_id, room_id)
 );
 
 CREATE TABLE IF NOT EXISTS crypto_cross_signing_keys (
 	user_id TEXT,
 	usage   TEXT,
-	key     CHAR(43) NOT NULL,
+	key     TEXT NOT NULL,
 	PRIMARY KEY (user_id, usage)
 );
 
@@ -81,6 +98,23 @@ CREATE TABLE IF NOT EXISTS crypto_cross_signing_signatures (
 	signed_key     TEXT,
 	signer_user_id TEXT,
 	signer_key     TEXT,
-	signature      CHAR(88) NOT NULL,
+	signature      TEXT NOT NULL,
 	PRIMARY KEY (signed_user_id, signed_key, signer_user_id, signer_key)
 );
+
+CREATE TABLE IF NOT EXISTS crypto_cross_signing_pinned_key (
+	user_id TEXT PRIMARY KEY,
+	key     TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS crypto_outgoing_key_request (
+	account_id  TEXT,
+	session_id  CHAR(43),
+	request_id  TEXT      NOT NULL,
+	room_id     TEXT      NOT NULL,
+	sender_key  CHAR(43)  NOT NULL,
+	targets     TEXT      NOT NULL,
+	own_devices BOOLEAN   NOT NULL,
+	created_at  timestamp NOT NULL,
+	PRIMARY KEY (account_id, session_id)
+);
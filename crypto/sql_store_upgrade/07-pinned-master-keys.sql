@@ -0,0 +1,8 @@
+-- v7: Add table for pinned cross-signing master keys
+CREATE TABLE IF NOT EXISTS crypto_cross_signing_pinned_key (
+	user_id TEXT PRIMARY KEY,
+	key     CHAR(43) NOT NULL
+);
+-- Pin the currently known master keys so existing identities aren't reported as changed
+INSERT INTO crypto_cross_signing_pinned_key (user_id, key)
+	SELECT user_id, key FROM crypto_cross_signing_keys WHERE usage='master';
@@ -0,0 +1,2 @@
+-- v9: Store when the Olm fallback key was last rotated
+ALTER TABLE crypto_account ADD COLUMN fallback_key_rotated_at timestamp;
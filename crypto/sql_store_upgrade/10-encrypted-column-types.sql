@@ -0,0 +1,7 @@
+-- v10: Allow storing encrypted values in device and cross-signing columns
+-- only: postgres
+
+ALTER TABLE crypto_device ALTER COLUMN signing_key TYPE TEXT;
+ALTER TABLE crypto_cross_signing_keys ALTER COLUMN key TYPE TEXT;
+ALTER TABLE crypto_cross_signing_signatures ALTER COLUMN signature TYPE TEXT;
+ALTER TABLE crypto_cross_signing_pinned_key ALTER COLUMN key TYPE TEXT;
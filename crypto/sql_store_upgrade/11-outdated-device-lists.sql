@@ -0,0 +1,2 @@
+-- v11: Track whether device lists are outdated
+ALTER TABLE crypto_tracked_user ADD COLUMN devices_outdated BOOLEAN NOT NULL DEFAULT false;
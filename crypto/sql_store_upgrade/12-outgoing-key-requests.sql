@@ -0,0 +1,12 @@
+-- v12: Store outgoing room key requests
+CREATE TABLE IF NOT EXISTS crypto_outgoing_key_request (
+	account_id  TEXT,
+	session_id  CHAR(43),
+	request_id  TEXT      NOT NULL,
+	room_id     TEXT      NOT NULL,
+	sender_key  CHAR(43)  NOT NULL,
+	targets     TEXT      NOT NULL,
+	own_devices BOOLEAN   NOT NULL,
+	created_at  timestamp NOT NULL,
+	PRIMARY KEY (account_id, session_id)
+);
@@ -0,0 +1,2 @@
+-- v13: Store where inbound group sessions were received from
+ALTER TABLE crypto_megolm_inbound_session ADD COLUMN key_source TEXT NOT NULL DEFAULT '';
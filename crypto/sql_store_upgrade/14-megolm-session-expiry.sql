@@ -0,0 +1,4 @@
+-- v14: Store expiry metadata of inbound group sessions
+ALTER TABLE crypto_megolm_inbound_session ADD COLUMN received_at timestamp;
+ALTER TABLE crypto_megolm_inbound_session ADD COLUMN max_age BIGINT;
+ALTER TABLE crypto_megolm_inbound_session ADD COLUMN max_messages INTEGER;
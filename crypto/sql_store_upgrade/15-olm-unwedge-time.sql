@@ -0,0 +1,7 @@
+-- v15: Store when Olm sessions were last recreated to unwedge them
+CREATE TABLE IF NOT EXISTS crypto_olm_unwedge (
+	account_id  TEXT,
+	sender_key  CHAR(43),
+	unwedged_at timestamp NOT NULL,
+	PRIMARY KEY (account_id, sender_key)
+);
@@ -0,0 +1,2 @@
+-- v16: Store the sharing state of outbound group sessions for each device
+ALTER TABLE crypto_megolm_outbound_session ADD COLUMN shared_with TEXT;
@@ -13,6 +13,7 @@ import (
 	"os"
 	"sort"
 	"sync"
+	"time"
 
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
@@ -82,8 +83,8 @@ type Store interface {
 	HasSession(id.SenderKey) bool
 	// GetSessions returns all Olm sessions in the store with the given sender key.
 	GetSessions(id.SenderKey) (OlmSessionList, error)
-	// GetLatestSession returns the session with the highest session ID (lexiographically sorting).
-	// It's usually safe to return the most recently added session if sorting by session ID is too difficult.
+	// GetLatestSession returns the most recently used session with the given sender key, i.e. the session with
+	// the latest LastEncryptedTime or LastDecryptedTime. This is the session that is used for encrypting.
 	GetLatestSession(id.SenderKey) (*OlmSession, error)
 	// UpdateSession updates a session that has previously been inserted with AddSession.
 	UpdateSession(id.SenderKey, *OlmSession) error
@@ -107,6 +108,18 @@ type Store interface {
 	// GetAllGroupSessions gets all the inbound Megolm sessions in the store. This is used for creating key export
 	// files. Unlike GetGroupSession, this should not return any errors about withheld keys.
 	GetAllGroupSessions() ([]*InboundGroupSession, error)
+	// RemoveGroupSession removes an inbound Megolm session along with the message indices stored for it.
+	RemoveGroupSession(id.RoomID, id.SenderKey, id.SessionID) error
+	// RemoveGroupSessionsForRoom removes all the inbound Megolm sessions and withheld entries of the given room,
+	// along with the message indices stored for them. It returns the number of sessions and withheld entries removed.
+	RemoveGroupSessionsForRoom(id.RoomID) (int64, error)
+	// RemoveExpiredGroupSessions removes the inbound Megolm sessions that are expired with the given grace period
+	// (see InboundGroupSession.IsExpired), along with the message indices stored for them.
+	// It returns the number of sessions removed.
+	RemoveExpiredGroupSessions(gracePeriod time.Duration) (int64, error)
+	// GetGroupSessionReport returns the number of inbound Megolm sessions in each room, along with how many of them
+	// are forwarded and how many are expired with the given grace period.
+	GetGroupSessionReport(gracePeriod time.Duration) ([]RoomGroupSessionReport, error)
 
 	// AddOutboundGroupSession inserts the given outbound Megolm session into the store.
 	//
@@ -129,6 +142,12 @@ type Store interface {
 	// * If the map key exists and the stored values match the given values, this should return true.
 	// * If the map key exists, but the stored values do not match the given values, this should return false.
 	ValidateMessageIndex(senderKey id.SenderKey, sessionID id.SessionID, eventID id.EventID, index uint, timestamp int64) bool
+	// PruneMessageIndices removes the message indices stored by ValidateMessageIndex whose timestamp is older than the
+	// given unix timestamp in milliseconds. It returns the number of indices removed.
+	PruneMessageIndices(before int64) (int64, error)
+	// GetLatestMessageIndex returns the highest message index stored by ValidateMessageIndex for the given session.
+	// The boolean is false if there are no indices stored for the session.
+	GetLatestMessageIndex(id.SenderKey, id.SessionID) (uint, bool, error)
 
 	// GetDevices returns a map from device ID to DeviceIdentity containing all devices of a given user.
 	GetDevices(id.UserID) (map[id.DeviceID]*DeviceIdentity, error)
@@ -143,6 +162,14 @@ type Store interface {
 	// FilterTrackedUsers returns a filtered version of the given list that only includes user IDs whose device lists
 	// have been stored with PutDevices. A user is considered tracked even if the PutDevices list was empty.
 	FilterTrackedUsers([]id.UserID) []id.UserID
+	// MarkTrackedUsersOutdated marks the device lists of the given users as outdated. Users that aren't tracked
+	// should be ignored. The outdated flag of a user must be cleared when their devices are stored with PutDevices.
+	MarkTrackedUsersOutdated([]id.UserID) error
+	// GetOutdatedTrackedUsers returns the tracked users whose device lists have been marked as outdated.
+	GetOutdatedTrackedUsers() ([]id.UserID, error)
+	// UntrackUsers stops tracking the device lists of the given users. Untracked users must not be returned by
+	// FilterTrackedUsers, and GetDevices should return nil for them until their devices are stored with PutDevices again.
+	UntrackUsers([]id.UserID) error
 
 	// PutCrossSigningKey stores a cross-signing key of some user along with its usage.
 	PutCrossSigningKey(id.UserID, id.CrossSigningUsage, id.Ed25519) error
@@ -156,6 +183,71 @@ type Store interface {
 	IsKeySignedBy(id.UserID, id.Ed25519, id.UserID, id.Ed25519) (bool, error)
 	// DropSignaturesByKey deletes the signatures made by the given user and key from the store. It returns the number of signatures deleted.
 	DropSignaturesByKey(id.UserID, id.Ed25519) (int64, error)
+
+	// PutOlmUnwedgeTime stores the time when a new Olm session was last created with the device that has the given
+	// identity key in order to recover from a broken session.
+	PutOlmUnwedgeTime(id.SenderKey, time.Time) error
+	// GetOlmUnwedgeTime returns the time stored with PutOlmUnwedgeTime, or a zero time if nothing has been stored.
+	GetOlmUnwedgeTime(id.SenderKey) (time.Time, error)
+
+	// PutPinnedMasterKey pins the given cross-signing master key as the trusted identity of a user. The first master key
+	// seen for each user is pinned automatically (trust on first use), later changes are only pinned explicitly.
+	PutPinnedMasterKey(id.UserID, id.Ed25519) error
+	// GetPinnedMasterKey returns the pinned cross-signing master key of a user, or an empty string if nothing has been pinned.
+	GetPinnedMasterKey(id.UserID) (id.Ed25519, error)
+
+	// PutOutgoingKeyRequest stores an outgoing room key request, replacing the existing request for the same session.
+	PutOutgoingKeyRequest(*OutgoingKeyRequest) error
+	// GetOutgoingKeyRequest returns the outgoing room key request for the given session, or nil if there isn't one.
+	GetOutgoingKeyRequest(id.SessionID) (*OutgoingKeyRequest, error)
+	// GetOutgoingKeyRequests returns all the outgoing room key requests in the store.
+	GetOutgoingKeyRequests() ([]*OutgoingKeyRequest, error)
+	// DeleteOutgoingKeyRequest removes the outgoing room key request for the given session.
+	DeleteOutgoingKeyRequest(id.SessionID) error
+}
+
+// MigratableStore is a Store that can also list everything it contains. Both the source and the target of
+// MigrateStore must implement this interface.
+type MigratableStore interface {
+	Store
+
+	// GetAllOlmSessions returns all Olm sessions in the store grouped by sender key.
+	GetAllOlmSessions() (map[id.SenderKey]OlmSessionList, error)
+	// GetAllWithheldGroupSessions returns all the withheld group session events in the store.
+	GetAllWithheldGroupSessions() ([]*event.RoomKeyWithheldEventContent, error)
+	// GetAllOutboundGroupSessions returns all the outbound Megolm sessions in the store. The sessions may be the same
+	// instances that the OlmMachine is using, so their sharing state must be read with OutboundGroupSession.UserStates.
+	GetAllOutboundGroupSessions() ([]*OutboundGroupSession, error)
+	// GetAllMessageIndices returns all the message indices stored with ValidateMessageIndex.
+	GetAllMessageIndices() ([]MessageIndex, error)
+	// GetAllTrackedUsers returns all the users whose device lists have been stored with PutDevices.
+	GetAllTrackedUsers() ([]id.UserID, error)
+	// GetAllUntrackedDevices returns the stored devices of users that are no longer tracked (see UntrackUsers).
+	GetAllUntrackedDevices() (map[id.UserID]map[id.DeviceID]*DeviceIdentity, error)
+	// GetAllCrossSigningKeys returns the cross-signing keys of all users in the store.
+	GetAllCrossSigningKeys() (map[id.UserID]map[id.CrossSigningUsage]id.Ed25519, error)
+	// GetAllSignatures returns all the cross-signing and device key signatures in the store.
+	GetAllSignatures() ([]KeySignature, error)
+	// GetAllPinnedMasterKeys returns the pinned master keys of all users in the store.
+	GetAllPinnedMasterKeys() (map[id.UserID]id.Ed25519, error)
+}
+
+// MessageIndex is a single entry stored with Store.ValidateMessageIndex.
+type MessageIndex struct {
+	SenderKey id.SenderKey
+	SessionID id.SessionID
+	Index     uint
+	EventID   id.EventID
+	Timestamp int64
+}
+
+// KeySignature is a single signature stored with Store.PutSignature.
+type KeySignature struct {
+	SignedUserID id.UserID
+	SignedKey    id.Ed25519
+	SignerUserID id.UserID
+	SignerKey    id.Ed25519
+	Signature    string
 }
 
 type messageIndexKey struct {
@@ -185,9 +277,18 @@ type GobStore struct {
 	Devices               map[id.UserID]map[id.DeviceID]*DeviceIdentity
 	CrossSigningKeys      map[id.UserID]map[id.CrossSigningUsage]id.Ed25519
 	KeySignatures         map[id.UserID]map[id.Ed25519]map[id.UserID]map[id.Ed25519]string
+	PinnedMasterKeys      map[id.UserID]id.Ed25519
+	OutdatedUsers         map[id.UserID]struct{}
+	UntrackedUsers        map[id.UserID]struct{}
+	OutgoingKeyRequests   map[id.SessionID]*OutgoingKeyRequest
+	OlmUnwedgeTimes       map[id.SenderKey]time.Time
+
+	// PinnedMasterKeysBackfilled is false in stores created before master keys were pinned. The master keys known
+	// in such stores are pinned when loading them, like the SQL store does in its upgrade.
+	PinnedMasterKeysBackfilled bool
 }
 
-var _ Store = (*GobStore)(nil)
+var _ MigratableStore = (*GobStore)(nil)
 
 // NewGobStore creates a new GobStore that saves everything to the given file.
 //
@@ -203,6 +304,11 @@ func NewGobStore(path string) (*GobStore, error) {
 		Devices:               make(map[id.UserID]map[id.DeviceID]*DeviceIdentity),
 		CrossSigningKeys:      make(map[id.UserID]map[id.CrossSigningUsage]id.Ed25519),
 		KeySignatures:         make(map[id.UserID]map[id.Ed25519]map[id.UserID]map[id.Ed25519]string),
+		PinnedMasterKeys:      make(map[id.UserID]id.Ed25519),
+		OutdatedUsers:         make(map[id.UserID]struct{}),
+		UntrackedUsers:        make(map[id.UserID]struct{}),
+		OutgoingKeyRequests:   make(map[id.SessionID]*OutgoingKeyRequest),
+		OlmUnwedgeTimes:       make(map[id.SenderKey]time.Time),
 	}
 	return gs, gs.load()
 }
@@ -221,13 +327,32 @@ func (gs *GobStore) load() error {
 	file, err := os.OpenFile(gs.path, os.O_RDONLY, 0600)
 	if err != nil {
 		if os.IsNotExist(err) {
+			gs.PinnedMasterKeysBackfilled = true
 			return nil
 		}
 		return err
 	}
 	err = gob.NewDecoder(file).Decode(gs)
 	_ = file.Close()
-	return err
+	if err != nil {
+		return err
+	} else if !gs.PinnedMasterKeysBackfilled {
+		return gs.backfillPinnedMasterKeys()
+	}
+	return nil
+}
+
+// backfillPinnedMasterKeys pins the currently known master keys so existing identities aren't reported as changed.
+func (gs *GobStore) backfillPinnedMasterKeys() error {
+	for userID, keys := range gs.CrossSigningKeys {
+		if masterKey, ok := keys[id.XSUsageMaster]; ok {
+			if _, pinned := gs.PinnedMasterKeys[userID]; !pinned {
+				gs.PinnedMasterKeys[userID] = masterKey
+			}
+		}
+	}
+	gs.PinnedMasterKeysBackfilled = true
+	return gs.save()
 }
 
 func (gs *GobStore) Flush() error {
@@ -289,7 +414,27 @@ func (gs *GobStore) GetLatestSession(senderKey id.SenderKey) (*OlmSession, error
 	if !ok || len(sessions) == 0 {
 		return nil, nil
 	}
-	return sessions[0], nil
+	latest := sessions[0]
+	for _, session := range sessions[1:] {
+		if session.LastUsedTime().After(latest.LastUsedTime()) {
+			latest = session
+		}
+	}
+	return latest, nil
+}
+
+func (gs *GobStore) PutOlmUnwedgeTime(senderKey id.SenderKey, ts time.Time) error {
+	gs.lock.Lock()
+	gs.OlmUnwedgeTimes[senderKey] = ts
+	err := gs.save()
+	gs.lock.Unlock()
+	return err
+}
+
+func (gs *GobStore) GetOlmUnwedgeTime(senderKey id.SenderKey) (time.Time, error) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+	return gs.OlmUnwedgeTimes[senderKey], nil
 }
 
 func (gs *GobStore) getGroupSessions(roomID id.RoomID, senderKey id.SenderKey) map[id.SessionID]*InboundGroupSession {
@@ -426,6 +571,133 @@ func (gs *GobStore) RemoveOutboundGroupSession(roomID id.RoomID) error {
 	return nil
 }
 
+func (gs *GobStore) RemoveGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) error {
+	gs.lock.Lock()
+	delete(gs.getGroupSessions(roomID, senderKey), sessionID)
+	delete(gs.getWithheldGroupSessions(roomID, senderKey), sessionID)
+	gs.removeMessageIndices(func(key messageIndexKey) bool {
+		return key.SenderKey == senderKey && key.SessionID == sessionID
+	})
+	err := gs.save()
+	gs.lock.Unlock()
+	return err
+}
+
+func (gs *GobStore) RemoveGroupSessionsForRoom(roomID id.RoomID) (int64, error) {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	removed := make(map[id.SessionID]struct{})
+	for _, sessions := range gs.GroupSessions[roomID] {
+		for sessionID := range sessions {
+			removed[sessionID] = struct{}{}
+		}
+	}
+	var count int64
+	for _, sessions := range gs.WithheldGroupSessions[roomID] {
+		count += int64(len(sessions))
+	}
+	count += int64(len(removed))
+	delete(gs.GroupSessions, roomID)
+	delete(gs.WithheldGroupSessions, roomID)
+	gs.removeMessageIndices(func(key messageIndexKey) bool {
+		_, ok := removed[key.SessionID]
+		return ok
+	})
+	return count, gs.save()
+}
+
+// latestMessageIndices returns the highest message index stored for each session.
+func (gs *GobStore) latestMessageIndices() map[id.SessionID]int64 {
+	latest := make(map[id.SessionID]int64)
+	for key := range gs.MessageIndices {
+		if current, ok := latest[key.SessionID]; !ok || int64(key.Index) > current {
+			latest[key.SessionID] = int64(key.Index)
+		}
+	}
+	return latest
+}
+
+func (gs *GobStore) getAllGroupSessionsWithLatestIndex() ([]*InboundGroupSession, []int64) {
+	latest := gs.latestMessageIndices()
+	var sessions []*InboundGroupSession
+	var latestIndices []int64
+	for _, room := range gs.GroupSessions {
+		for _, roomSessions := range room {
+			for sessionID, session := range roomSessions {
+				index, ok := latest[sessionID]
+				if !ok {
+					index = -1
+				}
+				sessions = append(sessions, session)
+				latestIndices = append(latestIndices, index)
+			}
+		}
+	}
+	return sessions, latestIndices
+}
+
+func (gs *GobStore) RemoveExpiredGroupSessions(gracePeriod time.Duration) (int64, error) {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	sessions, latestIndices := gs.getAllGroupSessionsWithLatestIndex()
+	removed := make(map[id.SessionID]struct{})
+	for i, session := range sessions {
+		if session.IsExpired(latestIndices[i], gracePeriod) {
+			delete(gs.getGroupSessions(session.RoomID, session.SenderKey), session.ID())
+			removed[session.ID()] = struct{}{}
+		}
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+	gs.removeMessageIndices(func(key messageIndexKey) bool {
+		_, ok := removed[key.SessionID]
+		return ok
+	})
+	return int64(len(removed)), gs.save()
+}
+
+func (gs *GobStore) GetGroupSessionReport(gracePeriod time.Duration) ([]RoomGroupSessionReport, error) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+	sessions, latestIndices := gs.getAllGroupSessionsWithLatestIndex()
+	return makeGroupSessionReport(sessions, latestIndices, gracePeriod), nil
+}
+
+func (gs *GobStore) removeMessageIndices(filter func(key messageIndexKey) bool) int64 {
+	var count int64
+	for key := range gs.MessageIndices {
+		if filter(key) {
+			delete(gs.MessageIndices, key)
+			count++
+		}
+	}
+	return count
+}
+
+func (gs *GobStore) PruneMessageIndices(before int64) (int64, error) {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	count := gs.removeMessageIndices(func(key messageIndexKey) bool {
+		return gs.MessageIndices[key].Timestamp < before
+	})
+	return count, gs.save()
+}
+
+func (gs *GobStore) GetLatestMessageIndex(senderKey id.SenderKey, sessionID id.SessionID) (uint, bool, error) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+	var latest uint
+	var found bool
+	for key := range gs.MessageIndices {
+		if key.SenderKey == senderKey && key.SessionID == sessionID && (!found || key.Index > latest) {
+			latest = key.Index
+			found = true
+		}
+	}
+	return latest, found, nil
+}
+
 func (gs *GobStore) ValidateMessageIndex(senderKey id.SenderKey, sessionID id.SessionID, eventID id.EventID, index uint, timestamp int64) bool {
 	gs.lock.Lock()
 	defer gs.lock.Unlock()
@@ -452,7 +724,7 @@ func (gs *GobStore) ValidateMessageIndex(senderKey id.SenderKey, sessionID id.Se
 func (gs *GobStore) GetDevices(userID id.UserID) (map[id.DeviceID]*DeviceIdentity, error) {
 	gs.lock.RLock()
 	devices, ok := gs.Devices[userID]
-	if !ok {
+	if _, untracked := gs.UntrackedUsers[userID]; !ok || untracked {
 		devices = nil
 	}
 	gs.lock.RUnlock()
@@ -504,6 +776,8 @@ func (gs *GobStore) PutDevice(userID id.UserID, device *DeviceIdentity) error {
 func (gs *GobStore) PutDevices(userID id.UserID, devices map[id.DeviceID]*DeviceIdentity) error {
 	gs.lock.Lock()
 	gs.Devices[userID] = devices
+	delete(gs.OutdatedUsers, userID)
+	delete(gs.UntrackedUsers, userID)
 	err := gs.save()
 	gs.lock.Unlock()
 	return err
@@ -514,7 +788,8 @@ func (gs *GobStore) FilterTrackedUsers(users []id.UserID) []id.UserID {
 	var ptr int
 	for _, userID := range users {
 		_, ok := gs.Devices[userID]
-		if ok {
+		_, untracked := gs.UntrackedUsers[userID]
+		if ok && !untracked {
 			users[ptr] = userID
 			ptr++
 		}
@@ -523,6 +798,43 @@ func (gs *GobStore) FilterTrackedUsers(users []id.UserID) []id.UserID {
 	return users[:ptr]
 }
 
+func (gs *GobStore) MarkTrackedUsersOutdated(users []id.UserID) error {
+	gs.lock.Lock()
+	for _, userID := range users {
+		_, untracked := gs.UntrackedUsers[userID]
+		if _, ok := gs.Devices[userID]; ok && !untracked {
+			gs.OutdatedUsers[userID] = struct{}{}
+		}
+	}
+	err := gs.save()
+	gs.lock.Unlock()
+	return err
+}
+
+func (gs *GobStore) GetOutdatedTrackedUsers() ([]id.UserID, error) {
+	gs.lock.RLock()
+	result := make([]id.UserID, 0, len(gs.OutdatedUsers))
+	for userID := range gs.OutdatedUsers {
+		result = append(result, userID)
+	}
+	gs.lock.RUnlock()
+	return result, nil
+}
+
+func (gs *GobStore) UntrackUsers(users []id.UserID) error {
+	gs.lock.Lock()
+	for _, userID := range users {
+		// The device identities are kept, so that GetDevice and FindDeviceByKey still work for untracked users
+		if _, ok := gs.Devices[userID]; ok {
+			gs.UntrackedUsers[userID] = struct{}{}
+		}
+		delete(gs.OutdatedUsers, userID)
+	}
+	err := gs.save()
+	gs.lock.Unlock()
+	return err
+}
+
 func (gs *GobStore) PutCrossSigningKey(userID id.UserID, usage id.CrossSigningUsage, key id.Ed25519) error {
 	gs.lock.RLock()
 	userKeys, ok := gs.CrossSigningKeys[userID]
@@ -612,3 +924,172 @@ func (gs *GobStore) DropSignaturesByKey(userID id.UserID, key id.Ed25519) (int64
 	gs.lock.RUnlock()
 	return count, nil
 }
+
+func (gs *GobStore) PutPinnedMasterKey(userID id.UserID, key id.Ed25519) error {
+	gs.lock.Lock()
+	gs.PinnedMasterKeys[userID] = key
+	err := gs.save()
+	gs.lock.Unlock()
+	return err
+}
+
+func (gs *GobStore) GetPinnedMasterKey(userID id.UserID) (id.Ed25519, error) {
+	gs.lock.RLock()
+	key := gs.PinnedMasterKeys[userID]
+	gs.lock.RUnlock()
+	return key, nil
+}
+
+func (gs *GobStore) GetAllOlmSessions() (map[id.SenderKey]OlmSessionList, error) {
+	gs.lock.RLock()
+	result := make(map[id.SenderKey]OlmSessionList, len(gs.Sessions))
+	for senderKey, sessions := range gs.Sessions {
+		if len(sessions) > 0 {
+			result[senderKey] = append(OlmSessionList{}, sessions...)
+		}
+	}
+	gs.lock.RUnlock()
+	return result, nil
+}
+
+func (gs *GobStore) GetAllWithheldGroupSessions() ([]*event.RoomKeyWithheldEventContent, error) {
+	gs.lock.RLock()
+	var result []*event.RoomKeyWithheldEventContent
+	for _, room := range gs.WithheldGroupSessions {
+		for _, sessions := range room {
+			for _, content := range sessions {
+				result = append(result, content)
+			}
+		}
+	}
+	gs.lock.RUnlock()
+	return result, nil
+}
+
+func (gs *GobStore) GetAllOutboundGroupSessions() ([]*OutboundGroupSession, error) {
+	gs.lock.RLock()
+	result := make([]*OutboundGroupSession, 0, len(gs.OutGroupSessions))
+	for _, session := range gs.OutGroupSessions {
+		result = append(result, session)
+	}
+	gs.lock.RUnlock()
+	return result, nil
+}
+
+func (gs *GobStore) GetAllMessageIndices() ([]MessageIndex, error) {
+	gs.lock.RLock()
+	result := make([]MessageIndex, 0, len(gs.MessageIndices))
+	for key, value := range gs.MessageIndices {
+		result = append(result, MessageIndex{
+			SenderKey: key.SenderKey,
+			SessionID: key.SessionID,
+			Index:     key.Index,
+			EventID:   value.EventID,
+			Timestamp: value.Timestamp,
+		})
+	}
+	gs.lock.RUnlock()
+	return result, nil
+}
+
+func (gs *GobStore) PutOutgoingKeyRequest(req *OutgoingKeyRequest) error {
+	gs.lock.Lock()
+	gs.OutgoingKeyRequests[req.SessionID] = req
+	err := gs.save()
+	gs.lock.Unlock()
+	return err
+}
+
+func (gs *GobStore) GetOutgoingKeyRequest(sessionID id.SessionID) (*OutgoingKeyRequest, error) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+	return gs.OutgoingKeyRequests[sessionID], nil
+}
+
+func (gs *GobStore) GetOutgoingKeyRequests() ([]*OutgoingKeyRequest, error) {
+	gs.lock.RLock()
+	result := make([]*OutgoingKeyRequest, 0, len(gs.OutgoingKeyRequests))
+	for _, req := range gs.OutgoingKeyRequests {
+		result = append(result, req)
+	}
+	gs.lock.RUnlock()
+	return result, nil
+}
+
+func (gs *GobStore) DeleteOutgoingKeyRequest(sessionID id.SessionID) error {
+	gs.lock.Lock()
+	delete(gs.OutgoingKeyRequests, sessionID)
+	err := gs.save()
+	gs.lock.Unlock()
+	return err
+}
+
+func (gs *GobStore) GetAllTrackedUsers() ([]id.UserID, error) {
+	gs.lock.RLock()
+	result := make([]id.UserID, 0, len(gs.Devices))
+	for userID := range gs.Devices {
+		if _, untracked := gs.UntrackedUsers[userID]; !untracked {
+			result = append(result, userID)
+		}
+	}
+	gs.lock.RUnlock()
+	return result, nil
+}
+
+func (gs *GobStore) GetAllUntrackedDevices() (map[id.UserID]map[id.DeviceID]*DeviceIdentity, error) {
+	gs.lock.RLock()
+	result := make(map[id.UserID]map[id.DeviceID]*DeviceIdentity, len(gs.UntrackedUsers))
+	for userID := range gs.UntrackedUsers {
+		if devices, ok := gs.Devices[userID]; ok {
+			result[userID] = devices
+		}
+	}
+	gs.lock.RUnlock()
+	return result, nil
+}
+
+func (gs *GobStore) GetAllCrossSigningKeys() (map[id.UserID]map[id.CrossSigningUsage]id.Ed25519, error) {
+	gs.lock.RLock()
+	result := make(map[id.UserID]map[id.CrossSigningUsage]id.Ed25519, len(gs.CrossSigningKeys))
+	for userID, keys := range gs.CrossSigningKeys {
+		userKeys := make(map[id.CrossSigningUsage]id.Ed25519, len(keys))
+		for usage, key := range keys {
+			userKeys[usage] = key
+		}
+		result[userID] = userKeys
+	}
+	gs.lock.RUnlock()
+	return result, nil
+}
+
+func (gs *GobStore) GetAllSignatures() ([]KeySignature, error) {
+	gs.lock.RLock()
+	var result []KeySignature
+	for signedUserID, signedUserSigs := range gs.KeySignatures {
+		for signedKey, signaturesForKey := range signedUserSigs {
+			for signerUserID, signedByUser := range signaturesForKey {
+				for signerKey, signature := range signedByUser {
+					result = append(result, KeySignature{
+						SignedUserID: signedUserID,
+						SignedKey:    signedKey,
+						SignerUserID: signerUserID,
+						SignerKey:    signerKey,
+						Signature:    signature,
+					})
+				}
+			}
+		}
+	}
+	gs.lock.RUnlock()
+	return result, nil
+}
+
+func (gs *GobStore) GetAllPinnedMasterKeys() (map[id.UserID]id.Ed25519, error) {
+	gs.lock.RLock()
+	result := make(map[id.UserID]id.Ed25519, len(gs.PinnedMasterKeys))
+	for userID, key := range gs.PinnedMasterKeys {
+		result[userID] = key
+	}
+	gs.lock.RUnlock()
+	return result, nil
+}
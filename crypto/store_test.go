@@ -8,9 +8,11 @@ package crypto
 
 import (
 	"database/sql"
+	"errors"
 	"os"
 	"strconv"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 
@@ -164,6 +166,9 @@ func TestStoreMegolmSession(t *testing.T) {
 				SigningKey: acc.SigningKey(),
 				SenderKey:  acc.IdentityKey(),
 				RoomID:     "room1",
+
+				SharedHistory: true,
+				KeySource:     KeySourceForwarded,
 			}
 
 			err = store.PutGroupSession("room1", acc.IdentityKey(), igs.ID(), igs)
@@ -179,6 +184,107 @@ func TestStoreMegolmSession(t *testing.T) {
 			if pickled := string(retrieved.Internal.Pickle([]byte("test"))); pickled != groupSession {
 				t.Error("Pickled inbound group session does not match original")
 			}
+			if !retrieved.SharedHistory {
+				t.Error("Shared history flag of inbound group session was not stored")
+			}
+			if retrieved.KeySource != KeySourceForwarded {
+				t.Errorf("Expected key source %q, got %q", KeySourceForwarded, retrieved.KeySource)
+			}
+			if !retrieved.IsForwarded() {
+				t.Error("Inbound group session with forwarded key source was not marked as forwarded")
+			}
+		})
+	}
+}
+
+func TestRemoveMegolmSessions(t *testing.T) {
+	stores, cleanup := getCryptoStores(t)
+	defer cleanup()
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			acc := NewOlmAccount()
+			internal, err := olm.InboundGroupSessionFromPickled([]byte(groupSession), []byte("test"))
+			if err != nil {
+				t.Fatalf("Error creating internal inbound group session: %v", err)
+			}
+			igs := &InboundGroupSession{
+				Internal:   *internal,
+				SigningKey: acc.SigningKey(),
+				SenderKey:  acc.IdentityKey(),
+				RoomID:     "room1",
+			}
+			err = store.PutGroupSession("room1", acc.IdentityKey(), igs.ID(), igs)
+			if err != nil {
+				t.Fatalf("Error storing inbound group session: %v", err)
+			}
+			store.ValidateMessageIndex(acc.IdentityKey(), igs.ID(), "$event1", 0, 1000)
+			store.ValidateMessageIndex(acc.IdentityKey(), igs.ID(), "$event2", 1, 3000)
+
+			if index, ok, err := store.GetLatestMessageIndex(acc.IdentityKey(), igs.ID()); err != nil || !ok || index != 1 {
+				t.Errorf("Expected latest message index 1, got %d (found: %t, error: %v)", index, ok, err)
+			}
+			if count, err := store.PruneMessageIndices(2000); err != nil || count != 1 {
+				t.Errorf("Expected 1 pruned message index, got %d (error: %v)", count, err)
+			}
+			if count, err := store.RemoveGroupSessionsForRoom("room1"); err != nil || count != 1 {
+				t.Errorf("Expected 1 removed session, got %d (error: %v)", count, err)
+			}
+			if sess, err := store.GetGroupSession("room1", acc.IdentityKey(), igs.ID()); err != nil || sess != nil {
+				t.Errorf("Got inbound group session after removing it (error: %v)", err)
+			}
+			if _, ok, err := store.GetLatestMessageIndex(acc.IdentityKey(), igs.ID()); err != nil || ok {
+				t.Errorf("Message indices of removed session were not removed (error: %v)", err)
+			}
+		})
+	}
+}
+
+func TestRemoveExpiredMegolmSessions(t *testing.T) {
+	stores, cleanup := getCryptoStores(t)
+	defer cleanup()
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			acc := NewOlmAccount()
+			newSession := func(receivedAt time.Time, maxAge time.Duration, maxMessages int) *InboundGroupSession {
+				igs, err := NewInboundGroupSession(acc.IdentityKey(), acc.SigningKey(), "room1", olm.NewOutboundGroupSession().Key())
+				if err != nil {
+					t.Fatalf("Error creating inbound group session: %v", err)
+				}
+				igs.ReceivedAt = receivedAt
+				igs.MaxAge = maxAge
+				igs.MaxMessages = maxMessages
+				if err = store.PutGroupSession("room1", acc.IdentityKey(), igs.ID(), igs); err != nil {
+					t.Fatalf("Error storing inbound group session: %v", err)
+				}
+				return igs
+			}
+			usedUp := newSession(time.Now(), 0, 2)
+			store.ValidateMessageIndex(acc.IdentityKey(), usedUp.ID(), "$event1", 0, 1000)
+			store.ValidateMessageIndex(acc.IdentityKey(), usedUp.ID(), "$event2", 1, 2000)
+			tooOld := newSession(time.Now().Add(-2*time.Hour), time.Hour, 0)
+			valid := newSession(time.Now().Add(-2*time.Hour), 3*time.Hour, 10)
+			store.ValidateMessageIndex(acc.IdentityKey(), valid.ID(), "$event3", 0, 3000)
+
+			if reports, err := store.GetGroupSessionReport(0); err != nil || len(reports) != 1 || reports[0].Sessions != 3 || reports[0].Expired != 2 {
+				t.Errorf("Expected 3 sessions with 2 expired, got %+v (error: %v)", reports, err)
+			}
+			if count, err := store.RemoveExpiredGroupSessions(0); err != nil || count != 2 {
+				t.Errorf("Expected 2 removed sessions, got %d (error: %v)", count, err)
+			}
+			for _, igs := range []*InboundGroupSession{usedUp, tooOld} {
+				if sess, err := store.GetGroupSession("room1", acc.IdentityKey(), igs.ID()); err != nil || sess != nil {
+					t.Errorf("Got expired inbound group session after removing it (error: %v)", err)
+				}
+			}
+			if _, ok, err := store.GetLatestMessageIndex(acc.IdentityKey(), usedUp.ID()); err != nil || ok {
+				t.Errorf("Message indices of removed session were not removed (error: %v)", err)
+			}
+			if sess, err := store.GetGroupSession("room1", acc.IdentityKey(), valid.ID()); err != nil || sess == nil {
+				t.Errorf("Valid inbound group session was removed (error: %v)", err)
+			}
+			if reports, err := store.GetGroupSessionReport(0); err != nil || len(reports) != 1 || reports[0].Sessions != 1 || reports[0].Expired != 0 {
+				t.Errorf("Expected 1 session with none expired, got %+v (error: %v)", reports, err)
+			}
 		})
 	}
 }
@@ -267,3 +373,290 @@ func TestStoreDevices(t *testing.T) {
 		})
 	}
 }
+
+func TestStoreOutdatedUsers(t *testing.T) {
+	stores, cleanup := getCryptoStores(t)
+	defer cleanup()
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			devices := map[id.DeviceID]*DeviceIdentity{"dev1": {UserID: "user1", DeviceID: "dev1"}}
+			if err := store.PutDevices("user1", devices); err != nil {
+				t.Fatalf("Error storing devices: %v", err)
+			}
+			if err := store.MarkTrackedUsersOutdated([]id.UserID{"user1", "user2"}); err != nil {
+				t.Fatalf("Error marking users outdated: %v", err)
+			}
+			if outdated, err := store.GetOutdatedTrackedUsers(); err != nil {
+				t.Errorf("Error getting outdated users: %v", err)
+			} else if len(outdated) != 1 || outdated[0] != "user1" {
+				t.Errorf("Expected only user1 to be outdated, got %v", outdated)
+			}
+
+			if err := store.PutDevices("user1", devices); err != nil {
+				t.Fatalf("Error storing devices: %v", err)
+			}
+			if outdated, err := store.GetOutdatedTrackedUsers(); err != nil {
+				t.Errorf("Error getting outdated users: %v", err)
+			} else if len(outdated) != 0 {
+				t.Errorf("Expected no outdated users after storing devices, got %v", outdated)
+			}
+
+			store.MarkTrackedUsersOutdated([]id.UserID{"user1"})
+			if err := store.UntrackUsers([]id.UserID{"user1"}); err != nil {
+				t.Fatalf("Error untracking user: %v", err)
+			}
+			if filtered := store.FilterTrackedUsers([]id.UserID{"user1"}); len(filtered) != 0 {
+				t.Errorf("Expected user1 to be untracked, got %v", filtered)
+			}
+			if devs, err := store.GetDevices("user1"); err != nil || devs != nil {
+				t.Errorf("Expected nil devices for untracked user, got %v (error: %v)", devs, err)
+			}
+			if dev, err := store.GetDevice("user1", "dev1"); err != nil || dev == nil {
+				t.Errorf("Expected device of untracked user to still be stored, got %v (error: %v)", dev, err)
+			}
+			if outdated, _ := store.GetOutdatedTrackedUsers(); len(outdated) != 0 {
+				t.Errorf("Expected untracked user to not be outdated, got %v", outdated)
+			}
+		})
+	}
+}
+
+func TestStoreOutgoingKeyRequests(t *testing.T) {
+	stores, cleanup := getCryptoStores(t)
+	defer cleanup()
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			req := &OutgoingKeyRequest{
+				RequestID:  "req1",
+				RoomID:     "!room:example.com",
+				SenderKey:  "sender",
+				SessionID:  olmSessID,
+				Targets:    map[id.UserID][]id.DeviceID{"user1": {"dev1"}},
+				OwnDevices: true,
+				CreatedAt:  time.Now().Truncate(time.Second),
+			}
+			if err := store.PutOutgoingKeyRequest(req); err != nil {
+				t.Fatalf("Error storing key request: %v", err)
+			}
+			req.Targets["user1"] = append(req.Targets["user1"], "dev2")
+			if err := store.PutOutgoingKeyRequest(req); err != nil {
+				t.Fatalf("Error updating key request: %v", err)
+			}
+			if stored, err := store.GetOutgoingKeyRequest(olmSessID); err != nil || stored == nil {
+				t.Fatalf("Error getting key request: %v", err)
+			} else if stored.RequestID != "req1" || !stored.OwnDevices || len(stored.Targets["user1"]) != 2 {
+				t.Errorf("Stored key request doesn't match: %+v", stored)
+			}
+			if reqs, err := store.GetOutgoingKeyRequests(); err != nil || len(reqs) != 1 {
+				t.Errorf("Expected 1 key request, got %d (error: %v)", len(reqs), err)
+			}
+			if err := store.DeleteOutgoingKeyRequest(olmSessID); err != nil {
+				t.Fatalf("Error deleting key request: %v", err)
+			}
+			if stored, err := store.GetOutgoingKeyRequest(olmSessID); err != nil || stored != nil {
+				t.Errorf("Expected no key request after deleting, got %+v (error: %v)", stored, err)
+			}
+		})
+	}
+}
+
+func TestStorePinnedMasterKey(t *testing.T) {
+	stores, cleanup := getCryptoStores(t)
+	defer cleanup()
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			if key, err := store.GetPinnedMasterKey("user1"); err != nil {
+				t.Errorf("Error retrieving pinned master key: %v", err)
+			} else if key != "" {
+				t.Errorf("Found pinned master key %s before pinning one", key)
+			}
+			store.PutPinnedMasterKey("user1", "key1")
+			store.PutPinnedMasterKey("user1", "key2")
+			if key, err := store.GetPinnedMasterKey("user1"); err != nil {
+				t.Errorf("Error retrieving pinned master key: %v", err)
+			} else if key != "key2" {
+				t.Errorf("Expected pinned master key key2, got %s", key)
+			}
+		})
+	}
+}
+
+func TestStoreOlmUnwedgeTime(t *testing.T) {
+	stores, cleanup := getCryptoStores(t)
+	defer cleanup()
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			if ts, err := store.GetOlmUnwedgeTime("key1"); err != nil {
+				t.Errorf("Error retrieving unwedge time: %v", err)
+			} else if !ts.IsZero() {
+				t.Errorf("Found unwedge time %s before storing one", ts)
+			}
+			first := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+			second := first.Add(time.Hour)
+			store.PutOlmUnwedgeTime("key1", first)
+			store.PutOlmUnwedgeTime("key1", second)
+			if ts, err := store.GetOlmUnwedgeTime("key1"); err != nil {
+				t.Errorf("Error retrieving unwedge time: %v", err)
+			} else if !ts.Equal(second) {
+				t.Errorf("Expected unwedge time %s, got %s", second, ts)
+			}
+		})
+	}
+}
+
+func TestMigrateStore(t *testing.T) {
+	stores, cleanup := getCryptoStores(t)
+	defer cleanup()
+	gobStore := stores["gob"].(*GobStore)
+	sqlStore := stores["sql"].(*SQLCryptoStore)
+
+	gobStore.PutAccount(NewOlmAccount())
+	olmInternal, err := olm.SessionFromPickled([]byte(olmPickled), []byte("test"))
+	if err != nil {
+		t.Fatalf("Error creating internal Olm session: %v", err)
+	}
+	gobStore.AddSession("senderkey", &OlmSession{Internal: *olmInternal})
+	gobStore.ValidateMessageIndex("senderkey", "sess1", "event1", 0, 1000)
+	gobStore.PutDevices("user1", map[id.DeviceID]*DeviceIdentity{
+		"dev1": {UserID: "user1", DeviceID: "dev1", IdentityKey: "idkey", SigningKey: "signkey"},
+	})
+	gobStore.PutDevices("user2", map[id.DeviceID]*DeviceIdentity{
+		"dev2": {UserID: "user2", DeviceID: "dev2", IdentityKey: "idkey2", SigningKey: "signkey2", Trust: TrustStateVerified},
+	})
+	gobStore.UntrackUsers([]id.UserID{"user2"})
+	gobStore.PutCrossSigningKey("user1", id.XSUsageMaster, "masterkey")
+	gobStore.PutSignature("user1", "signkey", "user1", "masterkey", "sig")
+	gobStore.PutPinnedMasterKey("user1", "masterkey")
+
+	result, err := MigrateStore(gobStore, sqlStore, true)
+	if err != nil {
+		t.Fatalf("Error in dry run migration: %v", err)
+	} else if result.Target.HasAccount || result.Target.Devices != 0 {
+		t.Errorf("Dry run migration wrote to target store: %+v", result.Target)
+	} else if result.Source.UntrackedUsers != 1 || result.Source.UntrackedDevices != 1 {
+		t.Errorf("Expected dry run to report 1 untracked user with 1 device, got %+v", result.Source)
+	}
+
+	result, err = MigrateStore(gobStore, sqlStore, false)
+	if err != nil {
+		t.Fatalf("Error migrating store: %v", err)
+	}
+	if !result.Source.HasAccount || result.Source.OlmSessions != 1 || result.Source.MessageIndices != 1 ||
+		result.Source.Devices != 1 || result.Source.Signatures != 1 || result.Source.PinnedMasterKeys != 1 {
+		t.Errorf("Unexpected source counts: %+v", result.Source)
+	}
+	if key, _ := sqlStore.GetPinnedMasterKey("user1"); key != "masterkey" {
+		t.Errorf("Expected pinned master key to be migrated, got %s", key)
+	}
+	if device, err := sqlStore.GetDevice("user2", "dev2"); err != nil || device == nil || device.Trust != TrustStateVerified {
+		t.Errorf("Expected untracked user's device to be migrated with its trust, got %+v (error: %v)", device, err)
+	}
+	if tracked := sqlStore.FilterTrackedUsers([]id.UserID{"user2"}); len(tracked) != 0 {
+		t.Errorf("Expected untracked user to stay untracked after migration, got %v", tracked)
+	}
+}
+
+func TestSQLStorePickleKeyRotation(t *testing.T) {
+	stores, cleanup := getCryptoStores(t)
+	defer cleanup()
+	store := stores["sql"].(*SQLCryptoStore)
+
+	account := NewOlmAccount()
+	if err := store.PutAccount(account); err != nil {
+		t.Fatalf("Error storing account: %v", err)
+	}
+	device := &DeviceIdentity{UserID: "user1", DeviceID: "dev1", IdentityKey: account.IdentityKey(), SigningKey: account.SigningKey(), Name: "Secret device"}
+	if err := store.PutDevices("user1", map[id.DeviceID]*DeviceIdentity{"dev1": device}); err != nil {
+		t.Fatalf("Error storing devices: %v", err)
+	}
+	store.PutCrossSigningKey("user1", id.XSUsageMaster, "masterkey")
+	store.PutSignature("user1", "masterkey", "user1", "signerkey", "signature")
+	store.PutPinnedMasterKey("user1", "masterkey")
+
+	if err := store.SetSensitiveColumnEncryption(true); err != nil {
+		t.Fatalf("Error enabling column encryption: %v", err)
+	}
+	var rawName string
+	if err := store.DB.QueryRow("SELECT name FROM crypto_device WHERE user_id='user1'").Scan(&rawName); err != nil {
+		t.Fatalf("Error reading raw device name: %v", err)
+	} else if rawName == device.Name {
+		t.Errorf("Device name was not encrypted")
+	}
+	if err := store.RotatePickleKey([]byte("new key")); err != nil {
+		t.Fatalf("Error rotating pickle key: %v", err)
+	}
+
+	newStore := NewSQLCryptoStore(store.Database, "accid", "dev", []byte("new key"))
+	newStore.EncryptSensitiveColumns = true
+	if acc, err := newStore.GetAccount(); err != nil {
+		t.Errorf("Error loading account with new key: %v", err)
+	} else if acc.IdentityKey() != account.IdentityKey() {
+		t.Errorf("Loaded account doesn't match stored account")
+	}
+	if dev, err := newStore.GetDevice("user1", "dev1"); err != nil || dev == nil {
+		t.Errorf("Error loading device: %v", err)
+	} else if dev.Name != device.Name || dev.SigningKey != device.SigningKey {
+		t.Errorf("Loaded device doesn't match stored device: %+v", dev)
+	}
+	if keys, err := newStore.GetCrossSigningKeys("user1"); err != nil || keys[id.XSUsageMaster] != "masterkey" {
+		t.Errorf("Unexpected cross-signing keys %v (error: %v)", keys, err)
+	}
+	if isSigned, err := newStore.IsKeySignedBy("user1", "masterkey", "user1", "signerkey"); err != nil || !isSigned {
+		t.Errorf("Expected key to be signed (error: %v)", err)
+	}
+	if key, err := newStore.GetPinnedMasterKey("user1"); err != nil || key != "masterkey" {
+		t.Errorf("Unexpected pinned master key %s (error: %v)", key, err)
+	}
+
+	oldStore := NewSQLCryptoStore(store.Database, "accid", "dev", []byte("test"))
+	if _, err := oldStore.GetAccount(); err == nil {
+		t.Errorf("Loading account with old key succeeded after rotation")
+	}
+	if _, err := oldStore.GetDevice("user1", "dev1"); !errors.Is(err, ErrColumnDecryptionFailed) {
+		t.Errorf("Expected decryption error when reading device with old key, got %v", err)
+	}
+
+	if err := newStore.SetSensitiveColumnEncryption(false); err != nil {
+		t.Fatalf("Error disabling column encryption: %v", err)
+	}
+	if err := store.DB.QueryRow("SELECT name FROM crypto_device WHERE user_id='user1'").Scan(&rawName); err != nil {
+		t.Fatalf("Error reading raw device name: %v", err)
+	} else if rawName != device.Name {
+		t.Errorf("Device name was not decrypted, got %s", rawName)
+	}
+}
+
+func TestSQLStorePickleKeyRotationConcurrentWrites(t *testing.T) {
+	stores, cleanup := getCryptoStores(t)
+	defer cleanup()
+	store := stores["sql"].(*SQLCryptoStore)
+	// Each connection to an in-memory SQLite database has its own database
+	store.DB.SetMaxOpenConns(1)
+
+	rooms := make([]id.RoomID, 20)
+	done := make(chan error, 1)
+	go func() {
+		for i := range rooms {
+			rooms[i] = id.RoomID("!room" + strconv.Itoa(i) + ":example.com")
+			if err := store.AddOutboundGroupSession(NewOutboundGroupSession(rooms[i], nil)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	if err := store.RotatePickleKey([]byte("new key")); err != nil {
+		t.Fatalf("Error rotating pickle key: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Error storing outbound session during rotation: %v", err)
+	}
+
+	// Sessions written before, during and after the rotation must all be readable with the new key
+	newStore := NewSQLCryptoStore(store.Database, "accid", "dev", []byte("new key"))
+	for _, roomID := range rooms {
+		if sess, err := newStore.GetOutboundGroupSession(roomID); err != nil || sess == nil {
+			t.Errorf("Error loading outbound session of %s with new key: %v", roomID, err)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var ErrStoreMigrationMismatch = errors.New("crypto store contents don't match after migration")
+
+// StoreContentCounts contains the number of items of each type in a crypto store.
+// UntrackedUsers and UntrackedDevices count the devices that are still stored for users who are no longer tracked.
+type StoreContentCounts struct {
+	HasAccount            bool
+	OlmSessions           int
+	InboundGroupSessions  int
+	WithheldGroupSessions int
+	OutboundGroupSessions int
+	MessageIndices        int
+	TrackedUsers          int
+	OutdatedUsers         int
+	Devices               int
+	UntrackedUsers        int
+	UntrackedDevices      int
+	CrossSigningKeys      int
+	Signatures            int
+	PinnedMasterKeys      int
+	OutgoingKeyRequests   int
+}
+
+// StoreMigrationResult contains the counts of items in the source and target stores of a MigrateStore call.
+type StoreMigrationResult struct {
+	DryRun bool
+	Source StoreContentCounts
+	// Target contains the counts in the target store after the migration.
+	// In dry run mode, it contains the counts before the migration.
+	Target StoreContentCounts
+}
+
+type storeContents struct {
+	account          *OlmAccount
+	olmSessions      map[id.SenderKey]OlmSessionList
+	groupSessions    []*InboundGroupSession
+	withheldSessions []*event.RoomKeyWithheldEventContent
+	outboundSessions []*OutboundGroupSession
+	messageIndices   []MessageIndex
+	devices          map[id.UserID]map[id.DeviceID]*DeviceIdentity
+	untrackedDevices map[id.UserID]map[id.DeviceID]*DeviceIdentity
+	outdatedUsers    []id.UserID
+	crossSigningKeys map[id.UserID]map[id.CrossSigningUsage]id.Ed25519
+	signatures       []KeySignature
+	pinnedKeys       map[id.UserID]id.Ed25519
+	keyRequests      []*OutgoingKeyRequest
+}
+
+func (sc *storeContents) counts() (counts StoreContentCounts) {
+	counts.HasAccount = sc.account != nil
+	for _, sessions := range sc.olmSessions {
+		counts.OlmSessions += len(sessions)
+	}
+	counts.InboundGroupSessions = len(sc.groupSessions)
+	counts.WithheldGroupSessions = len(sc.withheldSessions)
+	counts.OutboundGroupSessions = len(sc.outboundSessions)
+	counts.MessageIndices = len(sc.messageIndices)
+	counts.TrackedUsers = len(sc.devices)
+	counts.OutdatedUsers = len(sc.outdatedUsers)
+	for _, devices := range sc.devices {
+		counts.Devices += len(devices)
+	}
+	counts.UntrackedUsers = len(sc.untrackedDevices)
+	for _, devices := range sc.untrackedDevices {
+		counts.UntrackedDevices += len(devices)
+	}
+	for _, keys := range sc.crossSigningKeys {
+		counts.CrossSigningKeys += len(keys)
+	}
+	counts.Signatures = len(sc.signatures)
+	counts.PinnedMasterKeys = len(sc.pinnedKeys)
+	counts.OutgoingKeyRequests = len(sc.keyRequests)
+	return
+}
+
+func readStoreContents(store MigratableStore) (sc storeContents, err error) {
+	if sc.account, err = store.GetAccount(); err != nil {
+		err = fmt.Errorf("failed to get account: %w", err)
+	} else if sc.olmSessions, err = store.GetAllOlmSessions(); err != nil {
+		err = fmt.Errorf("failed to get Olm sessions: %w", err)
+	} else if sc.groupSessions, err = store.GetAllGroupSessions(); err != nil {
+		err = fmt.Errorf("failed to get inbound group sessions: %w", err)
+	} else if sc.withheldSessions, err = store.GetAllWithheldGroupSessions(); err != nil {
+		err = fmt.Errorf("failed to get withheld group sessions: %w", err)
+	} else if sc.outboundSessions, err = store.GetAllOutboundGroupSessions(); err != nil {
+		err = fmt.Errorf("failed to get outbound group sessions: %w", err)
+	} else if sc.messageIndices, err = store.GetAllMessageIndices(); err != nil {
+		err = fmt.Errorf("failed to get message indices: %w", err)
+	} else if sc.crossSigningKeys, err = store.GetAllCrossSigningKeys(); err != nil {
+		err = fmt.Errorf("failed to get cross-signing keys: %w", err)
+	} else if sc.signatures, err = store.GetAllSignatures(); err != nil {
+		err = fmt.Errorf("failed to get signatures: %w", err)
+	} else if sc.pinnedKeys, err = store.GetAllPinnedMasterKeys(); err != nil {
+		err = fmt.Errorf("failed to get pinned master keys: %w", err)
+	} else if sc.outdatedUsers, err = store.GetOutdatedTrackedUsers(); err != nil {
+		err = fmt.Errorf("failed to get outdated users: %w", err)
+	} else if sc.keyRequests, err = store.GetOutgoingKeyRequests(); err != nil {
+		err = fmt.Errorf("failed to get outgoing key requests: %w", err)
+	} else if sc.untrackedDevices, err = store.GetAllUntrackedDevices(); err != nil {
+		err = fmt.Errorf("failed to get devices of untracked users: %w", err)
+	} else {
+		var trackedUsers []id.UserID
+		trackedUsers, err = store.GetAllTrackedUsers()
+		if err != nil {
+			err = fmt.Errorf("failed to get tracked users: %w", err)
+			return
+		}
+		sc.devices = make(map[id.UserID]map[id.DeviceID]*DeviceIdentity, len(trackedUsers))
+		for _, userID := range trackedUsers {
+			var devices map[id.DeviceID]*DeviceIdentity
+			devices, err = store.GetDevices(userID)
+			if err != nil {
+				err = fmt.Errorf("failed to get devices of %s: %w", userID, err)
+				return
+			} else if devices == nil {
+				devices = make(map[id.DeviceID]*DeviceIdentity)
+			}
+			sc.devices[userID] = devices
+		}
+	}
+	return
+}
+
+func (sc *storeContents) writeTo(store MigratableStore) error {
+	if sc.account != nil {
+		if err := store.PutAccount(sc.account); err != nil {
+			return fmt.Errorf("failed to store account: %w", err)
+		}
+	}
+	for senderKey, sessions := range sc.olmSessions {
+		for _, session := range sessions {
+			if err := store.AddSession(senderKey, session); err != nil {
+				return fmt.Errorf("failed to store Olm session %s with %s: %w", session.ID(), senderKey, err)
+			}
+		}
+	}
+	// Withheld sessions are stored first, because PutGroupSession replaces withheld entries, but not the other way around.
+	for _, content := range sc.withheldSessions {
+		if err := store.PutWithheldGroupSession(*content); err != nil {
+			return fmt.Errorf("failed to store withheld group session %s: %w", content.SessionID, err)
+		}
+	}
+	for _, session := range sc.groupSessions {
+		if err := store.PutGroupSession(session.RoomID, session.SenderKey, session.ID(), session); err != nil {
+			return fmt.Errorf("failed to store inbound group session %s: %w", session.ID(), err)
+		}
+	}
+	for _, session := range sc.outboundSessions {
+		if err := store.AddOutboundGroupSession(session); err != nil {
+			return fmt.Errorf("failed to store outbound group session for %s: %w", session.RoomID, err)
+		}
+	}
+	for _, index := range sc.messageIndices {
+		if !store.ValidateMessageIndex(index.SenderKey, index.SessionID, index.EventID, index.Index, index.Timestamp) {
+			return fmt.Errorf("conflicting message index %d for session %s already exists in target store", index.Index, index.SessionID)
+		}
+	}
+	for userID, devices := range sc.devices {
+		if err := store.PutDevices(userID, devices); err != nil {
+			return fmt.Errorf("failed to store devices of %s: %w", userID, err)
+		}
+	}
+	// Devices of untracked users are kept for their trust state, so they're stored and then untracked again.
+	untrackedUsers := make([]id.UserID, 0, len(sc.untrackedDevices))
+	for userID, devices := range sc.untrackedDevices {
+		if err := store.PutDevices(userID, devices); err != nil {
+			return fmt.Errorf("failed to store devices of untracked user %s: %w", userID, err)
+		}
+		untrackedUsers = append(untrackedUsers, userID)
+	}
+	if err := store.UntrackUsers(untrackedUsers); err != nil {
+		return fmt.Errorf("failed to untrack users: %w", err)
+	}
+	if err := store.MarkTrackedUsersOutdated(sc.outdatedUsers); err != nil {
+		return fmt.Errorf("failed to mark outdated users: %w", err)
+	}
+	for userID, keys := range sc.crossSigningKeys {
+		for usage, key := range keys {
+			if err := store.PutCrossSigningKey(userID, usage, key); err != nil {
+				return fmt.Errorf("failed to store %s cross-signing key of %s: %w", usage, userID, err)
+			}
+		}
+	}
+	for _, sig := range sc.signatures {
+		if err := store.PutSignature(sig.SignedUserID, sig.SignedKey, sig.SignerUserID, sig.SignerKey, sig.Signature); err != nil {
+			return fmt.Errorf("failed to store signature of %s's key %s: %w", sig.SignedUserID, sig.SignedKey, err)
+		}
+	}
+	for userID, key := range sc.pinnedKeys {
+		if err := store.PutPinnedMasterKey(userID, key); err != nil {
+			return fmt.Errorf("failed to store pinned master key of %s: %w", userID, err)
+		}
+	}
+	for _, req := range sc.keyRequests {
+		if err := store.PutOutgoingKeyRequest(req); err != nil {
+			return fmt.Errorf("failed to store outgoing key request for %s: %w", req.SessionID, err)
+		}
+	}
+	return store.Flush()
+}
+
+// CountStoreContents returns the number of items of each type in the given store.
+func CountStoreContents(store MigratableStore) (StoreContentCounts, error) {
+	contents, err := readStoreContents(store)
+	if err != nil {
+		return StoreContentCounts{}, err
+	}
+	return contents.counts(), nil
+}
+
+// MigrateStore copies everything from the source store to the target store, e.g. from a GobStore to an
+// SQLCryptoStore or between SQLite and Postgres databases. The target store should be empty, and in the case of
+// SQLCryptoStore, it must be created with the same account ID and device ID as the source.
+//
+// After copying, the contents of the target store are counted again, and ErrStoreMigrationMismatch is returned if
+// the counts don't match the source store. If dryRun is true, the contents are only read and counted.
+func MigrateStore(source, target MigratableStore, dryRun bool) (*StoreMigrationResult, error) {
+	contents, err := readStoreContents(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source store: %w", err)
+	}
+	result := &StoreMigrationResult{
+		DryRun: dryRun,
+		Source: contents.counts(),
+	}
+	if !dryRun {
+		err = contents.writeTo(target)
+		if err != nil {
+			return result, fmt.Errorf("failed to write target store: %w", err)
+		}
+	}
+	result.Target, err = CountStoreContents(target)
+	if err != nil {
+		return result, fmt.Errorf("failed to read target store: %w", err)
+	} else if !dryRun && result.Source != result.Target {
+		return result, fmt.Errorf("%w: source has %+v, target has %+v", ErrStoreMigrationMismatch, result.Source, result.Target)
+	}
+	return result, nil
+}
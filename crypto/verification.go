@@ -19,6 +19,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"maunium.net/go/mautrix"
@@ -118,6 +119,8 @@ type verificationState struct {
 	extendTimeout       context.CancelFunc
 	inRoomID            id.RoomID
 	lock                sync.Mutex
+	// cancelled is set atomically when the transaction is cancelled by either side, so that it's cancelled only once.
+	cancelled int32
 }
 
 // getTransactionState retrieves the given transaction's state, or cancels the transaction if it cannot be found or there is a mismatch.
@@ -193,7 +196,14 @@ func (mach *OlmMachine) actuallyStartVerification(userID id.UserID, content *eve
 		verState.verificationStarted = true
 		return
 	}
-	resp, hooks := mach.AcceptVerificationFrom(transactionID, otherDevice, inRoomID)
+	var resp VerificationRequestResponse
+	var hooks VerificationHooks
+	if session := mach.GetVerificationSession(userID, transactionID); session != nil {
+		// The request was already accepted through the session, so the start doesn't need to be accepted separately.
+		resp, hooks = AcceptRequest, session.hooks()
+	} else {
+		resp, hooks = mach.AcceptVerificationFrom(transactionID, otherDevice, inRoomID)
+	}
 	if resp == AcceptRequest {
 		sasMethods := commonSASMethods(hooks, content.ShortAuthenticationString)
 		if len(sasMethods) == 0 {
@@ -399,7 +409,7 @@ func (mach *OlmMachine) handleVerificationKey(userID id.UserID, content *event.V
 	var initKey, acceptKey string
 	if verState.initiatedByUs {
 		initUserID = mach.Client.UserID
-		initDeviceID = mach.Client.DeviceID
+		initDeviceID = mach.ownDeviceID()
 		initKey = string(verState.sas.GetPubkey())
 		acceptUserID = device.UserID
 		acceptDeviceID = device.DeviceID
@@ -409,7 +419,7 @@ func (mach *OlmMachine) handleVerificationKey(userID id.UserID, content *event.V
 		initDeviceID = device.DeviceID
 		initKey = content.Key
 		acceptUserID = mach.Client.UserID
-		acceptDeviceID = mach.Client.DeviceID
+		acceptDeviceID = mach.ownDeviceID()
 		acceptKey = string(verState.sas.GetPubkey())
 	}
 	// use the prefered SAS method to generate a SAS
@@ -444,6 +454,10 @@ func (mach *OlmMachine) sasCompared(didMatch bool, transactionID string, verStat
 			mach.Log.Error("Error sending verification MAC to other device: %v", err)
 		}
 	} else {
+		// This is the only place where SAS mismatches are cancelled. The MAC handler only waits for the result.
+		mach.Log.Warn("SAS do not match! Canceling transaction %v", transactionID)
+		mach.keyVerificationTransactionState.Delete(verState.otherDevice.UserID.String() + ":" + transactionID)
+		_ = mach.callbackAndCancelSASVerification(verState, transactionID, "SAS do not match", event.VerificationCancelSASMismatch)
 		verState.sasMatched <- false
 	}
 }
@@ -480,15 +494,14 @@ func (mach *OlmMachine) handleVerificationMAC(userID id.UserID, content *event.V
 		defer verState.lock.Unlock()
 
 		if !matched {
-			mach.Log.Warn("SAS do not match! Canceling transaction %v", transactionID)
-			_ = mach.callbackAndCancelSASVerification(verState, transactionID, "SAS do not match", event.VerificationCancelSASMismatch)
+			// The transaction was already cancelled by sasCompared
 			return
 		}
 
 		keyID := id.NewKeyID(id.KeyAlgorithmEd25519, device.DeviceID.String())
 
 		expectedPKMAC, expectedKeysMAC, err := mach.getPKAndKeysMAC(verState.sas, device.UserID, device.DeviceID,
-			mach.Client.UserID, mach.Client.DeviceID, transactionID, device.SigningKey, keyID, content.Mac)
+			mach.Client.UserID, mach.ownDeviceID(), transactionID, device.SigningKey, keyID, content.Mac)
 		if err != nil {
 			mach.Log.Error("Error generating MAC to match with received MAC: %v", err)
 			return
@@ -553,7 +566,12 @@ func (mach *OlmMachine) handleVerificationCancel(userID id.UserID, content *even
 	// this verification will get canceled even if the senders do not match
 	verStateInterface, ok := mach.keyVerificationTransactionState.Load(userID.String() + ":" + transactionID)
 	if ok {
-		go verStateInterface.(*verificationState).hooks.OnCancel(false, content.Reason, content.Code)
+		verState := verStateInterface.(*verificationState)
+		atomic.StoreInt32(&verState.cancelled, 1)
+		go verState.hooks.OnCancel(false, content.Reason, content.Code)
+	}
+	if session := mach.GetVerificationSession(userID, transactionID); session != nil {
+		session.setCancelled(false, content.Reason, content.Code)
 	}
 
 	mach.keyVerificationTransactionState.Delete(userID.String() + ":" + transactionID)
@@ -578,6 +596,10 @@ func (mach *OlmMachine) handleVerificationRequest(userID id.UserID, content *eve
 		}
 		return
 	}
+	if mach.OnVerificationRequest != nil {
+		mach.newIncomingVerificationSession(otherDevice, content, transactionID, inRoomID)
+		return
+	}
 	resp, hooks := mach.AcceptVerificationFrom(transactionID, otherDevice, inRoomID)
 	if resp == AcceptRequest {
 		mach.Log.Debug("Accepting SAS verification %v from %v of user %v", transactionID, otherDevice.DeviceID, otherDevice.UserID)
@@ -684,6 +706,35 @@ func (mach *OlmMachine) SendSASVerificationCancel(userID id.UserID, deviceID id.
 	return mach.sendToOneDevice(userID, deviceID, event.ToDeviceVerificationCancel, content)
 }
 
+// SendSASVerificationRequest is used to manually send a SAS verification request message to another device.
+func (mach *OlmMachine) SendSASVerificationRequest(toUserID id.UserID, toDeviceID id.DeviceID, transactionID string) error {
+	content := &event.VerificationRequestEventContent{
+		FromDevice:    mach.ownDeviceID(),
+		TransactionID: transactionID,
+		Methods:       []event.VerificationMethod{event.VerificationMethodSAS},
+		Timestamp:     time.Now().UnixMilli(),
+	}
+	return mach.sendToOneDevice(toUserID, toDeviceID, event.ToDeviceVerificationRequest, content)
+}
+
+// SendSASVerificationReady is used to manually send a SAS verification ready message in response to a received request.
+func (mach *OlmMachine) SendSASVerificationReady(toUserID id.UserID, toDeviceID id.DeviceID, transactionID string, methods []event.VerificationMethod) error {
+	content := &event.VerificationReadyEventContent{
+		FromDevice:    mach.ownDeviceID(),
+		TransactionID: transactionID,
+		Methods:       methods,
+	}
+	return mach.sendToOneDevice(toUserID, toDeviceID, event.ToDeviceVerificationReady, content)
+}
+
+// SendSASVerificationDone is used to manually send a SAS verification done message after the other device's MAC was verified.
+func (mach *OlmMachine) SendSASVerificationDone(toUserID id.UserID, toDeviceID id.DeviceID, transactionID string) error {
+	content := &event.VerificationDoneEventContent{
+		TransactionID: transactionID,
+	}
+	return mach.sendToOneDevice(toUserID, toDeviceID, event.ToDeviceVerificationDone, content)
+}
+
 // SendSASVerificationStart is used to manually send the SAS verification start message to another device.
 func (mach *OlmMachine) SendSASVerificationStart(toUserID id.UserID, toDeviceID id.DeviceID, transactionID string, methods []VerificationMethod) (*event.VerificationStartEventContent, error) {
 	sasMethods := make([]event.SASMethod, len(methods))
@@ -691,7 +742,7 @@ func (mach *OlmMachine) SendSASVerificationStart(toUserID id.UserID, toDeviceID
 		sasMethods[i] = method.Type()
 	}
 	content := &event.VerificationStartEventContent{
-		FromDevice:                 mach.Client.DeviceID,
+		FromDevice:                 mach.ownDeviceID(),
 		TransactionID:              transactionID,
 		Method:                     event.VerificationMethodSAS,
 		KeyAgreementProtocols:      []event.KeyAgreementProtocol{event.KeyAgreementCurve25519HKDFSHA256},
@@ -737,7 +788,14 @@ func (mach *OlmMachine) SendSASVerificationAccept(fromUser id.UserID, startEvent
 }
 
 func (mach *OlmMachine) callbackAndCancelSASVerification(verState *verificationState, transactionID, reason string, code event.VerificationCancelCode) error {
+	if !atomic.CompareAndSwapInt32(&verState.cancelled, 0, 1) {
+		mach.Log.Debug("Not cancelling verification %s again (reason: %s)", transactionID, reason)
+		return nil
+	}
 	go verState.hooks.OnCancel(true, reason, code)
+	if verState.inRoomID != "" {
+		return mach.SendInRoomSASVerificationCancel(verState.inRoomID, verState.otherDevice.UserID, transactionID, reason, code)
+	}
 	return mach.SendSASVerificationCancel(verState.otherDevice.UserID, verState.otherDevice.DeviceID, transactionID, reason, code)
 }
 
@@ -752,7 +810,7 @@ func (mach *OlmMachine) SendSASVerificationKey(userID id.UserID, deviceID id.Dev
 
 // SendSASVerificationMAC is use the MAC of a device's key to the partner device.
 func (mach *OlmMachine) SendSASVerificationMAC(userID id.UserID, deviceID id.DeviceID, transactionID string, sas *olm.SAS) error {
-	keyID := id.NewKeyID(id.KeyAlgorithmEd25519, mach.Client.DeviceID.String())
+	keyID := id.NewKeyID(id.KeyAlgorithmEd25519, mach.ownDeviceID().String())
 
 	signingKey := mach.account.SigningKey()
 	keyIDsMap := map[id.KeyID]string{keyID: ""}
@@ -763,7 +821,7 @@ func (mach *OlmMachine) SendSASVerificationMAC(userID id.UserID, deviceID id.Dev
 		masterKeyID := id.NewKeyID(id.KeyAlgorithmEd25519, masterKey.String())
 		// add master key ID to key map
 		keyIDsMap[masterKeyID] = ""
-		masterKeyMAC, _, err := mach.getPKAndKeysMAC(sas, mach.Client.UserID, mach.Client.DeviceID,
+		masterKeyMAC, _, err := mach.getPKAndKeysMAC(sas, mach.Client.UserID, mach.ownDeviceID(),
 			userID, deviceID, transactionID, masterKey, masterKeyID, keyIDsMap)
 		if err != nil {
 			mach.Log.Error("Error generating master key MAC: %v", err)
@@ -773,7 +831,7 @@ func (mach *OlmMachine) SendSASVerificationMAC(userID id.UserID, deviceID id.Dev
 		}
 	}
 
-	pubKeyMac, keysMac, err := mach.getPKAndKeysMAC(sas, mach.Client.UserID, mach.Client.DeviceID, userID, deviceID, transactionID, signingKey, keyID, keyIDsMap)
+	pubKeyMac, keysMac, err := mach.getPKAndKeysMAC(sas, mach.Client.UserID, mach.ownDeviceID(), userID, deviceID, transactionID, signingKey, keyID, keyIDsMap)
 	if err != nil {
 		return err
 	}
@@ -56,9 +56,13 @@ func (mach *OlmMachine) ProcessInRoomVerification(evt *event.Event) error {
 			mach.handleVerificationRequest(evt.Sender, newContent, evt.ID.String(), evt.RoomID)
 		}
 	case *event.VerificationStartEventContent:
-		mach.handleVerificationStart(evt.Sender, content, content.RelatesTo.EventID.String(), 10*time.Minute, evt.RoomID)
+		if !mach.handleVerificationSessionStart(evt.Sender, content.RelatesTo.EventID.String()) {
+			mach.handleVerificationStart(evt.Sender, content, content.RelatesTo.EventID.String(), 10*time.Minute, evt.RoomID)
+		}
 	case *event.VerificationReadyEventContent:
-		mach.handleInRoomVerificationReady(evt.Sender, evt.RoomID, content, content.RelatesTo.EventID.String())
+		if !mach.handleVerificationSessionReady(evt.Sender, content, content.RelatesTo.EventID.String()) {
+			mach.handleInRoomVerificationReady(evt.Sender, evt.RoomID, content, content.RelatesTo.EventID.String())
+		}
 	case *event.VerificationAcceptEventContent:
 		mach.handleVerificationAccept(evt.Sender, content, content.RelatesTo.EventID.String())
 	case *event.VerificationKeyEventContent:
@@ -67,6 +71,8 @@ func (mach *OlmMachine) ProcessInRoomVerification(evt *event.Event) error {
 		mach.handleVerificationMAC(evt.Sender, content, content.RelatesTo.EventID.String())
 	case *event.VerificationCancelEventContent:
 		mach.handleVerificationCancel(evt.Sender, content, content.RelatesTo.EventID.String())
+	case *event.VerificationDoneEventContent:
+		mach.handleVerificationDone(evt.Sender, content.RelatesTo.EventID.String())
 	}
 	return nil
 }
@@ -92,7 +98,7 @@ func (mach *OlmMachine) SendInRoomSASVerificationCancel(roomID id.RoomID, userID
 func (mach *OlmMachine) SendInRoomSASVerificationRequest(roomID id.RoomID, toUserID id.UserID, methods []VerificationMethod) (string, error) {
 	content := &event.MessageEventContent{
 		MsgType:    event.MsgVerificationRequest,
-		FromDevice: mach.Client.DeviceID,
+		FromDevice: mach.ownDeviceID(),
 		Methods:    []event.VerificationMethod{event.VerificationMethodSAS},
 		To:         toUserID,
 	}
@@ -111,7 +117,7 @@ func (mach *OlmMachine) SendInRoomSASVerificationRequest(roomID id.RoomID, toUse
 // SendInRoomSASVerificationReady is used to manually send an in-room SAS verification ready message to another user.
 func (mach *OlmMachine) SendInRoomSASVerificationReady(roomID id.RoomID, transactionID string) error {
 	content := &event.VerificationReadyEventContent{
-		FromDevice: mach.Client.DeviceID,
+		FromDevice: mach.ownDeviceID(),
 		Methods:    []event.VerificationMethod{event.VerificationMethodSAS},
 		RelatesTo:  &event.RelatesTo{Type: event.RelReference, EventID: id.EventID(transactionID)},
 	}
@@ -124,6 +130,20 @@ func (mach *OlmMachine) SendInRoomSASVerificationReady(roomID id.RoomID, transac
 	return err
 }
 
+// SendInRoomSASVerificationDone is used to manually send an in-room SAS verification done message after the other device's MAC was verified.
+func (mach *OlmMachine) SendInRoomSASVerificationDone(roomID id.RoomID, userID id.UserID, transactionID string) error {
+	content := &event.VerificationDoneEventContent{
+		RelatesTo: &event.RelatesTo{Type: event.RelReference, EventID: id.EventID(transactionID)},
+	}
+
+	encrypted, err := mach.EncryptMegolmEvent(roomID, event.InRoomVerificationDone, content)
+	if err != nil {
+		return err
+	}
+	_, err = mach.Client.SendMessageEvent(roomID, event.EventEncrypted, encrypted)
+	return err
+}
+
 // SendInRoomSASVerificationStart is used to manually send the in-room SAS verification start message to another user.
 func (mach *OlmMachine) SendInRoomSASVerificationStart(roomID id.RoomID, toUserID id.UserID, transactionID string, methods []VerificationMethod) (*event.VerificationStartEventContent, error) {
 	sasMethods := make([]event.SASMethod, len(methods))
@@ -131,7 +151,7 @@ func (mach *OlmMachine) SendInRoomSASVerificationStart(roomID id.RoomID, toUserI
 		sasMethods[i] = method.Type()
 	}
 	content := &event.VerificationStartEventContent{
-		FromDevice:                 mach.Client.DeviceID,
+		FromDevice:                 mach.ownDeviceID(),
 		RelatesTo:                  &event.RelatesTo{Type: event.RelReference, EventID: id.EventID(transactionID)},
 		Method:                     event.VerificationMethodSAS,
 		KeyAgreementProtocols:      []event.KeyAgreementProtocol{event.KeyAgreementCurve25519HKDFSHA256},
@@ -208,7 +228,7 @@ func (mach *OlmMachine) SendInRoomSASVerificationKey(roomID id.RoomID, userID id
 
 // SendInRoomSASVerificationMAC sends the MAC of a device's key to the partner device for an in-room verification.
 func (mach *OlmMachine) SendInRoomSASVerificationMAC(roomID id.RoomID, userID id.UserID, deviceID id.DeviceID, transactionID string, sas *olm.SAS) error {
-	keyID := id.NewKeyID(id.KeyAlgorithmEd25519, mach.Client.DeviceID.String())
+	keyID := id.NewKeyID(id.KeyAlgorithmEd25519, mach.ownDeviceID().String())
 
 	signingKey := mach.account.SigningKey()
 	keyIDsMap := map[id.KeyID]string{keyID: ""}
@@ -219,7 +239,7 @@ func (mach *OlmMachine) SendInRoomSASVerificationMAC(roomID id.RoomID, userID id
 		masterKeyID := id.NewKeyID(id.KeyAlgorithmEd25519, masterKey.String())
 		// add master key ID to key map
 		keyIDsMap[masterKeyID] = ""
-		masterKeyMAC, _, err := mach.getPKAndKeysMAC(sas, mach.Client.UserID, mach.Client.DeviceID,
+		masterKeyMAC, _, err := mach.getPKAndKeysMAC(sas, mach.Client.UserID, mach.ownDeviceID(),
 			userID, deviceID, transactionID, masterKey, masterKeyID, keyIDsMap)
 		if err != nil {
 			mach.Log.Error("Error generating master key MAC: %v", err)
@@ -229,7 +249,7 @@ func (mach *OlmMachine) SendInRoomSASVerificationMAC(roomID id.RoomID, userID id
 		}
 	}
 
-	pubKeyMac, keysMac, err := mach.getPKAndKeysMAC(sas, mach.Client.UserID, mach.Client.DeviceID, userID, deviceID, transactionID, signingKey, keyID, keyIDsMap)
+	pubKeyMac, keysMac, err := mach.getPKAndKeysMAC(sas, mach.Client.UserID, mach.ownDeviceID(), userID, deviceID, transactionID, signingKey, keyID, keyIDsMap)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,621 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !nosas
+// +build !nosas
+
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrVerificationSessionFinished = errors.New("verification session has already finished")
+	ErrUnexpectedVerificationState = errors.New("unexpected verification session state")
+	ErrNoCommonVerificationMethods = errors.New("no common verification methods")
+)
+
+// VerificationState is the state of a VerificationSession.
+type VerificationState int
+
+const (
+	// VerificationStateRequested means a verification request has been sent or received, but not accepted yet.
+	VerificationStateRequested VerificationState = iota
+	// VerificationStateReady means the request has been accepted and the verification method has been negotiated.
+	VerificationStateReady
+	// VerificationStateStarted means the SAS verification has been started by either side.
+	VerificationStateStarted
+	// VerificationStateKeysExchanged means the SAS keys have been exchanged and the SAS needs to be compared.
+	VerificationStateKeysExchanged
+	// VerificationStateConfirmed means the user confirmed that the SAS matches and the MACs are being exchanged.
+	VerificationStateConfirmed
+	// VerificationStateDone means the other device's keys were verified and marked as trusted.
+	VerificationStateDone
+	// VerificationStateCancelled means the verification was cancelled by either side or timed out.
+	VerificationStateCancelled
+)
+
+func (state VerificationState) String() string {
+	switch state {
+	case VerificationStateRequested:
+		return "requested"
+	case VerificationStateReady:
+		return "ready"
+	case VerificationStateStarted:
+		return "started"
+	case VerificationStateKeysExchanged:
+		return "keys exchanged"
+	case VerificationStateConfirmed:
+		return "confirmed"
+	case VerificationStateDone:
+		return "done"
+	case VerificationStateCancelled:
+		return "cancelled"
+	default:
+		return fmt.Sprintf("VerificationState(%d)", int(state))
+	}
+}
+
+// IsFinal returns true if the state is either done or cancelled.
+func (state VerificationState) IsFinal() bool {
+	return state == VerificationStateDone || state == VerificationStateCancelled
+}
+
+// VerificationUpdate is sent to the VerificationSession.Updates channel every time the state of the session changes.
+type VerificationUpdate struct {
+	State VerificationState
+	// The short authentication string to compare, only set when the state is VerificationStateKeysExchanged.
+	SAS SASData
+	// Information about the cancellation, only set when the state is VerificationStateCancelled.
+	CancelledByUs bool
+	CancelReason  string
+	CancelCode    event.VerificationCancelCode
+}
+
+// supportedVerificationMethods contains the top-level verification methods that sessions can negotiate.
+var supportedVerificationMethods = []event.VerificationMethod{event.VerificationMethodSAS}
+
+func negotiateVerificationMethods(theirMethods []event.VerificationMethod) []event.VerificationMethod {
+	var common []event.VerificationMethod
+	for _, ours := range supportedVerificationMethods {
+		for _, theirs := range theirMethods {
+			if ours == theirs {
+				common = append(common, ours)
+				break
+			}
+		}
+	}
+	return common
+}
+
+// VerificationSession is a single interactive verification with another device, from the request to the end result.
+//
+// The same API is used for both to-device and in-room verification. The state machine goes through
+// requested, ready, started, keys exchanged, confirmed and done, or ends in cancelled at any point.
+// Every transition is sent to the Updates channel, which is closed when the session finishes.
+type VerificationSession struct {
+	// The transaction ID of the verification. For in-room verification, this is the event ID of the request.
+	TransactionID string
+	// The room where the verification is happening, or empty for to-device verification.
+	RoomID id.RoomID
+	// The user whose device is being verified.
+	OtherUserID id.UserID
+	// Whether the verification request was sent by us.
+	InitiatedByUs bool
+
+	mach         *OlmMachine
+	otherDevice  *DeviceIdentity
+	theirMethods []event.VerificationMethod
+	methods      []event.VerificationMethod
+	sasMethods   []VerificationMethod
+	state        VerificationState
+	startedByUs  bool
+	// Whether the other side sent or accepted a ready event, which means it will also send a done event.
+	expectDone bool
+	ourDone    bool
+	theirDone  bool
+
+	updates      chan VerificationUpdate
+	confirmation chan bool
+	finished     chan struct{}
+	timeout      *time.Timer
+	lock         sync.Mutex
+}
+
+func (mach *OlmMachine) newVerificationSession(transactionID string, roomID id.RoomID, userID id.UserID, device *DeviceIdentity, initiatedByUs bool) *VerificationSession {
+	return &VerificationSession{
+		TransactionID: transactionID,
+		RoomID:        roomID,
+		OtherUserID:   userID,
+		InitiatedByUs: initiatedByUs,
+
+		mach:        mach,
+		otherDevice: device,
+		state:       VerificationStateRequested,
+
+		// The buffer fits every possible transition, so sending updates never blocks.
+		updates:      make(chan VerificationUpdate, int(VerificationStateCancelled)+1),
+		confirmation: make(chan bool, 1),
+		finished:     make(chan struct{}),
+	}
+}
+
+func (session *VerificationSession) mapKey() string {
+	return session.OtherUserID.String() + ":" + session.TransactionID
+}
+
+// register stores the session in the machine and starts the timeout for the request phase.
+func (session *VerificationSession) register() bool {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	_, loaded := session.mach.verificationSessions.LoadOrStore(session.mapKey(), session)
+	if loaded {
+		return false
+	}
+	session.updates <- VerificationUpdate{State: VerificationStateRequested}
+	session.timeout = time.AfterFunc(session.mach.DefaultSASTimeout, session.requestTimedOut)
+	return true
+}
+
+// GetVerificationSession returns the active verification session with the given user and transaction ID, or nil if there isn't one.
+func (mach *OlmMachine) GetVerificationSession(userID id.UserID, transactionID string) *VerificationSession {
+	mach.verificationRequestLock.RLock()
+	defer mach.verificationRequestLock.RUnlock()
+	session, ok := mach.verificationSessions.Load(userID.String() + ":" + transactionID)
+	if !ok {
+		return nil
+	}
+	return session.(*VerificationSession)
+}
+
+// RequestVerification sends a to-device verification request to the given device.
+//
+// The SAS methods are used in order of preference. If none are given, emoji and decimal are used.
+func (mach *OlmMachine) RequestVerification(device *DeviceIdentity, sasMethods []VerificationMethod) (*VerificationSession, error) {
+	session := mach.newVerificationSession(mach.Client.TxnID(), "", device.UserID, device, true)
+	session.setSASMethods(sasMethods)
+	if !session.register() {
+		return nil, ErrTransactionAlreadyExists
+	}
+	mach.Log.Debug("Requesting verification %s with %s of %s", session.TransactionID, device.DeviceID, device.UserID)
+	err := mach.SendSASVerificationRequest(device.UserID, device.DeviceID, session.TransactionID)
+	if err != nil {
+		session.lock.Lock()
+		session.state = VerificationStateCancelled
+		session.finishLocked()
+		session.lock.Unlock()
+		return nil, err
+	}
+	return session, nil
+}
+
+// RequestInRoomVerification sends an in-room verification request to the given user.
+// The other user's device is known after they accept the request.
+//
+// The SAS methods are used in order of preference. If none are given, emoji and decimal are used.
+func (mach *OlmMachine) RequestInRoomVerification(roomID id.RoomID, userID id.UserID, sasMethods []VerificationMethod) (*VerificationSession, error) {
+	// The transaction ID is the event ID of the request, so the session can only be registered after sending it.
+	// Session lookups are blocked until then, so a response that arrives before the send returns isn't dropped.
+	mach.verificationRequestLock.Lock()
+	defer mach.verificationRequestLock.Unlock()
+	transactionID, err := mach.SendInRoomSASVerificationRequest(roomID, userID, sasMethods)
+	if err != nil {
+		return nil, err
+	}
+	session := mach.newVerificationSession(transactionID, roomID, userID, nil, true)
+	session.setSASMethods(sasMethods)
+	if !session.register() {
+		return nil, ErrTransactionAlreadyExists
+	}
+	mach.Log.Debug("Requested in-room verification %s with %s in %s", transactionID, userID, roomID)
+	return session, nil
+}
+
+func (mach *OlmMachine) newIncomingVerificationSession(device *DeviceIdentity, content *event.VerificationRequestEventContent, transactionID string, inRoomID id.RoomID) {
+	session := mach.newVerificationSession(transactionID, inRoomID, device.UserID, device, false)
+	session.theirMethods = content.Methods
+	if !session.register() {
+		mach.Log.Warn("Ignoring duplicate verification request %s from %s of %s", transactionID, device.DeviceID, device.UserID)
+		return
+	}
+	mach.Log.Debug("Received verification request %s from %s of %s", transactionID, device.DeviceID, device.UserID)
+	mach.OnVerificationRequest(session)
+}
+
+func (session *VerificationSession) setSASMethods(sasMethods []VerificationMethod) {
+	if len(sasMethods) == 0 {
+		sasMethods = []VerificationMethod{VerificationMethodEmoji{}, VerificationMethodDecimal{}}
+	}
+	session.sasMethods = sasMethods
+}
+
+// Updates returns the channel where state transitions are sent. The channel is closed when the session finishes.
+func (session *VerificationSession) Updates() <-chan VerificationUpdate {
+	return session.updates
+}
+
+// Finished returns a channel that is closed when the session is done or cancelled.
+func (session *VerificationSession) Finished() <-chan struct{} {
+	return session.finished
+}
+
+// State returns the current state of the session.
+func (session *VerificationSession) State() VerificationState {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.state
+}
+
+// OtherDevice returns the device being verified. For outgoing in-room requests, it's nil until the request is accepted.
+func (session *VerificationSession) OtherDevice() *DeviceIdentity {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.otherDevice
+}
+
+// Methods returns the verification methods that both sides support. It's empty until the session is ready.
+func (session *VerificationSession) Methods() []event.VerificationMethod {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.methods
+}
+
+func (session *VerificationSession) expectState(expected VerificationState) error {
+	if session.state.IsFinal() {
+		return ErrVerificationSessionFinished
+	} else if session.state != expected {
+		return fmt.Errorf("%w: expected %s, but session is %s", ErrUnexpectedVerificationState, expected, session.state)
+	}
+	return nil
+}
+
+func (session *VerificationSession) setStateLocked(update VerificationUpdate) {
+	if session.state.IsFinal() {
+		return
+	}
+	session.mach.Log.Debug("Verification %s with %s changed state: %s -> %s", session.TransactionID, session.OtherUserID, session.state, update.State)
+	session.state = update.State
+	session.updates <- update
+	if update.State.IsFinal() {
+		session.finishLocked()
+	}
+}
+
+func (session *VerificationSession) finishLocked() {
+	session.mach.verificationSessions.Delete(session.mapKey())
+	if session.timeout != nil {
+		session.timeout.Stop()
+	}
+	close(session.finished)
+	close(session.updates)
+}
+
+func (session *VerificationSession) setCancelled(byUs bool, reason string, code event.VerificationCancelCode) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.setStateLocked(VerificationUpdate{
+		State:         VerificationStateCancelled,
+		CancelledByUs: byUs,
+		CancelReason:  reason,
+		CancelCode:    code,
+	})
+}
+
+func (session *VerificationSession) sendCancel(reason string, code event.VerificationCancelCode) error {
+	if session.RoomID != "" {
+		return session.mach.SendInRoomSASVerificationCancel(session.RoomID, session.OtherUserID, session.TransactionID, reason, code)
+	}
+	return session.mach.SendSASVerificationCancel(session.OtherUserID, session.otherDevice.DeviceID, session.TransactionID, reason, code)
+}
+
+func (session *VerificationSession) cancelLocked(reason string, code event.VerificationCancelCode) error {
+	if session.state.IsFinal() {
+		return ErrVerificationSessionFinished
+	}
+	if verState, ok := session.mach.keyVerificationTransactionState.LoadAndDelete(session.mapKey()); ok {
+		// The cancel is sent here, so the SAS transaction mustn't send another one
+		atomic.StoreInt32(&verState.(*verificationState).cancelled, 1)
+	}
+	err := session.sendCancel(reason, code)
+	session.setStateLocked(VerificationUpdate{
+		State:         VerificationStateCancelled,
+		CancelledByUs: true,
+		CancelReason:  reason,
+		CancelCode:    code,
+	})
+	return err
+}
+
+// Cancel cancels the verification with the given reason.
+func (session *VerificationSession) Cancel(reason string) error {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.cancelLocked(reason, event.VerificationCancelByUser)
+}
+
+func (session *VerificationSession) requestTimedOut() {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	// After the SAS is started, the timeout of the SAS transaction applies instead.
+	if session.state == VerificationStateRequested || session.state == VerificationStateReady {
+		session.mach.Log.Warn("Verification %s with %s timed out in state %s", session.TransactionID, session.OtherUserID, session.state)
+		_ = session.cancelLocked("Timed out", event.VerificationCancelByTimeout)
+	}
+}
+
+// storeIncomingSASState stores a SAS transaction state for in-room verification, so that the start event
+// from the other side can be accepted.
+func (session *VerificationSession) storeIncomingSASState() {
+	session.mach.keyVerificationTransactionState.Store(session.mapKey(), &verificationState{
+		sas:         olm.NewSAS(),
+		otherDevice: session.otherDevice,
+		sasMatched:  make(chan bool, 1),
+		hooks:       session.hooks(),
+		inRoomID:    session.RoomID,
+	})
+}
+
+// Accept accepts an incoming verification request by sending a ready event.
+//
+// The SAS methods are used in order of preference. If none are given, emoji and decimal are used.
+// After accepting, either side can start the SAS verification.
+func (session *VerificationSession) Accept(sasMethods []VerificationMethod) error {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.InitiatedByUs {
+		return fmt.Errorf("%w: can't accept own request", ErrUnexpectedVerificationState)
+	} else if err := session.expectState(VerificationStateRequested); err != nil {
+		return err
+	}
+	methods := negotiateVerificationMethods(session.theirMethods)
+	if len(methods) == 0 {
+		_ = session.cancelLocked("No common verification methods", event.VerificationCancelUnknownMethod)
+		return ErrNoCommonVerificationMethods
+	}
+	session.setSASMethods(sasMethods)
+	var err error
+	if session.RoomID != "" {
+		err = session.mach.SendInRoomSASVerificationReady(session.RoomID, session.TransactionID)
+	} else {
+		err = session.mach.SendSASVerificationReady(session.OtherUserID, session.otherDevice.DeviceID, session.TransactionID, methods)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send ready event: %w", err)
+	}
+	session.methods = methods
+	session.expectDone = true
+	if session.RoomID != "" {
+		session.storeIncomingSASState()
+	}
+	session.setStateLocked(VerificationUpdate{State: VerificationStateReady})
+	return nil
+}
+
+// StartSAS starts the SAS verification after the session is ready.
+func (session *VerificationSession) StartSAS() error {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if err := session.expectState(VerificationStateReady); err != nil {
+		return err
+	}
+	var err error
+	if session.RoomID != "" {
+		_, err = session.mach.newInRoomSASVerificationWithInner(session.RoomID, session.otherDevice, session.hooks(), session.TransactionID, session.mach.DefaultSASTimeout)
+	} else {
+		_, err = session.mach.NewSASVerificationWith(session.otherDevice, session.hooks(), session.TransactionID, session.mach.DefaultSASTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to start SAS verification: %w", err)
+	}
+	session.startedByUs = true
+	session.setStateLocked(VerificationUpdate{State: VerificationStateStarted})
+	return nil
+}
+
+// Confirm tells the session whether the SAS shown in the keys exchanged update matches the one on the other device.
+// If it doesn't match, the verification is cancelled.
+func (session *VerificationSession) Confirm(match bool) error {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if err := session.expectState(VerificationStateKeysExchanged); err != nil {
+		return err
+	}
+	select {
+	case session.confirmation <- match:
+		return nil
+	default:
+		return fmt.Errorf("%w: SAS already confirmed", ErrUnexpectedVerificationState)
+	}
+}
+
+// handleVerificationSessionReady handles a m.key.verification.ready event for an outgoing request.
+// It returns false if there's no session for the transaction.
+func (mach *OlmMachine) handleVerificationSessionReady(userID id.UserID, content *event.VerificationReadyEventContent, transactionID string) bool {
+	session := mach.GetVerificationSession(userID, transactionID)
+	if session == nil {
+		return false
+	}
+	device, err := mach.GetOrFetchDevice(userID, content.FromDevice)
+	if err != nil {
+		mach.Log.Error("Failed to get device %s of %s for verification ready: %v", content.FromDevice, userID, err)
+		return true
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if !session.InitiatedByUs || session.state != VerificationStateRequested {
+		mach.Log.Warn("Unexpected verification ready for %s in state %s", transactionID, session.state)
+		if session.otherDevice == nil {
+			session.otherDevice = device
+		}
+		_ = session.cancelLocked("Unexpected ready message", event.VerificationCancelUnexpectedMessage)
+		return true
+	}
+	session.otherDevice = device
+	session.methods = negotiateVerificationMethods(content.Methods)
+	if len(session.methods) == 0 {
+		mach.Log.Warn("No common verification methods for %s: %v", transactionID, content.Methods)
+		_ = session.cancelLocked("No common verification methods", event.VerificationCancelUnknownMethod)
+		return true
+	}
+	session.expectDone = true
+	if session.RoomID != "" {
+		session.storeIncomingSASState()
+	}
+	session.setStateLocked(VerificationUpdate{State: VerificationStateReady})
+	return true
+}
+
+// startEventWins returns true if a start event sent by the given device should be used when both sides
+// start the verification at the same time, as specified in the spec.
+func startEventWins(userID id.UserID, deviceID id.DeviceID, otherUserID id.UserID, otherDeviceID id.DeviceID) bool {
+	if userID != otherUserID {
+		return userID < otherUserID
+	}
+	return deviceID < otherDeviceID
+}
+
+// handleVerificationSessionStart updates the state of the session when the other side starts the SAS verification.
+// It returns true if the start event should be ignored.
+func (mach *OlmMachine) handleVerificationSessionStart(userID id.UserID, transactionID string) bool {
+	session := mach.GetVerificationSession(userID, transactionID)
+	if session == nil {
+		return false
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	switch {
+	case session.state == VerificationStateReady:
+		session.setStateLocked(VerificationUpdate{State: VerificationStateStarted})
+		return false
+	case session.state == VerificationStateRequested && session.InitiatedByUs && session.RoomID == "":
+		// Starting right after a to-device request without a ready event implicitly accepts the request.
+		session.methods = []event.VerificationMethod{event.VerificationMethodSAS}
+		session.setStateLocked(VerificationUpdate{State: VerificationStateStarted})
+		return false
+	case session.state == VerificationStateStarted && session.startedByUs:
+		if startEventWins(mach.Client.UserID, mach.ownDeviceID(), session.otherDevice.UserID, session.otherDevice.DeviceID) {
+			mach.Log.Debug("Ignoring verification start for %s from %s, as our start event takes precedence", transactionID, userID)
+			return true
+		}
+		mach.Log.Debug("Both sides started verification %s, using the start event from %s", transactionID, userID)
+		session.startedByUs = false
+		if session.RoomID != "" {
+			session.storeIncomingSASState()
+		} else {
+			mach.keyVerificationTransactionState.Delete(session.mapKey())
+		}
+		return false
+	default:
+		// Let the normal SAS handling reject the unexpected start event
+		return false
+	}
+}
+
+// handleVerificationDone handles an incoming m.key.verification.done event.
+func (mach *OlmMachine) handleVerificationDone(userID id.UserID, transactionID string) {
+	session := mach.GetVerificationSession(userID, transactionID)
+	if session == nil {
+		mach.Log.Debug("Received verification done from %s for inactive transaction %s", userID, transactionID)
+		return
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.theirDone = true
+	mach.Log.Debug("Received verification done from %s for %s", userID, transactionID)
+	if session.ourDone {
+		session.setStateLocked(VerificationUpdate{State: VerificationStateDone})
+	}
+}
+
+func (session *VerificationSession) doneTimedOut() {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.ourDone && !session.state.IsFinal() {
+		session.mach.Log.Warn("Verification %s with %s timed out waiting for the other side to send done", session.TransactionID, session.OtherUserID)
+		_ = session.cancelLocked("Timed out", event.VerificationCancelByTimeout)
+	}
+}
+
+// verificationSessionHooks adapts a VerificationSession to the VerificationHooks used by the SAS implementation.
+type verificationSessionHooks struct {
+	session *VerificationSession
+}
+
+var _ VerificationHooks = verificationSessionHooks{}
+
+func (session *VerificationSession) hooks() VerificationHooks {
+	return verificationSessionHooks{session}
+}
+
+func (hooks verificationSessionHooks) VerifySASMatch(otherDevice *DeviceIdentity, sas SASData) bool {
+	session := hooks.session
+	session.lock.Lock()
+	if session.state.IsFinal() {
+		session.lock.Unlock()
+		return false
+	}
+	session.setStateLocked(VerificationUpdate{State: VerificationStateKeysExchanged, SAS: sas})
+	session.lock.Unlock()
+
+	var match bool
+	select {
+	case match = <-session.confirmation:
+	case <-session.finished:
+		return false
+	}
+
+	if match {
+		session.lock.Lock()
+		session.setStateLocked(VerificationUpdate{State: VerificationStateConfirmed})
+		session.lock.Unlock()
+	}
+	// Mismatches are cancelled by the SAS transaction, which calls OnCancel
+	return match
+}
+
+func (hooks verificationSessionHooks) VerificationMethods() []VerificationMethod {
+	return hooks.session.sasMethods
+}
+
+func (hooks verificationSessionHooks) OnCancel(cancelledByUs bool, reason string, reasonCode event.VerificationCancelCode) {
+	hooks.session.setCancelled(cancelledByUs, reason, reasonCode)
+}
+
+func (hooks verificationSessionHooks) OnSuccess() {
+	session := hooks.session
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	var err error
+	if session.RoomID != "" {
+		err = session.mach.SendInRoomSASVerificationDone(session.RoomID, session.OtherUserID, session.TransactionID)
+	} else {
+		err = session.mach.SendSASVerificationDone(session.OtherUserID, session.otherDevice.DeviceID, session.TransactionID)
+	}
+	if err != nil {
+		// The device is already trusted at this point, so a failure to send the done event isn't fatal.
+		session.mach.Log.Warn("Failed to send verification done for %s: %v", session.TransactionID, err)
+	}
+	session.ourDone = true
+	if session.expectDone && !session.theirDone {
+		// The verification is only done after both sides have sent done
+		session.mach.Log.Debug("Verification %s finished on our side, waiting for the other side to send done", session.TransactionID)
+		if session.timeout != nil {
+			session.timeout.Stop()
+		}
+		session.timeout = time.AfterFunc(session.mach.DefaultSASTimeout, session.doneTimedOut)
+		return
+	}
+	session.setStateLocked(VerificationUpdate{State: VerificationStateDone})
+}
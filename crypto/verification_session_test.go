@@ -0,0 +1,357 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !nosas
+// +build !nosas
+
+package crypto
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// toDeviceRelay is a fake homeserver that delivers the to-device events sent by one machine to another machine.
+type toDeviceRelay struct {
+	t      *testing.T
+	from   id.UserID
+	target *OlmMachine
+	// modify is called for every event before it's delivered. Returning false drops the event.
+	modify func(evt *event.Event) bool
+	queue  chan *event.Event
+}
+
+func (relay *toDeviceRelay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/sendToDevice/")
+	if len(parts) != 2 {
+		relay.t.Errorf("Unexpected request to %s", r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	evtType := event.Type{Type: strings.Split(parts[1], "/")[0], Class: event.ToDeviceEventType}
+	var req mautrix.ReqSendToDevice
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		relay.t.Errorf("Failed to decode to-device request: %v", err)
+	}
+	for _, content := range req.Messages[relay.target.Client.UserID] {
+		if err := content.ParseRaw(evtType); err != nil {
+			relay.t.Errorf("Failed to parse %s content: %v", evtType.Type, err)
+			continue
+		}
+		evt := &event.Event{Sender: relay.from, Type: evtType, Content: *content}
+		if relay.modify == nil || relay.modify(evt) {
+			relay.queue <- evt
+		}
+	}
+	_, _ = w.Write([]byte("{}"))
+}
+
+func (relay *toDeviceRelay) deliver() {
+	for evt := range relay.queue {
+		relay.target.HandleToDeviceEvent(evt)
+	}
+}
+
+func ownDeviceIdentity(mach *OlmMachine) *DeviceIdentity {
+	return &DeviceIdentity{
+		UserID:      mach.Client.UserID,
+		DeviceID:    mach.Client.DeviceID,
+		IdentityKey: mach.account.IdentityKey(),
+		SigningKey:  mach.account.SigningKey(),
+	}
+}
+
+// newVerificationTestMachines creates two machines that know each other's devices and can send to-device events
+// to each other. Events from machine A to B go through relayAB and events from B to A through relayBA.
+func newVerificationTestMachines(t *testing.T) (machineA, machineB *OlmMachine, relayAB, relayBA *toDeviceRelay) {
+	machineA, storeFileNameA := newMachine(t, "user1")
+	t.Cleanup(func() { os.Remove(storeFileNameA) })
+	machineB, storeFileNameB := newMachine(t, "user2")
+	t.Cleanup(func() { os.Remove(storeFileNameB) })
+	deviceA, deviceB := ownDeviceIdentity(machineA), ownDeviceIdentity(machineB)
+	machineA.CryptoStore.PutDevices(deviceB.UserID, map[id.DeviceID]*DeviceIdentity{deviceB.DeviceID: deviceB})
+	machineB.CryptoStore.PutDevices(deviceA.UserID, map[id.DeviceID]*DeviceIdentity{deviceA.DeviceID: deviceA})
+
+	relayAB = &toDeviceRelay{t: t, from: machineA.Client.UserID, target: machineB, queue: make(chan *event.Event, 32)}
+	relayBA = &toDeviceRelay{t: t, from: machineB.Client.UserID, target: machineA, queue: make(chan *event.Event, 32)}
+	serverA, serverB := httptest.NewServer(relayAB), httptest.NewServer(relayBA)
+	t.Cleanup(serverA.Close)
+	t.Cleanup(serverB.Close)
+	machineA.Client.HomeserverURL, _ = url.Parse(serverA.URL)
+	machineB.Client.HomeserverURL, _ = url.Parse(serverB.URL)
+	go relayAB.deliver()
+	go relayBA.deliver()
+	return
+}
+
+// startVerification sends a verification request from machine A to machine B and waits for B to receive it.
+func startVerification(t *testing.T, machineA, machineB *OlmMachine) (sessionA, sessionB *VerificationSession) {
+	incoming := make(chan *VerificationSession, 1)
+	machineB.OnVerificationRequest = func(session *VerificationSession) {
+		incoming <- session
+	}
+	device, _ := machineA.CryptoStore.GetDevice(machineB.Client.UserID, machineB.Client.DeviceID)
+	sessionA, err := machineA.RequestVerification(device, nil)
+	if err != nil {
+		t.Fatalf("Failed to request verification: %v", err)
+	}
+	expectVerificationUpdate(t, sessionA, VerificationStateRequested)
+	select {
+	case sessionB = <-incoming:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for verification request")
+	}
+	if sessionB.TransactionID != sessionA.TransactionID || sessionB.InitiatedByUs {
+		t.Fatalf("Unexpected incoming session %s (initiated by us: %t)", sessionB.TransactionID, sessionB.InitiatedByUs)
+	}
+	expectVerificationUpdate(t, sessionB, VerificationStateRequested)
+	return
+}
+
+func expectVerificationUpdate(t *testing.T, session *VerificationSession, state VerificationState) VerificationUpdate {
+	t.Helper()
+	select {
+	case update, ok := <-session.Updates():
+		if !ok {
+			t.Fatalf("Updates channel closed while waiting for %s", state)
+		} else if update.State != state {
+			t.Fatalf("Expected %s update, got %s (%s)", state, update.State, update.CancelReason)
+		}
+		return update
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for %s update", state)
+	}
+	return VerificationUpdate{}
+}
+
+func expectVerificationFinished(t *testing.T, session *VerificationSession) {
+	t.Helper()
+	select {
+	case <-session.Finished():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for session to finish")
+	}
+	if _, ok := <-session.Updates(); ok {
+		t.Error("Expected updates channel to be closed after the session finished")
+	}
+	if session.mach.GetVerificationSession(session.OtherUserID, session.TransactionID) != nil {
+		t.Error("Expected finished session to be removed from the machine")
+	}
+}
+
+// exchangeKeys accepts the request on machine B, starts the SAS verification from machine A and
+// waits for both sides to reach the keys exchanged state.
+func exchangeKeys(t *testing.T, sessionA, sessionB *VerificationSession) (sasA, sasB SASData) {
+	if err := sessionB.Accept(nil); err != nil {
+		t.Fatalf("Failed to accept verification: %v", err)
+	}
+	expectVerificationUpdate(t, sessionB, VerificationStateReady)
+	expectVerificationUpdate(t, sessionA, VerificationStateReady)
+	if len(sessionA.Methods()) != 1 || sessionA.Methods()[0] != event.VerificationMethodSAS {
+		t.Errorf("Expected SAS to be negotiated, got %v", sessionA.Methods())
+	}
+	if err := sessionA.StartSAS(); err != nil {
+		t.Fatalf("Failed to start SAS: %v", err)
+	}
+	expectVerificationUpdate(t, sessionA, VerificationStateStarted)
+	expectVerificationUpdate(t, sessionB, VerificationStateStarted)
+	sasA = expectVerificationUpdate(t, sessionA, VerificationStateKeysExchanged).SAS
+	sasB = expectVerificationUpdate(t, sessionB, VerificationStateKeysExchanged).SAS
+	return
+}
+
+func TestVerificationSession_SAS(t *testing.T) {
+	machineA, machineB, _, _ := newVerificationTestMachines(t)
+	sessionA, sessionB := startVerification(t, machineA, machineB)
+
+	if err := sessionA.Accept(nil); !errors.Is(err, ErrUnexpectedVerificationState) {
+		t.Errorf("Expected error when accepting own request, got %v", err)
+	}
+	if err := sessionB.Confirm(true); !errors.Is(err, ErrUnexpectedVerificationState) {
+		t.Errorf("Expected error when confirming before keys are exchanged, got %v", err)
+	}
+	if err := sessionA.StartSAS(); !errors.Is(err, ErrUnexpectedVerificationState) {
+		t.Errorf("Expected error when starting SAS before the request is accepted, got %v", err)
+	}
+
+	sasA, sasB := exchangeKeys(t, sessionA, sessionB)
+	if sasA == nil || !reflect.DeepEqual(sasA, sasB) {
+		t.Fatalf("Expected both sides to have the same SAS, got %v and %v", sasA, sasB)
+	}
+	if err := sessionA.Confirm(true); err != nil {
+		t.Fatalf("Failed to confirm SAS: %v", err)
+	}
+	if err := sessionB.Confirm(true); err != nil {
+		t.Fatalf("Failed to confirm SAS: %v", err)
+	}
+	for _, session := range []*VerificationSession{sessionA, sessionB} {
+		expectVerificationUpdate(t, session, VerificationStateConfirmed)
+		expectVerificationUpdate(t, session, VerificationStateDone)
+		expectVerificationFinished(t, session)
+	}
+
+	if device, _ := machineA.CryptoStore.GetDevice(machineB.Client.UserID, machineB.Client.DeviceID); device.Trust != TrustStateVerified {
+		t.Errorf("Expected machine B's device to be verified by machine A, got %s", device.Trust)
+	}
+	if device, _ := machineB.CryptoStore.GetDevice(machineA.Client.UserID, machineA.Client.DeviceID); device.Trust != TrustStateVerified {
+		t.Errorf("Expected machine A's device to be verified by machine B, got %s", device.Trust)
+	}
+	if err := sessionA.Cancel("Too late"); !errors.Is(err, ErrVerificationSessionFinished) {
+		t.Errorf("Expected error when cancelling finished session, got %v", err)
+	}
+}
+
+func TestVerificationSession_SASMismatch(t *testing.T) {
+	machineA, machineB, relayAB, relayBA := newVerificationTestMachines(t)
+	var cancelsFromA, cancelsFromB int32
+	relayAB.modify = func(evt *event.Event) bool {
+		if evt.Type == event.ToDeviceVerificationCancel {
+			atomic.AddInt32(&cancelsFromA, 1)
+		}
+		return true
+	}
+	relayBA.modify = func(evt *event.Event) bool {
+		if evt.Type == event.ToDeviceVerificationCancel {
+			atomic.AddInt32(&cancelsFromB, 1)
+		}
+		return true
+	}
+	sessionA, sessionB := startVerification(t, machineA, machineB)
+	exchangeKeys(t, sessionA, sessionB)
+
+	if err := sessionB.Confirm(false); err != nil {
+		t.Fatalf("Failed to reject SAS: %v", err)
+	}
+	updateB := expectVerificationUpdate(t, sessionB, VerificationStateCancelled)
+	if !updateB.CancelledByUs || updateB.CancelCode != event.VerificationCancelSASMismatch {
+		t.Errorf("Unexpected cancellation on machine B: %+v", updateB)
+	}
+	updateA := expectVerificationUpdate(t, sessionA, VerificationStateCancelled)
+	if updateA.CancelledByUs || updateA.CancelCode != event.VerificationCancelSASMismatch {
+		t.Errorf("Unexpected cancellation on machine A: %+v", updateA)
+	}
+	expectVerificationFinished(t, sessionA)
+	expectVerificationFinished(t, sessionB)
+	if device, _ := machineA.CryptoStore.GetDevice(machineB.Client.UserID, machineB.Client.DeviceID); device.Trust == TrustStateVerified {
+		t.Error("Expected machine B's device to not be verified after a SAS mismatch")
+	}
+	// Give the SAS goroutines a moment to send any extra cancels
+	time.Sleep(100 * time.Millisecond)
+	if fromA, fromB := atomic.LoadInt32(&cancelsFromA), atomic.LoadInt32(&cancelsFromB); fromA != 0 || fromB != 1 {
+		t.Errorf("Expected exactly one cancel from machine B and none from machine A, got %d and %d", fromB, fromA)
+	}
+}
+
+func TestVerificationSession_WaitsForDone(t *testing.T) {
+	machineA, machineB, _, relayBA := newVerificationTestMachines(t)
+	relayBA.modify = func(evt *event.Event) bool {
+		return evt.Type != event.ToDeviceVerificationDone
+	}
+	sessionA, sessionB := startVerification(t, machineA, machineB)
+	exchangeKeys(t, sessionA, sessionB)
+	if err := sessionA.Confirm(true); err != nil {
+		t.Fatalf("Failed to confirm SAS: %v", err)
+	}
+	if err := sessionB.Confirm(true); err != nil {
+		t.Fatalf("Failed to confirm SAS: %v", err)
+	}
+	expectVerificationUpdate(t, sessionA, VerificationStateConfirmed)
+	expectVerificationUpdate(t, sessionB, VerificationStateConfirmed)
+	expectVerificationUpdate(t, sessionB, VerificationStateDone)
+	expectVerificationFinished(t, sessionB)
+
+	// Machine B's done event was dropped, so machine A must not be done yet
+	select {
+	case update := <-sessionA.Updates():
+		t.Fatalf("Expected no update before machine B's done event, got %s", update.State)
+	case <-time.After(200 * time.Millisecond):
+	}
+	machineA.handleVerificationDone(machineB.Client.UserID, sessionA.TransactionID)
+	expectVerificationUpdate(t, sessionA, VerificationStateDone)
+	expectVerificationFinished(t, sessionA)
+}
+
+func TestVerificationSession_MismatchedMAC(t *testing.T) {
+	machineA, machineB, relayAB, _ := newVerificationTestMachines(t)
+	relayAB.modify = func(evt *event.Event) bool {
+		if content, ok := evt.Content.Parsed.(*event.VerificationMacEventContent); ok {
+			content.Keys = "invalid"
+		}
+		return true
+	}
+	sessionA, sessionB := startVerification(t, machineA, machineB)
+	exchangeKeys(t, sessionA, sessionB)
+
+	// Machine B confirms first, so that it's already waiting for the MAC from machine A
+	if err := sessionB.Confirm(true); err != nil {
+		t.Fatalf("Failed to confirm SAS: %v", err)
+	}
+	expectVerificationUpdate(t, sessionB, VerificationStateConfirmed)
+	if err := sessionA.Confirm(true); err != nil {
+		t.Fatalf("Failed to confirm SAS: %v", err)
+	}
+	updateB := expectVerificationUpdate(t, sessionB, VerificationStateCancelled)
+	if !updateB.CancelledByUs || updateB.CancelCode != event.VerificationCancelKeyMismatch {
+		t.Errorf("Unexpected cancellation on machine B: %+v", updateB)
+	}
+	expectVerificationFinished(t, sessionB)
+	if device, _ := machineB.CryptoStore.GetDevice(machineA.Client.UserID, machineA.Client.DeviceID); device.Trust == TrustStateVerified {
+		t.Error("Expected machine A's device to not be verified after a mismatched MAC")
+	}
+}
+
+func TestVerificationSession_Cancel(t *testing.T) {
+	machineA, machineB, _, _ := newVerificationTestMachines(t)
+	sessionA, sessionB := startVerification(t, machineA, machineB)
+
+	if err := sessionB.Cancel("Not now"); err != nil {
+		t.Fatalf("Failed to cancel verification: %v", err)
+	}
+	updateB := expectVerificationUpdate(t, sessionB, VerificationStateCancelled)
+	if !updateB.CancelledByUs || updateB.CancelCode != event.VerificationCancelByUser {
+		t.Errorf("Unexpected cancellation on machine B: %+v", updateB)
+	}
+	updateA := expectVerificationUpdate(t, sessionA, VerificationStateCancelled)
+	if updateA.CancelledByUs || updateA.CancelCode != event.VerificationCancelByUser || updateA.CancelReason != "Not now" {
+		t.Errorf("Unexpected cancellation on machine A: %+v", updateA)
+	}
+	expectVerificationFinished(t, sessionA)
+	expectVerificationFinished(t, sessionB)
+	if err := sessionB.Accept(nil); !errors.Is(err, ErrVerificationSessionFinished) {
+		t.Errorf("Expected error when accepting cancelled session, got %v", err)
+	}
+}
+
+func TestVerificationSession_Timeout(t *testing.T) {
+	machineA, machineB, _, _ := newVerificationTestMachines(t)
+	machineA.DefaultSASTimeout = 100 * time.Millisecond
+	sessionA, sessionB := startVerification(t, machineA, machineB)
+
+	// Machine B never accepts the request, so machine A's request times out
+	updateA := expectVerificationUpdate(t, sessionA, VerificationStateCancelled)
+	if !updateA.CancelledByUs || updateA.CancelCode != event.VerificationCancelByTimeout {
+		t.Errorf("Unexpected cancellation on machine A: %+v", updateA)
+	}
+	updateB := expectVerificationUpdate(t, sessionB, VerificationStateCancelled)
+	if updateB.CancelledByUs || updateB.CancelCode != event.VerificationCancelByTimeout {
+		t.Errorf("Unexpected cancellation on machine B: %+v", updateB)
+	}
+	expectVerificationFinished(t, sessionA)
+	expectVerificationFinished(t, sessionB)
+}
@@ -55,6 +55,18 @@ var (
 	// The client attempted to join a room that has a version the server does not support.
 	// Inspect the room_version property of the error response for the room's version.
 	MIncompatibleRoomVersion = RespError{ErrCode: "M_INCOMPATIBLE_ROOM_VERSION"}
+	// The server did not understand the request, usually because the endpoint isn't implemented.
+	MUnrecognized = RespError{ErrCode: "M_UNRECOGNIZED"}
+
+	// The homeserver doesn't have an URL configured for the application service.
+	MURLNotSet = RespError{ErrCode: "M_URL_NOT_SET"}
+	// The application service returned a non-200 status code to the homeserver.
+	// The status code and response body are included in the status and body fields.
+	MBadStatus = RespError{ErrCode: "M_BAD_STATUS"}
+	// The homeserver timed out while connecting to the application service.
+	MConnectionTimeout = RespError{ErrCode: "M_CONNECTION_TIMEOUT"}
+	// The homeserver failed to connect to the application service.
+	MConnectionFailed = RespError{ErrCode: "M_CONNECTION_FAILED"}
 )
 
 // HTTPError An HTTP Error response, which may wrap an underlying native Go Error.
@@ -89,6 +89,15 @@ type RoomKeyEventContent struct {
 	RoomID     id.RoomID    `json:"room_id"`
 	SessionID  id.SessionID `json:"session_id"`
 	SessionKey string       `json:"session_key"`
+
+	// SharedHistory marks the key as safe to share with users who are invited to the room later.
+	// See https://github.com/matrix-org/matrix-spec-proposals/pull/3061
+	SharedHistory bool `json:"org.matrix.msc3061.shared_history,omitempty"`
+
+	// MaxAge and MaxMessages are the rotation settings of the sender's outbound session. They tell the recipient
+	// when the sender will stop using the session, so that the inbound session can be expired later.
+	MaxAge      int64 `json:"com.beeper.max_age_ms,omitempty"`
+	MaxMessages int   `json:"com.beeper.max_messages,omitempty"`
 }
 
 // ForwardedRoomKeyEventContent represents the content of a m.forwarded_room_key to_device event.
@@ -105,6 +105,11 @@ func (evt *Event) MarshalJSON() ([]byte, error) {
 
 type MautrixInfo struct {
 	Verified bool
+	// TrustState is the trust level of the sender device of a decrypted event.
+	TrustState id.TrustState
+	// ForwardedKeys is true if the event was decrypted with a session that was forwarded or imported
+	// rather than received directly from the sender, which means the sender can't be authenticated.
+	ForwardedKeys bool
 
 	CheckpointSent bool
 }
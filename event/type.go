@@ -83,7 +83,8 @@ func (et *Type) IsToDevice() bool {
 func (et *Type) IsInRoomVerification() bool {
 	switch et.Type {
 	case InRoomVerificationStart.Type, InRoomVerificationReady.Type, InRoomVerificationAccept.Type,
-		InRoomVerificationKey.Type, InRoomVerificationMAC.Type, InRoomVerificationCancel.Type:
+		InRoomVerificationKey.Type, InRoomVerificationMAC.Type, InRoomVerificationCancel.Type,
+		InRoomVerificationDone.Type:
 		return true
 	default:
 		return false
@@ -120,7 +121,7 @@ func (et *Type) GuessClass() TypeClass {
 	case EventRedaction.Type, EventMessage.Type, EventEncrypted.Type, EventReaction.Type, EventSticker.Type,
 		InRoomVerificationStart.Type, InRoomVerificationReady.Type, InRoomVerificationAccept.Type,
 		InRoomVerificationKey.Type, InRoomVerificationMAC.Type, InRoomVerificationCancel.Type,
-		CallInvite.Type, CallCandidates.Type, CallAnswer.Type, CallReject.Type, CallSelectAnswer.Type,
+		InRoomVerificationDone.Type, CallInvite.Type, CallCandidates.Type, CallAnswer.Type, CallReject.Type, CallSelectAnswer.Type,
 		CallNegotiate.Type, CallHangup.Type, BeeperMessageStatus.Type:
 		return MessageEventType
 	case ToDeviceRoomKey.Type, ToDeviceRoomKeyRequest.Type, ToDeviceForwardedRoomKey.Type, ToDeviceRoomKeyWithheld.Type:
@@ -201,6 +202,7 @@ var (
 	InRoomVerificationKey    = Type{"m.key.verification.key", MessageEventType}
 	InRoomVerificationMAC    = Type{"m.key.verification.mac", MessageEventType}
 	InRoomVerificationCancel = Type{"m.key.verification.cancel", MessageEventType}
+	InRoomVerificationDone   = Type{"m.key.verification.done", MessageEventType}
 
 	CallInvite       = Type{"m.call.invite", MessageEventType}
 	CallCandidates   = Type{"m.call.candidates", MessageEventType}
@@ -244,11 +246,13 @@ var (
 	ToDeviceRoomKeyWithheld     = Type{"m.room_key.withheld", ToDeviceEventType}
 	ToDeviceDummy               = Type{"m.dummy", ToDeviceEventType}
 	ToDeviceVerificationRequest = Type{"m.key.verification.request", ToDeviceEventType}
+	ToDeviceVerificationReady   = Type{"m.key.verification.ready", ToDeviceEventType}
 	ToDeviceVerificationStart   = Type{"m.key.verification.start", ToDeviceEventType}
 	ToDeviceVerificationAccept  = Type{"m.key.verification.accept", ToDeviceEventType}
 	ToDeviceVerificationKey     = Type{"m.key.verification.key", ToDeviceEventType}
 	ToDeviceVerificationMAC     = Type{"m.key.verification.mac", ToDeviceEventType}
 	ToDeviceVerificationCancel  = Type{"m.key.verification.cancel", ToDeviceEventType}
+	ToDeviceVerificationDone    = Type{"m.key.verification.done", ToDeviceEventType}
 
 	ToDeviceOrgMatrixRoomKeyWithheld = Type{"org.matrix.room_key.withheld", ToDeviceEventType}
 )
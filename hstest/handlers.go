@@ -0,0 +1,352 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hstest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// request is an incoming client-server API request.
+type request struct {
+	*http.Request
+	vars map[string]string
+
+	// The authenticated user. For appservice requests, this is the user the appservice is masquerading as.
+	userID       id.UserID
+	device       *device
+	isAppService bool
+	accessToken  string
+}
+
+// timestamp returns the timestamp to use for events sent in this request. Appservices can override
+// the timestamp with the ts query parameter.
+func (req *request) timestamp() int64 {
+	if req.isAppService {
+		if ts, err := strconv.ParseInt(req.URL.Query().Get("ts"), 10, 64); err == nil {
+			return ts
+		}
+	}
+	return time.Now().UnixMilli()
+}
+
+func (req *request) parseJSON(into interface{}) error {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil || (len(body) > 0 && json.Unmarshal(body, into) != nil) {
+		return newError(http.StatusBadRequest, "M_NOT_JSON", "Request body is not valid JSON")
+	}
+	return nil
+}
+
+type handlerFunc func(req *request) (interface{}, error)
+
+const (
+	noAuth = iota
+	requireAuth
+	requireAppService
+)
+
+func (hs *Homeserver) handle(auth int, fn handlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &request{Request: r, vars: mux.Vars(r)}
+		for key, value := range req.vars {
+			req.vars[key], _ = url.PathUnescape(value)
+		}
+		resp, err := hs.authenticate(req, auth)
+		if err == nil {
+			resp, err = fn(req)
+		}
+		if hs.AutoPush {
+			hs.startAutoPush()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			re, ok := err.(*respError)
+			if !ok {
+				re = newError(http.StatusInternalServerError, "M_UNKNOWN", "%v", err)
+			}
+			w.WriteHeader(re.status)
+			_ = json.NewEncoder(w).Encode(map[string]string{"errcode": re.errcode, "error": re.message})
+			return
+		}
+		if resp == nil {
+			resp = struct{}{}
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// authenticate finds the user who made the request. If the request doesn't need to be authenticated, errors are
+// ignored, but the user is still filled if the request has a valid access token.
+func (hs *Homeserver) authenticate(req *request, auth int) (interface{}, error) {
+	token := req.URL.Query().Get("access_token")
+	if authHeader := req.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		token = strings.TrimPrefix(authHeader, "Bearer ")
+	}
+	req.accessToken = token
+	err := hs.findUser(req)
+	if auth == noAuth {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if auth == requireAppService && !req.isAppService {
+		return nil, newError(http.StatusUnauthorized, "M_FORBIDDEN", "This endpoint can only be used by appservices")
+	}
+	return nil, nil
+}
+
+func (hs *Homeserver) findUser(req *request) error {
+	if len(req.accessToken) == 0 {
+		return newError(http.StatusUnauthorized, "M_MISSING_TOKEN", "Missing access token")
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if hs.Registration != nil && req.accessToken == hs.Registration.AppToken {
+		req.isAppService = true
+		req.userID = id.UserID(req.URL.Query().Get("user_id"))
+		if len(req.userID) == 0 {
+			req.userID = id.NewUserID(hs.Registration.SenderLocalpart, hs.Domain)
+		} else if !hs.isAppServiceUser(req.userID) {
+			return newError(http.StatusForbidden, "M_EXCLUSIVE", "Application service cannot masquerade as this user")
+		}
+		return nil
+	}
+	dev, ok := hs.devices[req.accessToken]
+	if !ok {
+		return newError(http.StatusUnauthorized, "M_UNKNOWN_TOKEN", "Invalid access token")
+	}
+	req.userID = dev.userID
+	req.device = dev
+	return nil
+}
+
+// requireUser checks that the authenticated user exists, which isn't the case when an appservice is
+// masquerading as a user it hasn't registered yet. The lock must be held when calling this.
+func (hs *Homeserver) requireUser(req *request) (*user, error) {
+	u, ok := hs.users[req.userID]
+	if !ok {
+		return nil, newError(http.StatusForbidden, "M_FORBIDDEN", "Application service has not registered this user (%s)", req.userID)
+	}
+	return u, nil
+}
+
+func (hs *Homeserver) registerRoutes() {
+	client := hs.router.PathPrefix("/_matrix/client").Subrouter()
+	client.Handle("/versions", hs.handle(noAuth, hs.getVersions)).Methods(http.MethodGet)
+	v3 := client.PathPrefix("/v3").Subrouter()
+	v3.Handle("/register", hs.handle(noAuth, hs.postRegister)).Methods(http.MethodPost)
+	v3.Handle("/login", hs.handle(noAuth, hs.getLoginFlows)).Methods(http.MethodGet)
+	v3.Handle("/login", hs.handle(noAuth, hs.postLogin)).Methods(http.MethodPost)
+	v3.Handle("/logout", hs.handle(requireAuth, hs.postLogout)).Methods(http.MethodPost)
+	v3.Handle("/account/whoami", hs.handle(requireAuth, hs.getWhoami)).Methods(http.MethodGet)
+	v3.Handle("/user/{userID}/filter", hs.handle(requireAuth, hs.postFilter)).Methods(http.MethodPost)
+
+	v3.Handle("/profile/{userID}", hs.handle(noAuth, hs.getProfile)).Methods(http.MethodGet)
+	v3.Handle("/profile/{userID}/{field:displayname|avatar_url}", hs.handle(noAuth, hs.getProfile)).Methods(http.MethodGet)
+	v3.Handle("/profile/{userID}/{field:displayname|avatar_url}", hs.handle(requireAuth, hs.putProfile)).Methods(http.MethodPut)
+
+	v3.Handle("/createRoom", hs.handle(requireAuth, hs.postCreateRoom)).Methods(http.MethodPost)
+	v3.Handle("/joined_rooms", hs.handle(requireAuth, hs.getJoinedRooms)).Methods(http.MethodGet)
+	v3.Handle("/join/{roomIDOrAlias}", hs.handle(requireAuth, hs.postJoin)).Methods(http.MethodPost)
+	v3.Handle("/rooms/{roomID}/join", hs.handle(requireAuth, hs.postJoin)).Methods(http.MethodPost)
+	v3.Handle("/rooms/{roomID}/{action:leave|invite|kick|ban|unban}", hs.handle(requireAuth, hs.postMembership)).Methods(http.MethodPost)
+	v3.Handle("/rooms/{roomID}/send/{eventType}/{txnID}", hs.handle(requireAuth, hs.putSendEvent)).Methods(http.MethodPut)
+	v3.Handle("/rooms/{roomID}/state/{eventType}", hs.handle(requireAuth, hs.putStateEvent)).Methods(http.MethodPut)
+	v3.Handle("/rooms/{roomID}/state/{eventType}/{stateKey:.*}", hs.handle(requireAuth, hs.putStateEvent)).Methods(http.MethodPut)
+	v3.Handle("/rooms/{roomID}/state/{eventType}", hs.handle(requireAuth, hs.getStateEvent)).Methods(http.MethodGet)
+	v3.Handle("/rooms/{roomID}/state/{eventType}/{stateKey:.*}", hs.handle(requireAuth, hs.getStateEvent)).Methods(http.MethodGet)
+	v3.Handle("/rooms/{roomID}/state", hs.handle(requireAuth, hs.getState)).Methods(http.MethodGet)
+	v3.Handle("/rooms/{roomID}/members", hs.handle(requireAuth, hs.getMembers)).Methods(http.MethodGet)
+	v3.Handle("/rooms/{roomID}/joined_members", hs.handle(requireAuth, hs.getJoinedMembers)).Methods(http.MethodGet)
+	v3.Handle("/rooms/{roomID}/redact/{eventID}/{txnID}", hs.handle(requireAuth, hs.putRedact)).Methods(http.MethodPut)
+	v3.Handle("/rooms/{roomID}/typing/{userID}", hs.handle(requireAuth, hs.putTyping)).Methods(http.MethodPut)
+	v3.Handle("/directory/room/{alias}", hs.handle(noAuth, hs.getAlias)).Methods(http.MethodGet)
+	v3.Handle("/directory/room/{alias}", hs.handle(requireAuth, hs.putAlias)).Methods(http.MethodPut)
+	v3.Handle("/directory/room/{alias}", hs.handle(requireAuth, hs.deleteAlias)).Methods(http.MethodDelete)
+
+	v3.Handle("/sync", hs.handle(requireAuth, hs.getSync)).Methods(http.MethodGet)
+	v3.Handle("/sendToDevice/{eventType}/{txnID}", hs.handle(requireAuth, hs.putSendToDevice)).Methods(http.MethodPut)
+
+	client.Handle("/v1/appservice/{appserviceID}/ping", hs.handle(requireAppService, hs.postAppservicePing)).Methods(http.MethodPost)
+
+	media := hs.router.PathPrefix("/_matrix/media/v3").Subrouter()
+	media.Handle("/upload", hs.handle(requireAuth, hs.postUpload)).Methods(http.MethodPost)
+	media.HandleFunc("/download/{serverName}/{mediaID}", hs.getDownload).Methods(http.MethodGet)
+	media.HandleFunc("/download/{serverName}/{mediaID}/{fileName}", hs.getDownload).Methods(http.MethodGet)
+}
+
+func (hs *Homeserver) getVersions(_ *request) (interface{}, error) {
+	return map[string][]string{"versions": {"v1.1", "v1.2", "v1.3", "v1.4"}}, nil
+}
+
+func (hs *Homeserver) getLoginFlows(_ *request) (interface{}, error) {
+	return &mautrix.RespLoginFlows{Flows: []mautrix.LoginFlow{
+		{Type: mautrix.AuthTypePassword},
+		{Type: mautrix.AuthTypeAppservice},
+	}}, nil
+}
+
+func (hs *Homeserver) postRegister(req *request) (interface{}, error) {
+	var body mautrix.ReqRegister
+	if err := req.parseJSON(&body); err != nil {
+		return nil, err
+	}
+	if len(body.Username) == 0 {
+		return nil, newError(http.StatusBadRequest, "M_INVALID_USERNAME", "Username is required")
+	}
+	userID := id.NewUserID(strings.ToLower(body.Username), hs.Domain)
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if body.Type == mautrix.AuthTypeAppservice {
+		if !req.isAppService {
+			return nil, newError(http.StatusUnauthorized, "M_MISSING_TOKEN", "Appservice token required for appservice registration")
+		} else if !hs.isAppServiceUser(userID) {
+			return nil, newError(http.StatusBadRequest, "M_EXCLUSIVE", "User ID is not in the appservice's namespace")
+		}
+	} else if hs.Registration != nil && hs.Registration.IsUserExclusive(userID) {
+		return nil, newError(http.StatusBadRequest, "M_EXCLUSIVE", "User ID is reserved by an appservice")
+	}
+	if _, exists := hs.users[userID]; exists {
+		return nil, errUserInUse
+	}
+	hs.users[userID] = &user{id: userID, password: body.Password}
+	resp := &mautrix.RespRegister{UserID: userID, HomeServer: hs.Domain}
+	if !body.InhibitLogin {
+		dev := hs.newDevice(userID, body.DeviceID)
+		resp.AccessToken = dev.accessToken
+		resp.DeviceID = dev.deviceID
+	}
+	return resp, nil
+}
+
+func (hs *Homeserver) postLogin(req *request) (interface{}, error) {
+	var body mautrix.ReqLogin
+	if err := req.parseJSON(&body); err != nil {
+		return nil, err
+	}
+	userID := id.UserID(body.Identifier.User)
+	if !strings.HasPrefix(string(userID), "@") {
+		userID = id.NewUserID(string(userID), hs.Domain)
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	u, exists := hs.users[userID]
+	switch body.Type {
+	case mautrix.AuthTypeAppservice:
+		if !req.isAppService {
+			return nil, newError(http.StatusUnauthorized, "M_MISSING_TOKEN", "Appservice token required for appservice login")
+		} else if !hs.isAppServiceUser(userID) {
+			return nil, newError(http.StatusForbidden, "M_EXCLUSIVE", "User ID is not in the appservice's namespace")
+		} else if !exists {
+			return nil, newError(http.StatusForbidden, "M_FORBIDDEN", "User doesn't exist")
+		}
+	case mautrix.AuthTypePassword:
+		if !exists || len(u.password) == 0 || u.password != body.Password {
+			return nil, newError(http.StatusForbidden, "M_FORBIDDEN", "Invalid username or password")
+		}
+	default:
+		return nil, newError(http.StatusBadRequest, "M_UNKNOWN", "Unknown login type %s", body.Type)
+	}
+	dev := hs.newDevice(userID, body.DeviceID)
+	return &mautrix.RespLogin{
+		AccessToken: dev.accessToken,
+		DeviceID:    dev.deviceID,
+		UserID:      userID,
+	}, nil
+}
+
+func (hs *Homeserver) postLogout(req *request) (interface{}, error) {
+	if req.device == nil {
+		return nil, newError(http.StatusBadRequest, "M_UNKNOWN", "Appservice tokens can't be logged out")
+	}
+	hs.lock.Lock()
+	delete(hs.devices, req.accessToken)
+	hs.lock.Unlock()
+	return nil, nil
+}
+
+func (hs *Homeserver) getWhoami(req *request) (interface{}, error) {
+	resp := &mautrix.RespWhoami{UserID: req.userID}
+	if req.device != nil {
+		resp.DeviceID = req.device.deviceID
+	}
+	return resp, nil
+}
+
+func (hs *Homeserver) postFilter(_ *request) (interface{}, error) {
+	return &mautrix.RespCreateFilter{FilterID: "0"}, nil
+}
+
+func (hs *Homeserver) getProfile(req *request) (interface{}, error) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	u, ok := hs.users[id.UserID(req.vars["userID"])]
+	if !ok {
+		return nil, newError(http.StatusNotFound, "M_NOT_FOUND", "Profile not found")
+	}
+	resp := make(map[string]string)
+	if len(u.displayName) > 0 && req.vars["field"] != "avatar_url" {
+		resp["displayname"] = u.displayName
+	}
+	if len(u.avatarURL) > 0 && req.vars["field"] != "displayname" {
+		resp["avatar_url"] = string(u.avatarURL)
+	}
+	return resp, nil
+}
+
+func (hs *Homeserver) putProfile(req *request) (interface{}, error) {
+	var body map[string]string
+	if err := req.parseJSON(&body); err != nil {
+		return nil, err
+	} else if id.UserID(req.vars["userID"]) != req.userID {
+		return nil, newError(http.StatusForbidden, "M_FORBIDDEN", "Can't change the profile of other users")
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	u, err := hs.requireUser(req)
+	if err != nil {
+		return nil, err
+	}
+	field := req.vars["field"]
+	if field == "displayname" {
+		u.displayName = body[field]
+	} else {
+		u.avatarURL = id.ContentURIString(body[field])
+	}
+	hs.updateProfileInRooms(u, req.timestamp())
+	return nil, nil
+}
+
+func (hs *Homeserver) postAppservicePing(req *request) (interface{}, error) {
+	var body mautrix.ReqAppservicePing
+	if err := req.parseJSON(&body); err != nil {
+		return nil, err
+	} else if req.vars["appserviceID"] != hs.Registration.ID {
+		return nil, newError(http.StatusForbidden, "M_FORBIDDEN", "Appservice ID doesn't match the access token")
+	} else if hs.AppService == nil && len(hs.Registration.URL) == 0 {
+		return nil, newError(http.StatusBadRequest, "M_URL_NOT_SET", "Appservice doesn't have an URL")
+	}
+	reqBody, _ := json.Marshal(&body)
+	start := time.Now()
+	status, respBody, err := hs.sendToAppService(http.MethodPost, "/_matrix/app/v1/ping", reqBody)
+	if err != nil {
+		return nil, newError(http.StatusBadGateway, "M_CONNECTION_FAILED", "Failed to connect to appservice: %v", err)
+	} else if status != http.StatusOK {
+		return nil, newError(http.StatusBadGateway, "M_BAD_STATUS", "Appservice returned HTTP %d: %s", status, respBody)
+	}
+	return &mautrix.RespAppservicePing{DurationMS: time.Now().Sub(start).Milliseconds()}, nil
+}
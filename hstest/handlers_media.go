@@ -0,0 +1,59 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hstest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+)
+
+func (hs *Homeserver) postUpload(req *request) (interface{}, error) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, newError(http.StatusBadRequest, "M_UNKNOWN", "Failed to read request body")
+	}
+	uri := id.ContentURI{Homeserver: hs.Domain, FileID: appservice.RandomString(24)}
+	contentType := req.Header.Get("Content-Type")
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	hs.lock.Lock()
+	hs.media[uri.FileID] = &storedMedia{
+		data:        data,
+		contentType: contentType,
+		fileName:    req.URL.Query().Get("filename"),
+	}
+	hs.lock.Unlock()
+	return &mautrix.RespMediaUpload{ContentURI: uri}, nil
+}
+
+func (hs *Homeserver) getDownload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hs.lock.Lock()
+	media, ok := hs.media[vars["mediaID"]]
+	hs.lock.Unlock()
+	if !ok || vars["serverName"] != hs.Domain {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"errcode": "M_NOT_FOUND", "error": "Media not found"})
+		return
+	}
+	w.Header().Set("Content-Type", media.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(media.data)))
+	if len(media.fileName) > 0 {
+		w.Header().Set("Content-Disposition", "inline; filename=\""+media.fileName+"\"")
+	}
+	_, _ = w.Write(media.data)
+}
@@ -0,0 +1,376 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hstest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func (hs *Homeserver) postCreateRoom(req *request) (interface{}, error) {
+	var body mautrix.ReqCreateRoom
+	if err := req.parseJSON(&body); err != nil {
+		return nil, err
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if _, err := hs.requireUser(req); err != nil {
+		return nil, err
+	}
+	roomID, err := hs.createRoom(req.userID, &body, req.timestamp())
+	if err != nil {
+		return nil, err
+	}
+	return &mautrix.RespCreateRoom{RoomID: roomID}, nil
+}
+
+func (hs *Homeserver) getJoinedRooms(req *request) (interface{}, error) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	resp := &mautrix.RespJoinedRooms{JoinedRooms: []id.RoomID{}}
+	for roomID, rm := range hs.rooms {
+		if rm.membership(req.userID) == event.MembershipJoin {
+			resp.JoinedRooms = append(resp.JoinedRooms, roomID)
+		}
+	}
+	return resp, nil
+}
+
+// resolveRoom finds the room with the given ID or alias. The lock must be held when calling this.
+func (hs *Homeserver) resolveRoom(roomIDOrAlias string) (*room, error) {
+	if strings.HasPrefix(roomIDOrAlias, "#") {
+		roomID, ok := hs.aliases[id.RoomAlias(roomIDOrAlias)]
+		if !ok {
+			return nil, newError(http.StatusNotFound, "M_NOT_FOUND", "Room alias %s not found", roomIDOrAlias)
+		}
+		roomIDOrAlias = string(roomID)
+	}
+	return hs.getRoom(id.RoomID(roomIDOrAlias))
+}
+
+func (hs *Homeserver) postJoin(req *request) (interface{}, error) {
+	roomIDOrAlias := req.vars["roomID"]
+	if len(roomIDOrAlias) == 0 {
+		roomIDOrAlias = req.vars["roomIDOrAlias"]
+	}
+	var body mautrix.ReqLeave
+	if err := req.parseJSON(&body); err != nil {
+		return nil, err
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if _, err := hs.requireUser(req); err != nil {
+		return nil, err
+	}
+	rm, err := hs.resolveRoom(roomIDOrAlias)
+	if err != nil {
+		return nil, err
+	}
+	// Joining again is allowed and updates the member event, but isn't needed if the profile hasn't changed
+	if rm.membership(req.userID) != event.MembershipJoin {
+		_, err = hs.changeMembership(rm, req.userID, req.userID, event.MembershipJoin, body.Reason, false, req.timestamp())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &mautrix.RespJoinRoom{RoomID: rm.id}, nil
+}
+
+func (hs *Homeserver) postMembership(req *request) (interface{}, error) {
+	var body mautrix.ReqInviteUser
+	if err := req.parseJSON(&body); err != nil {
+		return nil, err
+	}
+	target := body.UserID
+	var membership event.Membership
+	switch req.vars["action"] {
+	case "leave":
+		target = req.userID
+		membership = event.MembershipLeave
+	case "invite":
+		membership = event.MembershipInvite
+	case "kick":
+		membership = event.MembershipLeave
+		if target == req.userID {
+			return nil, newError(http.StatusForbidden, "M_FORBIDDEN", "Use the leave endpoint to leave rooms")
+		}
+	case "ban":
+		membership = event.MembershipBan
+	case "unban":
+		membership = event.MembershipLeave
+	}
+	if len(target) == 0 {
+		return nil, newError(http.StatusBadRequest, "M_MISSING_PARAM", "user_id is required")
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if _, err := hs.requireUser(req); err != nil {
+		return nil, err
+	}
+	rm, err := hs.getRoom(id.RoomID(req.vars["roomID"]))
+	if err != nil {
+		return nil, err
+	}
+	if req.vars["action"] == "unban" && rm.membership(target) != event.MembershipBan {
+		return nil, newError(http.StatusForbidden, "M_FORBIDDEN", "%s is not banned", target)
+	}
+	_, err = hs.changeMembership(rm, req.userID, target, membership, body.Reason, false, req.timestamp())
+	return nil, err
+}
+
+func (hs *Homeserver) putSendEvent(req *request) (interface{}, error) {
+	var content json.RawMessage
+	if err := req.parseJSON(&content); err != nil {
+		return nil, err
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if _, err := hs.requireUser(req); err != nil {
+		return nil, err
+	}
+	txnKey := req.accessToken + "|" + string(req.userID) + "|" + req.vars["txnID"]
+	if eventID, alreadySent := hs.sentTxns[txnKey]; alreadySent {
+		return &mautrix.RespSendEvent{EventID: eventID}, nil
+	}
+	evt, err := hs.sendEvent(id.RoomID(req.vars["roomID"]), req.userID, event.Type{Type: req.vars["eventType"]}, nil, content, req.timestamp())
+	if err != nil {
+		return nil, err
+	}
+	hs.sentTxns[txnKey] = evt.ID
+	return &mautrix.RespSendEvent{EventID: evt.ID}, nil
+}
+
+func (hs *Homeserver) putStateEvent(req *request) (interface{}, error) {
+	var content json.RawMessage
+	if err := req.parseJSON(&content); err != nil {
+		return nil, err
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if _, err := hs.requireUser(req); err != nil {
+		return nil, err
+	}
+	stateKey := req.vars["stateKey"]
+	evtType := event.Type{Type: req.vars["eventType"], Class: event.StateEventType}
+	if evtType == event.StateMember {
+		// Membership changes sent as state events are handled like the membership endpoints
+		rm, err := hs.getRoom(id.RoomID(req.vars["roomID"]))
+		if err != nil {
+			return nil, err
+		}
+		var member event.MemberEventContent
+		if err = json.Unmarshal(content, &member); err != nil {
+			return nil, newError(http.StatusBadRequest, "M_BAD_JSON", "Invalid member event content")
+		}
+		evt, err := hs.changeMembership(rm, req.userID, id.UserID(stateKey), member.Membership, member.Reason, member.IsDirect, req.timestamp())
+		if err != nil {
+			return nil, err
+		}
+		return &mautrix.RespSendEvent{EventID: evt.ID}, nil
+	}
+	evt, err := hs.sendEvent(id.RoomID(req.vars["roomID"]), req.userID, evtType, &stateKey, content, req.timestamp())
+	if err != nil {
+		return nil, err
+	}
+	return &mautrix.RespSendEvent{EventID: evt.ID}, nil
+}
+
+// getVisibleRoom returns the room if the user is allowed to read its state. The lock must be held when calling this.
+func (hs *Homeserver) getVisibleRoom(req *request) (*room, error) {
+	rm, err := hs.getRoom(id.RoomID(req.vars["roomID"]))
+	if err != nil {
+		return nil, err
+	} else if rm.membership(req.userID) != event.MembershipJoin {
+		return nil, errNotJoined
+	}
+	return rm, nil
+}
+
+func (hs *Homeserver) getStateEvent(req *request) (interface{}, error) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	rm, err := hs.getVisibleRoom(req)
+	if err != nil {
+		return nil, err
+	}
+	evt := rm.getState(event.Type{Type: req.vars["eventType"]}, req.vars["stateKey"])
+	if evt == nil {
+		return nil, newError(http.StatusNotFound, "M_NOT_FOUND", "Event not found")
+	}
+	return &evt.Content, nil
+}
+
+func (hs *Homeserver) getState(req *request) (interface{}, error) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	rm, err := hs.getVisibleRoom(req)
+	if err != nil {
+		return nil, err
+	}
+	state := make([]*event.Event, 0)
+	for _, stateOfType := range rm.state {
+		for _, evt := range stateOfType {
+			state = append(state, evt)
+		}
+	}
+	return state, nil
+}
+
+func (hs *Homeserver) getMembers(req *request) (interface{}, error) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	rm, err := hs.getVisibleRoom(req)
+	if err != nil {
+		return nil, err
+	}
+	query := req.URL.Query()
+	resp := &mautrix.RespMembers{Chunk: []*event.Event{}}
+	for _, evt := range rm.state[event.StateMember.Type] {
+		membership := string(evt.Content.AsMember().Membership)
+		if (query.Has("membership") && query.Get("membership") != membership) ||
+			(query.Has("not_membership") && query.Get("not_membership") == membership) {
+			continue
+		}
+		resp.Chunk = append(resp.Chunk, evt)
+	}
+	return resp, nil
+}
+
+type joinedMember struct {
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+func (hs *Homeserver) getJoinedMembers(req *request) (interface{}, error) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	rm, err := hs.getVisibleRoom(req)
+	if err != nil {
+		return nil, err
+	}
+	joined := make(map[id.UserID]joinedMember)
+	for userID, evt := range rm.state[event.StateMember.Type] {
+		member := evt.Content.AsMember()
+		if member.Membership == event.MembershipJoin {
+			joined[id.UserID(userID)] = joinedMember{DisplayName: member.Displayname, AvatarURL: string(member.AvatarURL)}
+		}
+	}
+	return map[string]interface{}{"joined": joined}, nil
+}
+
+func (hs *Homeserver) putRedact(req *request) (interface{}, error) {
+	var content map[string]interface{}
+	if err := req.parseJSON(&content); err != nil {
+		return nil, err
+	}
+	if content == nil {
+		content = make(map[string]interface{})
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	rm, err := hs.getVisibleRoom(req)
+	if err != nil {
+		return nil, err
+	}
+	redacts := id.EventID(req.vars["eventID"])
+	var target *event.Event
+	for _, evt := range rm.timeline {
+		if evt.ID == redacts {
+			target = evt
+			break
+		}
+	}
+	if target == nil {
+		return nil, newError(http.StatusNotFound, "M_NOT_FOUND", "Event not found")
+	}
+	pl := rm.powerLevels()
+	if target.Sender != req.userID && pl.GetUserLevel(req.userID) < pl.Redact() {
+		return nil, newError(http.StatusForbidden, "M_FORBIDDEN", "You don't have permission to redact other users' events")
+	}
+	evt, err := hs.addEvent(rm, req.userID, event.EventRedaction, nil, content, req.timestamp())
+	if err != nil {
+		return nil, err
+	}
+	evt.Redacts = redacts
+	return &mautrix.RespSendEvent{EventID: evt.ID}, nil
+}
+
+func (hs *Homeserver) putTyping(req *request) (interface{}, error) {
+	var body mautrix.ReqTyping
+	if err := req.parseJSON(&body); err != nil {
+		return nil, err
+	} else if id.UserID(req.vars["userID"]) != req.userID {
+		return nil, newError(http.StatusForbidden, "M_FORBIDDEN", "Can't set typing status of other users")
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	rm, err := hs.getVisibleRoom(req)
+	if err != nil {
+		return nil, err
+	}
+	if body.Typing {
+		rm.typing[req.userID] = struct{}{}
+	} else {
+		delete(rm.typing, req.userID)
+	}
+	userIDs := make([]id.UserID, 0, len(rm.typing))
+	for userID := range rm.typing {
+		userIDs = append(userIDs, userID)
+	}
+	typingEvt := &event.Event{
+		Type:   event.EphemeralEventTyping,
+		RoomID: rm.id,
+	}
+	typingEvt.Content.Raw = map[string]interface{}{"user_ids": userIDs}
+	hs.queueEphemeral(typingEvt)
+	return nil, nil
+}
+
+func (hs *Homeserver) getAlias(req *request) (interface{}, error) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	roomID, ok := hs.aliases[id.RoomAlias(req.vars["alias"])]
+	if !ok {
+		return nil, newError(http.StatusNotFound, "M_NOT_FOUND", "Room alias not found")
+	}
+	return &mautrix.RespAliasResolve{RoomID: roomID, Servers: []string{hs.Domain}}, nil
+}
+
+func (hs *Homeserver) putAlias(req *request) (interface{}, error) {
+	var body mautrix.ReqAliasCreate
+	if err := req.parseJSON(&body); err != nil {
+		return nil, err
+	}
+	alias := id.RoomAlias(req.vars["alias"])
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if !strings.HasSuffix(string(alias), ":"+hs.Domain) {
+		return nil, newError(http.StatusBadRequest, "M_INVALID_PARAM", "Room alias must be on %s", hs.Domain)
+	} else if _, exists := hs.aliases[alias]; exists {
+		return nil, newError(http.StatusConflict, "M_UNKNOWN", "Room alias %s already exists", alias)
+	} else if _, err := hs.getRoom(body.RoomID); err != nil {
+		return nil, err
+	}
+	hs.aliases[alias] = body.RoomID
+	return nil, nil
+}
+
+func (hs *Homeserver) deleteAlias(req *request) (interface{}, error) {
+	alias := id.RoomAlias(req.vars["alias"])
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if _, exists := hs.aliases[alias]; !exists {
+		return nil, newError(http.StatusNotFound, "M_NOT_FOUND", "Room alias not found")
+	}
+	delete(hs.aliases, alias)
+	return nil, nil
+}
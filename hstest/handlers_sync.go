@@ -0,0 +1,154 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hstest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// strippedStateTypes are the state event types included in invites.
+var strippedStateTypes = []event.Type{
+	event.StateCreate, event.StateJoinRules, event.StateRoomName, event.StateRoomAvatar,
+	event.StateCanonicalAlias, event.StateEncryption,
+}
+
+func (hs *Homeserver) getSync(req *request) (interface{}, error) {
+	query := req.URL.Query()
+	var since int
+	if sinceStr := query.Get("since"); len(sinceStr) > 0 {
+		var err error
+		since, err = strconv.Atoi(sinceStr)
+		if err != nil || since < 0 {
+			return nil, newError(http.StatusBadRequest, "M_INVALID_PARAM", "Invalid since token")
+		}
+	}
+	timeoutMS, _ := strconv.Atoi(query.Get("timeout"))
+	deadline := time.Now().Add(time.Duration(timeoutMS) * time.Millisecond)
+
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	for {
+		resp := hs.buildSync(req, since)
+		if len(resp.Rooms.Join) > 0 || len(resp.Rooms.Invite) > 0 || len(resp.Rooms.Leave) > 0 || len(resp.ToDevice.Events) > 0 {
+			return resp, nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return resp, nil
+		}
+		changed := hs.changed
+		hs.lock.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(remaining):
+		case <-req.Context().Done():
+		}
+		hs.lock.Lock()
+		if req.Context().Err() != nil {
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// buildSync collects the events the user should receive after the given position in the event stream.
+// The lock must be held when calling this.
+func (hs *Homeserver) buildSync(req *request, since int) *mautrix.RespSync {
+	if since > len(hs.stream) {
+		since = len(hs.stream)
+	}
+	resp := &mautrix.RespSync{NextBatch: strconv.Itoa(len(hs.stream))}
+	resp.AccountData.Events = []*event.Event{}
+	resp.Presence.Events = []*event.Event{}
+	resp.ToDevice.Events = []*event.Event{}
+	resp.Rooms.Join = make(map[id.RoomID]mautrix.SyncJoinedRoom)
+	resp.Rooms.Invite = make(map[id.RoomID]mautrix.SyncInvitedRoom)
+	resp.Rooms.Leave = make(map[id.RoomID]mautrix.SyncLeftRoom)
+
+	// The user's membership at the end of the stream decides which section of the response a room goes to.
+	// Left rooms only include events up to the user leaving.
+	leftAt := make(map[id.RoomID]bool)
+	for _, evt := range hs.stream[since:] {
+		rm := hs.rooms[evt.RoomID]
+		switch rm.membership(req.userID) {
+		case event.MembershipJoin:
+			joined := resp.Rooms.Join[rm.id]
+			joined.Timeline.Events = append(joined.Timeline.Events, evt)
+			resp.Rooms.Join[rm.id] = joined
+		case event.MembershipInvite:
+			if _, alreadyAdded := resp.Rooms.Invite[rm.id]; !alreadyAdded {
+				var invited mautrix.SyncInvitedRoom
+				for _, evtType := range strippedStateTypes {
+					if stateEvt := rm.getState(evtType, ""); stateEvt != nil {
+						invited.State.Events = append(invited.State.Events, stateEvt)
+					}
+				}
+				invited.State.Events = append(invited.State.Events, rm.getState(event.StateMember, string(req.userID)))
+				resp.Rooms.Invite[rm.id] = invited
+			}
+		case event.MembershipLeave, event.MembershipBan:
+			if leftAt[rm.id] {
+				continue
+			}
+			// Only rooms where the user was a member at some point are included
+			left, wasMember := resp.Rooms.Leave[rm.id]
+			if evt.Type == event.StateMember && evt.GetStateKey() == string(req.userID) {
+				leftAt[rm.id] = rm.getState(event.StateMember, string(req.userID)) == evt
+				wasMember = true
+			}
+			if wasMember {
+				left.Timeline.Events = append(left.Timeline.Events, evt)
+				resp.Rooms.Leave[rm.id] = left
+			}
+		}
+	}
+	if req.device != nil {
+		resp.ToDevice.Events = append(resp.ToDevice.Events, req.device.toDevice...)
+		req.device.toDevice = nil
+	}
+	return resp
+}
+
+func (hs *Homeserver) putSendToDevice(req *request) (interface{}, error) {
+	var body struct {
+		Messages map[id.UserID]map[id.DeviceID]json.RawMessage `json:"messages"`
+	}
+	if err := req.parseJSON(&body); err != nil {
+		return nil, err
+	}
+	evtType := event.Type{Type: req.vars["eventType"], Class: event.ToDeviceEventType}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	for userID, messages := range body.Messages {
+		for deviceID, content := range messages {
+			for _, dev := range hs.devices {
+				if dev.userID != userID || (deviceID != "*" && dev.deviceID != deviceID) {
+					continue
+				}
+				evt := &event.Event{Sender: req.userID, Type: evtType}
+				if err := json.Unmarshal(content, &evt.Content); err != nil {
+					return nil, newError(http.StatusBadRequest, "M_BAD_JSON", "Invalid to-device content")
+				}
+				if hs.Registration != nil && hs.Registration.EphemeralEvents && hs.Registration.IsUserInNamespace(userID) {
+					evt.ToUserID = userID
+					evt.ToDeviceID = dev.deviceID
+					hs.queueEphemeral(evt)
+				} else {
+					dev.toDevice = append(dev.toDevice, evt)
+				}
+			}
+		}
+	}
+	hs.notifyChanged()
+	return nil, nil
+}
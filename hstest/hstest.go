@@ -0,0 +1,483 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package hstest provides an in-memory Matrix homeserver for testing clients and appservices.
+//
+// The simulated homeserver implements the subset of the client-server API used by mautrix.Client and
+// appservice.IntentAPI (registration, login, rooms, state, membership, sending, media, sync and to-device messages),
+// and pushes transactions to an appservice like a real homeserver would. It does not implement federation,
+// end-to-end encryption key management or most of the authorization rules.
+package hstest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Homeserver is an in-memory homeserver. Use New to create one.
+type Homeserver struct {
+	// Domain is the server name of the homeserver.
+	Domain string
+	// URL is the base URL of the HTTP server that serves the client-server API.
+	URL string
+	// Registration is the registration of the appservice connected to this homeserver, or nil if there is none.
+	Registration *appservice.Registration
+	// AppService is the handler that transactions are pushed to. If nil, transactions are sent to Registration.URL.
+	AppService http.Handler
+	// AutoPush makes the homeserver push pending transactions in the background after every client-server API
+	// request, like a real homeserver would. Use WaitForPush to wait until they've been delivered.
+	// If false, transactions are only pushed when PushTransactions is called.
+	AutoPush bool
+
+	server *httptest.Server
+	router *mux.Router
+
+	lock     sync.Mutex
+	users    map[id.UserID]*user
+	devices  map[string]*device
+	rooms    map[id.RoomID]*room
+	aliases  map[id.RoomAlias]id.RoomID
+	media    map[string]*storedMedia
+	sentTxns map[string]id.EventID
+	// stream contains all room events in the order they were sent, used for syncing
+	stream  []*event.Event
+	changed chan struct{}
+	// events waiting to be pushed to the appservice
+	pendingEvents    []*event.Event
+	pendingEphemeral []*event.Event
+
+	// pushing is true while a transaction is being sent to the appservice, and autoPushing is true while the
+	// background pusher started by AutoPush is running. pushCond is broadcast when either of them changes.
+	pushing     bool
+	autoPushing bool
+	pushCond    *sync.Cond
+	delivered   []*appservice.Transaction
+	txnCounter  int
+}
+
+type user struct {
+	id          id.UserID
+	password    string
+	displayName string
+	avatarURL   id.ContentURIString
+}
+
+type device struct {
+	userID      id.UserID
+	deviceID    id.DeviceID
+	accessToken string
+	toDevice    []*event.Event
+}
+
+type room struct {
+	id       id.RoomID
+	timeline []*event.Event
+	state    map[string]map[string]*event.Event
+	typing   map[id.UserID]struct{}
+}
+
+type storedMedia struct {
+	data        []byte
+	contentType string
+	fileName    string
+}
+
+// New creates a homeserver with the given server name and starts serving the client-server API on a local port.
+// If a registration is given, the homeserver accepts the appservice's token and creates its sender user.
+func New(domain string, registration *appservice.Registration) *Homeserver {
+	hs := &Homeserver{
+		Domain:       domain,
+		Registration: registration,
+
+		users:    make(map[id.UserID]*user),
+		devices:  make(map[string]*device),
+		rooms:    make(map[id.RoomID]*room),
+		aliases:  make(map[id.RoomAlias]id.RoomID),
+		media:    make(map[string]*storedMedia),
+		sentTxns: make(map[string]id.EventID),
+		changed:  make(chan struct{}),
+	}
+	hs.pushCond = sync.NewCond(&hs.lock)
+	if registration != nil {
+		senderID := id.NewUserID(registration.SenderLocalpart, domain)
+		hs.users[senderID] = &user{id: senderID}
+	}
+	hs.router = mux.NewRouter().UseEncodedPath()
+	hs.registerRoutes()
+	hs.server = httptest.NewServer(hs.router)
+	hs.URL = hs.server.URL
+	return hs
+}
+
+// Close shuts down the HTTP server.
+func (hs *Homeserver) Close() {
+	hs.server.Close()
+}
+
+// ConnectAppService configures the given appservice to use this homeserver and makes the homeserver push
+// transactions directly to the appservice's router. The homeserver must have been created with the same
+// registration that the appservice uses.
+func (hs *Homeserver) ConnectAppService(as *appservice.AppService) {
+	as.HomeserverURL = hs.URL
+	as.HomeserverDomain = hs.Domain
+	if as.Registration == nil {
+		as.Registration = hs.Registration
+	}
+	as.RegisterRoutes()
+	hs.AppService = as.Router
+}
+
+// RegisterUser creates a normal (non-appservice) user with the given localpart and password.
+func (hs *Homeserver) RegisterUser(localpart, password string) (id.UserID, error) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	userID := id.NewUserID(localpart, hs.Domain)
+	if _, exists := hs.users[userID]; exists {
+		return "", errUserInUse
+	}
+	hs.users[userID] = &user{id: userID, password: password}
+	return userID, nil
+}
+
+// NewClient logs in as the given user with a new device and returns a client that uses the new access token.
+func (hs *Homeserver) NewClient(userID id.UserID) (*mautrix.Client, error) {
+	hs.lock.Lock()
+	if _, exists := hs.users[userID]; !exists {
+		hs.lock.Unlock()
+		return nil, fmt.Errorf("user %s doesn't exist", userID)
+	}
+	dev := hs.newDevice(userID, "")
+	hs.lock.Unlock()
+	client, err := mautrix.NewClient(hs.URL, userID, dev.accessToken)
+	if err != nil {
+		return nil, err
+	}
+	client.DeviceID = dev.deviceID
+	return client, nil
+}
+
+// newDevice creates a new device with a new access token for the given user, replacing the existing device
+// with the same ID if there is one. The lock must be held when calling this.
+func (hs *Homeserver) newDevice(userID id.UserID, deviceID id.DeviceID) *device {
+	if len(deviceID) == 0 {
+		deviceID = id.DeviceID(appservice.RandomString(10))
+	}
+	for token, dev := range hs.devices {
+		if dev.userID == userID && dev.deviceID == deviceID {
+			delete(hs.devices, token)
+		}
+	}
+	dev := &device{
+		userID:      userID,
+		deviceID:    deviceID,
+		accessToken: "syt_" + appservice.RandomString(32),
+	}
+	hs.devices[dev.accessToken] = dev
+	return dev
+}
+
+// notifyChanged wakes up all syncs that are waiting for new data. The lock must be held when calling this.
+func (hs *Homeserver) notifyChanged() {
+	close(hs.changed)
+	hs.changed = make(chan struct{})
+}
+
+// isInterested checks if the appservice should receive the given event. The lock must be held when calling this.
+func (hs *Homeserver) isInterested(rm *room, evt *event.Event) bool {
+	reg := hs.Registration
+	if reg == nil {
+		return false
+	} else if hs.isAppServiceUser(evt.Sender) || reg.IsRoomInNamespace(rm.id) {
+		return true
+	} else if evt.Type == event.StateMember && hs.isAppServiceUser(id.UserID(evt.GetStateKey())) {
+		return true
+	}
+	if aliasEvt := rm.getState(event.StateCanonicalAlias, ""); aliasEvt != nil {
+		if alias, ok := aliasEvt.Content.Raw["alias"].(string); ok && reg.IsAliasInNamespace(id.RoomAlias(alias)) {
+			return true
+		}
+	}
+	for userID, member := range rm.state[event.StateMember.Type] {
+		membership := member.Content.AsMember().Membership
+		if (membership == event.MembershipJoin || membership == event.MembershipInvite) && hs.isAppServiceUser(id.UserID(userID)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAppServiceUser checks if the user is the appservice's sender user or in its user namespace.
+func (hs *Homeserver) isAppServiceUser(userID id.UserID) bool {
+	return userID == id.NewUserID(hs.Registration.SenderLocalpart, hs.Domain) || hs.Registration.IsUserInNamespace(userID)
+}
+
+// queueEphemeral queues an ephemeral event to be sent to the appservice, if the appservice has
+// enabled ephemeral events. The lock must be held when calling this.
+func (hs *Homeserver) queueEphemeral(evt *event.Event) {
+	if hs.Registration == nil || !hs.Registration.EphemeralEvents {
+		return
+	}
+	hs.pendingEphemeral = append(hs.pendingEphemeral, evt)
+}
+
+// hasPendingEvents checks if there are events waiting to be pushed. The lock must be held when calling this.
+func (hs *Homeserver) hasPendingEvents() bool {
+	return len(hs.pendingEvents) > 0 || len(hs.pendingEphemeral) > 0
+}
+
+// startAutoPush starts the background pusher if there are pending events and it isn't running already.
+func (hs *Homeserver) startAutoPush() {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if hs.autoPushing || !hs.hasPendingEvents() {
+		return
+	}
+	hs.autoPushing = true
+	go hs.autoPush()
+}
+
+// autoPush pushes transactions until there are no pending events left. If the appservice rejects a transaction,
+// the events are kept and the pusher is started again after the next client-server API request.
+func (hs *Homeserver) autoPush() {
+	for {
+		err := hs.PushTransactions()
+		hs.lock.Lock()
+		if err != nil || !hs.hasPendingEvents() {
+			hs.autoPushing = false
+			hs.pushCond.Broadcast()
+			hs.lock.Unlock()
+			return
+		}
+		hs.lock.Unlock()
+	}
+}
+
+// WaitForPush waits until the background pusher started by AutoPush has pushed all pending events,
+// or until it has stopped because the appservice rejected a transaction.
+func (hs *Homeserver) WaitForPush() {
+	hs.lock.Lock()
+	for hs.autoPushing {
+		hs.pushCond.Wait()
+	}
+	hs.lock.Unlock()
+}
+
+// PushTransactions sends all pending events to the appservice in a single transaction. If another transaction is
+// being sent, this waits for it to finish first, so transactions are always delivered in order. If the appservice
+// doesn't accept the transaction, the events are kept and sent again on the next call.
+func (hs *Homeserver) PushTransactions() error {
+	hs.lock.Lock()
+	for hs.pushing {
+		hs.pushCond.Wait()
+	}
+	if !hs.hasPendingEvents() {
+		hs.lock.Unlock()
+		return nil
+	} else if hs.Registration == nil {
+		hs.lock.Unlock()
+		return fmt.Errorf("no appservice registered")
+	}
+	txn := &appservice.Transaction{
+		Events:          hs.pendingEvents,
+		EphemeralEvents: hs.pendingEphemeral,
+	}
+	if txn.Events == nil {
+		txn.Events = []*event.Event{}
+	}
+	body, err := json.Marshal(txn)
+	if err != nil {
+		hs.lock.Unlock()
+		return err
+	}
+	hs.pendingEvents = nil
+	hs.pendingEphemeral = nil
+	hs.pushing = true
+	hs.txnCounter++
+	path := "/_matrix/app/v1/transactions/" + strconv.Itoa(hs.txnCounter)
+	hs.lock.Unlock()
+
+	// No locks are held while the appservice handles the transaction, as it may call the homeserver.
+	status, respBody, err := hs.sendToAppService(http.MethodPut, path, body)
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("appservice returned HTTP %d for transaction: %s", status, respBody)
+	}
+	hs.lock.Lock()
+	if err != nil {
+		hs.pendingEvents = append(txn.Events, hs.pendingEvents...)
+		hs.pendingEphemeral = append(txn.EphemeralEvents, hs.pendingEphemeral...)
+	} else {
+		hs.delivered = append(hs.delivered, txn)
+	}
+	hs.pushing = false
+	hs.pushCond.Broadcast()
+	hs.lock.Unlock()
+	return err
+}
+
+func (hs *Homeserver) sendToAppService(method, path string, body []byte) (int, []byte, error) {
+	var req *http.Request
+	var err error
+	if hs.AppService != nil {
+		req = httptest.NewRequest(method, path, bytes.NewReader(body))
+	} else {
+		req, err = http.NewRequest(method, hs.Registration.URL+path, bytes.NewReader(body))
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	req.Header.Set("Authorization", "Bearer "+hs.Registration.ServerToken)
+	req.Header.Set("Content-Type", "application/json")
+	if hs.AppService != nil {
+		w := httptest.NewRecorder()
+		hs.AppService.ServeHTTP(w, req)
+		return w.Code, w.Body.Bytes(), nil
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(resp.Body)
+	return resp.StatusCode, buf.Bytes(), err
+}
+
+// DeliveredTransactions returns the transactions that have been successfully pushed to the appservice.
+func (hs *Homeserver) DeliveredTransactions() []*appservice.Transaction {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	txns := make([]*appservice.Transaction, len(hs.delivered))
+	copy(txns, hs.delivered)
+	return txns
+}
+
+// Timeline returns all events in the given room in the order they were sent.
+// The returned events are shared with the homeserver and must not be modified.
+func (hs *Homeserver) Timeline(roomID id.RoomID) []*event.Event {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	rm, ok := hs.rooms[roomID]
+	if !ok {
+		return nil
+	}
+	timeline := make([]*event.Event, len(rm.timeline))
+	copy(timeline, rm.timeline)
+	return timeline
+}
+
+// RoomState returns the current state event with the given type and state key, or nil if there isn't one.
+// The returned event is shared with the homeserver and must not be modified.
+func (hs *Homeserver) RoomState(roomID id.RoomID, evtType event.Type, stateKey string) *event.Event {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	rm, ok := hs.rooms[roomID]
+	if !ok {
+		return nil
+	}
+	return rm.getState(evtType, stateKey)
+}
+
+// Membership returns the current membership of the given user in the given room.
+func (hs *Homeserver) Membership(roomID id.RoomID, userID id.UserID) event.Membership {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	rm, ok := hs.rooms[roomID]
+	if !ok {
+		return event.MembershipLeave
+	}
+	return rm.membership(userID)
+}
+
+// Profile returns the global profile of the given user. The last return value is false if the user doesn't exist.
+func (hs *Homeserver) Profile(userID id.UserID) (displayName string, avatarURL id.ContentURIString, ok bool) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	u, ok := hs.users[userID]
+	if !ok {
+		return "", "", false
+	}
+	return u.displayName, u.avatarURL, true
+}
+
+// IsRegistered checks if the given user exists on the homeserver.
+func (hs *Homeserver) IsRegistered(userID id.UserID) bool {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	_, ok := hs.users[userID]
+	return ok
+}
+
+// Media returns the data and content type of uploaded media. The last return value is false if the media doesn't exist.
+func (hs *Homeserver) Media(uri id.ContentURI) (data []byte, contentType string, ok bool) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if uri.Homeserver != hs.Domain {
+		return nil, "", false
+	}
+	media, ok := hs.media[uri.FileID]
+	if !ok {
+		return nil, "", false
+	}
+	return media.data, media.contentType, true
+}
+
+// CreateRoom creates a room as the given user, like the /createRoom endpoint.
+func (hs *Homeserver) CreateRoom(creator id.UserID, req *mautrix.ReqCreateRoom) (id.RoomID, error) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	return hs.createRoom(creator, req, time.Now().UnixMilli())
+}
+
+// SendMessageEvent sends a message event to a room as the given user. The user must be joined to the room.
+// This can be used to simulate users that aren't controlled by the code being tested.
+func (hs *Homeserver) SendMessageEvent(roomID id.RoomID, sender id.UserID, evtType event.Type, content interface{}) (id.EventID, error) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	evt, err := hs.sendEvent(roomID, sender, evtType, nil, content, time.Now().UnixMilli())
+	if err != nil {
+		return "", err
+	}
+	return evt.ID, nil
+}
+
+// SendStateEvent sends a state event to a room as the given user. The user must be joined to the room and have
+// a sufficient power level. Membership events should be sent with SetMembership instead.
+func (hs *Homeserver) SendStateEvent(roomID id.RoomID, sender id.UserID, evtType event.Type, stateKey string, content interface{}) (id.EventID, error) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	evt, err := hs.sendEvent(roomID, sender, evtType, &stateKey, content, time.Now().UnixMilli())
+	if err != nil {
+		return "", err
+	}
+	return evt.ID, nil
+}
+
+// SetMembership changes the membership of the target user in the room, using the same rules as the membership
+// endpoints: joining and leaving are done by the target themselves, while inviting, kicking, banning and
+// unbanning are done by the sender.
+func (hs *Homeserver) SetMembership(roomID id.RoomID, sender, target id.UserID, membership event.Membership, reason string) error {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	rm, err := hs.getRoom(roomID)
+	if err != nil {
+		return err
+	}
+	_, err = hs.changeMembership(rm, sender, target, membership, reason, false, time.Now().UnixMilli())
+	return err
+}
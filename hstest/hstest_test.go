@@ -0,0 +1,275 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hstest
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func newTestAppService(t *testing.T) (*Homeserver, *appservice.AppService) {
+	reg := &appservice.Registration{
+		ID:              "test",
+		AppToken:        "as_token",
+		ServerToken:     "hs_token",
+		SenderLocalpart: "bot",
+		EphemeralEvents: true,
+	}
+	reg.Namespaces.UserIDs.Register(regexp.MustCompile(`@ghost_.+:example\.com`), true)
+	hs := New("example.com", reg)
+	t.Cleanup(hs.Close)
+
+	as := appservice.Create()
+	as.Log = maulogger.Create()
+	as.Log.(*maulogger.BasicLogger).PrintLevel = maulogger.LevelError.Severity
+	as.Events = make(chan *event.Event, appservice.EventChannelSize)
+	hs.ConnectAppService(as)
+	return hs, as
+}
+
+func collectEvents(as *appservice.AppService) (evts []*event.Event) {
+	for {
+		select {
+		case evt := <-as.Events:
+			evts = append(evts, evt)
+		default:
+			return
+		}
+	}
+}
+
+func TestHomeserver_AppService(t *testing.T) {
+	hs, as := newTestAppService(t)
+	userID, err := hs.RegisterUser("alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roomID, err := hs.CreateRoom(userID, &mautrix.ReqCreateRoom{Name: "Test room", Preset: "public_chat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ghost := as.Intent("@ghost_1:example.com")
+	if err = ghost.EnsureJoined(roomID); err != nil {
+		t.Fatalf("Failed to join ghost: %v", err)
+	} else if !hs.IsRegistered(ghost.UserID) {
+		t.Error("Expected ghost to be registered")
+	} else if hs.Membership(roomID, ghost.UserID) != event.MembershipJoin {
+		t.Error("Expected ghost to be joined")
+	}
+	if err = ghost.SetDisplayName("Ghost"); err != nil {
+		t.Fatalf("Failed to set displayname: %v", err)
+	}
+	member := hs.RoomState(roomID, event.StateMember, string(ghost.UserID))
+	if member == nil || member.Content.AsMember().Displayname != "Ghost" {
+		t.Errorf("Expected member event to have the new displayname, got %+v", member)
+	}
+	resp, err := ghost.SendText(roomID, "Hello")
+	if err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if err = hs.SetMembership(roomID, userID, "@ghost_2:example.com", event.MembershipBan, "Spam"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = as.Intent("@ghost_2:example.com").SendText(roomID, "Hi")
+	if !errors.Is(err, mautrix.MForbidden) {
+		t.Errorf("Expected M_FORBIDDEN for banned ghost, got %v", err)
+	}
+	_, err = as.Intent("@alice:example.com").SendText(roomID, "Hi")
+	if !errors.Is(err, mautrix.MExclusive) {
+		t.Errorf("Expected M_EXCLUSIVE when masquerading outside of namespace, got %v", err)
+	}
+
+	_, err = hs.SendMessageEvent(roomID, userID, event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "Hey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = hs.PushTransactions(); err != nil {
+		t.Fatalf("Failed to push transactions: %v", err)
+	}
+	var received []id.EventID
+	for _, evt := range collectEvents(as) {
+		if evt.Type == event.EventMessage {
+			received = append(received, evt.ID)
+		}
+	}
+	timeline := hs.Timeline(roomID)
+	if len(received) != 2 || received[0] != resp.EventID || received[1] != timeline[len(timeline)-1].ID {
+		t.Errorf("Expected appservice to receive both messages, got %v", received)
+	}
+	if len(hs.DeliveredTransactions()) != 1 {
+		t.Errorf("Expected 1 delivered transaction, got %d", len(hs.DeliveredTransactions()))
+	}
+	if _, err = as.Ping(); err != nil {
+		t.Errorf("Failed to ping appservice: %v", err)
+	}
+}
+
+func TestHomeserver_ClientSync(t *testing.T) {
+	hs, as := newTestAppService(t)
+	hs.AutoPush = true
+	userID, _ := hs.RegisterUser("alice", "password")
+	client, err := hs.NewClient(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot := as.BotIntent()
+	createResp, err := bot.CreateRoom(&mautrix.ReqCreateRoom{Invite: []id.UserID{userID}, Topic: "Topic"})
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	roomID := createResp.RoomID
+
+	syncResp, err := client.SyncRequest(0, "", "", false, "", nil)
+	if err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	} else if _, ok := syncResp.Rooms.Invite[roomID]; !ok {
+		t.Fatalf("Expected invite to %s in sync, got %+v", roomID, syncResp.Rooms)
+	}
+	if _, err = client.JoinRoomByID(roomID); err != nil {
+		t.Fatalf("Failed to join room: %v", err)
+	}
+	if _, err = bot.SendText(roomID, "Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	syncResp, err = client.SyncRequest(1000, syncResp.NextBatch, "", false, "", nil)
+	if err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	joined, ok := syncResp.Rooms.Join[roomID]
+	if !ok || len(joined.Timeline.Events) != 2 || joined.Timeline.Events[1].Content.Raw["body"] != "Welcome" {
+		t.Fatalf("Expected join and message in sync, got %+v", syncResp.Rooms)
+	}
+
+	// The appservice gets the user's join and the topic through automatically pushed transactions
+	hs.WaitForPush()
+	if !as.StateStore.IsInRoom(roomID, userID) {
+		t.Error("Expected appservice state store to have the user's join")
+	}
+	if topic := hs.RoomState(roomID, event.StateTopic, ""); topic == nil || topic.Content.AsTopic().Topic != "Topic" {
+		t.Errorf("Expected room to have topic, got %+v", topic)
+	}
+
+	_, err = bot.SendToDevice(event.ToDeviceRoomKeyRequest, &mautrix.ReqSendToDevice{
+		Messages: map[id.UserID]map[id.DeviceID]*event.Content{
+			userID: {"*": {Raw: map[string]interface{}{"action": "request_cancellation"}}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to send to-device event: %v", err)
+	}
+	syncResp, err = client.SyncRequest(0, syncResp.NextBatch, "", false, "", nil)
+	if err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	} else if len(syncResp.ToDevice.Events) != 1 || syncResp.ToDevice.Events[0].Sender != bot.UserID {
+		t.Errorf("Expected to-device event in sync, got %+v", syncResp.ToDevice.Events)
+	}
+
+	if _, err = client.LeaveRoom(roomID); err != nil {
+		t.Fatal(err)
+	}
+	syncResp, err = client.SyncRequest(0, syncResp.NextBatch, "", false, "", nil)
+	if err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	} else if _, ok = syncResp.Rooms.Leave[roomID]; !ok {
+		t.Errorf("Expected room in leave section of sync, got %+v", syncResp.Rooms)
+	}
+}
+
+func TestHomeserver_AutoPushFullChannel(t *testing.T) {
+	hs, as := newTestAppService(t)
+	hs.AutoPush = true
+	as.Events = make(chan *event.Event, 1)
+	bot := as.BotIntent()
+
+	// Client requests must not wait for the appservice, even if it's blocked on a full event channel
+	sent := make(chan error, 1)
+	var roomID id.RoomID
+	go func() {
+		createResp, err := bot.CreateRoom(&mautrix.ReqCreateRoom{})
+		if err != nil {
+			sent <- err
+			return
+		}
+		roomID = createResp.RoomID
+		for i := 0; i < 5; i++ {
+			if _, err = bot.SendText(roomID, strconv.Itoa(i)); err != nil {
+				break
+			}
+		}
+		sent <- err
+	}()
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatalf("Failed to send messages: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client requests blocked while the appservice event channel was full")
+	}
+
+	// Handling events may call the homeserver, which must not deadlock with the pusher
+	var received []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for evt := range as.Events {
+			if evt.Type != event.EventMessage {
+				continue
+			}
+			if _, err := bot.JoinedRooms(); err != nil {
+				t.Errorf("Failed to make request while handling event: %v", err)
+			}
+			received = append(received, evt.Content.Raw["body"].(string))
+			if len(received) == 5 {
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for pushed events, got %v", received)
+	}
+	hs.WaitForPush()
+	for i, body := range received {
+		if body != strconv.Itoa(i) {
+			t.Errorf("Expected messages to be pushed in order, got %v", received)
+			break
+		}
+	}
+}
+
+func TestHomeserver_Media(t *testing.T) {
+	hs, as := newTestAppService(t)
+	data := []byte("hello world")
+	resp, err := as.BotClient().UploadBytes(data, "text/plain")
+	if err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	stored, contentType, ok := hs.Media(resp.ContentURI)
+	if !ok || !bytes.Equal(stored, data) || contentType != "text/plain" {
+		t.Errorf("Unexpected stored media %q (%s)", stored, contentType)
+	}
+	downloaded, err := as.BotClient().DownloadBytes(resp.ContentURI)
+	if err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	} else if !bytes.Equal(downloaded, data) {
+		t.Errorf("Expected downloaded media to match, got %q", downloaded)
+	}
+}
@@ -0,0 +1,325 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package hstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// respError is a Matrix error with an HTTP status code. errors.Is can be used to compare
+// it to the error codes defined in the mautrix package, e.g. mautrix.MForbidden.
+type respError struct {
+	status  int
+	errcode string
+	message string
+}
+
+func newError(status int, errcode, format string, args ...interface{}) *respError {
+	return &respError{status: status, errcode: errcode, message: fmt.Sprintf(format, args...)}
+}
+
+func (re *respError) Error() string {
+	return re.errcode + ": " + re.message
+}
+
+func (re *respError) Is(target error) bool {
+	targetErr, ok := target.(mautrix.RespError)
+	return ok && targetErr.ErrCode == re.errcode
+}
+
+var (
+	errUserInUse = newError(http.StatusBadRequest, "M_USER_IN_USE", "User ID already taken")
+	errNotJoined = newError(http.StatusForbidden, "M_FORBIDDEN", "User is not in the room")
+)
+
+func (rm *room) getState(evtType event.Type, stateKey string) *event.Event {
+	return rm.state[evtType.Type][stateKey]
+}
+
+func (rm *room) membership(userID id.UserID) event.Membership {
+	memberEvt := rm.getState(event.StateMember, string(userID))
+	if memberEvt == nil {
+		return event.MembershipLeave
+	}
+	return memberEvt.Content.AsMember().Membership
+}
+
+func (rm *room) powerLevels() *event.PowerLevelsEventContent {
+	plEvt := rm.getState(event.StatePowerLevels, "")
+	if plEvt == nil {
+		return &event.PowerLevelsEventContent{}
+	}
+	return plEvt.Content.AsPowerLevels()
+}
+
+// getRoom returns the room with the given ID. The lock must be held when calling this.
+func (hs *Homeserver) getRoom(roomID id.RoomID) (*room, error) {
+	rm, ok := hs.rooms[roomID]
+	if !ok {
+		return nil, newError(http.StatusNotFound, "M_NOT_FOUND", "Unknown room %s", roomID)
+	}
+	return rm, nil
+}
+
+// addEvent creates an event and adds it to the room without any authorization checks.
+// The lock must be held when calling this.
+func (hs *Homeserver) addEvent(rm *room, sender id.UserID, evtType event.Type, stateKey *string, content interface{}, ts int64) (*event.Event, error) {
+	rawContent, err := json.Marshal(content)
+	if err != nil {
+		return nil, newError(http.StatusBadRequest, "M_BAD_JSON", "Failed to encode content: %v", err)
+	}
+	if stateKey != nil {
+		evtType.Class = event.StateEventType
+	} else {
+		evtType.Class = event.MessageEventType
+	}
+	evt := &event.Event{
+		StateKey:  stateKey,
+		Sender:    sender,
+		Type:      evtType,
+		Timestamp: ts,
+		ID:        id.EventID("$" + appservice.RandomString(43)),
+		RoomID:    rm.id,
+	}
+	err = json.Unmarshal(rawContent, &evt.Content)
+	if err != nil || evt.Content.Raw == nil {
+		return nil, newError(http.StatusBadRequest, "M_BAD_JSON", "Content must be a JSON object")
+	}
+	// Parsing errors are ignored, unknown event types are fine and just won't have parsed content.
+	_ = evt.Content.ParseRaw(evtType)
+	if stateKey != nil {
+		if prevEvt := rm.getState(evtType, *stateKey); prevEvt != nil {
+			evt.Unsigned.PrevContent = &prevEvt.Content
+		}
+		stateOfType, ok := rm.state[evtType.Type]
+		if !ok {
+			stateOfType = make(map[string]*event.Event)
+			rm.state[evtType.Type] = stateOfType
+		}
+		stateOfType[*stateKey] = evt
+	}
+	rm.timeline = append(rm.timeline, evt)
+	hs.stream = append(hs.stream, evt)
+	// Interest is checked after updating the state, so that the appservice gets the invites and joins of its users
+	if hs.isInterested(rm, evt) {
+		hs.pendingEvents = append(hs.pendingEvents, evt)
+	}
+	hs.notifyChanged()
+	return evt, nil
+}
+
+// sendEvent sends a non-membership event after checking that the sender is allowed to send it.
+// The lock must be held when calling this.
+func (hs *Homeserver) sendEvent(roomID id.RoomID, sender id.UserID, evtType event.Type, stateKey *string, content interface{}, ts int64) (*event.Event, error) {
+	rm, err := hs.getRoom(roomID)
+	if err != nil {
+		return nil, err
+	} else if rm.membership(sender) != event.MembershipJoin {
+		return nil, errNotJoined
+	}
+	if stateKey != nil {
+		if evtType.Type == event.StateMember.Type {
+			return nil, newError(http.StatusBadRequest, "M_BAD_JSON", "Use the membership endpoints to change memberships")
+		}
+		evtType.Class = event.StateEventType
+	} else {
+		evtType.Class = event.MessageEventType
+	}
+	pl := rm.powerLevels()
+	if pl.GetUserLevel(sender) < pl.GetEventLevel(evtType) {
+		return nil, newError(http.StatusForbidden, "M_FORBIDDEN", "Insufficient power level to send %s", evtType.Type)
+	}
+	return hs.addEvent(rm, sender, evtType, stateKey, content, ts)
+}
+
+func (hs *Homeserver) memberContent(userID id.UserID, membership event.Membership, reason string, isDirect bool) *event.MemberEventContent {
+	content := &event.MemberEventContent{
+		Membership: membership,
+		Reason:     reason,
+		IsDirect:   isDirect,
+	}
+	if u, ok := hs.users[userID]; ok && (membership == event.MembershipJoin || membership == event.MembershipInvite) {
+		content.Displayname = u.displayName
+		content.AvatarURL = u.avatarURL
+	}
+	return content
+}
+
+// changeMembership changes the membership of the target user after checking the rules for the membership change.
+// The lock must be held when calling this.
+func (hs *Homeserver) changeMembership(rm *room, sender, target id.UserID, membership event.Membership, reason string, isDirect bool, ts int64) (*event.Event, error) {
+	// Banning and kicking users who don't exist is allowed, e.g. to preemptively ban users
+	_, exists := hs.users[target]
+	if !exists && target.Homeserver() == hs.Domain && (membership == event.MembershipJoin || membership == event.MembershipInvite) {
+		return nil, newError(http.StatusNotFound, "M_NOT_FOUND", "User %s doesn't exist", target)
+	}
+	current := rm.membership(target)
+	senderMembership := rm.membership(sender)
+	pl := rm.powerLevels()
+	senderLevel := pl.GetUserLevel(sender)
+	forbidden := func(format string, args ...interface{}) (*event.Event, error) {
+		return nil, newError(http.StatusForbidden, "M_FORBIDDEN", format, args...)
+	}
+	switch membership {
+	case event.MembershipJoin:
+		if sender != target {
+			return forbidden("Can't join on behalf of another user")
+		} else if current == event.MembershipBan {
+			return forbidden("You are banned from the room")
+		} else if current != event.MembershipInvite && current != event.MembershipJoin && hs.joinRule(rm) != event.JoinRulePublic {
+			return forbidden("You are not invited to this room.")
+		}
+	case event.MembershipInvite:
+		if senderMembership != event.MembershipJoin {
+			return forbidden("You are not in the room")
+		} else if current == event.MembershipJoin {
+			return forbidden("%s is already in the room.", target)
+		} else if current == event.MembershipBan {
+			return forbidden("%s is banned from the room", target)
+		} else if senderLevel < pl.Invite() {
+			return forbidden("You don't have permission to invite users")
+		}
+	case event.MembershipLeave:
+		if sender == target {
+			if current != event.MembershipJoin && current != event.MembershipInvite {
+				return forbidden("You are not in the room")
+			}
+		} else if current == event.MembershipBan {
+			if senderLevel < pl.Ban() {
+				return forbidden("You don't have permission to unban users")
+			}
+		} else if current != event.MembershipJoin && current != event.MembershipInvite {
+			return forbidden("%s is not in the room", target)
+		} else if senderMembership != event.MembershipJoin || senderLevel < pl.Kick() || senderLevel <= pl.GetUserLevel(target) {
+			return forbidden("You don't have permission to kick %s", target)
+		}
+	case event.MembershipBan:
+		if senderMembership != event.MembershipJoin || senderLevel < pl.Ban() || senderLevel <= pl.GetUserLevel(target) {
+			return forbidden("You don't have permission to ban %s", target)
+		}
+	default:
+		return nil, newError(http.StatusBadRequest, "M_BAD_JSON", "Unsupported membership %s", membership)
+	}
+	stateKey := string(target)
+	return hs.addEvent(rm, sender, event.StateMember, &stateKey, hs.memberContent(target, membership, reason, isDirect), ts)
+}
+
+func (hs *Homeserver) joinRule(rm *room) event.JoinRule {
+	evt := rm.getState(event.StateJoinRules, "")
+	if evt == nil {
+		return event.JoinRuleInvite
+	}
+	return evt.Content.AsJoinRules().JoinRule
+}
+
+// createRoom creates a room like the /createRoom endpoint. The lock must be held when calling this.
+func (hs *Homeserver) createRoom(creator id.UserID, req *mautrix.ReqCreateRoom, ts int64) (id.RoomID, error) {
+	var alias id.RoomAlias
+	if len(req.RoomAliasName) > 0 {
+		alias = id.NewRoomAlias(req.RoomAliasName, hs.Domain)
+		if _, exists := hs.aliases[alias]; exists {
+			return "", newError(http.StatusBadRequest, "M_ROOM_IN_USE", "Room alias already taken")
+		}
+	}
+	rm := &room{
+		id:     id.RoomID(fmt.Sprintf("!%s:%s", appservice.RandomString(18), hs.Domain)),
+		state:  make(map[string]map[string]*event.Event),
+		typing: make(map[id.UserID]struct{}),
+	}
+	hs.rooms[rm.id] = rm
+
+	emptyKey := ""
+	addState := func(evtType event.Type, stateKey string, content interface{}) error {
+		_, err := hs.addEvent(rm, creator, evtType, &stateKey, content, ts)
+		return err
+	}
+	createContent := map[string]interface{}{}
+	for key, value := range req.CreationContent {
+		createContent[key] = value
+	}
+	createContent["creator"] = creator
+	if _, ok := createContent["room_version"]; !ok {
+		createContent["room_version"] = "9"
+	}
+	joinRule := event.JoinRuleInvite
+	if req.Preset == "public_chat" || (len(req.Preset) == 0 && req.Visibility == "public") {
+		joinRule = event.JoinRulePublic
+	}
+	pl := &event.PowerLevelsEventContent{
+		Users: map[id.UserID]int{creator: 100},
+	}
+	if joinRule == event.JoinRuleInvite {
+		// Like Synapse, allow everyone to invite in private rooms
+		inviteLevel := 0
+		pl.InvitePtr = &inviteLevel
+	}
+	if req.PowerLevelOverride != nil {
+		overrideData, _ := json.Marshal(req.PowerLevelOverride)
+		_ = json.Unmarshal(overrideData, pl)
+	}
+
+	err := addState(event.StateCreate, emptyKey, createContent)
+	if err == nil {
+		err = addState(event.StateMember, string(creator), hs.memberContent(creator, event.MembershipJoin, "", false))
+	}
+	if err == nil {
+		err = addState(event.StatePowerLevels, emptyKey, pl)
+	}
+	if err == nil {
+		err = addState(event.StateJoinRules, emptyKey, &event.JoinRulesEventContent{JoinRule: joinRule})
+	}
+	if err == nil {
+		err = addState(event.StateHistoryVisibility, emptyKey, &event.HistoryVisibilityEventContent{HistoryVisibility: event.HistoryVisibilityShared})
+	}
+	if err == nil && len(alias) > 0 {
+		hs.aliases[alias] = rm.id
+		err = addState(event.StateCanonicalAlias, emptyKey, &event.CanonicalAliasEventContent{Alias: alias})
+	}
+	for i := 0; err == nil && i < len(req.InitialState); i++ {
+		evt := req.InitialState[i]
+		err = addState(event.Type{Type: evt.Type.Type}, evt.GetStateKey(), &evt.Content)
+	}
+	if err == nil && len(req.Name) > 0 {
+		err = addState(event.StateRoomName, emptyKey, &event.RoomNameEventContent{Name: req.Name})
+	}
+	if err == nil && len(req.Topic) > 0 {
+		err = addState(event.StateTopic, emptyKey, &event.TopicEventContent{Topic: req.Topic})
+	}
+	for i := 0; err == nil && i < len(req.Invite); i++ {
+		_, err = hs.changeMembership(rm, creator, req.Invite[i], event.MembershipInvite, "", req.IsDirect, ts)
+	}
+	if err != nil {
+		return "", err
+	}
+	return rm.id, nil
+}
+
+// updateProfileInRooms sends new member events with the current profile to all rooms the user is joined to.
+// The lock must be held when calling this.
+func (hs *Homeserver) updateProfileInRooms(u *user, ts int64) {
+	for _, rm := range hs.rooms {
+		memberEvt := rm.getState(event.StateMember, string(u.id))
+		if memberEvt == nil || memberEvt.Content.AsMember().Membership != event.MembershipJoin {
+			continue
+		}
+		content := *memberEvt.Content.AsMember()
+		if content.Displayname == u.displayName && content.AvatarURL == u.avatarURL {
+			continue
+		}
+		content.Displayname = u.displayName
+		content.AvatarURL = u.avatarURL
+		stateKey := string(u.id)
+		_, _ = hs.addEvent(rm, u.id, event.StateMember, &stateKey, &content, ts)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package id
+
+import (
+	"fmt"
+)
+
+// TrustState describes how much the sender of an encrypted event can be trusted.
+//
+// Higher values mean more trust, so trust states can be compared with the normal comparison operators.
+type TrustState int
+
+const (
+	// TrustStateBlacklisted means the sender device has been blacklisted.
+	TrustStateBlacklisted TrustState = -100
+	// TrustStateUnset means the sender device isn't verified or cross-signed.
+	TrustStateUnset TrustState = 0
+	// TrustStateUnknownDevice means the sender device couldn't be found or its keys don't match the session.
+	TrustStateUnknownDevice TrustState = 10
+	// TrustStateForwardedKeys means the session keys were forwarded or imported, so the sender can't be authenticated.
+	TrustStateForwardedKeys TrustState = 20
+	// TrustStateCrossSignedUntrusted means the device is cross-signed, but the user's master key has changed since it was pinned.
+	TrustStateCrossSignedUntrusted TrustState = 50
+	// TrustStateCrossSignedTOFU means the device is cross-signed by the master key that was pinned on first use.
+	TrustStateCrossSignedTOFU TrustState = 100
+	// TrustStateCrossSignedVerified means the device is cross-signed by a master key that we have verified.
+	TrustStateCrossSignedVerified TrustState = 200
+	// TrustStateVerified means the device itself has been verified.
+	TrustStateVerified TrustState = 300
+)
+
+func (ts TrustState) String() string {
+	switch ts {
+	case TrustStateBlacklisted:
+		return "blacklisted"
+	case TrustStateUnset:
+		return "unverified"
+	case TrustStateUnknownDevice:
+		return "unknown-device"
+	case TrustStateForwardedKeys:
+		return "forwarded-keys"
+	case TrustStateCrossSignedUntrusted:
+		return "cross-signed-untrusted"
+	case TrustStateCrossSignedTOFU:
+		return "cross-signed-tofu"
+	case TrustStateCrossSignedVerified:
+		return "cross-signed-verified"
+	case TrustStateVerified:
+		return "verified"
+	default:
+		return fmt.Sprintf("TrustState(%d)", int(ts))
+	}
+}
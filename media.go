@@ -0,0 +1,247 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrNoMediaContent   = errors.New("no content given to upload")
+	ErrNoMediaURL       = errors.New("message doesn't contain a media URL")
+	ErrNoMediaThumbnail = errors.New("message doesn't contain a thumbnail")
+)
+
+// UploadEncryptedMedia encrypts the given data with a new random key and uploads the ciphertext to the content repository.
+//
+// The content type and file name in the request are not sent to the server, as they would leak metadata about the file.
+// If the data is given as an io.Reader, it's encrypted while streaming and closed after the upload if it's an io.ReadCloser.
+// The returned EncryptedFileInfo contains everything needed to decrypt the file and can be put directly in the file field
+// of a message.
+func (cli *Client) UploadEncryptedMedia(data ReqUploadMedia) (*event.EncryptedFileInfo, error) {
+	file := attachment.NewEncryptedFile()
+	var encryptStream io.ReadCloser
+	if data.ContentBytes != nil {
+		ciphertext := make([]byte, len(data.ContentBytes))
+		copy(ciphertext, data.ContentBytes)
+		file.EncryptInPlace(ciphertext)
+		data.ContentBytes = ciphertext
+	} else if data.Content != nil {
+		encryptStream = file.EncryptStream(data.Content)
+		// Hide the Close method so that the HTTP client doesn't finalize the stream before we read the hash.
+		data.Content = struct{ io.Reader }{encryptStream}
+	} else {
+		return nil, ErrNoMediaContent
+	}
+	data.ContentType = "application/octet-stream"
+	data.FileName = ""
+	resp, err := cli.UploadMedia(data)
+	if encryptStream != nil {
+		closeErr := encryptStream.Close()
+		if err == nil && closeErr != nil {
+			err = fmt.Errorf("failed to finalize encrypted upload: %w", closeErr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &event.EncryptedFileInfo{
+		EncryptedFile: *file,
+		URL:           resp.ContentURI.CUString(),
+	}, nil
+}
+
+// ReqUploadMessageMedia contains the parameters for UploadMessageMedia.
+type ReqUploadMessageMedia struct {
+	// The media itself. FileName is used as the body of the message and ContentType as the mime type.
+	ReqUploadMedia
+	// The message type to use, defaults to m.file.
+	MsgType event.MessageType
+	// Whether the media should be encrypted, i.e. whether the message will be sent to an encrypted room.
+	Encrypt bool
+	// Optional extra info for the media. The mime type and size are filled automatically if they're not set.
+	Info *event.FileInfo
+
+	// Optional thumbnail to upload alongside the media. The thumbnail is encrypted if the media is encrypted.
+	Thumbnail *ReqUploadMedia
+	// Optional extra info for the thumbnail. The mime type and size are filled automatically if they're not set.
+	ThumbnailInfo *event.FileInfo
+}
+
+func uploadSize(data *ReqUploadMedia) int {
+	if data.ContentBytes != nil {
+		return len(data.ContentBytes)
+	}
+	return int(data.ContentLength)
+}
+
+func (cli *Client) uploadMediaMaybeEncrypted(data ReqUploadMedia, encrypt bool) (id.ContentURIString, *event.EncryptedFileInfo, error) {
+	if encrypt {
+		file, err := cli.UploadEncryptedMedia(data)
+		if err != nil {
+			return "", nil, err
+		}
+		return "", file, nil
+	} else if data.ContentBytes == nil && data.Content == nil {
+		return "", nil, ErrNoMediaContent
+	}
+	resp, err := cli.UploadMedia(data)
+	if err != nil {
+		return "", nil, err
+	}
+	return resp.ContentURI.CUString(), nil, nil
+}
+
+// UploadMessageMedia uploads the given media (and optionally a thumbnail) and returns message content that references it.
+//
+// If Encrypt is set, the media and thumbnail are encrypted before uploading and the file fields of the content are filled.
+// Otherwise, the plain url fields are filled. The returned content can be sent with SendMessageEvent as-is.
+func (cli *Client) UploadMessageMedia(req ReqUploadMessageMedia) (*event.MessageEventContent, error) {
+	content := &event.MessageEventContent{
+		MsgType: req.MsgType,
+		Body:    req.FileName,
+		Info:    req.Info,
+	}
+	if len(content.MsgType) == 0 {
+		content.MsgType = event.MsgFile
+	}
+	if len(content.Body) == 0 {
+		content.Body = "file"
+	}
+	if content.Info == nil {
+		content.Info = &event.FileInfo{}
+	}
+	if len(content.Info.MimeType) == 0 {
+		content.Info.MimeType = req.ContentType
+	}
+	if content.Info.Size == 0 {
+		content.Info.Size = uploadSize(&req.ReqUploadMedia)
+	}
+
+	var err error
+	content.URL, content.File, err = cli.uploadMediaMaybeEncrypted(req.ReqUploadMedia, req.Encrypt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload media: %w", err)
+	}
+
+	if req.Thumbnail != nil {
+		thumbInfo := req.ThumbnailInfo
+		if thumbInfo == nil {
+			thumbInfo = &event.FileInfo{}
+		}
+		if len(thumbInfo.MimeType) == 0 {
+			thumbInfo.MimeType = req.Thumbnail.ContentType
+		}
+		if thumbInfo.Size == 0 {
+			thumbInfo.Size = uploadSize(req.Thumbnail)
+		}
+		content.Info.ThumbnailInfo = thumbInfo
+		content.Info.ThumbnailURL, content.Info.ThumbnailFile, err = cli.uploadMediaMaybeEncrypted(*req.Thumbnail, req.Encrypt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload thumbnail: %w", err)
+		}
+	}
+	return content, nil
+}
+
+// downloadChecked downloads the given content URI like Download, but returns an HTTPError if the response isn't 2xx.
+func (cli *Client) downloadChecked(uri id.ContentURIString) (io.ReadCloser, error) {
+	mxc, err := uri.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse content URI: %w", err)
+	} else if mxc.IsEmpty() {
+		return nil, ErrNoMediaURL
+	}
+	req, err := http.NewRequest(http.MethodGet, cli.GetDownloadURL(mxc), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", cli.UserAgent)
+	res, err := cli.Client.Do(req)
+	if err != nil {
+		return nil, HTTPError{
+			Request:      req,
+			Message:      "request error",
+			WrappedError: err,
+		}
+	} else if res.StatusCode < 200 || res.StatusCode >= 300 {
+		defer res.Body.Close()
+		_, err = cli.handleResponseError(req, res)
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// DownloadEncrypted downloads the given encrypted file and returns a stream of the decrypted data.
+//
+// The hash of the file is validated when the returned stream is closed. If Close returns an error,
+// the data that was read should be discarded.
+func (cli *Client) DownloadEncrypted(file *event.EncryptedFileInfo) (io.ReadCloser, error) {
+	if err := file.PrepareForDecryption(); err != nil {
+		return nil, err
+	}
+	body, err := cli.downloadChecked(file.URL)
+	if err != nil {
+		return nil, err
+	}
+	return file.DecryptStream(body), nil
+}
+
+// DownloadEncryptedBytes downloads the given encrypted file into memory, validates the hash and decrypts it.
+func (cli *Client) DownloadEncryptedBytes(file *event.EncryptedFileInfo) ([]byte, error) {
+	if err := file.PrepareForDecryption(); err != nil {
+		return nil, err
+	}
+	body, err := cli.downloadChecked(file.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	} else if err = file.DecryptInPlace(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (cli *Client) downloadMaybeEncrypted(url id.ContentURIString, file *event.EncryptedFileInfo) ([]byte, error) {
+	if file != nil {
+		return cli.DownloadEncryptedBytes(file)
+	}
+	body, err := cli.downloadChecked(url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// DownloadMessageMedia downloads the media in the given message, decrypting it if necessary.
+func (cli *Client) DownloadMessageMedia(content *event.MessageEventContent) ([]byte, error) {
+	if content.File == nil && len(content.URL) == 0 {
+		return nil, ErrNoMediaURL
+	}
+	return cli.downloadMaybeEncrypted(content.URL, content.File)
+}
+
+// DownloadMessageThumbnail downloads the thumbnail of the media in the given message, decrypting it if necessary.
+func (cli *Client) DownloadMessageThumbnail(content *event.MessageEventContent) ([]byte, error) {
+	if content.Info == nil || (content.Info.ThumbnailFile == nil && len(content.Info.ThumbnailURL) == 0) {
+		return nil, ErrNoMediaThumbnail
+	}
+	return cli.downloadMaybeEncrypted(content.Info.ThumbnailURL, content.Info.ThumbnailFile)
+}
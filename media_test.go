@@ -0,0 +1,134 @@
+package mautrix
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+)
+
+type fakeMediaRepo struct {
+	lock  sync.Mutex
+	files map[string][]byte
+	types map[string]string
+}
+
+func (repo *fakeMediaRepo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/_matrix/media/v3/upload":
+		data, _ := ioutil.ReadAll(r.Body)
+		fileID := string(rune('a' + len(repo.files)))
+		repo.files[fileID] = data
+		repo.types[fileID] = r.Header.Get("Content-Type")
+		_, _ = w.Write([]byte(`{"content_uri": "mxc://example.com/` + fileID + `"}`))
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/_matrix/media/v3/download/example.com/"):
+		data, ok := repo.files[strings.TrimPrefix(r.URL.Path, "/_matrix/media/v3/download/example.com/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Media not found"}`))
+			return
+		}
+		_, _ = w.Write(data)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newMediaTestClient(t *testing.T) (*Client, *fakeMediaRepo) {
+	repo := &fakeMediaRepo{files: make(map[string][]byte), types: make(map[string]string)}
+	server := httptest.NewServer(repo)
+	t.Cleanup(server.Close)
+	cli, err := NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	return cli, repo
+}
+
+func TestClient_UploadMessageMedia_Encrypted(t *testing.T) {
+	cli, repo := newMediaTestClient(t)
+	plaintext := []byte("hello world, this is a secret file")
+	thumbnail := []byte("tiny secret thumbnail")
+
+	content, err := cli.UploadMessageMedia(ReqUploadMessageMedia{
+		ReqUploadMedia: ReqUploadMedia{
+			Content:       bytes.NewReader(plaintext),
+			ContentLength: int64(len(plaintext)),
+			ContentType:   "text/plain",
+			FileName:      "secret.txt",
+		},
+		Encrypt:   true,
+		Thumbnail: &ReqUploadMedia{ContentBytes: thumbnail, ContentType: "image/png"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, event.MsgFile, content.MsgType)
+	assert.Equal(t, "secret.txt", content.Body)
+	assert.Empty(t, content.URL)
+	require.NotNil(t, content.File)
+	require.NotNil(t, content.Info.ThumbnailFile)
+	assert.Equal(t, "text/plain", content.Info.MimeType)
+	assert.Equal(t, len(plaintext), content.Info.Size)
+	assert.NotEmpty(t, content.File.Hashes.SHA256)
+
+	for fileID, data := range repo.files {
+		assert.NotContains(t, string(data), "secret", "file %s was uploaded unencrypted", fileID)
+		assert.Equal(t, "application/octet-stream", repo.types[fileID])
+	}
+
+	downloaded, err := cli.DownloadMessageMedia(content)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, downloaded)
+	downloadedThumb, err := cli.DownloadMessageThumbnail(content)
+	require.NoError(t, err)
+	assert.Equal(t, thumbnail, downloadedThumb)
+
+	stream, err := cli.DownloadEncrypted(content.File)
+	require.NoError(t, err)
+	streamed, err := ioutil.ReadAll(stream)
+	require.NoError(t, err)
+	assert.NoError(t, stream.Close())
+	assert.Equal(t, plaintext, streamed)
+}
+
+func TestClient_UploadMessageMedia_Unencrypted(t *testing.T) {
+	cli, _ := newMediaTestClient(t)
+	content, err := cli.UploadMessageMedia(ReqUploadMessageMedia{
+		ReqUploadMedia: ReqUploadMedia{ContentBytes: []byte("hello"), ContentType: "text/plain"},
+		MsgType:        event.MsgText,
+	})
+	require.NoError(t, err)
+	assert.Nil(t, content.File)
+	assert.NotEmpty(t, content.URL)
+	downloaded, err := cli.DownloadMessageMedia(content)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(downloaded))
+	_, err = cli.DownloadMessageThumbnail(content)
+	assert.ErrorIs(t, err, ErrNoMediaThumbnail)
+}
+
+func TestClient_DownloadEncryptedBytes_Errors(t *testing.T) {
+	cli, repo := newMediaTestClient(t)
+	file, err := cli.UploadEncryptedMedia(ReqUploadMedia{ContentBytes: []byte("hello")})
+	require.NoError(t, err)
+
+	for fileID := range repo.files {
+		repo.files[fileID][0] ^= 0xff
+	}
+	_, err = cli.DownloadEncryptedBytes(file)
+	assert.Error(t, err, "tampered file should fail hash check")
+
+	file.URL = "mxc://example.com/missing"
+	_, err = cli.DownloadEncryptedBytes(file)
+	var httpErr HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.True(t, httpErr.IsStatus(http.StatusNotFound))
+	assert.ErrorIs(t, err, MNotFound)
+}
@@ -169,6 +169,7 @@ type ReqAliasCreate struct {
 type OneTimeKey struct {
 	Key        id.Curve25519          `json:"key"`
 	IsSigned   bool                   `json:"-"`
+	IsFallback bool                   `json:"fallback,omitempty"`
 	Signatures Signatures             `json:"signatures,omitempty"`
 	Unsigned   map[string]interface{} `json:"unsigned,omitempty"`
 }
@@ -199,6 +200,8 @@ func (otk *OneTimeKey) MarshalJSON() ([]byte, error) {
 type ReqUploadKeys struct {
 	DeviceKeys  *DeviceKeys             `json:"device_keys,omitempty"`
 	OneTimeKeys map[id.KeyID]OneTimeKey `json:"one_time_keys"`
+
+	FallbackKeys map[id.KeyID]OneTimeKey `json:"fallback_keys,omitempty"`
 }
 
 type ReqKeysSignatures struct {
@@ -281,6 +284,11 @@ type ReqClaimKeys struct {
 
 type OneTimeKeysRequest map[id.UserID]map[id.DeviceID]id.KeyAlgorithm
 
+// ReqAppserviceClaimKeys is the request body for the appservice one-time key claim endpoint.
+// Each algorithm is listed once per key to claim.
+// See https://github.com/matrix-org/matrix-spec-proposals/pull/3983
+type ReqAppserviceClaimKeys map[id.UserID]map[id.DeviceID][]id.KeyAlgorithm
+
 type ReqSendToDevice struct {
 	Messages map[id.UserID]map[id.DeviceID]*event.Content `json:"messages"`
 }
@@ -324,3 +332,8 @@ type ReqSetReadMarkers struct {
 	Read      id.EventID `json:"m.read"`
 	FullyRead id.EventID `json:"m.fully_read"`
 }
+
+// ReqAppservicePing is the JSON request for https://github.com/matrix-org/matrix-spec-proposals/pull/2659
+type ReqAppservicePing struct {
+	TxnID string `json:"transaction_id,omitempty"`
+}
@@ -216,6 +216,9 @@ type RespSync struct {
 	DeviceLists    DeviceLists `json:"device_lists"`
 	DeviceOTKCount OTKCount    `json:"device_one_time_keys_count"`
 
+	// DeviceUnusedFallbackKeyTypes is nil if the server doesn't support fallback keys.
+	DeviceUnusedFallbackKeyTypes []id.KeyAlgorithm `json:"device_unused_fallback_key_types"`
+
 	Rooms struct {
 		Leave  map[id.RoomID]SyncLeftRoom    `json:"leave"`
 		Join   map[id.RoomID]SyncJoinedRoom  `json:"join"`
@@ -235,6 +238,10 @@ type OTKCount struct {
 	// For appservice OTK counts only: the user ID in question
 	UserID   id.UserID   `json:"-"`
 	DeviceID id.DeviceID `json:"-"`
+
+	// The key algorithms that have an unused fallback key on the server, from device_unused_fallback_key_types.
+	// This is nil if the server didn't send the field, i.e. if it doesn't support fallback keys.
+	UnusedFallbackKeyTypes []id.KeyAlgorithm `json:"-"`
 }
 
 type SyncLeftRoom struct {
@@ -308,6 +315,10 @@ type RespClaimKeys struct {
 	OneTimeKeys map[id.UserID]map[id.DeviceID]map[id.KeyID]OneTimeKey `json:"one_time_keys"`
 }
 
+// RespAppserviceClaimKeys is the response body for the appservice one-time key claim endpoint.
+// See https://github.com/matrix-org/matrix-spec-proposals/pull/3983
+type RespAppserviceClaimKeys map[id.UserID]map[id.DeviceID]map[id.KeyID]OneTimeKey
+
 type RespUploadSignatures struct {
 	Failures map[string]interface{} `json:"failures"`
 }
@@ -342,3 +353,52 @@ type RespBatchSend struct {
 
 	NextBatchID id.BatchID `json:"next_batch_id"`
 }
+
+// RespAppservicePing is the JSON response for https://github.com/matrix-org/matrix-spec-proposals/pull/2659
+type RespAppservicePing struct {
+	DurationMS int64 `json:"duration_ms"`
+}
+
+// ThirdPartyFieldType describes a field used to look up third party users or locations.
+// See https://spec.matrix.org/v1.2/application-service-api/#get_matrixappv1thirdpartyprotocolprotocol
+type ThirdPartyFieldType struct {
+	// A regular expression for validation of a field's value.
+	Regexp string `json:"regexp"`
+	// A placeholder serving as a valid example of the field value.
+	Placeholder string `json:"placeholder"`
+}
+
+// ThirdPartyProtocolInstance is a single instance of a third party protocol, e.g. a specific IRC network.
+type ThirdPartyProtocolInstance struct {
+	Description string              `json:"desc"`
+	Icon        id.ContentURIString `json:"icon,omitempty"`
+	Fields      map[string]string   `json:"fields"`
+	NetworkID   string              `json:"network_id"`
+	// InstanceID is generated by the homeserver and is only present in responses to clients.
+	InstanceID string `json:"instance_id,omitempty"`
+}
+
+// ThirdPartyProtocol is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3thirdpartyprotocolprotocol
+type ThirdPartyProtocol struct {
+	UserFields     []string                       `json:"user_fields"`
+	LocationFields []string                       `json:"location_fields"`
+	Icon           id.ContentURIString            `json:"icon"`
+	FieldTypes     map[string]ThirdPartyFieldType `json:"field_types"`
+	Instances      []ThirdPartyProtocolInstance   `json:"instances"`
+}
+
+// ThirdPartyUser is a user on a third party network.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3thirdpartyuserprotocol
+type ThirdPartyUser struct {
+	UserID   id.UserID         `json:"userid"`
+	Protocol string            `json:"protocol"`
+	Fields   map[string]string `json:"fields"`
+}
+
+// ThirdPartyLocation is a portal room for a location on a third party network.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3thirdpartylocationprotocol
+type ThirdPartyLocation struct {
+	Alias    id.RoomAlias      `json:"alias"`
+	Protocol string            `json:"protocol"`
+	Fields   map[string]string `json:"fields"`
+}